@@ -0,0 +1,168 @@
+package arrival
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+)
+
+// Process generates the intervals between two consecutive requests, expressed in time units, of an open loop arrival model,
+// i.e. a model where requests arrive independently of how fast they are served
+type Process interface {
+	Next() int
+}
+
+// names of the arrival models supported
+const (
+	Fixed   = "fixed"
+	Poisson = "poisson"
+	OnOff   = "onoff"
+	Diurnal = "diurnal"
+	Step    = "step"
+	Closed  = "closed"
+)
+
+// Config holds the parameters used to build an arrival model - not all parameters are used by all models
+type Config struct {
+	// the name of the model
+	Name string `yaml:"model"`
+	// the (mean) interval between two requests in time units
+	Interval int `yaml:"interval"`
+	// the seed of the random generator
+	Seed int64 `yaml:"seed"`
+	// onoff: the mean interval between two requests during a burst
+	BurstInterval int `yaml:"burstInterval"`
+	// onoff: the mean duration of a burst
+	OnDuration int `yaml:"onDuration"`
+	// onoff: the mean duration of the quiet period between two bursts
+	OffDuration int `yaml:"offDuration"`
+	// diurnal: the period of the sine wave which modulates the rate of the requests
+	Period int `yaml:"period"`
+	// diurnal: the amplitude, between 0 and 1, of the variation of the rate around its mean
+	Amplitude float64 `yaml:"amplitude"`
+	// step: the time at which the interval between requests changes
+	StepTime int `yaml:"stepTime"`
+	// step: the interval between requests after the step
+	StepInterval int `yaml:"stepInterval"`
+	// closed: the number of clients, each one sending a new request only after the previous one has been processed or dropped
+	Clients int `yaml:"clients"`
+	// closed: the mean time a client thinks before sending the next request
+	ThinkTime int `yaml:"thinkTime"`
+}
+
+// NewProcess builds the open loop process described by the configuration
+func NewProcess(cfg Config) (Process, error) {
+	rnd := rand.New(rand.NewSource(cfg.Seed))
+	switch cfg.Name {
+	case Fixed, "":
+		return &fixed{interval: cfg.Interval}, nil
+	case Poisson:
+		return &poisson{mean: float64(cfg.Interval), rnd: rnd}, nil
+	case OnOff:
+		if cfg.OnDuration <= 0 || cfg.OffDuration <= 0 {
+			return nil, fmt.Errorf("the durations of the on and off periods must be greater than 0")
+		}
+		p := onOff{
+			means:     [2]float64{float64(cfg.Interval), float64(cfg.BurstInterval)},
+			durations: [2]float64{float64(cfg.OffDuration), float64(cfg.OnDuration)},
+			rnd:       rnd,
+		}
+		p.stateEnd = p.rnd.ExpFloat64() * p.durations[p.state]
+		return &p, nil
+	case Diurnal:
+		if cfg.Period <= 0 {
+			return nil, fmt.Errorf("the period of a diurnal model must be greater than 0")
+		}
+		if cfg.Amplitude < 0 || cfg.Amplitude >= 1 {
+			return nil, fmt.Errorf("the amplitude of a diurnal model must be between 0 and 1 (excluded)")
+		}
+		return &diurnal{mean: float64(cfg.Interval), period: float64(cfg.Period), amplitude: cfg.Amplitude, rnd: rnd}, nil
+	case Step:
+		return &step{before: cfg.Interval, after: cfg.StepInterval, stepTime: cfg.StepTime}, nil
+	case Closed:
+		return nil, fmt.Errorf("the closed model is not an open loop process, use NewGenerator")
+	}
+	return nil, fmt.Errorf("unknown arrival model %q", cfg.Name)
+}
+
+// requests arrive at a fixed interval, like a metronome
+type fixed struct {
+	interval int
+}
+
+func (p *fixed) Next() int {
+	return p.interval
+}
+
+// the intervals between requests are exponentially distributed
+type poisson struct {
+	mean float64
+	rnd  *rand.Rand
+}
+
+func (p *poisson) Next() int {
+	return int(math.Round(p.rnd.ExpFloat64() * p.mean))
+}
+
+// a Markov modulated Poisson process with 2 states - state 0 is the quiet period and state 1 is the burst
+type onOff struct {
+	means     [2]float64
+	durations [2]float64
+	state     int
+	// the current time and the time at which the current state ends
+	now      float64
+	stateEnd float64
+	rnd      *rand.Rand
+}
+
+func (p *onOff) Next() int {
+	start := p.now
+	for {
+		candidate := p.now + p.rnd.ExpFloat64()*p.means[p.state]
+		if candidate < p.stateEnd {
+			p.now = candidate
+			break
+		}
+		// the state changes before the next request arrives - since the process is memoryless we can draw a new
+		// interval starting from the moment the state changes
+		p.now = p.stateEnd
+		p.state = 1 - p.state
+		p.stateEnd = p.now + p.rnd.ExpFloat64()*p.durations[p.state]
+	}
+	return int(math.Round(p.now - start))
+}
+
+// a Poisson process whose rate follows a sine wave around its mean, to simulate the daily variation of the traffic
+type diurnal struct {
+	mean      float64
+	period    float64
+	amplitude float64
+	now       float64
+	rnd       *rand.Rand
+}
+
+func (p *diurnal) Next() int {
+	// the rate is evaluated at the time of the previous request, which is a good approximation as long as the period
+	// is much longer than the interval between requests
+	rate := (1 + p.amplitude*math.Sin(2*math.Pi*p.now/p.period)) / p.mean
+	interval := p.rnd.ExpFloat64() / rate
+	p.now = p.now + interval
+	return int(math.Round(interval))
+}
+
+// requests arrive at a fixed interval which changes at a certain time, to simulate a sudden change of load
+type step struct {
+	before   int
+	after    int
+	stepTime int
+	now      int
+}
+
+func (p *step) Next() int {
+	interval := p.before
+	if p.now >= p.stepTime {
+		interval = p.after
+	}
+	p.now = p.now + interval
+	return interval
+}
@@ -0,0 +1,86 @@
+package arrival
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/EnricoPicci/drop-pattern-with-timeout/src/request"
+)
+
+func TestPoissonMean(t *testing.T) {
+	p, err := NewProcess(Config{Name: Poisson, Interval: 100, Seed: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	n := 100000
+	sum := 0
+	for i := 0; i < n; i++ {
+		sum = sum + p.Next()
+	}
+	if mean := sum / n; mean < 95 || mean > 105 {
+		t.Errorf("The mean interval should be close to 100 - mean %v", mean)
+	}
+}
+
+func TestStep(t *testing.T) {
+	p, _ := NewProcess(Config{Name: Step, Interval: 100, StepTime: 300, StepInterval: 10})
+	expected := []int{100, 100, 100, 10, 10}
+	for i, e := range expected {
+		if v := p.Next(); v != e {
+			t.Errorf("Interval %v should be %v - found %v", i, e, v)
+		}
+	}
+}
+
+// during the bursts the requests arrive much faster, so the mean interval must lie between the burst and the quiet intervals
+func TestOnOffMean(t *testing.T) {
+	p, err := NewProcess(Config{Name: OnOff, Interval: 100, BurstInterval: 10, OnDuration: 1000, OffDuration: 1000, Seed: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	n := 100000
+	sum := 0
+	for i := 0; i < n; i++ {
+		sum = sum + p.Next()
+	}
+	if mean := sum / n; mean <= 10 || mean >= 100 {
+		t.Errorf("The mean interval should be between 10 and 100 - mean %v", mean)
+	}
+}
+
+// in a closed loop no client sends a new request before its previous one has been notified as done
+func TestClosedLoop(t *testing.T) {
+	g, err := NewGenerator(Config{Name: Closed, Clients: 3, ThinkTime: 1, Seed: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var mu sync.Mutex
+	inFlight := 0
+	maxInFlight := 0
+	submitted := 0
+	submit := func(req request.Request) {
+		mu.Lock()
+		inFlight++
+		submitted++
+		if inFlight > maxInFlight {
+			maxInFlight = inFlight
+		}
+		mu.Unlock()
+		go func() {
+			time.Sleep(time.Millisecond)
+			mu.Lock()
+			inFlight--
+			mu.Unlock()
+			req.Notify()
+		}()
+	}
+	g.Run(30, time.Microsecond, func(i int) request.Request { return request.Request{Param: i} }, submit)
+
+	if submitted != 30 {
+		t.Errorf("30 requests should have been submitted - submitted %v", submitted)
+	}
+	if maxInFlight > 3 {
+		t.Errorf("There should never be more requests in flight than clients - max in flight %v", maxInFlight)
+	}
+}
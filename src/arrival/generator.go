@@ -0,0 +1,122 @@
+package arrival
+
+import (
+	"math"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/EnricoPicci/drop-pattern-with-timeout/src/request"
+)
+
+// Generator simulates a stream of incoming requests
+type Generator interface {
+	// Run sends "numReq" requests, built by "newReq", to "submit" and returns when all of them have been submitted - newReq
+	// is never called concurrently, so it can use state which is not safe for concurrent use, e.g. a random generator
+	Run(numReq int, timeUnit time.Duration, newReq func(i int) request.Request, submit func(req request.Request))
+}
+
+// NewGenerator builds the generator of the arrival model described by the configuration
+func NewGenerator(cfg Config) (Generator, error) {
+	if cfg.Name == Closed {
+		g := closedLoop{
+			clients: cfg.NumClients(),
+			next:    ThinkTimes(cfg),
+		}
+		return &g, nil
+	}
+	p, err := NewProcess(cfg)
+	if err != nil {
+		return nil, err
+	}
+	return OpenLoop(p), nil
+}
+
+// FixedInterval returns a generator which sends the requests at a fixed interval
+func FixedInterval(interval int) Generator {
+	return OpenLoop(&fixed{interval: interval})
+}
+
+// OpenLoop returns a generator which sends the requests at the intervals generated by the process
+func OpenLoop(p Process) Generator {
+	return &openLoop{process: p}
+}
+
+type openLoop struct {
+	process Process
+}
+
+func (g *openLoop) Run(numReq int, timeUnit time.Duration, newReq func(i int) request.Request, submit func(req request.Request)) {
+	for i := 0; i < numReq; i++ {
+		// interval between each incoming request
+		time.Sleep(time.Duration(g.process.Next()) * timeUnit)
+		submit(newReq(i))
+	}
+}
+
+// NumClients returns the number of clients of a closed loop model, which is at least 1
+func (cfg Config) NumClients() int {
+	if cfg.Clients <= 0 {
+		return 1
+	}
+	return cfg.Clients
+}
+
+// ThinkTimes returns the function which generates the think times, in time units, of the clients of a closed loop model - the
+// think times are exponentially distributed and the function is not safe for concurrent use
+func ThinkTimes(cfg Config) func() int {
+	rnd := rand.New(rand.NewSource(cfg.Seed))
+	thinkTime := float64(cfg.ThinkTime)
+	return func() int {
+		return int(math.Round(rnd.ExpFloat64() * thinkTime))
+	}
+}
+
+// each client sends a request and waits for it to be processed or dropped, then thinks for a while before sending the next one
+type closedLoop struct {
+	clients int
+
+	// the think times are shared among the clients
+	muNext sync.Mutex
+	next   func() int
+}
+
+func (g *closedLoop) Run(numReq int, timeUnit time.Duration, newReq func(i int) request.Request, submit func(req request.Request)) {
+	var wg sync.WaitGroup
+	// the index of the next request to send is shared among the clients
+	var muNext sync.Mutex
+	next := 0
+
+	wg.Add(g.clients)
+	for c := 0; c < g.clients; c++ {
+		go func() {
+			defer wg.Done()
+			for {
+				// the request is built while holding the lock, as required by the contract of Run
+				muNext.Lock()
+				i := next
+				next++
+				if i >= numReq {
+					muNext.Unlock()
+					return
+				}
+				req := newReq(i)
+				muNext.Unlock()
+
+				req.Done = make(chan request.Request, 1)
+				submit(req)
+				<-req.Done
+
+				time.Sleep(g.think() * timeUnit)
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+// the think time is exponentially distributed
+func (g *closedLoop) think() time.Duration {
+	g.muNext.Lock()
+	defer g.muNext.Unlock()
+	return time.Duration(g.next())
+}
@@ -0,0 +1,223 @@
+package cache
+
+import (
+	"container/list"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/EnricoPicci/drop-pattern-with-timeout/src/request"
+)
+
+// an entry of the cache: the last request processed with the key
+type entry struct {
+	key     string
+	result  request.Request
+	expires time.Time
+}
+
+// Cache is an LRU cache, bounded in size, of the results of the requests, keyed by the key of the requests: an entry is fresh
+// for the TTL after it has been stored and the least recently used entry is evicted when the cache is full. It is checked
+// before a request enters the waiting room, so that a hit is answered without taking a waiting slot or a worker.
+type Cache struct {
+	capacity int
+	ttl      time.Duration
+
+	// if true a request dropped is answered with the entry of its key if it has expired not more than MaxStale ago, e.g. to
+	// serve a stale result during an overload rather than no result - they have to be set before the cache is used
+	ServeStale bool
+	// 0 means that an entry expired can be served until it is evicted
+	MaxStale time.Duration
+	// the clock of the cache, time.Now by default - e.g. the virtual clock of a simulation - it has to be set before the cache
+	// is used
+	Now func() time.Time
+
+	mu      sync.Mutex
+	entries map[string]*list.Element
+	// the entries from the most to the least recently used
+	lru    *list.List
+	hits   int
+	misses int
+	stale  int
+
+	// the requests sent to the waiting room and not yet processed or dropped
+	wg sync.WaitGroup
+}
+
+// New returns a cache with up to capacity entries, each fresh for the ttl
+func New(capacity int, ttl time.Duration) *Cache {
+	c := Cache{
+		capacity: capacity,
+		ttl:      ttl,
+		entries:  make(map[string]*list.Element),
+		lru:      list.New(),
+		Now:      time.Now,
+	}
+	return &c
+}
+
+// Submit returns a function which checks the cache before submitting the requests, e.g. to a waiting room: a request whose key
+// has a fresh entry is answered immediately, notified on its Done channel as cached, while the others are submitted and their
+// result is stored when they have been processed. The requests without a key are submitted without checking the cache.
+func (c *Cache) Submit(submit func(req request.Request)) func(req request.Request) {
+	return func(req request.Request) {
+		if req.Key == "" {
+			submit(req)
+			return
+		}
+		if stored, ok := c.Lookup(req.Key); ok {
+			c.answer(req, stored, false)
+			return
+		}
+
+		c.wg.Add(1)
+		done := req.Done
+		req.Done = make(chan request.Request, 1)
+		go func(processed chan request.Request) {
+			defer c.wg.Done()
+			req := <-processed
+			req.Done = done
+			switch {
+			case req.Dropped:
+				if stored, ok := c.LookupStale(req.Key); ok {
+					req.Dropped = false
+					c.answer(req, stored, true)
+					return
+				}
+			case !req.Failed:
+				c.Put(req.Key, req)
+			}
+			req.Notify()
+		}(req.Done)
+		submit(req)
+	}
+}
+
+// notifies a request answered from the cache with the result and the outcome of the request stored
+func (c *Cache) answer(req request.Request, stored request.Request, stale bool) {
+	Answer(&req, stored, stale, c.Now())
+	req.Notify()
+}
+
+// Answer sets on a request answered from the cache, at the time passed, the result and the outcome of the request stored
+func Answer(req *request.Request, stored request.Request, stale bool, at time.Time) {
+	req.Result = stored.Result
+	req.Failed = stored.Failed
+	req.Cached = true
+	req.Stale = stale
+	req.CompletedAt = at
+}
+
+// Lookup returns the request stored for the key if its entry is fresh, counting a hit, or counts a miss
+func (c *Cache) Lookup(key string) (request.Request, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	stored, fresh, _ := c.lookup(key, c.Now())
+	if !fresh {
+		c.misses++
+		return request.Request{}, false
+	}
+	c.hits++
+	return stored, true
+}
+
+// LookupStale returns the request stored for the key of a request dropped, and counts it, if its entry has expired but can
+// still be served
+func (c *Cache) LookupStale(key string) (request.Request, bool) {
+	if !c.ServeStale {
+		return request.Request{}, false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	stored, _, ok := c.lookup(key, c.Now())
+	if !ok {
+		return request.Request{}, false
+	}
+	c.stale++
+	return stored, true
+}
+
+// Put stores the result of a request, evicting the least recently used entry if the cache is full
+func (c *Cache) Put(key string, result request.Request) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	expires := c.Now().Add(c.ttl)
+	if e, ok := c.entries[key]; ok {
+		e.Value = entry{key: key, result: result, expires: expires}
+		c.lru.MoveToFront(e)
+		return
+	}
+	c.entries[key] = c.lru.PushFront(entry{key: key, result: result, expires: expires})
+	if c.lru.Len() > c.capacity {
+		oldest := c.lru.Back()
+		c.lru.Remove(oldest)
+		delete(c.entries, oldest.Value.(entry).key)
+	}
+}
+
+// Get returns the result stored for the key if it is fresh
+func (c *Cache) Get(key string) (request.Request, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	result, fresh, _ := c.lookup(key, c.Now())
+	return result, fresh
+}
+
+// returns the entry of the key, if any, and whether it is fresh - an entry expired is removed unless it can still be served
+// stale - the caller holds the lock
+func (c *Cache) lookup(key string, now time.Time) (result request.Request, fresh bool, ok bool) {
+	e, ok := c.entries[key]
+	if !ok {
+		return request.Request{}, false, false
+	}
+	en := e.Value.(entry)
+	fresh = now.Before(en.expires)
+	if !fresh && (!c.ServeStale || (c.MaxStale > 0 && now.After(en.expires.Add(c.MaxStale)))) {
+		c.lru.Remove(e)
+		delete(c.entries, key)
+		return request.Request{}, false, false
+	}
+	c.lru.MoveToFront(e)
+	return en.result, fresh, true
+}
+
+// Wait waits until the requests submitted through the cache have been processed or dropped
+func (c *Cache) Wait() {
+	c.wg.Wait()
+}
+
+// Len returns the number of entries of the cache
+func (c *Cache) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.lru.Len()
+}
+
+// Hits returns the number of requests answered from the cache
+func (c *Cache) Hits() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.hits
+}
+
+// Misses returns the number of requests with a key not found fresh in the cache, which have been submitted
+func (c *Cache) Misses() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.misses
+}
+
+// Stale returns the number of requests dropped and answered with an entry expired
+func (c *Cache) Stale() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.stale
+}
+
+// Summary prints the hits, the misses and the stale entries served
+func (c *Cache) Summary(w io.Writer) {
+	fmt.Fprintf(w, "Number of requests answered from the cache: %v\n", c.Hits())
+	fmt.Fprintf(w, "Number of requests not found in the cache: %v\n", c.Misses())
+	fmt.Fprintf(w, "Number of requests dropped and answered with a stale entry of the cache: %v\n", c.Stale())
+}
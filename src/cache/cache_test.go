@@ -0,0 +1,167 @@
+package cache
+
+import (
+	"testing"
+	"time"
+
+	"github.com/EnricoPicci/drop-pattern-with-timeout/src/request"
+	"github.com/EnricoPicci/drop-pattern-with-timeout/src/waitingroom"
+	"github.com/EnricoPicci/drop-pattern-with-timeout/src/workerpool"
+)
+
+// a clock moved forward by the tests, so that the entries expire without waiting on the real clock
+type fakeClock struct {
+	now time.Time
+}
+
+func (f *fakeClock) Now() time.Time {
+	return f.now
+}
+
+func (f *fakeClock) advance(d time.Duration) {
+	f.now = f.now.Add(d)
+}
+
+func TestLRUAndTTL(t *testing.T) {
+	c := New(2, 20*time.Millisecond)
+	clock := &fakeClock{now: time.Now()}
+	c.Now = clock.Now
+	c.Put("a", request.New(0))
+	c.Put("b", request.New(1))
+	// a is used, so b is the least recently used entry and is evicted by c
+	if _, ok := c.Get("a"); !ok {
+		t.Fatalf("a should be in the cache")
+	}
+	c.Put("c", request.New(2))
+	if _, ok := c.Get("b"); ok || c.Len() != 2 {
+		t.Errorf("b should have been evicted - found %v entries", c.Len())
+	}
+	if result, ok := c.Get("c"); !ok || result.Param != 2 {
+		t.Errorf("c should be in the cache - found %+v", result)
+	}
+	clock.advance(30 * time.Millisecond)
+	if _, ok := c.Get("a"); ok || c.Len() != 1 {
+		t.Errorf("a should have expired and been removed - found %v entries", c.Len())
+	}
+}
+
+// sends the requests with the keys passed through the cache to a waiting room in front of a pool with one worker, which takes
+// procTime to process a request, and returns them when they have been processed, answered from the cache or dropped
+func run(c *Cache, timeout int, procTime int, keys ...string) ([]request.Request, *waitingroom.WaitingRoom) {
+	inPoolCh := make(chan request.Request)
+	pool := workerpool.NewWorkerPool(inPoolCh, 1, 0, procTime, 0, 0, 0, time.Millisecond)
+	waitingRoom := waitingroom.New(make(chan request.Request), inPoolCh, timeout, time.Millisecond)
+	pool.Start()
+	waitingRoom.Open()
+	submit := c.Submit(waitingRoom.LetIn)
+	reqs := make([]request.Request, len(keys))
+	for i, key := range keys {
+		req := request.New(i)
+		req.Key = key
+		req.Done = make(chan request.Request, 1)
+		submit(req)
+		reqs[i] = <-req.Done
+	}
+	waitingRoom.Close()
+	pool.Stop()
+	c.Wait()
+	return reqs, waitingRoom
+}
+
+func TestHitsNeverTakeAWorker(t *testing.T) {
+	c := New(10, time.Second)
+	reqs, waitingRoom := run(c, 100, 10, "a", "b", "a", "a", "b", "")
+
+	if c.Hits() != 3 || c.Misses() != 2 || waitingRoom.Admitted() != 3 {
+		t.Errorf("Expected 3 hits, 2 misses and 3 requests let in - found %v, %v and %v", c.Hits(), c.Misses(), waitingRoom.Admitted())
+	}
+	for i, req := range reqs {
+		cached := i == 2 || i == 3 || i == 4
+		if req.Cached != cached || req.Stale || req.Dropped || req.CompletedAt.IsZero() {
+			t.Errorf("The request %v should have been answered from the cache: %v - found %+v", i, cached, req)
+		}
+	}
+}
+
+// the requests answered from the cache carry the result of the request of the same key processed, which is its param
+func TestHitsCarryTheStoredResult(t *testing.T) {
+	c := New(10, time.Second)
+	reqs, _ := run(c, 100, 10, "a", "b", "a", "b")
+
+	for i, want := range []int{0, 1, 0, 1} {
+		if reqs[i].Result != want {
+			t.Errorf("The request %v should have the result %v - found %v", i, want, reqs[i].Result)
+		}
+	}
+	if !reqs[2].Cached || !reqs[3].Cached {
+		t.Errorf("The requests 2 and 3 should have been answered from the cache")
+	}
+}
+
+func TestServeStaleInsteadOfDropping(t *testing.T) {
+	c := New(10, 10*time.Millisecond)
+	c.ServeStale = true
+	stored := request.New(0)
+	stored.Result = "stored result"
+	c.Put("a", stored)
+	time.Sleep(20 * time.Millisecond)
+	// the worker is kept busy by the request b, so the request a, whose entry has expired, is dropped and answered stale,
+	// while the request c, not in the cache, is dropped
+	inPoolCh := make(chan request.Request)
+	pool := workerpool.NewWorkerPool(inPoolCh, 1, 0, 100, 0, 0, 0, time.Millisecond)
+	waitingRoom := waitingroom.New(make(chan request.Request), inPoolCh, 10, time.Millisecond)
+	pool.Start()
+	waitingRoom.Open()
+	submit := c.Submit(waitingRoom.LetIn)
+	done := make(chan request.Request, 3)
+	for _, key := range []string{"b", "a", "c"} {
+		req := request.New(0)
+		req.Key = key
+		req.Done = done
+		submit(req)
+		for pool.Taken() == 0 {
+			time.Sleep(time.Millisecond)
+		}
+	}
+	reqs := map[string]request.Request{}
+	for i := 0; i < 3; i++ {
+		req := <-done
+		reqs[req.Key] = req
+	}
+	waitingRoom.Close()
+	pool.Stop()
+	c.Wait()
+
+	if a := reqs["a"]; !a.Cached || !a.Stale || a.Dropped || a.Result != "stored result" {
+		t.Errorf("The request a should have been answered with the stale entry - found %+v", a)
+	}
+	if !reqs["c"].Dropped || reqs["b"].Dropped || reqs["b"].Cached {
+		t.Errorf("The request c should have been dropped and b processed")
+	}
+	if c.Stale() != 1 || c.Misses() != 3 || c.Hits() != 0 || waitingRoom.Dropped() != 2 {
+		t.Errorf("Expected 1 stale entry served and 3 misses - found %v and %v", c.Stale(), c.Misses())
+	}
+	if _, ok := c.Get("b"); !ok {
+		t.Errorf("The result of b should have been stored")
+	}
+}
+
+func TestMaxStale(t *testing.T) {
+	c := New(10, 10*time.Millisecond)
+	c.ServeStale = true
+	c.MaxStale = 10 * time.Millisecond
+	clock := &fakeClock{now: time.Now()}
+	c.Now = clock.Now
+	c.Put("a", request.New(0))
+	clock.advance(15 * time.Millisecond)
+	c.mu.Lock()
+	_, fresh, ok := c.lookup("a", c.Now())
+	c.mu.Unlock()
+	if fresh || !ok {
+		t.Errorf("The entry should be expired but still available stale")
+	}
+	clock.advance(10 * time.Millisecond)
+	if _, ok := c.LookupStale("a"); ok || c.Len() != 0 {
+		t.Errorf("The entry should have been removed after the max stale")
+	}
+}
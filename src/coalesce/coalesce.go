@@ -0,0 +1,261 @@
+package coalesce
+
+import (
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/EnricoPicci/drop-pattern-with-timeout/src/events"
+	"github.com/EnricoPicci/drop-pattern-with-timeout/src/request"
+	"github.com/EnricoPicci/drop-pattern-with-timeout/src/waitingroom"
+)
+
+// a request waiting in the waiting room, or being processed, with the requests with the same key attached to it
+type flight struct {
+	leader string
+	// closed when the leader is sent to the pool and when the leader has been processed or dropped
+	dispatched chan struct{}
+	done       chan struct{}
+	// the leader processed or dropped - it can be read after done has been closed
+	result request.Request
+}
+
+// Coalescer lets the requests in a waiting room so that the requests with the same key share one execution: the first request
+// with a key, the leader, is let in the waiting room, while the ones which come in while the leader is waiting or being
+// processed, the followers, are attached to it and receive its outcome. A follower waits for the leader to be sent to the pool
+// up to its own timeout, or deadline, and is dropped without affecting the leader if the leader is not sent in time. If the
+// leader is dropped the followers still within their timeout are let in again, so that one of them becomes the new leader.
+type Coalescer struct {
+	WaitingRoom *waitingroom.WaitingRoom
+
+	// the followers and the leaders still running
+	wg sync.WaitGroup
+
+	mu      sync.Mutex
+	flights map[string]*flight
+	leaders int
+	// the followers attached to a leader, the ones which have received the outcome of the leader and the ones dropped
+	followers int
+	shared    int
+	dropped   int
+	// the followers dropped
+	droppedRequests []request.Request
+	// the processing time of the leaders shared with the followers, i.e. the work saved
+	savedWork time.Duration
+}
+
+// New returns a coalescer in front of the waiting room - it has to be created before the waiting room is opened
+func New(waitingRoom *waitingroom.WaitingRoom) *Coalescer {
+	c := Coalescer{
+		WaitingRoom: waitingRoom,
+		flights:     make(map[string]*flight),
+	}
+	onDispatch := waitingRoom.OnDispatch
+	waitingRoom.OnDispatch = func(req request.Request) {
+		c.dispatched(req)
+		if onDispatch != nil {
+			onDispatch(req)
+		}
+	}
+	return &c
+}
+
+// LetIn lets the request in the waiting room or, if a request with the same key is waiting or being processed, attaches it to
+// that request - the requests without a key are let in the waiting room. It can be passed as the submit function of an arrival
+// generator.
+func (c *Coalescer) LetIn(req request.Request) {
+	if req.Key == "" {
+		c.WaitingRoom.LetIn(req)
+		return
+	}
+	if req.ID == "" {
+		req.ID = request.NewID()
+	}
+	c.letIn(req, time.Time{})
+}
+
+// attaches the request to the leader with the same key, if any, or lets it in the waiting room as leader. A follower let in
+// again after its leader has been dropped passes the end of the timeout it has started as follower, which it keeps, and is
+// not counted again as follower - it is counted as leader instead if it becomes the new leader.
+func (c *Coalescer) letIn(req request.Request, timeoutEnd time.Time) {
+	again := !timeoutEnd.IsZero()
+	c.mu.Lock()
+	f, ok := c.flights[req.Key]
+	if ok {
+		if !again {
+			c.followers++
+		}
+		c.wg.Add(1)
+		c.mu.Unlock()
+		go c.follow(f, req, timeoutEnd)
+		return
+	}
+	f = &flight{leader: req.ID, dispatched: make(chan struct{}), done: make(chan struct{})}
+	c.flights[req.Key] = f
+	c.leaders++
+	if again {
+		c.followers--
+	}
+	c.wg.Add(1)
+	c.mu.Unlock()
+
+	notify := req.Done
+	processed := make(chan request.Request, 1)
+	req.Done = processed
+	if again {
+		c.WaitingRoom.LetInUntil(req, timeoutEnd)
+	} else {
+		c.WaitingRoom.LetIn(req)
+	}
+	go c.lead(f, req.Key, processed, notify)
+}
+
+// Close waits until the leaders and the followers have been processed or dropped and closes the waiting room
+func (c *Coalescer) Close() {
+	c.wg.Wait()
+	c.WaitingRoom.Close()
+}
+
+// waits for the outcome of the leader and shares it with the followers
+func (c *Coalescer) lead(f *flight, key string, processed chan request.Request, notify chan request.Request) {
+	defer c.wg.Done()
+	leader := <-processed
+	// no follower can attach to the flight after it has been removed, so that all the followers see the outcome
+	c.mu.Lock()
+	delete(c.flights, key)
+	c.mu.Unlock()
+	f.result = leader
+	close(f.done)
+	leader.Done = notify
+	leader.Notify()
+}
+
+// marks the flight of a leader as dispatched
+func (c *Coalescer) dispatched(req request.Request) {
+	if req.Key == "" {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if f, ok := c.flights[req.Key]; ok && f.leader == req.ID {
+		close(f.dispatched)
+	}
+}
+
+// waits for the outcome of the leader, or drops the follower if the leader is not sent to the pool within its timeout, which
+// ends at timeoutEnd if the follower has already been attached to a leader dropped
+func (c *Coalescer) follow(f *flight, req request.Request, timeoutEnd time.Time) {
+	defer c.wg.Done()
+	if timeoutEnd.IsZero() {
+		req.EnteredAt = time.Now()
+		timeoutEnd = req.EnteredAt.Add(c.WaitingRoom.Timeout())
+	}
+	expiry := timeoutEnd
+	reason := waitingroom.DropTimeout
+	if !req.Deadline.IsZero() && req.Deadline.Before(expiry) {
+		expiry = req.Deadline
+		reason = waitingroom.DropDeadline
+	}
+	timer := time.NewTimer(time.Until(expiry))
+	defer timer.Stop()
+	select {
+	case <-f.dispatched:
+	case <-f.done:
+	case <-timer.C:
+		select {
+		case <-f.dispatched:
+		case <-f.done:
+		default:
+			c.drop(req, reason)
+			return
+		}
+	}
+	<-f.done
+	leader := f.result
+	if leader.Dropped {
+		// the leader has been dropped before the follower has expired: the follower is let in again, for what is left of its
+		// timeout, and becomes the leader or follows another leader
+		c.letIn(req, timeoutEnd)
+		return
+	}
+	req.Leader = leader.ID
+	req.Result = leader.Result
+	req.Failed = leader.Failed
+	req.DispatchedAt = leader.DispatchedAt
+	req.StartedAt = leader.StartedAt
+	req.CompletedAt = leader.CompletedAt
+	req.WaitDuration = leader.StartedAt.Sub(req.Created)
+	c.mu.Lock()
+	c.shared++
+	c.savedWork += leader.ProcessingTime()
+	c.mu.Unlock()
+	req.Notify()
+}
+
+func (c *Coalescer) drop(req request.Request, reason string) {
+	req.Dropped = true
+	req.DroppedAt = time.Now()
+	c.mu.Lock()
+	c.dropped++
+	c.droppedRequests = append(c.droppedRequests, req)
+	c.mu.Unlock()
+	e := events.OfRequest(events.Dropped, req)
+	e.Wait = req.DroppedAt.Sub(req.EnteredAt)
+	e.Reason = reason
+	c.WaitingRoom.Events.Emit(e)
+	req.Notify()
+}
+
+// Leaders returns the number of requests with a key let in the waiting room, including the followers which have taken over
+// a leader dropped
+func (c *Coalescer) Leaders() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.leaders
+}
+
+// Followers returns the number of requests attached to a leader which have not become leaders themselves
+func (c *Coalescer) Followers() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.followers
+}
+
+// Shared returns the number of followers which have received the outcome of their leader, i.e. the number of executions saved
+func (c *Coalescer) Shared() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.shared
+}
+
+// Dropped returns the number of followers dropped since their leader has not been sent to the pool within their timeout
+func (c *Coalescer) Dropped() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.dropped
+}
+
+// GetDroppedRequests returns the followers dropped since their leader has not been sent to the pool within their timeout
+func (c *Coalescer) GetDroppedRequests() []request.Request {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.droppedRequests
+}
+
+// SavedWork returns the processing time of the leaders shared with the followers, i.e. the work the workers would have done
+// without coalescing
+func (c *Coalescer) SavedWork() time.Duration {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.savedWork
+}
+
+// Summary prints how much work the coalescing has saved
+func (c *Coalescer) Summary(w io.Writer) {
+	fmt.Fprintf(w, "Number of requests executed as leaders: %v\n", c.Leaders())
+	fmt.Fprintf(w, "Number of requests attached to a leader: %v\n", c.Followers())
+	fmt.Fprintf(w, "Number of executions saved: %v\n", c.Shared())
+	fmt.Fprintf(w, "Number of followers dropped: %v\n", c.Dropped())
+	fmt.Fprintf(w, "Processing time saved: %v\n", c.SavedWork())
+}
@@ -0,0 +1,157 @@
+package coalesce
+
+import (
+	"testing"
+	"time"
+
+	"github.com/EnricoPicci/drop-pattern-with-timeout/src/request"
+	"github.com/EnricoPicci/drop-pattern-with-timeout/src/waitingroom"
+	"github.com/EnricoPicci/drop-pattern-with-timeout/src/workerpool"
+)
+
+var timeUnit = time.Millisecond
+
+// returns a coalescer in front of a waiting room with the timeout passed and a pool with one worker
+func newCoalescer(timeout int, procTime int) (*Coalescer, *workerpool.WorkerPool) {
+	inPoolCh := make(chan request.Request)
+	pool := workerpool.NewWorkerPool(inPoolCh, 1, 0, procTime, 0, 0, 0, timeUnit)
+	waitingRoom := waitingroom.New(make(chan request.Request), inPoolCh, timeout, timeUnit)
+	c := New(waitingRoom)
+	pool.Start()
+	waitingRoom.Open()
+	return c, pool
+}
+
+func newRequest(param int, key string) (request.Request, chan request.Request) {
+	req := request.New(param)
+	req.Key = key
+	req.Done = make(chan request.Request, 1)
+	return req, req.Done
+}
+
+// lets in a request which keeps the only worker of the pool busy
+func block(c *Coalescer, pool *workerpool.WorkerPool, procTime int) chan request.Request {
+	blocker, done := newRequest(0, "")
+	blocker.ProcTime = procTime
+	c.LetIn(blocker)
+	for pool.Taken() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	return done
+}
+
+func TestFollowersShareLeader(t *testing.T) {
+	c, pool := newCoalescer(1000, 50)
+	done := []chan request.Request{}
+	keys := []string{"a", "a", "a", "b", "a", "", "a"}
+	for i, key := range keys {
+		req, d := newRequest(i, key)
+		c.LetIn(req)
+		done = append(done, d)
+	}
+	reqs := make([]request.Request, len(done))
+	for i, d := range done {
+		reqs[i] = <-d
+	}
+	c.Close()
+	pool.Stop()
+
+	if pool.Completed() != 3 || c.Leaders() != 2 || c.Followers() != 4 || c.Shared() != 4 || c.Dropped() != 0 {
+		t.Errorf("Expected 3 executions, 2 leaders and 4 followers served - found %v, %v and %v", pool.Completed(), c.Leaders(), c.Shared())
+	}
+	leader := reqs[0]
+	for _, i := range []int{1, 2, 4, 6} {
+		if reqs[i].Leader != leader.ID || reqs[i].Dropped || reqs[i].CompletedAt != leader.CompletedAt || reqs[i].Result != leader.Result {
+			t.Errorf("The request %v should have received the outcome of its leader - found %+v", i, reqs[i])
+		}
+	}
+	if leader.Result != 0 {
+		t.Errorf("The leader should have the result of its processing - found %v", leader.Result)
+	}
+	if leader.Leader != "" || reqs[3].Leader != "" || reqs[5].Leader != "" {
+		t.Errorf("The leaders and the requests without a key should have been executed")
+	}
+	if c.SavedWork() < 4*50*time.Millisecond {
+		t.Errorf("Expected at least 200ms of processing time saved - found %v", c.SavedWork())
+	}
+}
+
+func TestFollowerDropsOutIndependently(t *testing.T) {
+	c, pool := newCoalescer(1000, 100)
+	blockerDone := block(c, pool, 100)
+	// the leader waits for the blocker to be processed
+	leader, leaderDone := newRequest(1, "a")
+	c.LetIn(leader)
+	follower, followerDone := newRequest(2, "a")
+	follower.Deadline = time.Now().Add(20 * time.Millisecond)
+	c.LetIn(follower)
+
+	follower = <-followerDone
+	if !follower.Dropped || time.Since(follower.Created) > 80*time.Millisecond {
+		t.Errorf("The follower should have been dropped at its deadline")
+	}
+	leader = <-leaderDone
+	<-blockerDone
+	c.Close()
+	pool.Stop()
+
+	if leader.Dropped || pool.Completed() != 2 || c.Dropped() != 1 || c.Shared() != 0 {
+		t.Errorf("The leader should have been executed - found %v executions and %v followers dropped", pool.Completed(), c.Dropped())
+	}
+}
+
+// the leader is dropped while the follower has still time, so the follower is let in and executed
+func TestFollowerTakesOverLeaderDropped(t *testing.T) {
+	c, pool := newCoalescer(100, 10)
+	blockerDone := block(c, pool, 130)
+	leader, leaderDone := newRequest(1, "a")
+	c.LetIn(leader)
+	time.Sleep(60 * time.Millisecond)
+	follower, followerDone := newRequest(2, "a")
+	c.LetIn(follower)
+
+	leader = <-leaderDone
+	follower = <-followerDone
+	<-blockerDone
+	c.Close()
+	pool.Stop()
+
+	if !leader.Dropped || follower.Dropped || follower.Leader != "" {
+		t.Errorf("The leader should have been dropped and the follower executed")
+	}
+	if pool.Completed() != 2 || c.Leaders() != 2 || c.Followers() != 0 || c.WaitingRoom.Dropped() != 1 {
+		t.Errorf("Expected 2 executions, 2 leaders and no follower - found %v, %v and %v", pool.Completed(), c.Leaders(), c.Followers())
+	}
+}
+
+// the follower let in again after its leader has been dropped waits for what is left of its timeout and, when it expires, is
+// dropped for the timeout, not for a deadline it never had
+func TestFollowerLetInAgainDroppedForTimeout(t *testing.T) {
+	c, pool := newCoalescer(100, 10)
+	blockerDone := block(c, pool, 300)
+	leader, leaderDone := newRequest(1, "a")
+	c.LetIn(leader)
+	time.Sleep(60 * time.Millisecond)
+	follower, followerDone := newRequest(2, "a")
+	c.LetIn(follower)
+
+	leader = <-leaderDone
+	follower = <-followerDone
+	<-blockerDone
+	c.Close()
+	pool.Stop()
+
+	if !leader.Dropped || !follower.Dropped || !follower.Deadline.IsZero() {
+		t.Errorf("The leader and the follower should have been dropped and the follower should have no deadline")
+	}
+	if waited := follower.DroppedAt.Sub(follower.Created); waited < 90*time.Millisecond || waited > 150*time.Millisecond {
+		t.Errorf("The follower should have been dropped at the end of its own timeout - found after %v", waited)
+	}
+	dropped := c.WaitingRoom.DroppedByReason()
+	if dropped[waitingroom.DropTimeout] != 2 || dropped[waitingroom.DropDeadline] != 0 {
+		t.Errorf("Expected 2 requests dropped for the timeout - found %v", dropped)
+	}
+	if c.Leaders() != 2 || c.Followers() != 0 || c.Dropped() != 0 {
+		t.Errorf("Expected 2 leaders, no follower and no follower dropped - found %v, %v and %v", c.Leaders(), c.Followers(), c.Dropped())
+	}
+}
@@ -0,0 +1,213 @@
+package dashboard
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/EnricoPicci/drop-pattern-with-timeout/src/histogram"
+	"github.com/EnricoPicci/drop-pattern-with-timeout/src/waitingroom"
+	"github.com/EnricoPicci/drop-pattern-with-timeout/src/workerpool"
+)
+
+// ansi escape sequences used to redraw the screen and color the workers
+const (
+	clearScreen = "\033[H\033[2J"
+	green       = "\033[32m"
+	yellow      = "\033[33m"
+	red         = "\033[31m"
+	reset       = "\033[0m"
+)
+
+// the characters used to draw the sparkline, from the lowest to the highest value
+var sparks = []rune("▁▂▃▄▅▆▇█")
+
+// Snapshot is the state of a simulation shown in a frame
+type Snapshot struct {
+	// the time elapsed since the dashboard has been started
+	Elapsed     time.Duration
+	QueueLength int
+	// the state of each worker, indexed by worker id
+	Workers []workerpool.WorkerState
+	// false if the requests are sent straight to the pool, in which case the counters of the waiting room are not shown
+	WaitingRoom bool
+	Admitted    int
+	SentToPool  int
+	// the requests dropped by the waiting room and by the workers in batch mode
+	Dropped   int
+	Completed int
+	Failed    int
+	WaitTimes *histogram.Histogram
+}
+
+// Dashboard renders, at regular intervals, the state of a worker pool and of the waiting room in front of it
+type Dashboard struct {
+	title string
+	pool  *workerpool.WorkerPool
+	// nil if the requests are sent straight to the pool
+	waitingRoom *waitingroom.WaitingRoom
+	out         io.Writer
+	refresh     time.Duration
+
+	// the number of queue length samples shown in the sparkline
+	Width int
+
+	queueLengths []int
+
+	start time.Time
+	done  chan struct{}
+	wg    sync.WaitGroup
+}
+
+// New returns a dashboard which writes a new frame on out every refresh interval
+func New(title string, pool *workerpool.WorkerPool, waitingRoom *waitingroom.WaitingRoom, out io.Writer, refresh time.Duration) *Dashboard {
+	d := Dashboard{
+		title:        title,
+		pool:         pool,
+		waitingRoom:  waitingRoom,
+		out:          out,
+		refresh:      refresh,
+		Width:        60,
+		queueLengths: make([]int, 0),
+		done:         make(chan struct{}),
+	}
+	return &d
+}
+
+// Start starts rendering - it should be called just before the simulation is run
+func (d *Dashboard) Start() {
+	d.start = time.Now()
+	d.wg.Add(1)
+	go func() {
+		defer d.wg.Done()
+		ticker := time.NewTicker(d.refresh)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-d.done:
+				return
+			case <-ticker.C:
+				d.Render(d.snapshot())
+			}
+		}
+	}()
+}
+
+// Stop stops rendering, after having written a last frame with the final state of the simulation
+func (d *Dashboard) Stop() {
+	close(d.done)
+	d.wg.Wait()
+	d.Render(d.snapshot())
+}
+
+// returns the current state of the pool and of the waiting room
+func (d *Dashboard) snapshot() Snapshot {
+	s := Snapshot{
+		Elapsed:     time.Since(d.start),
+		QueueLength: d.pool.QueueLength(),
+		Workers:     d.pool.States(),
+		Completed:   d.pool.Completed(),
+		Failed:      d.pool.FailedRequests(),
+		// the requests expired while being batched by the workers are dropped by the pool
+		Dropped:   d.pool.Dropped(),
+		WaitTimes: d.pool.WaitTimes(),
+	}
+	if d.waitingRoom != nil {
+		s.QueueLength = d.waitingRoom.Len()
+		s.WaitingRoom = true
+		s.Admitted = d.waitingRoom.Admitted()
+		s.SentToPool = d.waitingRoom.SentToPool()
+		s.Dropped = s.Dropped + d.waitingRoom.Dropped()
+	}
+	return s
+}
+
+// Render writes the frame of a snapshot and adds its queue length to the sparkline - it is called at each refresh and can be
+// called with snapshots built elsewhere, e.g. in a test or to replay a recorded run
+func (d *Dashboard) Render(s Snapshot) {
+	d.queueLengths = append(d.queueLengths, s.QueueLength)
+	if len(d.queueLengths) > d.Width {
+		d.queueLengths = d.queueLengths[1:]
+	}
+	fmt.Fprint(d.out, d.frame(s))
+}
+
+// builds the text of a frame
+func (d *Dashboard) frame(s Snapshot) string {
+	var b strings.Builder
+	b.WriteString(clearScreen)
+	fmt.Fprintf(&b, "%v - elapsed %v\n\n", d.title, s.Elapsed.Round(100*time.Millisecond))
+
+	fmt.Fprintf(&b, "Queue length %4d  %v (max %v)\n\n", s.QueueLength, sparkline(d.queueLengths), maxOf(d.queueLengths))
+
+	idle, busy, halted := count(s.Workers)
+	fmt.Fprintf(&b, "Workers  %v\n", workerRow(s.Workers))
+	fmt.Fprintf(&b, "         %vidle %v%v - %vbusy %v%v - %vhalted %v%v\n\n", green, idle, reset, yellow, busy, reset, red, halted, reset)
+
+	if s.WaitingRoom {
+		fmt.Fprintf(&b, "Admitted %v - sent to pool %v - dropped %v\n", s.Admitted, s.SentToPool, s.Dropped)
+	}
+	fmt.Fprintf(&b, "Completed %v - failed %v\n\n", s.Completed, s.Failed)
+
+	if s.WaitTimes != nil {
+		fmt.Fprintf(&b, "Wait time percentiles - %v\n", s.WaitTimes.Summary())
+	}
+	return b.String()
+}
+
+// returns the number of workers in each state
+func count(states []workerpool.WorkerState) (idle int, busy int, halted int) {
+	for _, state := range states {
+		switch state {
+		case workerpool.Idle:
+			idle++
+		case workerpool.Busy:
+			busy++
+		case workerpool.Halted:
+			halted++
+		}
+	}
+	return
+}
+
+// returns a sparkline where the highest value is drawn with the tallest character
+func sparkline(values []int) string {
+	max := maxOf(values)
+	var b strings.Builder
+	for _, v := range values {
+		i := 0
+		if max > 0 {
+			i = v * (len(sparks) - 1) / max
+		}
+		b.WriteRune(sparks[i])
+	}
+	return b.String()
+}
+
+func maxOf(values []int) int {
+	max := 0
+	for _, v := range values {
+		if v > max {
+			max = v
+		}
+	}
+	return max
+}
+
+// returns a row with a colored block for each worker
+func workerRow(states []workerpool.WorkerState) string {
+	var b strings.Builder
+	for _, state := range states {
+		switch state {
+		case workerpool.Idle:
+			b.WriteString(green + "□" + reset)
+		case workerpool.Busy:
+			b.WriteString(yellow + "■" + reset)
+		case workerpool.Halted:
+			b.WriteString(red + "■" + reset)
+		}
+	}
+	return b.String()
+}
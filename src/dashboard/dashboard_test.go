@@ -0,0 +1,65 @@
+package dashboard
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/EnricoPicci/drop-pattern-with-timeout/src/histogram"
+	"github.com/EnricoPicci/drop-pattern-with-timeout/src/workerpool"
+)
+
+func TestFrames(t *testing.T) {
+	var out bytes.Buffer
+	d := New("test run", nil, nil, &out, time.Second)
+	waitTimes := histogram.New()
+	waitTimes.Record(10 * time.Millisecond)
+	d.Render(Snapshot{QueueLength: 3, Workers: []workerpool.WorkerState{workerpool.Halted, workerpool.Halted}, WaitingRoom: true,
+		Admitted: 5, SentToPool: 2})
+	d.Render(Snapshot{Elapsed: 1500 * time.Millisecond, QueueLength: 0,
+		Workers: []workerpool.WorkerState{workerpool.Busy, workerpool.Idle}, WaitingRoom: true, Admitted: 6, SentToPool: 4,
+		Dropped: 2, Completed: 3, Failed: 1, WaitTimes: waitTimes})
+
+	frames := strings.Split(out.String(), clearScreen)[1:]
+	if len(frames) != 2 {
+		t.Fatalf("Expected 2 frames - found %v", len(frames))
+	}
+	if !strings.Contains(frames[0], "halted 2") || !strings.Contains(frames[0], strings.Repeat(red+"■"+reset, 2)) {
+		t.Errorf("The first frame should show the 2 workers halted - found\n%v", frames[0])
+	}
+	for _, expected := range []string{
+		"test run - elapsed 1.5s",
+		"Queue length    0  █▁ (max 3)",
+		"Workers  " + yellow + "■" + reset + green + "□" + reset,
+		"idle 1",
+		"busy 1",
+		"Admitted 6 - sent to pool 4 - dropped 2",
+		"Completed 3 - failed 1",
+		fmt.Sprintf("Wait time percentiles - %v", waitTimes.Summary()),
+	} {
+		if !strings.Contains(frames[1], expected) {
+			t.Errorf("The second frame should contain %q - found\n%v", expected, frames[1])
+		}
+	}
+}
+
+// the counters of the waiting room are not shown if the requests are sent straight to the pool
+func TestFrameWithoutWaitingRoom(t *testing.T) {
+	var out bytes.Buffer
+	d := New("no drop", nil, nil, &out, time.Second)
+	d.Render(Snapshot{Workers: []workerpool.WorkerState{workerpool.Idle}})
+	if strings.Contains(out.String(), "Admitted") {
+		t.Errorf("A frame without waiting room should not show its counters - found\n%v", out.String())
+	}
+}
+
+func TestSparkline(t *testing.T) {
+	if s := sparkline([]int{0, 2, 4, 7}); s != "▁▃▅█" {
+		t.Errorf("Unexpected sparkline %q", s)
+	}
+	if s := sparkline([]int{0, 0}); s != "▁▁" {
+		t.Errorf("A sparkline of zeros should be flat - found %q", s)
+	}
+}
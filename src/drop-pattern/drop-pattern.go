@@ -3,9 +3,21 @@ package main
 import (
 	"flag"
 	"fmt"
+	"os"
 	"time"
 
+	"github.com/EnricoPicci/drop-pattern-with-timeout/src/arrival"
+	"github.com/EnricoPicci/drop-pattern-with-timeout/src/dashboard"
+	"github.com/EnricoPicci/drop-pattern-with-timeout/src/events"
+	"github.com/EnricoPicci/drop-pattern-with-timeout/src/faults"
+	"github.com/EnricoPicci/drop-pattern-with-timeout/src/metrics"
+	"github.com/EnricoPicci/drop-pattern-with-timeout/src/recorder"
+	"github.com/EnricoPicci/drop-pattern-with-timeout/src/report"
 	"github.com/EnricoPicci/drop-pattern-with-timeout/src/request"
+	"github.com/EnricoPicci/drop-pattern-with-timeout/src/scenario"
+	"github.com/EnricoPicci/drop-pattern-with-timeout/src/servicetime"
+	"github.com/EnricoPicci/drop-pattern-with-timeout/src/simulation"
+	"github.com/EnricoPicci/drop-pattern-with-timeout/src/tracing"
 	"github.com/EnricoPicci/drop-pattern-with-timeout/src/waitingroom"
 	"github.com/EnricoPicci/drop-pattern-with-timeout/src/workerpool"
 )
@@ -23,6 +35,44 @@ func main() {
 	haltPoolTime := flag.Int("haltPoolTime", 2000, "at which time (after start) the pool is halted and stops processing in milliseconds")
 	haltPoolDuration := flag.Int("haltPoolDuration", 1000, "for how long the pool is halted in milliseconds")
 	timeout := flag.Int("timeout", 500, "the timeout after which an incoming request not yet taken by the worker pool is dropped")
+	faultsFile := flag.String("faults", "", "path of a json file with the faults to inject in the worker pool (halts, slowdowns, stalls, jitter, errors)")
+	procDist := flag.String("procDist", "constant", "distribution of the processing time of the requests: constant, exponential, lognormal, pareto, bimodal, empirical")
+	procSigma := flag.Float64("procSigma", 1, "standard deviation of the underlying normal distribution for the lognormal distribution")
+	procAlpha := flag.Float64("procAlpha", 2, "shape of the pareto distribution, the lower the heavier the tail (must be greater than 1)")
+	procSlowProb := flag.Float64("procSlowProb", 0.1, "probability that a request is slow for the bimodal distribution")
+	procSlowTime := flag.Int("procSlowTime", 5000, "processing time of the slow requests for the bimodal distribution")
+	procFile := flag.String("procFile", "", "file with one processing time per line for the empirical distribution")
+	seed := flag.Int64("seed", 1, "seed of the random generators")
+	arrivalModel := flag.String("arrival", "fixed", "arrival model of the requests: fixed, poisson, onoff, diurnal, step, closed")
+	burstInterval := flag.Int("burstInterval", 20, "mean interval between requests during a burst for the onoff model")
+	onDuration := flag.Int("onDuration", 1000, "mean duration of a burst for the onoff model")
+	offDuration := flag.Int("offDuration", 3000, "mean duration of the quiet period between bursts for the onoff model")
+	period := flag.Int("period", 10000, "period of the sine wave modulating the rate of requests for the diurnal model")
+	amplitude := flag.Float64("amplitude", 0.5, "amplitude, between 0 and 1, of the variation of the rate of requests for the diurnal model")
+	stepTime := flag.Int("stepTime", 5000, "time at which the interval between requests changes for the step model")
+	stepInterval := flag.Int("stepInterval", 50, "interval between requests after the step for the step model")
+	clients := flag.Int("clients", 10, "number of clients for the closed model")
+	thinkTime := flag.Int("thinkTime", 100, "mean think time of a client between two requests for the closed model")
+	traceFile := flag.String("trace", "", "path of a csv or json-lines trace to replay - when set, arrivals and processing times are read from the trace")
+	traceScale := flag.Float64("traceScale", 1, "factor applied to the timings of the trace, e.g. 0.5 replays the trace twice as fast")
+	scenarioFile := flag.String("scenario", "", "path of a yaml or json scenario file - when set, all the other parameters are ignored")
+	recordFile := flag.String("record", "", "path of a csv (or json, if the extension is .json) file where the state of the simulation sampled over time is written")
+	recordEvery := flag.Int("recordEvery", 100, "interval between two samples of the state of the simulation")
+	reportFile := flag.String("report", "", "path of an html file where a report with the charts of the run is written")
+	compare := flag.Bool("compare", false, "run also the same scenario without the drop pattern and overlay it on the charts of the report")
+	metricsAddr := flag.String("metrics-addr", "", "address, e.g. :9090, where the metrics are exposed on /metrics in the Prometheus text format while the simulation runs")
+	metricsLinger := flag.Duration("metrics-linger", 0, "how long the metrics are still exposed after the end of the simulation, so that the final values can be scraped")
+	eventSink := flag.String("events", "text", "how the events of the requests, of the workers and of the pool are written: text, json (one json object per line) or none")
+	eventsFile := flag.String("eventsFile", "", "path of the file where the events are written - if not set they are written on the console")
+	spansFile := flag.String("spansFile", "", "path of the file where the spans of the lifecycle of each request are written in the OTLP json format")
+	ui := flag.Bool("ui", false, "show a terminal dashboard refreshed while the simulation runs instead of a line for each request")
+	uiRefresh := flag.Duration("uiRefresh", 200*time.Millisecond, "interval between two refreshes of the terminal dashboard")
+	cacheSize := flag.Int("cacheSize", 0, "maximum number of entries of the cache of the results checked before the requests enter the waiting room - 0 means no cache")
+	cacheTTL := flag.Int("cacheTTL", 1000, "time an entry of the cache is fresh after it has been stored")
+	cacheKeys := flag.Int("cacheKeys", 100, "number of distinct keys of the requests, each request having a key drawn at random, when the cache is used")
+	serveStale := flag.Bool("serveStale", false, "answer a request dropped with the entry of its key expired, if any, rather than dropping it")
+	maxStale := flag.Int("maxStale", 0, "how long after its expiry an entry of the cache can be served stale - 0 means until it is evicted")
+	coalesceKeys := flag.Int("coalesceKeys", 0, "number of distinct keys of the requests, each request having a key drawn at random, whose requests waiting share one execution - 0 means no coalescing, if the cache is used it must be equal to cacheKeys")
 	flag.Parse()
 
 	flag.VisitAll(func(f *flag.Flag) {
@@ -30,14 +80,215 @@ func main() {
 	})
 	fmt.Print("\n")
 
-	avgIdleTime, avgWaitTime, requestsSentToPool, requestsDropped := workerPoolWithDropPattern(
-		*poolSize, *reqInterval, *procTime, *numReq, *haltPoolTime, *haltPoolDuration, *timeout,
-	)
+	var sc *scenario.Scenario
+	var err error
+	if *scenarioFile != "" {
+		// the scenario file replaces all the other parameters
+		sc, err = scenario.Load(*scenarioFile)
+	} else {
+		sc = &scenario.Scenario{
+			NumReq:      *numReq,
+			Seed:        *seed,
+			Pool:        scenario.Pool{Size: *poolSize},
+			WaitingRoom: scenario.WaitingRoom{Policy: scenario.Drop, Timeout: *timeout},
+			Arrival: arrival.Config{
+				Name:          *arrivalModel,
+				Interval:      *reqInterval,
+				BurstInterval: *burstInterval,
+				OnDuration:    *onDuration,
+				OffDuration:   *offDuration,
+				Period:        *period,
+				Amplitude:     *amplitude,
+				StepTime:      *stepTime,
+				StepInterval:  *stepInterval,
+				Clients:       *clients,
+				ThinkTime:     *thinkTime,
+			},
+			ServiceTime: servicetime.Config{
+				Name:     *procDist,
+				Mean:     *procTime,
+				Sigma:    *procSigma,
+				Alpha:    *procAlpha,
+				SlowProb: *procSlowProb,
+				SlowTime: *procSlowTime,
+				File:     *procFile,
+			},
+		}
+		// the halt of the pool is one of the faults injected
+		if *haltPoolDuration > 0 {
+			sc.FaultTimeline.Faults = append(sc.FaultTimeline.Faults, faults.HaltWindow(*haltPoolTime, *haltPoolDuration))
+		}
+		if *faultsFile != "" {
+			faultScenario, err := faults.Load(*faultsFile)
+			if err != nil {
+				fmt.Println(err)
+				os.Exit(1)
+			}
+			sc.FaultTimeline.Faults = append(sc.FaultTimeline.Faults, faultScenario.Faults...)
+			sc.FaultTimeline.Seed = faultScenario.Seed
+		}
+		if *traceFile != "" {
+			sc.Trace = &scenario.Trace{File: *traceFile, Scale: *traceScale}
+		}
+		if *cacheSize > 0 {
+			sc.Cache = &scenario.Cache{Size: *cacheSize, TTL: *cacheTTL, Keys: *cacheKeys, ServeStale: *serveStale, MaxStale: *maxStale}
+		}
+		if *coalesceKeys > 0 {
+			sc.Coalesce = &scenario.Coalesce{Keys: *coalesceKeys}
+		}
+		err = sc.Validate()
+	}
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	if sc.WaitingRoom.Policy != scenario.Drop {
+		fmt.Printf("the scenario has the policy %q, run it with the no-drop-pattern command\n", sc.WaitingRoom.Policy)
+		os.Exit(1)
+	}
+
+	fmt.Println("Start processing requests")
+	fmt.Print("\n")
 
-	fmt.Printf("Average idle time for a worker: %v\n", avgIdleTime)
-	fmt.Printf("Average wait time for a request: %v\n", avgWaitTime)
-	fmt.Printf("Number of requests sent to pool: %v\n", len(requestsSentToPool))
-	fmt.Printf("Number of requests dropped: %v\n", len(requestsDropped))
+	sim, err := simulation.New(sc)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	// the dashboard replaces the lines written on the console for each event
+	if *ui && *eventsFile == "" {
+		*eventSink = "none"
+	}
+	sink, closeEvents, err := events.Open(*eventSink, *eventsFile)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	defer func() {
+		if err := closeEvents(); err != nil {
+			fmt.Println("Error writing the events:", err)
+		}
+	}()
+	var tracer *tracing.Tracer
+	if *spansFile != "" {
+		exporter, err := tracing.NewOTLPFile(*spansFile, "drop-pattern")
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		defer exporter.Close()
+		tracer = tracing.New(exporter)
+		sink = events.Multi(sink, tracer)
+	}
+	sim.SetEvents(sink)
+
+	var rec *recorder.Recorder
+	if *recordFile != "" || *reportFile != "" {
+		rec = recorder.New(sim.Pool, sim.WaitingRoom, *recordEvery, sc.Unit())
+		rec.Start()
+	}
+	if *metricsAddr != "" {
+		server, err := metrics.Serve(*metricsAddr, metrics.New(sim.Pool, sim.WaitingRoom))
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		fmt.Printf("Metrics exposed on http://%v/metrics\n", server.Addr())
+		defer func() {
+			time.Sleep(*metricsLinger)
+			server.Close()
+		}()
+	}
+	var dash *dashboard.Dashboard
+	if *ui {
+		dash = dashboard.New("Drop pattern with timeout", sim.Pool, sim.WaitingRoom, os.Stdout, *uiRefresh)
+		dash.Start()
+	}
+
+	result := sim.Run()
+
+	if tracer != nil {
+		tracer.Flush()
+		if err := tracer.Err(); err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		if lost := tracer.Lost(); lost > 0 {
+			fmt.Printf("The spans of %v requests have been lost since the exporter could not keep up\n", lost)
+		}
+	}
+
+	if dash != nil {
+		dash.Stop()
+		fmt.Print("\n")
+	}
+
+	var samples []recorder.Sample
+	if rec != nil {
+		samples = rec.Stop()
+	}
+	if *recordFile != "" {
+		if err := recorder.WriteFile(*recordFile, samples); err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+	}
+
+	fmt.Printf("Average idle time for a worker: %v\n", result.AvgIdleTime)
+	fmt.Printf("Average wait time for a request: %v\n", result.AvgWaitTime)
+	fmt.Printf("Wait time percentiles - %v\n", result.WaitTimes.Summary())
+	fmt.Printf("Processing time percentiles - %v\n", result.ProcTimes.Summary())
+	fmt.Printf("End to end time percentiles - %v\n", result.EndToEndTimes.Summary())
+	fmt.Printf("Number of requests sent to pool: %v\n", len(result.Processed))
+	fmt.Printf("Number of requests dropped: %v\n", len(result.Dropped))
+	fmt.Printf("Number of requests failed: %v\n", result.Failed)
+	if sim.Cache != nil {
+		fmt.Printf("Number of requests answered from the cache: %v\n", result.CacheHits)
+		fmt.Printf("Number of requests not found in the cache: %v\n", result.CacheMisses)
+		fmt.Printf("Number of requests dropped and answered with a stale entry of the cache: %v\n", result.CacheStale)
+	}
+	if sim.Coalescer != nil {
+		fmt.Printf("Number of requests executed as leaders: %v\n", result.CoalesceLeaders)
+		fmt.Printf("Number of executions saved sharing the outcome of a leader: %v\n", result.CoalesceShared)
+		fmt.Printf("Number of followers dropped: %v\n", result.CoalesceDropped)
+		fmt.Printf("Processing time saved: %v\n", result.CoalesceSavedWork)
+	}
+
+	if *reportFile != "" {
+		runs := []report.Run{{Name: "drop", Result: result, Samples: samples}}
+		if *compare {
+			fmt.Print("\nRunning the same scenario without the drop pattern\n")
+			noDropRun, err := runWithoutDrop(sc, *recordEvery)
+			if err != nil {
+				fmt.Println(err)
+				os.Exit(1)
+			}
+			runs = append(runs, noDropRun)
+		}
+		r := report.ForRuns("Drop pattern with timeout", runs, sim.HaltWindows(), sc.Unit())
+		if err := report.WriteFile(*reportFile, r); err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		fmt.Printf("Report written to %v\n", *reportFile)
+	}
+}
+
+// runs a copy of the scenario without the drop pattern, recording its state every "recordEvery" time units
+func runWithoutDrop(sc *scenario.Scenario, recordEvery int) (report.Run, error) {
+	noDrop := *sc
+	noDrop.WaitingRoom = scenario.WaitingRoom{Policy: scenario.NoDrop}
+	if err := noDrop.Validate(); err != nil {
+		return report.Run{}, err
+	}
+	sim, err := simulation.New(&noDrop)
+	if err != nil {
+		return report.Run{}, err
+	}
+	rec := recorder.New(sim.Pool, nil, recordEvery, noDrop.Unit())
+	rec.Start()
+	result := sim.Run()
+	return report.Run{Name: "no drop", Result: result, Samples: rec.Stop()}, nil
 }
 
 func workerPoolWithDropPattern(
@@ -84,35 +335,11 @@ func _workerPoolWithDropPattern(
 	fmt.Println("Start processing requests")
 	fmt.Print("\n")
 
-	// start the worker pool
-	pool.Start()
-	// start the waiting room
-	waitingRoom.Open()
-
-	// we simulate a stream of incoming requests
-	sendRequestsToWaitingRoom(numReq, reqInterval, waitingRoom)
-
-	// close the waiting room since there are no more requests that can arrive
-	waitingRoom.Close()
-	// when there are no more requests that can enter the pool we can stop the pool
-	pool.Stop()
+	result := simulation.RunDrop(pool, waitingRoom, numReq, arrival.FixedInterval(reqInterval), nil)
 
-	idleTime = pool.AvgWorkerIdleTime()
-	waitTime = pool.AvgRequestWaitTime(numReq)
-	requestsProcessed = pool.GetRequests()
-	requestsDropped = waitingRoom.ReqDropped
+	idleTime = result.AvgIdleTime
+	waitTime = result.AvgWaitTime
+	requestsProcessed = result.Processed
+	requestsDropped = result.Dropped
 	return
 }
-
-// simulates a stream of incoming requests
-func sendRequestsToWaitingRoom(numReq int, reqInterval int, waitingRoom *waitingroom.WaitingRoom) {
-	for i := 0; i < numReq; i++ {
-		// interval between each incoming request
-		var intervalBetweenRequests = time.Duration(reqInterval) * timeUnit
-		time.Sleep(time.Duration(intervalBetweenRequests))
-		req := request.Request{Param: i, Created: time.Now()}
-
-		// the request is sent to the waiting room
-		waitingRoom.LetIn(req)
-	}
-}
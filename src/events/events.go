@@ -0,0 +1,358 @@
+package events
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/EnricoPicci/drop-pattern-with-timeout/src/request"
+)
+
+// Kind is the kind of an event
+type Kind string
+
+const (
+	// a request has been let in the waiting room
+	Admitted Kind = "admitted"
+	// a request has been sent from the waiting room to the worker pool
+	Dispatched Kind = "dispatched"
+	// a request has been dropped by the waiting room
+	Dropped Kind = "dropped"
+	// a request taken in by a worker in batch mode has been dropped since it has expired before the batch was processed
+	BatchDropped Kind = "batchDropped"
+	// a worker has started processing a request
+	Started Kind = "started"
+	// a worker has completed the processing of a request
+	Completed Kind = "completed"
+	// all the workers of the pool have been halted
+	Halted Kind = "halted"
+	// the workers of the pool are back to normal operations
+	Restored Kind = "restored"
+	// a worker has been started with the pool
+	WorkerStarted Kind = "workerStarted"
+	// a worker has been stopped since there are no more requests to process
+	WorkerStopped Kind = "workerStopped"
+	// a worker has completed a request and is ready to take in the next one
+	WorkerIdle Kind = "workerIdle"
+)
+
+// Event is something that happened to a request, a worker or the whole pool
+type Event struct {
+	Kind Kind
+	Time time.Time
+	// the id and the param of the request the event refers to, if any
+	Request string
+	Param   int
+	// the worker the event refers to, if any
+	Worker int
+	// the time the request has been waiting: in the waiting room for dispatched and dropped events, in the batch of a worker
+	// for batch dropped events, since its creation for started and completed events
+	Wait time.Duration
+	// the processing time for completed events, the duration of the halt for restored events
+	Duration time.Duration
+	// the reason why a request has been dropped
+	Reason string
+	// true if the processing of the request has failed
+	Failed bool
+	// the priority and the W3C trace context of the request
+	Priority    int
+	TraceParent string
+}
+
+// OfRequest returns an event of the kind passed, happening now, which refers to the request
+func OfRequest(kind Kind, req request.Request) Event {
+	return Event{Kind: kind, Time: time.Now(), Request: req.ID, Param: req.Param, Priority: req.Priority, TraceParent: req.TraceParent}
+}
+
+// returns true if the event refers to a request
+func (e Event) hasRequest() bool {
+	return e.Kind != Halted && e.Kind != Restored && e.Kind != WorkerStarted && e.Kind != WorkerStopped && e.Kind != WorkerIdle
+}
+
+// returns true if the event refers to a worker
+func (e Event) hasWorker() bool {
+	return e.Kind == Started || e.Kind == Completed || e.Kind == BatchDropped || e.Kind == WorkerStarted || e.Kind == WorkerStopped || e.Kind == WorkerIdle
+}
+
+// MarshalJSON writes the event as a json object containing only the fields relevant for its kind - the durations are
+// expressed in nanoseconds
+func (e Event) MarshalJSON() ([]byte, error) {
+	type event struct {
+		Kind     Kind          `json:"kind"`
+		Time     time.Time     `json:"time"`
+		Request  string        `json:"request,omitempty"`
+		Param    *int          `json:"param,omitempty"`
+		Worker   *int          `json:"worker,omitempty"`
+		Wait     time.Duration `json:"wait,omitempty"`
+		Duration time.Duration `json:"duration,omitempty"`
+		Reason   string        `json:"reason,omitempty"`
+		Failed   bool          `json:"failed,omitempty"`
+		Priority int           `json:"priority,omitempty"`
+		Trace    string        `json:"traceParent,omitempty"`
+	}
+	out := event{Kind: e.Kind, Time: e.Time, Wait: e.Wait, Duration: e.Duration, Reason: e.Reason, Failed: e.Failed,
+		Priority: e.Priority, Trace: e.TraceParent}
+	if e.hasRequest() {
+		out.Request = e.Request
+		out.Param = &e.Param
+	}
+	if e.hasWorker() {
+		out.Worker = &e.Worker
+	}
+	return json.Marshal(out)
+}
+
+// Sink receives the events emitted by the waiting room and the worker pool - Emit is called on the path of the requests,
+// so it has to be fast and safe for concurrent use
+type Sink interface {
+	Emit(e Event)
+}
+
+// SinkFunc adapts a function to the Sink interface
+type SinkFunc func(e Event)
+
+func (f SinkFunc) Emit(e Event) {
+	f(e)
+}
+
+type discard struct{}
+
+func (discard) Emit(e Event) {}
+
+// Discard is a sink which ignores all the events - it is the default of the waiting room and of the worker pool
+var Discard Sink = discard{}
+
+// JSONLines is a sink which writes each event as a json object on a separate line
+type JSONLines struct {
+	mu  sync.Mutex
+	enc *json.Encoder
+	// the first error writing an event
+	err error
+}
+
+// NewJSONLines returns a sink writing the events as json lines on w
+func NewJSONLines(w io.Writer) *JSONLines {
+	s := JSONLines{enc: json.NewEncoder(w)}
+	return &s
+}
+
+func (s *JSONLines) Emit(e Event) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.enc.Encode(e); err != nil && s.err == nil {
+		s.err = err
+	}
+}
+
+// Err returns the first error writing an event, if any - the events following the error are still written
+func (s *JSONLines) Err() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.err
+}
+
+// Text is a sink which writes a human readable line for each event
+type Text struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+// NewText returns a sink writing a line for each event on w
+func NewText(w io.Writer) *Text {
+	s := Text{w: w}
+	return &s
+}
+
+func (s *Text) Emit(e Event) {
+	var line string
+	switch e.Kind {
+	case Admitted:
+		line = fmt.Sprintf("Request %v in the waiting room", e.Request)
+	case Dispatched:
+		line = fmt.Sprintf("Request %v sent to pool", e.Request)
+	case Dropped:
+		line = fmt.Sprintf("Request %v dropped", e.Request)
+	case BatchDropped:
+		line = fmt.Sprintf("Request %v dropped by worker %v while batched", e.Request, e.Worker)
+	case Completed:
+		line = fmt.Sprintf("===>>>> Request %v executed with parameter %v - wait time %v", e.Request, e.Param, e.Wait)
+	case Halted:
+		line = "Pool halted"
+	case Restored:
+		line = fmt.Sprintf("Pool restored after %v", e.Duration)
+	case WorkerStarted:
+		line = fmt.Sprintf("Worker %v started", e.Worker)
+	case WorkerStopped:
+		line = fmt.Sprintf("Worker %v shutting down", e.Worker)
+	default:
+		// the start of the processing and the workers becoming idle are not shown to keep the output readable
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	fmt.Fprintln(s.w, line)
+}
+
+// Memory is a sink which keeps all the events in memory, e.g. to check them in tests
+type Memory struct {
+	mu     sync.Mutex
+	events []Event
+}
+
+// NewMemory returns an empty memory sink
+func NewMemory() *Memory {
+	s := Memory{events: make([]Event, 0)}
+	return &s
+}
+
+func (s *Memory) Emit(e Event) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.events = append(s.events, e)
+}
+
+// Events returns the events received so far, optionally only the ones of the kinds passed
+func (s *Memory) Events(kinds ...Kind) []Event {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	events := make([]Event, 0, len(s.events))
+	for _, e := range s.events {
+		if len(kinds) == 0 || contains(kinds, e.Kind) {
+			events = append(events, e)
+		}
+	}
+	return events
+}
+
+func contains(kinds []Kind, kind Kind) bool {
+	for _, k := range kinds {
+		if k == kind {
+			return true
+		}
+	}
+	return false
+}
+
+// Multi returns a sink which sends each event to all the sinks passed
+func Multi(sinks ...Sink) Sink {
+	return SinkFunc(func(e Event) {
+		for _, s := range sinks {
+			s.Emit(e)
+		}
+	})
+}
+
+// Async is a sink which delivers the events to another sink in a separate goroutine, through a buffer, so that a slow sink
+// never blocks the waiting room and the worker pool - if the buffer is full the event is discarded and counted as lost
+type Async struct {
+	sink Sink
+	ch   chan Event
+	done chan struct{}
+
+	// protects the channel from being closed while an event is being sent
+	mu     sync.RWMutex
+	closed bool
+	lost   int
+}
+
+// NewAsync returns a sink which delivers the events to "sink" through a buffer of the size passed
+func NewAsync(sink Sink, buffer int) *Async {
+	a := Async{
+		sink: sink,
+		ch:   make(chan Event, buffer),
+		done: make(chan struct{}),
+	}
+	go func() {
+		defer close(a.done)
+		for e := range a.ch {
+			a.sink.Emit(e)
+		}
+	}()
+	return &a
+}
+
+func (a *Async) Emit(e Event) {
+	a.mu.RLock()
+	if a.closed {
+		a.mu.RUnlock()
+		return
+	}
+	select {
+	case a.ch <- e:
+		a.mu.RUnlock()
+	default:
+		a.mu.RUnlock()
+		a.mu.Lock()
+		a.lost++
+		a.mu.Unlock()
+	}
+}
+
+// Close waits until all the events in the buffer have been delivered - the events emitted afterwards are ignored
+func (a *Async) Close() {
+	a.mu.Lock()
+	if !a.closed {
+		a.closed = true
+		close(a.ch)
+	}
+	a.mu.Unlock()
+	<-a.done
+}
+
+// Lost returns the number of events discarded because the buffer was full
+func (a *Async) Lost() int {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	return a.lost
+}
+
+// New returns the sink with the name passed: "text" and "json" write on w, "none" discards all the events
+func New(name string, w io.Writer) (Sink, error) {
+	switch name {
+	case "text":
+		return NewText(w), nil
+	case "json":
+		return NewJSONLines(w), nil
+	case "none", "":
+		return Discard, nil
+	default:
+		return nil, fmt.Errorf("unknown event sink %q - valid values are text, json and none", name)
+	}
+}
+
+// Open returns the sink with the name passed writing on the file at path, or on the console if path is empty, and a function
+// which closes the file and returns the first error writing the events, if any, or closing the file
+func Open(name string, path string) (Sink, func() error, error) {
+	if path == "" {
+		sink, err := New(name, os.Stdout)
+		return sink, func() error { return sinkErr(sink) }, err
+	}
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	sink, err := New(name, f)
+	if err != nil {
+		f.Close()
+		return nil, nil, err
+	}
+	closeFile := func() error {
+		err := sinkErr(sink)
+		if errClose := f.Close(); err == nil {
+			err = errClose
+		}
+		return err
+	}
+	return sink, closeFile, nil
+}
+
+// returns the first error writing the events of the sink, if it records it
+func sinkErr(sink Sink) error {
+	if s, ok := sink.(*JSONLines); ok {
+		return s.Err()
+	}
+	return nil
+}
@@ -0,0 +1,86 @@
+package events
+
+import (
+	"errors"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestJSONLines(t *testing.T) {
+	var b strings.Builder
+	sink := NewJSONLines(&b)
+	at := time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC)
+	sink.Emit(Event{Kind: Dropped, Time: at, Request: "a-1", Param: 0, Wait: 500 * time.Millisecond, Reason: "timeout"})
+	sink.Emit(Event{Kind: Completed, Time: at, Request: "a-2", Param: 1, Worker: 0, Wait: time.Millisecond, Duration: time.Second})
+	sink.Emit(Event{Kind: Halted, Time: at})
+
+	expected := `{"kind":"dropped","time":"2022-01-01T00:00:00Z","request":"a-1","param":0,"wait":500000000,"reason":"timeout"}
+{"kind":"completed","time":"2022-01-01T00:00:00Z","request":"a-2","param":1,"worker":0,"wait":1000000,"duration":1000000000}
+{"kind":"halted","time":"2022-01-01T00:00:00Z"}
+`
+	if b.String() != expected {
+		t.Errorf("The json lines should be\n%v\nfound\n%v", expected, b.String())
+	}
+}
+
+// a writer which fails after having written n bytes
+type failingWriter struct {
+	n int
+}
+
+func (w *failingWriter) Write(p []byte) (int, error) {
+	if len(p) > w.n {
+		return 0, errors.New("disk full")
+	}
+	w.n -= len(p)
+	return len(p), nil
+}
+
+// the first error writing an event is recorded and returned by the function closing the sink
+func TestJSONLinesError(t *testing.T) {
+	sink := NewJSONLines(&failingWriter{n: 100})
+	sink.Emit(Event{Kind: Halted})
+	if sink.Err() != nil {
+		t.Fatalf("The first event should be written - %v", sink.Err())
+	}
+	sink.Emit(Event{Kind: Dropped, Request: "a-1", Reason: "a reason long enough to exceed what is left of the writer"})
+	sink.Emit(Event{Kind: Restored})
+	if sink.Err() == nil || sink.Err().Error() != "disk full" {
+		t.Errorf("The error writing the second event should be recorded - found %v", sink.Err())
+	}
+
+	path := filepath.Join(t.TempDir(), "events.jsonl")
+	s, closeEvents, err := Open("json", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.(*JSONLines).err = errors.New("disk full")
+	if err := closeEvents(); err == nil {
+		t.Errorf("Closing the sink should return the error writing the events")
+	}
+}
+
+func TestText(t *testing.T) {
+	var b strings.Builder
+	sink := NewText(&b)
+	sink.Emit(Event{Kind: Admitted, Request: "a-3", Param: 3})
+	// the start of the processing is not written
+	sink.Emit(Event{Kind: Started, Request: "a-3", Param: 3, Worker: 1})
+	sink.Emit(Event{Kind: Completed, Request: "a-3", Param: 3, Worker: 1, Wait: time.Second})
+
+	expected := "Request a-3 in the waiting room\n===>>>> Request a-3 executed with parameter 3 - wait time 1s\n"
+	if b.String() != expected {
+		t.Errorf("The text should be\n%v\nfound\n%v", expected, b.String())
+	}
+}
+
+func TestNew(t *testing.T) {
+	if sink, err := New("none", nil); err != nil || sink != Discard {
+		t.Errorf("The none sink should discard the events")
+	}
+	if _, err := New("xml", nil); err == nil {
+		t.Errorf("An unknown sink should return an error")
+	}
+}
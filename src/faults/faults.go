@@ -0,0 +1,266 @@
+package faults
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"os"
+	"sync"
+	"time"
+)
+
+// Kind identifies the type of fault injected in the worker pool
+type Kind string
+
+const (
+	// all the workers of the pool stop processing requests for the duration of the fault
+	Halt Kind = "halt"
+	// the processing time of the requests is multiplied by a factor for the duration of the fault
+	Slowdown Kind = "slowdown"
+	// a subset of the workers of the pool stop processing requests for the duration of the fault
+	Stall Kind = "stall"
+	// a random delay, between 0 and a max value, is added to the processing time of the requests
+	Jitter Kind = "jitter"
+	// requests fail with a certain probability
+	Error Kind = "error"
+)
+
+// Fault describes a single fault injected in the worker pool.
+// All times are expressed in time units and are relative to the moment the pool is started.
+type Fault struct {
+	Kind Kind `json:"kind" yaml:"kind"`
+	// time (after the pool is started) at which the fault starts
+	Start int `json:"start" yaml:"start"`
+	// for how long the fault lasts - 0 means that the fault lasts until the end of the run
+	Duration int `json:"duration" yaml:"duration"`
+	// the factor applied to the processing time by a slowdown fault
+	Factor float64 `json:"factor,omitempty" yaml:"factor"`
+	// the ids of the workers stalled by a stall fault
+	Workers []int `json:"workers,omitempty" yaml:"workers"`
+	// the max delay added to the processing time by a jitter fault
+	MaxJitter int `json:"maxJitter,omitempty" yaml:"maxJitter"`
+	// the probability, between 0 and 1, that a request fails while an error fault is active
+	Rate float64 `json:"rate,omitempty" yaml:"rate"`
+}
+
+// HaltWindow returns a fault that halts all the workers at "start" for "duration"
+func HaltWindow(start int, duration int) Fault {
+	return Fault{Kind: Halt, Start: start, Duration: duration}
+}
+
+// SlowdownWindow returns a fault that multiplies the processing time by "factor" starting at "start" for "duration"
+func SlowdownWindow(start int, duration int, factor float64) Fault {
+	return Fault{Kind: Slowdown, Start: start, Duration: duration, Factor: factor}
+}
+
+// StallWindow returns a fault that halts the workers with the ids specified starting at "start" for "duration"
+func StallWindow(start int, duration int, workers ...int) Fault {
+	return Fault{Kind: Stall, Start: start, Duration: duration, Workers: workers}
+}
+
+// JitterWindow returns a fault that adds a random delay, up to "maxJitter", to the processing time starting at "start" for "duration"
+func JitterWindow(start int, duration int, maxJitter int) Fault {
+	return Fault{Kind: Jitter, Start: start, Duration: duration, MaxJitter: maxJitter}
+}
+
+// ErrorWindow returns a fault that makes requests fail with probability "rate" starting at "start" for "duration"
+func ErrorWindow(start int, duration int, rate float64) Fault {
+	return Fault{Kind: Error, Start: start, Duration: duration, Rate: rate}
+}
+
+// Scenario is a set of faults injected in a worker pool during a run
+type Scenario struct {
+	Faults []Fault `json:"faults" yaml:"faults"`
+	// the seed used to generate the random values of jitter and error faults
+	Seed int64 `json:"seed" yaml:"seed"`
+
+	// protects the random generator which is shared among all the workers
+	muRnd sync.Mutex
+	rnd   *rand.Rand
+}
+
+// New builds a scenario in code
+func New(seed int64, faults ...Fault) *Scenario {
+	s := Scenario{
+		Faults: faults,
+		Seed:   seed,
+	}
+	return &s
+}
+
+// Load reads a scenario from a json file like this one
+//
+//	{
+//	  "seed": 1,
+//	  "faults": [
+//	    {"kind": "halt", "start": 1000, "duration": 2000},
+//	    {"kind": "slowdown", "start": 4000, "duration": 1000, "factor": 2},
+//	    {"kind": "stall", "start": 6000, "duration": 500, "workers": [0, 1]},
+//	    {"kind": "jitter", "start": 0, "duration": 0, "maxJitter": 100},
+//	    {"kind": "error", "start": 7000, "duration": 500, "rate": 0.1}
+//	  ]
+//	}
+func Load(path string) (*Scenario, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	s := Scenario{}
+	err = json.Unmarshal(data, &s)
+	if err != nil {
+		return nil, fmt.Errorf("fault scenario %v: %w", path, err)
+	}
+	// the size of the pool is not known here, so the workers of the stalls are checked when the faults are set in a scenario
+	err = s.Validate(0)
+	if err != nil {
+		return nil, fmt.Errorf("fault scenario %v: %w", path, err)
+	}
+	return &s, nil
+}
+
+// Validate checks that all the faults of the scenario are consistent and, if poolSize is greater than 0, that the workers
+// stalled are workers of a pool of that size
+func (s *Scenario) Validate(poolSize int) error {
+	for i, f := range s.Faults {
+		if f.Start < 0 || f.Duration < 0 {
+			return fmt.Errorf("faults[%v]: start and duration can not be negative", i)
+		}
+		switch f.Kind {
+		case Halt:
+			// a halt lasting until the end of the run would never let the pool stop
+			if f.Duration == 0 {
+				return fmt.Errorf("faults[%v]: the duration of a halt must be greater than 0", i)
+			}
+		case Slowdown:
+			if f.Factor <= 0 {
+				return fmt.Errorf("faults[%v]: the factor of a slowdown must be greater than 0", i)
+			}
+		case Stall:
+			if len(f.Workers) == 0 {
+				return fmt.Errorf("faults[%v]: a stall must specify at least one worker", i)
+			}
+			if f.Duration == 0 {
+				return fmt.Errorf("faults[%v]: the duration of a stall must be greater than 0", i)
+			}
+			for _, id := range f.Workers {
+				// a stall of a worker which does not exist would silently do nothing
+				if id < 0 || (poolSize > 0 && id >= poolSize) {
+					return fmt.Errorf("faults[%v]: the worker %v of a stall is not a worker of the pool", i, id)
+				}
+			}
+		case Jitter:
+			if f.MaxJitter <= 0 {
+				return fmt.Errorf("faults[%v]: the maxJitter of a jitter must be greater than 0", i)
+			}
+		case Error:
+			if f.Rate < 0 || f.Rate > 1 {
+				return fmt.Errorf("faults[%v]: the rate of an error must be between 0 and 1", i)
+			}
+		default:
+			return fmt.Errorf("faults[%v]: unknown kind %q", i, f.Kind)
+		}
+	}
+	return nil
+}
+
+// HaltWindows returns the start and the end of the periods when all the workers are halted
+func (s *Scenario) HaltWindows(timeUnit time.Duration) [][2]time.Duration {
+	windows := make([][2]time.Duration, 0)
+	for _, f := range s.Faults {
+		if f.Kind == Halt {
+			start, end := f.window(timeUnit)
+			windows = append(windows, [2]time.Duration{start, end})
+		}
+	}
+	return windows
+}
+
+// StallFor returns how long the worker with id "workerId" has to wait before it can process a request, given the time elapsed
+// since the start of the pool - 0 means that the worker is not affected by any halt or stall
+func (s *Scenario) StallFor(workerId int, elapsed time.Duration, timeUnit time.Duration) time.Duration {
+	var wait time.Duration
+	for _, f := range s.Faults {
+		if f.Kind != Halt && !(f.Kind == Stall && f.affects(workerId)) {
+			continue
+		}
+		if !f.isActive(elapsed, timeUnit) {
+			continue
+		}
+		_, end := f.window(timeUnit)
+		if end-elapsed > wait {
+			wait = end - elapsed
+		}
+	}
+	return wait
+}
+
+// ProcTime returns the processing time of a request, starting from its nominal processing time "procTime" and applying
+// the slowdown and jitter faults active at the time elapsed since the start of the pool
+func (s *Scenario) ProcTime(procTime time.Duration, elapsed time.Duration, timeUnit time.Duration) time.Duration {
+	for _, f := range s.Faults {
+		if !f.isActive(elapsed, timeUnit) {
+			continue
+		}
+		switch f.Kind {
+		case Slowdown:
+			procTime = time.Duration(float64(procTime) * f.Factor)
+		case Jitter:
+			procTime = procTime + time.Duration(s.intn(f.MaxJitter+1))*timeUnit
+		}
+	}
+	return procTime
+}
+
+// Fail returns true if a request processed at the time elapsed since the start of the pool has to fail
+func (s *Scenario) Fail(elapsed time.Duration, timeUnit time.Duration) bool {
+	for _, f := range s.Faults {
+		if f.Kind == Error && f.isActive(elapsed, timeUnit) && s.float64() < f.Rate {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *Scenario) intn(n int) int {
+	s.muRnd.Lock()
+	defer s.muRnd.Unlock()
+	return s.random().Intn(n)
+}
+
+func (s *Scenario) float64() float64 {
+	s.muRnd.Lock()
+	defer s.muRnd.Unlock()
+	return s.random().Float64()
+}
+
+// the random generator is created lazily since a scenario can be loaded from a file or built as a literal
+func (s *Scenario) random() *rand.Rand {
+	if s.rnd == nil {
+		s.rnd = rand.New(rand.NewSource(s.Seed))
+	}
+	return s.rnd
+}
+
+// returns the start and the end of the fault
+func (f Fault) window(timeUnit time.Duration) (time.Duration, time.Duration) {
+	start := time.Duration(f.Start) * timeUnit
+	end := start + time.Duration(f.Duration)*timeUnit
+	return start, end
+}
+
+func (f Fault) isActive(elapsed time.Duration, timeUnit time.Duration) bool {
+	start, end := f.window(timeUnit)
+	if elapsed < start {
+		return false
+	}
+	return f.Duration == 0 || elapsed < end
+}
+
+func (f Fault) affects(workerId int) bool {
+	for _, id := range f.Workers {
+		if id == workerId {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,92 @@
+package faults
+
+import (
+	"testing"
+	"time"
+)
+
+func TestStallFor(t *testing.T) {
+	s := New(1, HaltWindow(100, 200), StallWindow(250, 200, 1))
+
+	// before the halt no worker is stalled
+	if wait := s.StallFor(0, 50*time.Millisecond, time.Millisecond); wait != 0 {
+		t.Errorf("No worker should be stalled before the halt - wait %v", wait)
+	}
+	// during the halt all workers wait until the end of the halt
+	if wait := s.StallFor(0, 150*time.Millisecond, time.Millisecond); wait != 150*time.Millisecond {
+		t.Errorf("The worker should wait until the end of the halt - wait %v", wait)
+	}
+	// the stall affects only the workers listed and overlaps with the halt
+	if wait := s.StallFor(1, 280*time.Millisecond, time.Millisecond); wait != 170*time.Millisecond {
+		t.Errorf("The worker 1 should wait until the end of the stall - wait %v", wait)
+	}
+	if wait := s.StallFor(0, 320*time.Millisecond, time.Millisecond); wait != 0 {
+		t.Errorf("The worker 0 is not affected by the stall - wait %v", wait)
+	}
+}
+
+func TestProcTime(t *testing.T) {
+	s := New(1, SlowdownWindow(100, 100, 3), JitterWindow(300, 0, 10))
+
+	procTime := 100 * time.Millisecond
+	if p := s.ProcTime(procTime, 50*time.Millisecond, time.Millisecond); p != procTime {
+		t.Errorf("The processing time should not change outside the slowdown - processing time %v", p)
+	}
+	if p := s.ProcTime(procTime, 150*time.Millisecond, time.Millisecond); p != 300*time.Millisecond {
+		t.Errorf("The processing time should be multiplied by the factor of the slowdown - processing time %v", p)
+	}
+	// a jitter with duration 0 lasts until the end of the run
+	for i := 0; i < 100; i++ {
+		p := s.ProcTime(procTime, time.Hour, time.Millisecond)
+		if p < procTime || p > procTime+10*time.Millisecond {
+			t.Fatalf("The jitter should add at most 10ms - processing time %v", p)
+		}
+	}
+}
+
+func TestFail(t *testing.T) {
+	s := New(1, ErrorWindow(0, 1000, 0.5))
+
+	failed := 0
+	for i := 0; i < 1000; i++ {
+		if s.Fail(time.Duration(i)*time.Millisecond, time.Millisecond) {
+			failed++
+		}
+	}
+	if failed < 400 || failed > 600 {
+		t.Errorf("About half of the requests should fail - failed %v", failed)
+	}
+	if s.Fail(2*time.Second, time.Millisecond) {
+		t.Error("No request should fail after the end of the error window")
+	}
+}
+
+func TestLoad(t *testing.T) {
+	s, err := Load("incident.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(s.Faults) != 5 {
+		t.Errorf("The scenario should contain 5 faults - found %v", len(s.Faults))
+	}
+
+	invalid := New(1, Fault{Kind: Slowdown, Start: 0, Duration: 100})
+	if err := invalid.Validate(0); err == nil {
+		t.Error("A slowdown without factor should be invalid")
+	}
+}
+
+// a stall of a worker which is not in the pool would do nothing
+func TestStallOfAWorkerNotInThePool(t *testing.T) {
+	s := New(1, StallWindow(0, 100, 1, 2))
+	if err := s.Validate(3); err != nil {
+		t.Error(err)
+	}
+	if err := s.Validate(2); err == nil {
+		t.Error("A stall of the worker 2 should be invalid in a pool of 2 workers")
+	}
+	negative := New(1, StallWindow(0, 100, -1))
+	if err := negative.Validate(0); err == nil {
+		t.Error("A stall of a negative worker should be invalid")
+	}
+}
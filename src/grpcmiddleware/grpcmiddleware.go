@@ -0,0 +1,130 @@
+package grpcmiddleware
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+
+	"github.com/EnricoPicci/drop-pattern-with-timeout/src/middleware"
+)
+
+// the trailer through which the server tells a client, which retries the calls, how long to wait before retrying
+const pushbackTrailer = "grpc-retry-pushback-ms"
+
+// Config is the configuration of the drop pattern in front of the calls of a grpc server
+type Config struct {
+	// the concurrency and the timeout - the retry after, if set, is sent to the clients in the grpc-retry-pushback-ms trailer
+	middleware.Config `yaml:",inline"`
+	// the code of the error returned when a call is dropped: ResourceExhausted, the default, or Unavailable
+	DropCode codes.Code `yaml:"-"`
+}
+
+// Validate returns an error if the configuration is not valid
+func (c Config) Validate() error {
+	if c.DropCode != codes.OK && c.DropCode != codes.ResourceExhausted && c.DropCode != codes.Unavailable {
+		return fmt.Errorf("the drop code must be ResourceExhausted or Unavailable - found %v", c.DropCode)
+	}
+	return c.Config.Validate()
+}
+
+// Interceptors admits the calls of a grpc server through a gate: a call waits for a worker up to the timeout, or up to the
+// deadline set by the client if it comes first, and then is either executed on the worker or rejected with the drop code.
+// The calls which come in after the interceptors have been closed are rejected with Unavailable and the ones whose context is
+// done when a worker takes them in with Canceled or DeadlineExceeded. The interceptors have to be
+// closed, after the grpc server has been stopped, to stop the workers.
+type Interceptors struct {
+	*middleware.Gate
+	dropCode codes.Code
+	// the value of the pushback trailer, empty if not sent
+	pushback string
+}
+
+// New returns the interceptors with the concurrency and the timeout of the configuration and starts their workers
+func New(config Config) (*Interceptors, error) {
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
+	gate, err := middleware.NewGate(config.Config)
+	if err != nil {
+		return nil, err
+	}
+	i := Interceptors{
+		Gate:     gate,
+		dropCode: config.DropCode,
+	}
+	if i.dropCode == codes.OK {
+		i.dropCode = codes.ResourceExhausted
+	}
+	if config.RetryAfter > 0 {
+		i.pushback = strconv.FormatInt(config.RetryAfter.Milliseconds(), 10)
+	}
+	return &i, nil
+}
+
+// Unary returns the interceptor of the unary calls, to be passed to grpc.UnaryInterceptor or grpc.ChainUnaryInterceptor
+func (i *Interceptors) Unary() grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		var resp interface{}
+		var err error
+		outcome := i.Admit(ctx, traceParent(ctx), func() {
+			resp, err = handler(ctx, req)
+		})
+		if outcome != middleware.Executed {
+			if i.pushback != "" && outcome != middleware.Canceled {
+				grpc.SetTrailer(ctx, metadata.Pairs(pushbackTrailer, i.pushback))
+			}
+			return nil, i.rejected(ctx, outcome, info.FullMethod)
+		}
+		return resp, err
+	}
+}
+
+// Stream returns the interceptor of the streaming calls, to be passed to grpc.StreamInterceptor or
+// grpc.ChainStreamInterceptor - a stream holds its worker until it ends
+func (i *Interceptors) Stream() grpc.StreamServerInterceptor {
+	return func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		var err error
+		outcome := i.Admit(ss.Context(), traceParent(ss.Context()), func() {
+			err = handler(srv, ss)
+		})
+		if outcome != middleware.Executed {
+			if i.pushback != "" && outcome != middleware.Canceled {
+				ss.SetTrailer(metadata.Pairs(pushbackTrailer, i.pushback))
+			}
+			return i.rejected(ss.Context(), outcome, info.FullMethod)
+		}
+		return err
+	}
+}
+
+// returns the error of a call which has not been executed
+func (i *Interceptors) rejected(ctx context.Context, outcome middleware.Outcome, method string) error {
+	switch outcome {
+	case middleware.Closed:
+		return status.Errorf(codes.Unavailable, "%v: the server is shutting down", method)
+	case middleware.Canceled:
+		if ctx.Err() == context.DeadlineExceeded {
+			return status.Errorf(codes.DeadlineExceeded, "%v: the deadline has expired before a worker has been available", method)
+		}
+		return status.Errorf(codes.Canceled, "%v: canceled before a worker has been available", method)
+	}
+	return status.Errorf(i.dropCode, "%v: dropped since no worker has been available in time", method)
+}
+
+// returns the W3C trace context sent by the client, if any
+func traceParent(ctx context.Context) string {
+	md, ok := metadata.FromIncomingContext(ctx)
+	if !ok {
+		return ""
+	}
+	values := md.Get("traceparent")
+	if len(values) == 0 {
+		return ""
+	}
+	return values[0]
+}
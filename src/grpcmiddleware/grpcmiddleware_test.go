@@ -0,0 +1,212 @@
+package grpcmiddleware
+
+import (
+	"context"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+
+	"github.com/EnricoPicci/drop-pattern-with-timeout/src/middleware"
+	"github.com/EnricoPicci/drop-pattern-with-timeout/src/waitingroom"
+)
+
+// a health service which takes procTime to answer a check and to send the first message of a watch
+type slowHealth struct {
+	grpc_health_v1.UnimplementedHealthServer
+	procTime time.Duration
+}
+
+func (h *slowHealth) Check(ctx context.Context, req *grpc_health_v1.HealthCheckRequest) (*grpc_health_v1.HealthCheckResponse, error) {
+	time.Sleep(h.procTime)
+	return &grpc_health_v1.HealthCheckResponse{Status: grpc_health_v1.HealthCheckResponse_SERVING}, nil
+}
+
+func (h *slowHealth) Watch(req *grpc_health_v1.HealthCheckRequest, stream grpc_health_v1.Health_WatchServer) error {
+	time.Sleep(h.procTime)
+	return stream.Send(&grpc_health_v1.HealthCheckResponse{Status: grpc_health_v1.HealthCheckResponse_SERVING})
+}
+
+// starts an in-process grpc server fronted by the interceptors and returns a client connected to it
+func newServer(t *testing.T, config Config, procTime time.Duration) (grpc_health_v1.HealthClient, *Interceptors) {
+	interceptors, err := New(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener := bufconn.Listen(1024 * 1024)
+	server := grpc.NewServer(grpc.UnaryInterceptor(interceptors.Unary()), grpc.StreamInterceptor(interceptors.Stream()))
+	grpc_health_v1.RegisterHealthServer(server, &slowHealth{procTime: procTime})
+	go server.Serve(listener)
+
+	conn, err := grpc.DialContext(context.Background(), "bufnet",
+		grpc.WithContextDialer(func(ctx context.Context, s string) (net.Conn, error) { return listener.DialContext(ctx) }),
+		grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		conn.Close()
+		server.Stop()
+		interceptors.Close()
+	})
+	return grpc_health_v1.NewHealthClient(conn), interceptors
+}
+
+// sends n concurrent checks and returns the codes of the responses and the trailers
+func checks(client grpc_health_v1.HealthClient, n int, timeout time.Duration) ([]codes.Code, []metadata.MD) {
+	cs := make([]codes.Code, n)
+	trailers := make([]metadata.MD, n)
+	var wg sync.WaitGroup
+	wg.Add(n)
+	for i := 0; i < n; i++ {
+		go func(i int) {
+			defer wg.Done()
+			ctx, cancel := context.WithTimeout(context.Background(), timeout)
+			defer cancel()
+			_, err := client.Check(ctx, &grpc_health_v1.HealthCheckRequest{}, grpc.Trailer(&trailers[i]))
+			cs[i] = status.Code(err)
+		}(i)
+	}
+	wg.Wait()
+	return cs, trailers
+}
+
+func count(cs []codes.Code, code codes.Code) int {
+	n := 0
+	for _, c := range cs {
+		if c == code {
+			n++
+		}
+	}
+	return n
+}
+
+func TestUnaryServedWithinTimeout(t *testing.T) {
+	client, interceptors := newServer(t, Config{Config: middleware.Config{Workers: 2, Timeout: time.Second}}, 10*time.Millisecond)
+
+	cs, _ := checks(client, 6, 5*time.Second)
+	if count(cs, codes.OK) != 6 {
+		t.Errorf("All the calls should have been served - found %v", cs)
+	}
+	if interceptors.Pool.Completed() != 6 {
+		t.Errorf("Expected 6 calls completed by the pool - found %v", interceptors.Pool.Completed())
+	}
+}
+
+func TestUnaryDropped(t *testing.T) {
+	config := Config{Config: middleware.Config{Workers: 1, Timeout: 20 * time.Millisecond, RetryAfter: 1500 * time.Millisecond}}
+	client, interceptors := newServer(t, config, 200*time.Millisecond)
+
+	cs, trailers := checks(client, 3, 5*time.Second)
+	if count(cs, codes.OK) != 1 || count(cs, codes.ResourceExhausted) != 2 {
+		t.Errorf("Expected 1 call served and 2 dropped with ResourceExhausted - found %v", cs)
+	}
+	for i, c := range cs {
+		if c == codes.ResourceExhausted {
+			if pushback := trailers[i].Get(pushbackTrailer); len(pushback) != 1 || pushback[0] != "1500" {
+				t.Errorf("The calls dropped should have the pushback trailer set to 1500 - found %v", pushback)
+			}
+		}
+	}
+	if interceptors.WaitingRoom.DroppedByReason()[waitingroom.DropTimeout] != 2 {
+		t.Errorf("The calls should have been dropped for the timeout - found %v", interceptors.WaitingRoom.DroppedByReason())
+	}
+}
+
+// the deadline of the client comes before the timeout, so the call waits for a worker only until the deadline
+func TestUnaryClientDeadline(t *testing.T) {
+	client, interceptors := newServer(t, Config{Config: middleware.Config{Workers: 1, Timeout: 5 * time.Second}}, 300*time.Millisecond)
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		checks(client, 1, 5*time.Second)
+	}()
+	// the second call comes when the only worker is busy
+	time.Sleep(50 * time.Millisecond)
+	start := time.Now()
+	cs, _ := checks(client, 1, 50*time.Millisecond)
+	waited := time.Since(start)
+	wg.Wait()
+
+	if cs[0] == codes.OK {
+		t.Errorf("The call should not have been served before its deadline")
+	}
+	if waited > 250*time.Millisecond {
+		t.Errorf("The call should have returned at its deadline - it took %v", waited)
+	}
+	if interceptors.WaitingRoom.DroppedByReason()[waitingroom.DropDeadline] != 1 {
+		t.Errorf("The call should have been dropped for the deadline - found %v", interceptors.WaitingRoom.DroppedByReason())
+	}
+}
+
+func TestStreamDropped(t *testing.T) {
+	config := Config{Config: middleware.Config{Workers: 1, Timeout: 20 * time.Millisecond}, DropCode: codes.Unavailable}
+	client, interceptors := newServer(t, config, 200*time.Millisecond)
+
+	cs := make([]codes.Code, 3)
+	var wg sync.WaitGroup
+	wg.Add(len(cs))
+	for i := range cs {
+		go func(i int) {
+			defer wg.Done()
+			stream, err := client.Watch(context.Background(), &grpc_health_v1.HealthCheckRequest{})
+			if err != nil {
+				cs[i] = status.Code(err)
+				return
+			}
+			_, err = stream.Recv()
+			cs[i] = status.Code(err)
+		}(i)
+	}
+	wg.Wait()
+
+	if count(cs, codes.OK) != 1 || count(cs, codes.Unavailable) != 2 {
+		t.Errorf("Expected 1 stream served and 2 dropped with Unavailable - found %v", cs)
+	}
+	if interceptors.WaitingRoom.Dropped() != 2 {
+		t.Errorf("The waiting room should have dropped 2 streams - found %v", interceptors.WaitingRoom.Dropped())
+	}
+}
+
+func TestClosed(t *testing.T) {
+	client, interceptors := newServer(t, Config{Config: middleware.Config{Workers: 1, Timeout: time.Second}}, 0)
+	interceptors.Close()
+
+	cs, _ := checks(client, 1, time.Second)
+	if cs[0] != codes.Unavailable {
+		t.Errorf("A call to a server shutting down should fail with Unavailable - found %v", cs[0])
+	}
+}
+
+func TestValidate(t *testing.T) {
+	if _, err := New(Config{Config: middleware.Config{Workers: 1, Timeout: time.Second}, DropCode: codes.Internal}); err == nil {
+		t.Errorf("A drop code other than ResourceExhausted and Unavailable should not be valid")
+	}
+	if _, err := New(Config{Config: middleware.Config{Workers: 1}}); err == nil {
+		t.Errorf("A timeout of 0 should not be valid")
+	}
+}
+
+func TestCanceledCodes(t *testing.T) {
+	i := Interceptors{dropCode: codes.ResourceExhausted}
+	canceled, cancel := context.WithCancel(context.Background())
+	cancel()
+	expired, cancel := context.WithTimeout(context.Background(), -time.Second)
+	defer cancel()
+	if code := status.Code(i.rejected(canceled, middleware.Canceled, "/m")); code != codes.Canceled {
+		t.Errorf("A call canceled should fail with Canceled - found %v", code)
+	}
+	if code := status.Code(i.rejected(expired, middleware.Canceled, "/m")); code != codes.DeadlineExceeded {
+		t.Errorf("A call expired should fail with DeadlineExceeded - found %v", code)
+	}
+}
@@ -0,0 +1,272 @@
+package histogram
+
+import (
+	"fmt"
+	"math"
+	"math/bits"
+	"sync"
+	"time"
+)
+
+// the values are stored in buckets whose width grows with the value, like in an HDR histogram: each power of 2 is split in
+// subBucketCount/2 buckets, so that the relative error of any value read from the histogram is lower than 2/subBucketCount
+const subBucketBits = 8
+const subBucketCount = 1 << subBucketBits
+const halfSubBucketCount = subBucketCount / 2
+
+// the number of buckets needed to store any positive int64
+const bucketCount = subBucketCount + (64-subBucketBits)*halfSubBucketCount
+
+// Histogram records durations with a relative precision better than 1% and returns their percentiles.
+// It is safe for concurrent use, so it can be read while the values are being recorded.
+type Histogram struct {
+	mu     sync.Mutex
+	counts []uint64
+	count  uint64
+	sum    time.Duration
+	min    time.Duration
+	max    time.Duration
+}
+
+// New returns an empty histogram
+func New() *Histogram {
+	h := Histogram{counts: make([]uint64, bucketCount)}
+	return &h
+}
+
+// Record adds a duration to the histogram - negative durations are recorded as 0
+func (h *Histogram) Record(d time.Duration) {
+	if d < 0 {
+		d = 0
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.counts[index(uint64(d))]++
+	if h.count == 0 || d < h.min {
+		h.min = d
+	}
+	if d > h.max {
+		h.max = d
+	}
+	h.count++
+	h.sum = h.sum + d
+}
+
+// Count returns the number of durations recorded
+func (h *Histogram) Count() int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return int(h.count)
+}
+
+// Mean returns the average of the durations recorded
+func (h *Histogram) Mean() time.Duration {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.count == 0 {
+		return 0
+	}
+	return h.sum / time.Duration(h.count)
+}
+
+// Max returns the highest duration recorded
+func (h *Histogram) Max() time.Duration {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.max
+}
+
+// Percentile returns the duration below which falls the percentage p (between 0 and 100) of the durations recorded
+func (h *Histogram) Percentile(p float64) time.Duration {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.percentile(p)
+}
+
+func (h *Histogram) percentile(p float64) time.Duration {
+	if h.count == 0 {
+		return 0
+	}
+	if p >= 100 {
+		return h.max
+	}
+	// the rank of the value we look for, counting from 1 - the small epsilon avoids that floating point errors, e.g. with
+	// p equal to 99.9, move the rank to the next value
+	rank := uint64(math.Ceil(p/100*float64(h.count) - 1e-9))
+	if rank == 0 {
+		rank = 1
+	}
+	var seen uint64
+	for i, c := range h.counts {
+		seen = seen + c
+		if seen >= rank {
+			// the highest value of the bucket, which can not be higher than the max recorded
+			v := time.Duration(highestValue(i))
+			if v > h.max {
+				v = h.max
+			}
+			if v < h.min {
+				v = h.min
+			}
+			return v
+		}
+	}
+	return h.max
+}
+
+// Snapshot returns a copy of the histogram, which is not affected by the durations recorded afterwards
+func (h *Histogram) Snapshot() *Histogram {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	s := Histogram{
+		counts: make([]uint64, bucketCount),
+		count:  h.count,
+		sum:    h.sum,
+		min:    h.min,
+		max:    h.max,
+	}
+	copy(s.counts, h.counts)
+	return &s
+}
+
+// Merge adds all the durations recorded in "other" to the histogram
+func (h *Histogram) Merge(other *Histogram) {
+	o := other.Snapshot()
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if o.count == 0 {
+		return
+	}
+	for i, c := range o.counts {
+		h.counts[i] = h.counts[i] + c
+	}
+	if h.count == 0 || o.min < h.min {
+		h.min = o.min
+	}
+	if o.max > h.max {
+		h.max = o.max
+	}
+	h.count = h.count + o.count
+	h.sum = h.sum + o.sum
+}
+
+// Since returns an histogram with the durations recorded after "older", which must be a snapshot of the same histogram.
+// The min and max of the histogram returned are known with the precision of the buckets.
+func (h *Histogram) Since(older *Histogram) *Histogram {
+	o := older.Snapshot()
+	s := h.Snapshot()
+	d := New()
+	for i := range s.counts {
+		d.counts[i] = s.counts[i] - o.counts[i]
+		if d.counts[i] == 0 {
+			continue
+		}
+		if d.count == 0 {
+			d.min = time.Duration(lowestValue(i))
+		}
+		d.max = time.Duration(highestValue(i))
+		d.count = d.count + d.counts[i]
+	}
+	d.sum = s.sum - o.sum
+	if d.max > s.max {
+		d.max = s.max
+	}
+	return d
+}
+
+// Sum returns the sum of the durations recorded
+func (h *Histogram) Sum() time.Duration {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.sum
+}
+
+// CumulativeCounts returns, for each of the bounds passed in increasing order, the number of durations recorded which are
+// lower than or equal to the bound, with the precision of the buckets of the histogram
+func (h *Histogram) CumulativeCounts(bounds []time.Duration) []int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	counts := make([]int, len(bounds))
+	var cumulative uint64
+	b := 0
+	for i, c := range h.counts {
+		for b < len(bounds) && lowestValue(i) > uint64(bounds[b]) {
+			counts[b] = int(cumulative)
+			b++
+		}
+		if b == len(bounds) {
+			break
+		}
+		cumulative = cumulative + c
+	}
+	for ; b < len(bounds); b++ {
+		counts[b] = int(cumulative)
+	}
+	return counts
+}
+
+// Summary holds the percentiles of a histogram usually reported
+type Summary struct {
+	Count int
+	Mean  time.Duration
+	P50   time.Duration
+	P90   time.Duration
+	P99   time.Duration
+	P999  time.Duration
+	Max   time.Duration
+}
+
+// Summary returns the usual percentiles of the durations recorded
+func (h *Histogram) Summary() Summary {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	s := Summary{
+		Count: int(h.count),
+		P50:   h.percentile(50),
+		P90:   h.percentile(90),
+		P99:   h.percentile(99),
+		P999:  h.percentile(99.9),
+		Max:   h.max,
+	}
+	if h.count > 0 {
+		s.Mean = h.sum / time.Duration(h.count)
+	}
+	return s
+}
+
+func (s Summary) String() string {
+	return fmt.Sprintf("p50: %v - p90: %v - p99: %v - p99.9: %v - max: %v",
+		s.P50.Round(time.Microsecond), s.P90.Round(time.Microsecond), s.P99.Round(time.Microsecond),
+		s.P999.Round(time.Microsecond), s.Max.Round(time.Microsecond))
+}
+
+// returns the index of the bucket which holds the value
+func index(v uint64) int {
+	if v < subBucketCount {
+		return int(v)
+	}
+	// v is in [2^(l-1), 2^l) and, shifted, falls in [halfSubBucketCount, subBucketCount)
+	shift := bits.Len64(v) - subBucketBits
+	sub := int(v >> uint(shift))
+	return subBucketCount + (shift-1)*halfSubBucketCount + sub - halfSubBucketCount
+}
+
+// returns the lowest value which falls in the bucket with the index passed
+func lowestValue(i int) uint64 {
+	if i < subBucketCount {
+		return uint64(i)
+	}
+	shift := (i-subBucketCount)/halfSubBucketCount + 1
+	sub := uint64((i-subBucketCount)%halfSubBucketCount + halfSubBucketCount)
+	return sub << uint(shift)
+}
+
+// returns the highest value which falls in the bucket with the index passed
+func highestValue(i int) uint64 {
+	if i < subBucketCount {
+		return uint64(i)
+	}
+	shift := (i-subBucketCount)/halfSubBucketCount + 1
+	sub := uint64((i-subBucketCount)%halfSubBucketCount + halfSubBucketCount)
+	return (sub+1)<<uint(shift) - 1
+}
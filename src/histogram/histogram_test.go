@@ -0,0 +1,93 @@
+package histogram
+
+import (
+	"math/rand"
+	"sort"
+	"testing"
+	"time"
+)
+
+// the percentiles read from the histogram must be within 1% of the exact ones
+func TestPercentilePrecision(t *testing.T) {
+	h := New()
+	rnd := rand.New(rand.NewSource(1))
+	values := make([]time.Duration, 10000)
+	for i := range values {
+		values[i] = time.Duration(rnd.ExpFloat64() * float64(100*time.Millisecond))
+		h.Record(values[i])
+	}
+	sort.Slice(values, func(i, j int) bool { return values[i] < values[j] })
+
+	for _, p := range []float64{50, 90, 99, 99.9} {
+		exact := values[int(p/100*float64(len(values)))-1]
+		got := h.Percentile(p)
+		if diff := float64(got-exact) / float64(exact); diff < -0.01 || diff > 0.01 {
+			t.Errorf("The percentile %v should be close to %v - found %v", p, exact, got)
+		}
+	}
+	if h.Percentile(100) != values[len(values)-1] || h.Max() != values[len(values)-1] {
+		t.Errorf("The max should be %v - found %v", values[len(values)-1], h.Max())
+	}
+}
+
+func TestSmallValuesAreExact(t *testing.T) {
+	h := New()
+	for i := 1; i <= 100; i++ {
+		h.Record(time.Duration(i))
+	}
+	if p := h.Percentile(50); p != 50 {
+		t.Errorf("The median should be 50 - found %v", p)
+	}
+	if m := h.Mean(); m != 50 {
+		t.Errorf("The mean should be 50 - found %v", m)
+	}
+}
+
+// a snapshot is not affected by the values recorded afterwards
+func TestSnapshotAndMerge(t *testing.T) {
+	h := New()
+	h.Record(time.Second)
+	s := h.Snapshot()
+	h.Record(2 * time.Second)
+	if s.Count() != 1 || h.Count() != 2 {
+		t.Errorf("The snapshot should hold 1 value and the histogram 2 - %v and %v", s.Count(), h.Count())
+	}
+	s.Merge(h)
+	if s.Count() != 3 || s.Max() != 2*time.Second {
+		t.Errorf("The merged histogram should hold 3 values with max 2s - %v values with max %v", s.Count(), s.Max())
+	}
+}
+
+func TestSince(t *testing.T) {
+	h := New()
+	h.Record(time.Second)
+	older := h.Snapshot()
+	h.Record(10 * time.Millisecond)
+	h.Record(20 * time.Millisecond)
+
+	d := h.Since(older)
+	if d.Count() != 2 {
+		t.Fatalf("2 values have been recorded after the snapshot - found %v", d.Count())
+	}
+	if max := d.Max(); max < 19*time.Millisecond || max > 21*time.Millisecond {
+		t.Errorf("The max of the values recorded after the snapshot should be about 20ms - found %v", max)
+	}
+}
+
+func TestCumulativeCounts(t *testing.T) {
+	h := New()
+	for i := 1; i <= 1000; i++ {
+		h.Record(time.Duration(i) * time.Millisecond)
+	}
+	counts := h.CumulativeCounts([]time.Duration{0, 100 * time.Millisecond, 500 * time.Millisecond, time.Hour})
+	expected := []int{0, 100, 500, 1000}
+	for i := range expected {
+		// the counts are known with the precision of the buckets
+		if diff := counts[i] - expected[i]; diff < -5 || diff > 5 {
+			t.Errorf("The count of the bound %v should be close to %v - found %v", i, expected[i], counts[i])
+		}
+	}
+	if h.Sum() != 500500*time.Millisecond {
+		t.Errorf("The sum should be %v - found %v", 500500*time.Millisecond, h.Sum())
+	}
+}
@@ -0,0 +1,82 @@
+package hooks
+
+import (
+	"github.com/EnricoPicci/drop-pattern-with-timeout/src/events"
+	"github.com/EnricoPicci/drop-pattern-with-timeout/src/waitingroom"
+	"github.com/EnricoPicci/drop-pattern-with-timeout/src/workerpool"
+)
+
+// Hooks holds the callbacks called when something happens in the waiting room or in the worker pool - the callbacks not set
+// are ignored. Hooks is an events sink, so the callbacks are called by the goroutines of the waiting room and of the workers:
+// they must be fast and safe for concurrent use, otherwise they have to be attached asynchronously.
+type Hooks struct {
+	// a request has been let in the waiting room
+	OnAdmit func(e events.Event)
+	// a request has been sent to the worker pool
+	OnDispatch func(e events.Event)
+	// a request has been dropped, by the waiting room or by a worker in batch mode
+	OnDrop func(e events.Event)
+	// a worker has started processing a request
+	OnStart func(e events.Event)
+	// a worker has completed the processing of a request
+	OnComplete func(e events.Event)
+	// all the workers of the pool have been halted
+	OnHalt func(e events.Event)
+	// the workers of the pool are back to normal operations
+	OnRestore func(e events.Event)
+	// a worker is ready to take in the next request
+	OnWorkerIdle func(e events.Event)
+}
+
+// Emit calls the callback corresponding to the kind of the event
+func (h *Hooks) Emit(e events.Event) {
+	var hook func(e events.Event)
+	switch e.Kind {
+	case events.Admitted:
+		hook = h.OnAdmit
+	case events.Dispatched:
+		hook = h.OnDispatch
+	case events.Dropped, events.BatchDropped:
+		hook = h.OnDrop
+	case events.Started:
+		hook = h.OnStart
+	case events.Completed:
+		hook = h.OnComplete
+	case events.Halted:
+		hook = h.OnHalt
+	case events.Restored:
+		hook = h.OnRestore
+	case events.WorkerIdle, events.WorkerStarted:
+		// a worker just started is idle
+		hook = h.OnWorkerIdle
+	}
+	if hook != nil {
+		hook(e)
+	}
+}
+
+// Attach adds a sink, e.g. some hooks, to the events sinks of the pool and of the waiting room, if not nil, so that it receives the
+// events synchronously, together with the sinks already set
+func Attach(sink events.Sink, pool *workerpool.WorkerPool, waitingRoom *waitingroom.WaitingRoom) {
+	pool.Events = add(pool.Events, sink)
+	if waitingRoom != nil {
+		waitingRoom.Events = add(waitingRoom.Events, sink)
+	}
+}
+
+// AttachAsync adds the hooks to the events sinks of the pool and of the waiting room, if not nil, so that the callbacks are
+// called in a separate goroutine, through a buffer of the size passed. If the buffer is full the events are lost rather than
+// blocking the requests. The sink returned has to be closed, after the pool has been stopped, to deliver all the events buffered.
+func AttachAsync(h *Hooks, pool *workerpool.WorkerPool, waitingRoom *waitingroom.WaitingRoom, buffer int) *events.Async {
+	async := events.NewAsync(h, buffer)
+	Attach(async, pool, waitingRoom)
+	return async
+}
+
+// returns a sink which sends the events to both sinks
+func add(current events.Sink, sink events.Sink) events.Sink {
+	if current == nil || current == events.Discard {
+		return sink
+	}
+	return events.Multi(current, sink)
+}
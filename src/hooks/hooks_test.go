@@ -0,0 +1,98 @@
+package hooks
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/EnricoPicci/drop-pattern-with-timeout/src/events"
+	"github.com/EnricoPicci/drop-pattern-with-timeout/src/internal/scenariotest"
+	"github.com/EnricoPicci/drop-pattern-with-timeout/src/simulation"
+)
+
+func newSimulation(t *testing.T) *simulation.Simulation {
+	sc, err := scenariotest.Example()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sim, err := simulation.New(sc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return sim
+}
+
+func TestAsyncHooks(t *testing.T) {
+	sim := newSimulation(t)
+	var mu sync.Mutex
+	counts := make(map[string]int)
+	count := func(name string) func(e events.Event) {
+		return func(e events.Event) {
+			mu.Lock()
+			counts[name]++
+			mu.Unlock()
+		}
+	}
+	h := Hooks{
+		OnAdmit:      count("admit"),
+		OnDispatch:   count("dispatch"),
+		OnDrop:       count("drop"),
+		OnStart:      count("start"),
+		OnComplete:   count("complete"),
+		OnHalt:       count("halt"),
+		OnRestore:    count("restore"),
+		OnWorkerIdle: count("idle"),
+	}
+	// the sink already set keeps receiving the events
+	memory := events.NewMemory()
+	sim.SetEvents(memory)
+	async := AttachAsync(&h, sim.Pool, sim.WaitingRoom, 1000)
+	result := sim.Run()
+	async.Close()
+
+	// every request is admitted and every worker gets idle once after each request and once when it starts
+	sc := sim.Scenario
+	processed, dropped := len(result.Processed), len(result.Dropped)
+	expected := map[string]int{
+		"admit": sc.NumReq, "dispatch": processed, "drop": dropped, "start": processed, "complete": processed,
+		"halt": 1, "restore": 1, "idle": processed + sc.Pool.Size,
+	}
+	for name, n := range expected {
+		if counts[name] != n {
+			t.Errorf("The hook %v should have been called %v times - found %v", name, n, counts[name])
+		}
+	}
+	if dropped == 0 {
+		t.Errorf("Some requests should have been dropped")
+	}
+	if len(memory.Events(events.Admitted)) != sc.NumReq {
+		t.Errorf("The sink already set should receive the events too")
+	}
+	if async.Lost() != 0 {
+		t.Errorf("No event should be lost - found %v", async.Lost())
+	}
+}
+
+// a hook which blocks must not block the requests when the hooks are attached asynchronously
+func TestAsyncHooksDoNotBlock(t *testing.T) {
+	sim := newSimulation(t)
+	unblock := make(chan struct{})
+	h := Hooks{OnComplete: func(e events.Event) { <-unblock }}
+	async := AttachAsync(&h, sim.Pool, sim.WaitingRoom, 1)
+
+	done := make(chan struct{})
+	go func() {
+		sim.Run()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("The simulation should not be blocked by the hook")
+	}
+	close(unblock)
+	async.Close()
+	if async.Lost() == 0 {
+		t.Errorf("Some events should have been lost since the buffer was full")
+	}
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+
+	"github.com/EnricoPicci/drop-pattern-with-timeout/src/events"
+	"github.com/EnricoPicci/drop-pattern-with-timeout/src/metrics"
+	"github.com/EnricoPicci/drop-pattern-with-timeout/src/middleware"
+)
+
+// In this example a real http server fronts its handlers with the drop pattern with timeout
+
+// route is a route of the demo server, served by a handler which takes procTime to serve each request
+type route struct {
+	Path     string        `yaml:"path"`
+	ProcTime time.Duration `yaml:"procTime"`
+	// the concurrency and the timeout of the route
+	middleware.Config `yaml:",inline"`
+}
+
+type routesFile struct {
+	Routes []route `yaml:"routes"`
+}
+
+// the routes served if no routes file is passed: a fast route with many workers and a short timeout and a slow one with few
+// workers and a longer timeout
+var defaultRoutes = []route{
+	{Path: "/fast", ProcTime: 20 * time.Millisecond, Config: middleware.Config{Workers: 10, Timeout: 100 * time.Millisecond}},
+	{Path: "/slow", ProcTime: time.Second, Config: middleware.Config{Workers: 2, Timeout: 500 * time.Millisecond, RetryAfter: 2 * time.Second}},
+}
+
+func main() {
+	addr := flag.String("addr", ":8080", "address the server listens on")
+	routesPath := flag.String("routes", "", "path of a yaml file with the routes to serve, with their workers, timeout, retryAfter and procTime - if not set /fast and /slow are served")
+	eventSink := flag.String("events", "none", "how the events of the requests and of the workers are written: text, json or none")
+	eventsFile := flag.String("eventsFile", "", "path of the file where the events are written - if not set they are written on the console")
+	flag.Parse()
+
+	routes := defaultRoutes
+	if *routesPath != "" {
+		var err error
+		routes, err = loadRoutes(*routesPath)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+	}
+	sink, closeEvents, err := events.Open(*eventSink, *eventsFile)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	defer func() {
+		if err := closeEvents(); err != nil {
+			fmt.Println("Error writing the events:", err)
+		}
+	}()
+	mux, err := newMux(routes, sink)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	defer mux.Close()
+
+	listener, err := net.Listen("tcp", *addr)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	server := &http.Server{Handler: mux}
+	go server.Serve(listener)
+	for _, r := range routes {
+		fmt.Printf("Serving http://%v%v with %v workers and a timeout of %v - metrics on http://%v%v\n", listener.Addr(), r.Path,
+			r.Workers, r.Timeout, listener.Addr(), metricsPath(r.Path))
+	}
+
+	// the server is shut down gracefully on ctrl-c, serving the requests already let in
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt)
+	<-interrupt
+	fmt.Println("Shutting down")
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := server.Shutdown(ctx); err != nil {
+		fmt.Println(err)
+	}
+}
+
+// returns a multiplexer which serves the routes, each fronted by the drop pattern, and their metrics
+func newMux(routes []route, sink events.Sink) (*middleware.Mux, error) {
+	mux := middleware.NewMux()
+	for _, r := range routes {
+		r.Events = sink
+		if err := mux.Handle(r.Path, work(r.ProcTime), r.Config); err != nil {
+			mux.Close()
+			return nil, err
+		}
+		mw := mux.Route(r.Path)
+		mux.HandleUnprotected(metricsPath(r.Path), metrics.New(mw.Pool, mw.WaitingRoom))
+	}
+	return mux, nil
+}
+
+// returns the path where the metrics of a route are exposed, e.g. /metrics/slow for /slow
+func metricsPath(path string) string {
+	name := strings.Trim(path, "/")
+	if name == "" {
+		name = "root"
+	}
+	return "/metrics/" + strings.ReplaceAll(name, "/", "_")
+}
+
+// returns a handler which simulates the work done to serve a request, unless the client goes away
+func work(procTime time.Duration) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-time.After(procTime):
+			fmt.Fprintf(w, "Served %v in %v\n", r.URL.Path, procTime)
+		case <-r.Context().Done():
+		}
+	})
+}
+
+// reads the routes from a yaml file
+func loadRoutes(path string) ([]route, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var f routesFile
+	if err := yaml.Unmarshal(data, &f); err != nil {
+		return nil, fmt.Errorf("%v: %v", path, err)
+	}
+	if len(f.Routes) == 0 {
+		return nil, fmt.Errorf("%v: no routes defined", path)
+	}
+	for _, r := range f.Routes {
+		if r.Path == "" {
+			return nil, fmt.Errorf("%v: a route has no path", path)
+		}
+	}
+	return f.Routes, nil
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/EnricoPicci/drop-pattern-with-timeout/src/events"
+)
+
+func TestLoadRoutes(t *testing.T) {
+	routes, err := loadRoutes("routes.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(routes) != 2 {
+		t.Fatalf("Expected 2 routes - found %v", len(routes))
+	}
+	slow := routes[1]
+	if slow.Path != "/slow" || slow.Workers != 2 || slow.Timeout != 500*time.Millisecond || slow.RetryAfter != 2*time.Second ||
+		slow.ProcTime != time.Second {
+		t.Errorf("The slow route has not been read correctly: %+v", slow)
+	}
+}
+
+// a load test against the demo server on localhost: a burst of requests on a route with few workers is partly served and
+// partly answered with 503, while another route keeps serving all its requests
+func TestLoadOnLocalhost(t *testing.T) {
+	routes := []route{
+		{Path: "/fast", ProcTime: time.Millisecond, Config: defaultRoutes[0].Config},
+		{Path: "/slow", ProcTime: 100 * time.Millisecond, Config: defaultRoutes[1].Config},
+	}
+	routes[1].Timeout = 50 * time.Millisecond
+	mux, err := newMux(routes, events.Discard)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mux.Close()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &http.Server{Handler: mux}
+	go server.Serve(listener)
+	defer server.Close()
+	url := "http://" + listener.Addr().String()
+
+	// a request every 5ms for 200ms on each route
+	numReq := 40
+	var mu sync.Mutex
+	status := map[string]map[int]int{"/fast": {}, "/slow": {}}
+	var wg sync.WaitGroup
+	for i := 0; i < numReq; i++ {
+		for path := range status {
+			wg.Add(1)
+			go func(path string) {
+				defer wg.Done()
+				resp, err := http.Get(url + path)
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				resp.Body.Close()
+				if resp.StatusCode == http.StatusServiceUnavailable && resp.Header.Get("Retry-After") != "2" {
+					t.Errorf("The Retry-After header of the slow route should be 2 - found %q", resp.Header.Get("Retry-After"))
+				}
+				mu.Lock()
+				status[path][resp.StatusCode]++
+				mu.Unlock()
+			}(path)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	wg.Wait()
+	t.Logf("Status codes: %v", status)
+
+	if status["/fast"][http.StatusOK] != numReq {
+		t.Errorf("All the requests of the fast route should have been served - found %v", status["/fast"])
+	}
+	// the slow route can serve at most 2 requests every 100ms, so about 8 requests over the 200ms of the test
+	served := status["/slow"][http.StatusOK]
+	if served < 2 || served > 12 || served+status["/slow"][http.StatusServiceUnavailable] != numReq {
+		t.Errorf("The slow route should have served a few requests and dropped the others - found %v", status["/slow"])
+	}
+
+	resp, err := http.Get(url + "/metrics/slow")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	if !strings.Contains(string(body), "droppattern_waiting_room_admitted_total 40\n") {
+		t.Errorf("The metrics of the slow route should count all its requests:\n%s", body)
+	}
+}
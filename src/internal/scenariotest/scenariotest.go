@@ -0,0 +1,27 @@
+// Package scenariotest provides the scenarios used by the tests of the components which observe a simulation
+package scenariotest
+
+import (
+	"github.com/EnricoPicci/drop-pattern-with-timeout/src/arrival"
+	"github.com/EnricoPicci/drop-pattern-with-timeout/src/faults"
+	"github.com/EnricoPicci/drop-pattern-with-timeout/src/scenario"
+	"github.com/EnricoPicci/drop-pattern-with-timeout/src/servicetime"
+)
+
+// Example returns a short scenario, validated, where the pool is halted long enough for some requests to be dropped - it runs
+// in a few tens of milliseconds
+func Example() (*scenario.Scenario, error) {
+	s := scenario.Scenario{
+		TimeUnit:      "100us",
+		NumReq:        40,
+		Pool:          scenario.Pool{Size: 4},
+		WaitingRoom:   scenario.WaitingRoom{Policy: scenario.Drop, Timeout: 50},
+		Arrival:       arrival.Config{Name: arrival.Fixed, Interval: 10},
+		ServiceTime:   servicetime.Config{Name: servicetime.Constant, Mean: 40},
+		FaultTimeline: scenario.FaultTimeline{Faults: []faults.Fault{faults.HaltWindow(100, 200)}},
+	}
+	if err := s.Validate(); err != nil {
+		return nil, err
+	}
+	return &s, nil
+}
@@ -0,0 +1,160 @@
+package limiter
+
+import (
+	"fmt"
+	"math"
+	"time"
+)
+
+// the names of the algorithms
+const (
+	AIMDName     = "aimd"
+	VegasName    = "vegas"
+	GradientName = "gradient"
+)
+
+// Algorithm computes the new concurrency limit from the outcome of each request. The limiter calls it while holding its lock,
+// so it does not need to be safe for concurrent use.
+type Algorithm interface {
+	// Update returns the new limit given the current one, the latency of a request, the number of requests in flight when the
+	// request has been sent and whether the request has been dropped
+	Update(limit float64, latency time.Duration, inFlight int, dropped bool) float64
+}
+
+// NewAlgorithm returns the algorithm with the name passed, with its default parameters
+func NewAlgorithm(name string) (Algorithm, error) {
+	switch name {
+	case AIMDName:
+		return NewAIMD(), nil
+	case VegasName:
+		return NewVegas(), nil
+	case GradientName:
+		return NewGradient(), nil
+	default:
+		return nil, fmt.Errorf("unknown limiter algorithm %q - valid values are aimd, vegas and gradient", name)
+	}
+}
+
+// the number of requests after which the latency without load is measured again, since the latency of the server can
+// change over time
+const probeEvery = 500
+
+// AIMD increases the limit by a constant while the requests succeed and multiplies it by a factor lower than 1 when a request
+// is dropped or is slower than the timeout, as the congestion control of TCP
+type AIMD struct {
+	// the increase of the limit for each request succeeded
+	Increase float64
+	// the factor applied to the limit when a request is dropped
+	Backoff float64
+	// the latency above which a request is considered dropped - 0 means that only the requests actually dropped count
+	Timeout time.Duration
+}
+
+// NewAIMD returns an AIMD algorithm which increases the limit by 1 and halves it, as TCP does
+func NewAIMD() *AIMD {
+	a := AIMD{Increase: 1, Backoff: 0.5}
+	return &a
+}
+
+func (a *AIMD) Update(limit float64, latency time.Duration, inFlight int, dropped bool) float64 {
+	if dropped || (a.Timeout > 0 && latency > a.Timeout) {
+		return limit * a.Backoff
+	}
+	// the limit is increased only if it is actually used, otherwise it would grow without any evidence that it is safe
+	if appLimited(limit, inFlight) {
+		return limit
+	}
+	return limit + a.Increase
+}
+
+// Vegas estimates the number of requests queued in the server from how much the latency is above the latency without load, as
+// TCP Vegas does: the limit is increased while the queue is shorter than Alpha and decreased when it is longer than Beta
+type Vegas struct {
+	Alpha float64
+	Beta  float64
+
+	// the lowest latency observed, i.e. the latency of a request which has not been queued
+	minLatency time.Duration
+	samples    int
+}
+
+// NewVegas returns a Vegas algorithm which keeps from 3 to 6 requests queued in the server
+func NewVegas() *Vegas {
+	v := Vegas{Alpha: 3, Beta: 6}
+	return &v
+}
+
+func (v *Vegas) Update(limit float64, latency time.Duration, inFlight int, dropped bool) float64 {
+	latency = measurable(latency)
+	v.minLatency, v.samples = updateMinLatency(v.minLatency, v.samples, latency)
+	if dropped {
+		return limit / 2
+	}
+	queue := limit * (1 - float64(v.minLatency)/float64(latency))
+	switch {
+	case queue > v.Beta:
+		return limit - 1
+	case queue < v.Alpha && !appLimited(limit, inFlight):
+		return limit + 1
+	}
+	return limit
+}
+
+// Gradient scales the limit by the ratio between the latency without load and the latency of each request, the gradient,
+// and adds some headroom to let the requests queue a little - the new limit is smoothed with the current one
+type Gradient struct {
+	// the weight, between 0 and 1, of the new limit when it is smoothed with the current one
+	Smoothing float64
+	// how much the latency can grow above the latency without load before the limit is reduced
+	Tolerance float64
+
+	minLatency time.Duration
+	samples    int
+}
+
+// NewGradient returns a gradient algorithm which tolerates latencies up to 1.5 times the latency without load
+func NewGradient() *Gradient {
+	g := Gradient{Smoothing: 0.2, Tolerance: 1.5}
+	return &g
+}
+
+func (g *Gradient) Update(limit float64, latency time.Duration, inFlight int, dropped bool) float64 {
+	latency = measurable(latency)
+	g.minLatency, g.samples = updateMinLatency(g.minLatency, g.samples, latency)
+	gradient := 0.5
+	if !dropped {
+		gradient = math.Max(0.5, math.Min(1, g.Tolerance*float64(g.minLatency)/float64(latency)))
+	}
+	// the headroom grows with the square root of the limit
+	newLimit := limit*gradient + math.Sqrt(limit)
+	if newLimit > limit && appLimited(limit, inFlight) {
+		return limit
+	}
+	return limit*(1-g.Smoothing) + newLimit*g.Smoothing
+}
+
+// returns true if less than half of the limit is used, in which case the latency says nothing about a higher limit
+func appLimited(limit float64, inFlight int) bool {
+	return float64(inFlight)*2 < limit
+}
+
+// returns the latency, or 1ns if it is not greater than 0, e.g. measured by a coarse clock, so that the ratio between the
+// latency without load and the latency is never 0/0
+func measurable(latency time.Duration) time.Duration {
+	if latency <= 0 {
+		return time.Nanosecond
+	}
+	return latency
+}
+
+// returns the lowest latency observed and the number of samples since it has been reset
+func updateMinLatency(minLatency time.Duration, samples int, latency time.Duration) (time.Duration, int) {
+	samples++
+	if samples > probeEvery {
+		return latency, 1
+	}
+	if minLatency == 0 || latency < minLatency {
+		minLatency = latency
+	}
+	return minLatency, samples
+}
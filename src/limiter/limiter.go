@@ -0,0 +1,215 @@
+package limiter
+
+import (
+	"errors"
+	"math"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/EnricoPicci/drop-pattern-with-timeout/src/report"
+	"github.com/EnricoPicci/drop-pattern-with-timeout/src/request"
+)
+
+// ErrLimitExceeded is the error returned by the transport when a request is dropped by the limiter
+var ErrLimitExceeded = errors.New("concurrency limit exceeded")
+
+// Sample is the concurrency limit at a certain time
+type Sample struct {
+	// the time since the limiter has been created
+	Time     time.Duration
+	Limit    float64
+	InFlight int
+}
+
+// Limiter limits the number of requests a client sends concurrently to a server, dropping the requests above the limit before
+// they reach the server. The limit is learnt from the latency and the drops observed, with the algorithm passed, so that the
+// requests are queued in the client rather than in an overloaded server.
+type Limiter struct {
+	algorithm Algorithm
+	start     time.Time
+
+	// the bounds of the limit - they have to be set before the limiter is used
+	MinLimit int
+	MaxLimit int
+
+	mu       sync.Mutex
+	limit    float64
+	inFlight int
+	// the requests dropped by the limiter and the ones dropped by the server
+	rejected int
+	dropped  int
+	// the limit each time it has changed
+	history []Sample
+}
+
+// New returns a limiter which starts with the limit passed and updates it with the algorithm
+func New(algorithm Algorithm, initialLimit int) *Limiter {
+	l := Limiter{
+		algorithm: algorithm,
+		start:     time.Now(),
+		MinLimit:  1,
+		MaxLimit:  1000,
+		limit:     float64(initialLimit),
+		history:   []Sample{{Limit: float64(initialLimit)}},
+	}
+	return &l
+}
+
+// Token is the permission to send a request, to be released when the request is completed
+type Token struct {
+	limiter  *Limiter
+	start    time.Time
+	inFlight int
+	released bool
+}
+
+// Acquire returns a token if the requests in flight are below the limit, otherwise false, in which case the request has to be
+// dropped
+func (l *Limiter) Acquire() (*Token, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.inFlight >= l.currentLimit() {
+		l.rejected++
+		return nil, false
+	}
+	l.inFlight++
+	t := Token{limiter: l, start: time.Now(), inFlight: l.inFlight}
+	return &t, true
+}
+
+// Release releases the token when the request is completed, updating the limit with its latency and with whether the
+// request has been dropped by the server - a token can be released only once
+func (t *Token) Release(dropped bool) {
+	latency := time.Since(t.start)
+	l := t.limiter
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if t.released {
+		return
+	}
+	t.released = true
+	l.inFlight--
+	if dropped {
+		l.dropped++
+	}
+	limit := l.algorithm.Update(l.limit, latency, t.inFlight, dropped)
+	// a limit not finite, e.g. the result of a division by 0, would stick and reject all the requests, so it is ignored
+	if math.IsNaN(limit) || math.IsInf(limit, 0) {
+		return
+	}
+	limit = math.Max(float64(l.MinLimit), math.Min(float64(l.MaxLimit), limit))
+	if limit != l.limit {
+		l.limit = limit
+		l.history = append(l.history, Sample{Time: time.Since(l.start), Limit: limit, InFlight: l.inFlight})
+	}
+}
+
+// Limit returns the current limit
+func (l *Limiter) Limit() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.currentLimit()
+}
+
+func (l *Limiter) currentLimit() int {
+	return int(math.Max(1, math.Floor(l.limit)))
+}
+
+// InFlight returns the number of requests sent and not yet completed
+func (l *Limiter) InFlight() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.inFlight
+}
+
+// Rejected returns the number of requests dropped by the limiter
+func (l *Limiter) Rejected() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.rejected
+}
+
+// Dropped returns the number of requests sent and dropped by the server
+func (l *Limiter) Dropped() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.dropped
+}
+
+// History returns the limit each time it has changed, starting with the initial limit
+func (l *Limiter) History() []Sample {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	history := make([]Sample, len(l.history))
+	copy(history, l.history)
+	return history
+}
+
+// Chart returns a chart of the limit over time, in seconds, to be added to a report
+func (l *Limiter) Chart(title string) report.Chart {
+	history := l.History()
+	points := make([][2]float64, 0, len(history)+1)
+	for i, s := range history {
+		// the limit is constant between two changes
+		if i > 0 {
+			points = append(points, [2]float64{s.Time.Seconds(), history[i-1].Limit})
+		}
+		points = append(points, [2]float64{s.Time.Seconds(), s.Limit})
+	}
+	points = append(points, [2]float64{time.Since(l.start).Seconds(), history[len(history)-1].Limit})
+	return report.Chart{
+		Title:  title,
+		XLabel: "time (s)",
+		YLabel: "concurrency limit",
+		Series: []report.Series{{Name: "limit", Style: report.Line, Points: points}},
+	}
+}
+
+// Submit returns a function which submits the requests, e.g. to a waiting room or to the input channel of a worker pool,
+// through the limiter. A request above the limit is not submitted and is notified as dropped. The latency of a request is the
+// time until it is notified as processed or dropped, after which the notification is forwarded to its own Done channel, if any.
+func (l *Limiter) Submit(submit func(req request.Request)) func(req request.Request) {
+	return func(req request.Request) {
+		token, ok := l.Acquire()
+		if !ok {
+			req.Dropped = true
+			req.DroppedAt = time.Now()
+			req.Notify()
+			return
+		}
+		done := req.Done
+		req.Done = make(chan request.Request, 1)
+		go func(processed chan request.Request) {
+			req := <-processed
+			token.Release(req.Dropped || req.Failed)
+			req.Done = done
+			req.Notify()
+		}(req.Done)
+		submit(req)
+	}
+}
+
+// Transport is an http.RoundTripper which sends the requests through a limiter: a request above the limit fails with
+// ErrLimitExceeded without being sent, and a response 503 or 429 counts as a drop. The latency of a request is the time until
+// the headers of the response have been received.
+type Transport struct {
+	Limiter *Limiter
+	// the transport which actually sends the requests - if nil http.DefaultTransport is used
+	Base http.RoundTripper
+}
+
+func (t *Transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	token, ok := t.Limiter.Acquire()
+	if !ok {
+		return nil, ErrLimitExceeded
+	}
+	base := t.Base
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	resp, err := base.RoundTrip(req)
+	dropped := err != nil || resp.StatusCode == http.StatusServiceUnavailable || resp.StatusCode == http.StatusTooManyRequests
+	token.Release(dropped)
+	return resp, err
+}
@@ -0,0 +1,206 @@
+package limiter
+
+import (
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/EnricoPicci/drop-pattern-with-timeout/src/arrival"
+	"github.com/EnricoPicci/drop-pattern-with-timeout/src/middleware"
+	"github.com/EnricoPicci/drop-pattern-with-timeout/src/request"
+	"github.com/EnricoPicci/drop-pattern-with-timeout/src/waitingroom"
+	"github.com/EnricoPicci/drop-pattern-with-timeout/src/workerpool"
+)
+
+func TestAIMD(t *testing.T) {
+	a := NewAIMD()
+	if limit := a.Update(10, time.Millisecond, 8, false); limit != 11 {
+		t.Errorf("The limit should be increased by 1 - found %v", limit)
+	}
+	if limit := a.Update(10, time.Millisecond, 2, false); limit != 10 {
+		t.Errorf("The limit should not be increased if it is not used - found %v", limit)
+	}
+	if limit := a.Update(10, time.Millisecond, 8, true); limit != 5 {
+		t.Errorf("The limit should be halved after a drop - found %v", limit)
+	}
+	a.Timeout = 10 * time.Millisecond
+	if limit := a.Update(10, 20*time.Millisecond, 8, false); limit != 5 {
+		t.Errorf("The limit should be halved after a request slower than the timeout - found %v", limit)
+	}
+}
+
+func TestVegasAndGradient(t *testing.T) {
+	for _, name := range []string{VegasName, GradientName} {
+		a, err := NewAlgorithm(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		limit := 20.0
+		// the first sample sets the latency without load
+		limit = a.Update(limit, 10*time.Millisecond, 20, false)
+		grown := a.Update(limit, 10*time.Millisecond, 20, false)
+		if grown <= limit {
+			t.Errorf("%v: the limit should grow while the latency is the one without load - found %v from %v", name, grown, limit)
+		}
+		shrunk := a.Update(grown, 40*time.Millisecond, 20, false)
+		if shrunk >= grown {
+			t.Errorf("%v: the limit should shrink when the latency grows - found %v from %v", name, shrunk, grown)
+		}
+	}
+	if _, err := NewAlgorithm("unknown"); err == nil {
+		t.Errorf("An unknown algorithm should return an error")
+	}
+}
+
+// a latency of 0 with a latency without load of 0 does not make the limit NaN
+func TestZeroLatency(t *testing.T) {
+	for _, name := range []string{VegasName, GradientName} {
+		a, err := NewAlgorithm(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		limit := 20.0
+		for i := 0; i < 3; i++ {
+			limit = a.Update(limit, 0, 20, false)
+		}
+		if math.IsNaN(limit) || math.IsInf(limit, 0) {
+			t.Errorf("%v: the limit should be finite with latencies of 0 - found %v", name, limit)
+		}
+	}
+}
+
+// an algorithm which returns a limit not finite
+type brokenAlgorithm struct{}
+
+func (brokenAlgorithm) Update(limit float64, latency time.Duration, inFlight int, dropped bool) float64 {
+	return math.NaN()
+}
+
+// a limit not finite returned by the algorithm is ignored, so that the requests are still accepted
+func TestNotFiniteLimitIgnored(t *testing.T) {
+	l := New(brokenAlgorithm{}, 5)
+	token, ok := l.Acquire()
+	if !ok {
+		t.Fatalf("The first request should be accepted")
+	}
+	token.Release(false)
+	if l.Limit() != 5 {
+		t.Errorf("The limit should stay 5 - found %v", l.Limit())
+	}
+	if _, ok := l.Acquire(); !ok {
+		t.Errorf("The requests should still be accepted")
+	}
+}
+
+func TestLimiterBounds(t *testing.T) {
+	l := New(NewAIMD(), 2)
+	t1, ok1 := l.Acquire()
+	_, ok2 := l.Acquire()
+	if _, ok := l.Acquire(); !ok1 || !ok2 || ok {
+		t.Fatalf("Only 2 requests should be let through")
+	}
+	if l.Rejected() != 1 || l.InFlight() != 2 {
+		t.Errorf("Expected 1 request rejected and 2 in flight - found %v and %v", l.Rejected(), l.InFlight())
+	}
+	t1.Release(true)
+	t1.Release(true)
+	if l.Limit() != 1 || l.InFlight() != 1 || l.Dropped() != 1 {
+		t.Errorf("A token released twice should count once - found limit %v, in flight %v, dropped %v", l.Limit(), l.InFlight(), l.Dropped())
+	}
+	if h := l.History(); len(h) != 2 || h[0].Limit != 2 || h[1].Limit != 1 {
+		t.Errorf("Unexpected history %v", h)
+	}
+	if c := l.Chart("limit"); len(c.Series) != 1 || len(c.Series[0].Points) != 4 {
+		t.Errorf("Unexpected chart %v", c)
+	}
+}
+
+// the limiter sends the requests to an in-process waiting room in front of a pool of 4 workers: it learns to keep about 4
+// requests in flight, so that the waiting room drops only a few of them
+func TestInProcessPool(t *testing.T) {
+	timeUnit := time.Millisecond
+	inPoolCh := make(chan request.Request)
+	pool := workerpool.NewWorkerPool(inPoolCh, 4, 0, 10, 0, 0, 0, timeUnit)
+	waitingRoom := waitingroom.New(make(chan request.Request), inPoolCh, 2, timeUnit)
+	pool.Start()
+	waitingRoom.Open()
+
+	l := New(NewAIMD(), 20)
+	var wg sync.WaitGroup
+	submit := l.Submit(waitingRoom.LetIn)
+	numReq := 300
+	arrival.FixedInterval(1).Run(numReq, timeUnit, request.New, func(req request.Request) {
+		wg.Add(1)
+		req.Done = make(chan request.Request, 1)
+		go func() {
+			defer wg.Done()
+			<-req.Done
+		}()
+		submit(req)
+	})
+	wg.Wait()
+	waitingRoom.Close()
+	pool.Stop()
+
+	t.Logf("Limit %v - rejected %v - dropped by the waiting room %v - processed %v", l.Limit(), l.Rejected(), waitingRoom.Dropped(),
+		pool.Completed())
+	if l.Rejected()+waitingRoom.Dropped()+pool.Completed() != numReq {
+		t.Errorf("All the requests should have been rejected, dropped or processed")
+	}
+	if l.Rejected() == 0 || waitingRoom.Dropped() > numReq/4 {
+		t.Errorf("The limiter should have rejected the requests above the limit so that the waiting room drops only a few of them")
+	}
+	if l.Limit() > 10 {
+		t.Errorf("The limit should be close to the number of workers - found %v", l.Limit())
+	}
+}
+
+// the limiter is used over http against a server fronted by the drop pattern with 4 workers
+func TestTransport(t *testing.T) {
+	mw, err := middleware.New(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(10 * time.Millisecond)
+	}), middleware.Config{Workers: 4, Timeout: 2 * time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewServer(mw)
+	defer mw.Close()
+	defer server.Close()
+
+	for _, name := range []string{AIMDName, VegasName, GradientName} {
+		algorithm, _ := NewAlgorithm(name)
+		l := New(algorithm, 20)
+		client := &http.Client{Transport: &Transport{Limiter: l}}
+		// 20 clients which send a request each 2ms
+		var wg sync.WaitGroup
+		var mu sync.Mutex
+		status := map[int]int{}
+		for c := 0; c < 20; c++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for i := 0; i < 20; i++ {
+					resp, err := client.Get(server.URL)
+					if err == nil {
+						resp.Body.Close()
+						mu.Lock()
+						status[resp.StatusCode]++
+						mu.Unlock()
+					}
+					time.Sleep(2 * time.Millisecond)
+				}
+			}()
+		}
+		wg.Wait()
+		t.Logf("%v: limit %v - rejected %v - status %v", name, l.Limit(), l.Rejected(), status)
+		if l.Rejected() == 0 || status[http.StatusOK] == 0 {
+			t.Errorf("%v: the limiter should have rejected some requests and let the others through", name)
+		}
+		if l.Limit() > 12 {
+			t.Errorf("%v: the limit should be close to the number of workers - found %v", name, l.Limit())
+		}
+	}
+}
@@ -0,0 +1,258 @@
+package main
+
+import (
+	"encoding/csv"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/EnricoPicci/drop-pattern-with-timeout/src/arrival"
+	"github.com/EnricoPicci/drop-pattern-with-timeout/src/histogram"
+	"github.com/EnricoPicci/drop-pattern-with-timeout/src/limiter"
+	"github.com/EnricoPicci/drop-pattern-with-timeout/src/report"
+	"github.com/EnricoPicci/drop-pattern-with-timeout/src/request"
+)
+
+// In this example the requests are sent to a real http endpoint, e.g. a server fronted by the drop pattern, with the same
+// arrival models used by the simulations
+
+// time unit utilized to calculate durations
+var timeUnit = time.Millisecond
+
+// the outcomes of a request sent to the endpoint
+const (
+	// the endpoint has answered with a 2xx status
+	served = "served"
+	// the endpoint has answered with 503, i.e. the request has been dropped
+	dropped = "dropped"
+	// the request has not been sent since the concurrency limit of the client has been reached
+	limited = "limited"
+	// the endpoint has answered with another status or the request has not been completed, e.g. because of the client timeout
+	failed = "failed"
+)
+
+// the result of a request sent to the endpoint
+type result struct {
+	id      string
+	param   int
+	sent    time.Time
+	latency time.Duration
+	// the http status, 0 if no response has been received
+	status  int
+	outcome string
+	err     string
+}
+
+func main() {
+	url := flag.String("url", "http://localhost:8080/slow", "url of the endpoint the requests are sent to")
+	method := flag.String("method", http.MethodGet, "http method of the requests")
+	numReq := flag.Int("numReq", 100, "number of requests sent")
+	reqInterval := flag.Int("reqInterval", 100, "interval between requests in miliseconds")
+	clientTimeout := flag.Duration("clientTimeout", 30*time.Second, "time after which a request without a response is abandoned and counted as failed")
+	seed := flag.Int64("seed", 1, "seed of the random generators")
+	arrivalModel := flag.String("arrival", "fixed", "arrival model of the requests: fixed, poisson, onoff, diurnal, step, closed")
+	burstInterval := flag.Int("burstInterval", 20, "mean interval between requests during a burst for the onoff model")
+	onDuration := flag.Int("onDuration", 1000, "mean duration of a burst for the onoff model")
+	offDuration := flag.Int("offDuration", 3000, "mean duration of the quiet period between bursts for the onoff model")
+	period := flag.Int("period", 10000, "period of the sine wave modulating the rate of requests for the diurnal model")
+	amplitude := flag.Float64("amplitude", 0.5, "amplitude, between 0 and 1, of the variation of the rate of requests for the diurnal model")
+	stepTime := flag.Int("stepTime", 5000, "time at which the interval between requests changes for the step model")
+	stepInterval := flag.Int("stepInterval", 50, "interval between requests after the step for the step model")
+	clients := flag.Int("clients", 10, "number of clients for the closed model")
+	thinkTime := flag.Int("thinkTime", 100, "mean think time of a client between two requests for the closed model")
+	out := flag.String("out", "", "path of a csv file where the latency and the status of each request are written")
+	limiterName := flag.String("limiter", "", "algorithm of the client side adaptive concurrency limiter: aimd, vegas or gradient - if not set the requests are not limited")
+	initialLimit := flag.Int("initialLimit", 10, "initial concurrency limit of the limiter")
+	reportFile := flag.String("report", "", "path of an html file where the chart of the concurrency limit of the limiter over time is written")
+	flag.Parse()
+
+	flag.VisitAll(func(f *flag.Flag) {
+		fmt.Printf("%s: %s  (%s)\n", f.Name, f.Value, f.Usage)
+	})
+	fmt.Print("\n")
+
+	generator, err := arrival.NewGenerator(arrival.Config{
+		Name:          *arrivalModel,
+		Interval:      *reqInterval,
+		Seed:          *seed,
+		BurstInterval: *burstInterval,
+		OnDuration:    *onDuration,
+		OffDuration:   *offDuration,
+		Period:        *period,
+		Amplitude:     *amplitude,
+		StepTime:      *stepTime,
+		StepInterval:  *stepInterval,
+		Clients:       *clients,
+		ThinkTime:     *thinkTime,
+	})
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	client := newClient(*clientTimeout)
+	var lim *limiter.Limiter
+	if *limiterName != "" {
+		algorithm, err := limiter.NewAlgorithm(*limiterName)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		lim = limiter.New(algorithm, *initialLimit)
+		client.Transport = &limiter.Transport{Limiter: lim, Base: client.Transport}
+	}
+
+	fmt.Printf("Start sending requests to %v\n", *url)
+	fmt.Print("\n")
+
+	results := sendRequests(client, *method, *url, generator, *numReq, timeUnit)
+	printSummary(os.Stdout, results)
+	if lim != nil {
+		fmt.Printf("Concurrency limit at the end: %v\n", lim.Limit())
+	}
+
+	if *reportFile != "" {
+		if lim == nil {
+			fmt.Println("the report can be written only if a limiter is used")
+			os.Exit(1)
+		}
+		r := report.Report{Title: "Concurrency limit of the client", Charts: []report.Chart{lim.Chart("Concurrency limit (" + *limiterName + ")")}}
+		if err := report.WriteFile(*reportFile, r); err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		fmt.Printf("Report written to %v\n", *reportFile)
+	}
+
+	if *out != "" {
+		if err := writeCsvFile(*out, results); err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		fmt.Printf("Results written to %v\n", *out)
+	}
+}
+
+// returns a client which keeps open enough connections to the endpoint for the requests sent concurrently
+func newClient(timeout time.Duration) *http.Client {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.MaxIdleConnsPerHost = 100
+	return &http.Client{Timeout: timeout, Transport: transport}
+}
+
+// sends numReq requests to the url at the intervals of the generator and returns their results, in the order they have
+// been sent, when all of them have been completed
+func sendRequests(client *http.Client, method string, url string, generator arrival.Generator, numReq int,
+	timeUnit time.Duration) []result {
+	results := make([]result, numReq)
+	var wg sync.WaitGroup
+	submit := func(req request.Request) {
+		wg.Add(1)
+		// the request is sent in its own goroutine so that the arrival of the next ones is not delayed - the closed loop
+		// generator waits for the notification before sending the next request of the same client
+		go func() {
+			defer wg.Done()
+			results[req.Param] = send(client, method, url, req)
+			req.Notify()
+		}()
+	}
+	generator.Run(numReq, timeUnit, request.New, submit)
+	wg.Wait()
+	return results
+}
+
+// sends a request and classifies its outcome
+func send(client *http.Client, method string, url string, req request.Request) result {
+	r := result{id: req.ID, param: req.Param, sent: time.Now(), outcome: failed}
+	httpReq, err := http.NewRequest(method, url, nil)
+	if err != nil {
+		r.err = err.Error()
+		return r
+	}
+	httpReq.Header.Set("X-Request-Id", req.ID)
+	resp, err := client.Do(httpReq)
+	if err != nil {
+		r.latency = time.Since(r.sent)
+		r.err = err.Error()
+		if errors.Is(err, limiter.ErrLimitExceeded) {
+			r.outcome = limited
+		}
+		return r
+	}
+	// the body is read so that the latency includes the whole response and the connection can be reused
+	_, err = io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+	r.latency = time.Since(r.sent)
+	r.status = resp.StatusCode
+	switch {
+	case err != nil:
+		r.err = err.Error()
+	case resp.StatusCode == http.StatusServiceUnavailable:
+		r.outcome = dropped
+	case resp.StatusCode >= 200 && resp.StatusCode < 300:
+		r.outcome = served
+	}
+	return r
+}
+
+// prints the latencies of the requests served and dropped and the number of requests for each outcome, in the format of the
+// summary of the drop-pattern command
+func printSummary(w io.Writer, results []result) {
+	latencies := histogram.New()
+	dropLatencies := histogram.New()
+	count := map[string]int{}
+	for _, r := range results {
+		count[r.outcome]++
+		switch r.outcome {
+		case served:
+			latencies.Record(r.latency)
+		case dropped:
+			dropLatencies.Record(r.latency)
+		}
+	}
+	fmt.Fprintf(w, "Average latency for a request served: %v\n", latencies.Mean())
+	fmt.Fprintf(w, "Latency percentiles of the requests served - %v\n", latencies.Summary())
+	fmt.Fprintf(w, "Latency percentiles of the requests dropped - %v\n", dropLatencies.Summary())
+	fmt.Fprintf(w, "Number of requests served: %v\n", count[served])
+	fmt.Fprintf(w, "Number of requests dropped: %v\n", count[dropped])
+	fmt.Fprintf(w, "Number of requests failed: %v\n", count[failed])
+	if count[limited] > 0 {
+		fmt.Fprintf(w, "Number of requests dropped by the concurrency limiter: %v\n", count[limited])
+	}
+}
+
+var header = []string{"id", "param", "sent", "latencyMs", "status", "outcome", "error"}
+
+func writeCsvFile(path string, results []result) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if err := writeCsv(f, results); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+func writeCsv(w io.Writer, results []result) error {
+	writer := csv.NewWriter(w)
+	if err := writer.Write(header); err != nil {
+		return err
+	}
+	for _, r := range results {
+		latency := strconv.FormatFloat(float64(r.latency)/float64(time.Millisecond), 'f', 3, 64)
+		values := []string{r.id, strconv.Itoa(r.param), r.sent.Format(time.RFC3339Nano), latency, strconv.Itoa(r.status), r.outcome, r.err}
+		if err := writer.Write(values); err != nil {
+			return err
+		}
+	}
+	writer.Flush()
+	return writer.Error()
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/EnricoPicci/drop-pattern-with-timeout/src/arrival"
+	"github.com/EnricoPicci/drop-pattern-with-timeout/src/limiter"
+	"github.com/EnricoPicci/drop-pattern-with-timeout/src/middleware"
+)
+
+// starts a local server, fronted by the drop pattern, which takes procTime to serve each request
+func newServer(t *testing.T, config middleware.Config, procTime time.Duration) *httptest.Server {
+	mw, err := middleware.New(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/broken" {
+			http.Error(w, "broken", http.StatusInternalServerError)
+			return
+		}
+		time.Sleep(procTime)
+	}), config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewServer(mw)
+	t.Cleanup(func() {
+		server.Close()
+		mw.Close()
+	})
+	return server
+}
+
+// the server can serve 2 requests every 50ms while a request arrives every 5ms, so most of the requests are dropped
+func TestDropsToldApartFromSuccesses(t *testing.T) {
+	server := newServer(t, middleware.Config{Workers: 2, Timeout: 20 * time.Millisecond}, 50*time.Millisecond)
+
+	numReq := 40
+	results := sendRequests(newClient(5*time.Second), http.MethodGet, server.URL, arrival.FixedInterval(5), numReq, time.Millisecond)
+
+	count := map[string]int{}
+	for i, r := range results {
+		if r.param != i {
+			t.Errorf("The results should be in the order the requests have been sent - found %v at %v", r.param, i)
+		}
+		count[r.outcome]++
+		if (r.outcome == served && r.status != http.StatusOK) || (r.outcome == dropped && r.status != http.StatusServiceUnavailable) {
+			t.Errorf("Outcome %v with status %v", r.outcome, r.status)
+		}
+	}
+	t.Logf("Outcomes: %v", count)
+	if count[served] < 2 || count[dropped] < numReq/2 || count[failed] != 0 {
+		t.Errorf("Expected a few requests served and most of them dropped - found %v", count)
+	}
+
+	var b bytes.Buffer
+	printSummary(&b, results)
+	summary := b.String()
+	for _, line := range []string{"Latency percentiles of the requests served - ", "Number of requests dropped: ", "Number of requests failed: 0\n"} {
+		if !strings.Contains(summary, line) {
+			t.Errorf("The summary should contain %q:\n%v", line, summary)
+		}
+	}
+}
+
+// with the closed model each client waits for the response before sending the next request, so a server with as many workers
+// as the clients serves all of them
+func TestClosedLoopAndFailures(t *testing.T) {
+	server := newServer(t, middleware.Config{Workers: 4, Timeout: 20 * time.Millisecond}, 5*time.Millisecond)
+	generator, err := arrival.NewGenerator(arrival.Config{Name: arrival.Closed, Clients: 4, ThinkTime: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	results := sendRequests(newClient(5*time.Second), http.MethodGet, server.URL, generator, 20, time.Millisecond)
+	for _, r := range results {
+		if r.outcome != served {
+			t.Errorf("All the requests should have been served - found %+v", r)
+		}
+	}
+
+	results = sendRequests(newClient(5*time.Second), http.MethodGet, server.URL+"/broken", arrival.FixedInterval(1), 3, time.Millisecond)
+	for _, r := range results {
+		if r.outcome != failed || r.status != http.StatusInternalServerError {
+			t.Errorf("The requests answered with 500 should have failed - found %+v", r)
+		}
+	}
+
+	var b bytes.Buffer
+	if err := writeCsv(&b, results); err != nil {
+		t.Fatal(err)
+	}
+	records, err := csv.NewReader(&b).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 4 || records[1][4] != "500" || records[1][5] != failed {
+		t.Errorf("Unexpected csv: %v", records)
+	}
+}
+
+// the requests above the concurrency limit of the client are not sent to the server
+func TestLimiter(t *testing.T) {
+	server := newServer(t, middleware.Config{Workers: 2, Timeout: 20 * time.Millisecond}, 50*time.Millisecond)
+	client := newClient(5 * time.Second)
+	l := limiter.New(limiter.NewAIMD(), 2)
+	client.Transport = &limiter.Transport{Limiter: l, Base: client.Transport}
+
+	results := sendRequests(client, http.MethodGet, server.URL, arrival.FixedInterval(1), 10, time.Millisecond)
+	count := map[string]int{}
+	for _, r := range results {
+		count[r.outcome]++
+	}
+	if count[limited] == 0 || count[limited] != l.Rejected() || count[dropped] != 0 {
+		t.Errorf("The requests above the limit should have been dropped by the limiter rather than by the server - found %v", count)
+	}
+
+	var b bytes.Buffer
+	printSummary(&b, results)
+	if !strings.Contains(b.String(), "Number of requests dropped by the concurrency limiter: ") {
+		t.Errorf("The summary should report the requests dropped by the limiter:\n%v", b.String())
+	}
+}
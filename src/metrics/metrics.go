@@ -0,0 +1,177 @@
+package metrics
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/EnricoPicci/drop-pattern-with-timeout/src/histogram"
+	"github.com/EnricoPicci/drop-pattern-with-timeout/src/waitingroom"
+	"github.com/EnricoPicci/drop-pattern-with-timeout/src/workerpool"
+)
+
+// the prefix of the names of all the metrics exposed
+const namespace = "droppattern"
+
+// DefaultBuckets are the upper bounds, in seconds, of the buckets of the histograms exposed
+var DefaultBuckets = []float64{0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// Exporter exposes the metrics of a worker pool, and of the waiting room in front of it, in the Prometheus text format.
+// It implements http.Handler so that it can be mounted on the mux of a service, usually on the /metrics path.
+type Exporter struct {
+	pool *workerpool.WorkerPool
+	// nil if the requests are sent straight to the pool
+	waitingRoom *waitingroom.WaitingRoom
+
+	// the upper bounds, in seconds and in increasing order, of the buckets of the histograms
+	Buckets []float64
+}
+
+// New returns an exporter of the metrics of the pool and, if not nil, of the waiting room
+func New(pool *workerpool.WorkerPool, waitingRoom *waitingroom.WaitingRoom) *Exporter {
+	e := Exporter{
+		pool:        pool,
+		waitingRoom: waitingRoom,
+		Buckets:     DefaultBuckets,
+	}
+	return &e
+}
+
+// ServeHTTP writes the current value of the metrics - they are rendered before being sent, so that an error is answered with
+// 500 rather than with metrics cut short
+func (e *Exporter) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var buf bytes.Buffer
+	if err := e.Write(&buf); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	// an error here means that the scraper has gone away, so there is no one left to answer
+	_, _ = w.Write(buf.Bytes())
+}
+
+// Write writes the current value of the metrics in the Prometheus text format
+func (e *Exporter) Write(w io.Writer) error {
+	b := bufio.NewWriter(w)
+
+	if e.waitingRoom != nil {
+		metric(b, "waiting_room_admitted_total", "counter", "Requests let in the waiting room.")
+		sample(b, "waiting_room_admitted_total", "", float64(e.waitingRoom.Admitted()))
+		metric(b, "waiting_room_dispatched_total", "counter", "Requests sent from the waiting room to the worker pool.")
+		sample(b, "waiting_room_dispatched_total", "", float64(e.waitingRoom.SentToPool()))
+		metric(b, "waiting_room_dropped_total", "counter", "Requests dropped by the waiting room, by reason.")
+		byReason(b, "waiting_room_dropped_total", e.waitingRoom.DroppedByReason())
+		metric(b, "waiting_room_queue_length", "gauge", "Requests waiting in the waiting room.")
+		sample(b, "waiting_room_queue_length", "", float64(e.waitingRoom.Len()))
+	} else {
+		metric(b, "pool_queue_length", "gauge", "Requests waiting in the input channel of the worker pool.")
+		sample(b, "pool_queue_length", "", float64(e.pool.QueueLength()))
+	}
+
+	idle, busy, halted := e.pool.WorkerStates()
+	metric(b, "pool_workers", "gauge", "Workers of the pool, by state.")
+	sample(b, "pool_workers", `state="idle"`, float64(idle))
+	sample(b, "pool_workers", `state="busy"`, float64(busy))
+	sample(b, "pool_workers", `state="halted"`, float64(halted))
+	metric(b, "pool_completed_total", "counter", "Requests processed by the worker pool.")
+	sample(b, "pool_completed_total", "", float64(e.pool.Completed()))
+	metric(b, "pool_failed_total", "counter", "Requests whose processing failed.")
+	sample(b, "pool_failed_total", "", float64(e.pool.FailedRequests()))
+	metric(b, "pool_dropped_total", "counter", "Requests dropped by the workers in batch mode since they expired before the batch was processed, by reason.")
+	byReason(b, "pool_dropped_total", e.pool.DroppedByReason())
+
+	e.histogram(b, "pool_wait_seconds", "Time spent by the requests before being taken in by a worker.", e.pool.WaitTimes())
+	e.histogram(b, "pool_processing_seconds", "Time spent by the workers processing the requests.", e.pool.ProcTimes())
+	e.histogram(b, "pool_end_to_end_seconds", "Time from the creation of the requests to the end of their processing.", e.pool.EndToEndTimes())
+
+	return b.Flush()
+}
+
+func (e *Exporter) histogram(w io.Writer, name string, help string, h *histogram.Histogram) {
+	bounds := make([]time.Duration, len(e.Buckets))
+	for i, le := range e.Buckets {
+		bounds[i] = time.Duration(le * float64(time.Second))
+	}
+	// a snapshot so that the buckets, the sum and the count are consistent
+	h = h.Snapshot()
+	counts := h.CumulativeCounts(bounds)
+	metric(w, name, "histogram", help)
+	for i, le := range e.Buckets {
+		sample(w, name+"_bucket", fmt.Sprintf(`le="%v"`, formatFloat(le)), float64(counts[i]))
+	}
+	sample(w, name+"_bucket", `le="+Inf"`, float64(h.Count()))
+	sample(w, name+"_sum", "", h.Sum().Seconds())
+	sample(w, name+"_count", "", float64(h.Count()))
+}
+
+// writes the values of a counter of the requests dropped, one for each reason
+func byReason(w io.Writer, name string, dropped map[string]int) {
+	// the timeout reason is always present so that the rate of drops can be calculated from the start
+	if _, ok := dropped[waitingroom.DropTimeout]; !ok {
+		dropped[waitingroom.DropTimeout] = 0
+	}
+	reasons := make([]string, 0, len(dropped))
+	for reason := range dropped {
+		reasons = append(reasons, reason)
+	}
+	sort.Strings(reasons)
+	for _, reason := range reasons {
+		sample(w, name, fmt.Sprintf(`reason=%q`, reason), float64(dropped[reason]))
+	}
+}
+
+// writes the help and the type of a metric
+func metric(w io.Writer, name string, kind string, help string) {
+	fmt.Fprintf(w, "# HELP %v_%v %v\n", namespace, name, help)
+	fmt.Fprintf(w, "# TYPE %v_%v %v\n", namespace, name, kind)
+}
+
+// writes the value of a metric, with its labels if not empty
+func sample(w io.Writer, name string, labels string, v float64) {
+	if labels != "" {
+		labels = "{" + labels + "}"
+	}
+	fmt.Fprintf(w, "%v_%v%v %v\n", namespace, name, labels, formatFloat(v))
+}
+
+func formatFloat(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// Server serves the metrics of an exporter over http on the /metrics path
+type Server struct {
+	server   *http.Server
+	listener net.Listener
+}
+
+// Serve starts serving the metrics of the exporter on addr, e.g. ":9090" or "127.0.0.1:0" to use a free port
+func Serve(addr string, e *Exporter) (*Server, error) {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", e)
+	s := Server{
+		server:   &http.Server{Handler: mux},
+		listener: listener,
+	}
+	go s.server.Serve(listener)
+	return &s, nil
+}
+
+// Addr returns the address the server is listening on
+func (s *Server) Addr() string {
+	return s.listener.Addr().String()
+}
+
+// Close stops the server
+func (s *Server) Close() error {
+	return s.server.Close()
+}
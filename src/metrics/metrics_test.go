@@ -0,0 +1,104 @@
+package metrics
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/EnricoPicci/drop-pattern-with-timeout/src/faults"
+	"github.com/EnricoPicci/drop-pattern-with-timeout/src/internal/scenariotest"
+	"github.com/EnricoPicci/drop-pattern-with-timeout/src/request"
+	"github.com/EnricoPicci/drop-pattern-with-timeout/src/simulation"
+	"github.com/EnricoPicci/drop-pattern-with-timeout/src/waitingroom"
+	"github.com/EnricoPicci/drop-pattern-with-timeout/src/workerpool"
+)
+
+// runs a simulation where the pool is halted long enough for some requests to be dropped and reads the metrics over http
+func TestMetricsOverLocalhost(t *testing.T) {
+	sc, err := scenariotest.Example()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sim, err := simulation.New(sc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, err := Serve("127.0.0.1:0", New(sim.Pool, sim.WaitingRoom))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	result := sim.Run()
+
+	resp, err := http.Get("http://" + server.Addr() + "/metrics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if !strings.HasPrefix(resp.Header.Get("Content-Type"), "text/plain") {
+		t.Errorf("The content type should be text/plain - found %v", resp.Header.Get("Content-Type"))
+	}
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	text := string(body)
+
+	if len(result.Dropped) == 0 {
+		t.Fatalf("Some requests should have been dropped during the halt")
+	}
+	expected := []string{
+		"droppattern_waiting_room_admitted_total " + formatFloat(float64(sc.NumReq)) + "\n",
+		"# TYPE droppattern_waiting_room_dropped_total counter\n",
+		`droppattern_waiting_room_dropped_total{reason="timeout"} ` + formatFloat(float64(len(result.Dropped))) + "\n",
+		"droppattern_waiting_room_queue_length 0\n",
+		`droppattern_pool_workers{state="busy"} 0` + "\n",
+		"droppattern_pool_completed_total " + formatFloat(float64(len(result.Processed))) + "\n",
+		`droppattern_pool_dropped_total{reason="timeout"} 0` + "\n",
+		"# TYPE droppattern_pool_wait_seconds histogram\n",
+		`droppattern_pool_wait_seconds_bucket{le="+Inf"} ` + formatFloat(float64(len(result.Processed))) + "\n",
+		"droppattern_pool_processing_seconds_count " + formatFloat(float64(len(result.Processed))) + "\n",
+	}
+	for _, e := range expected {
+		if !strings.Contains(text, e) {
+			t.Errorf("The metrics should contain %q", e)
+		}
+	}
+	if strings.Contains(text, "busy_workers") {
+		t.Errorf("The busy workers should be exposed only by droppattern_pool_workers")
+	}
+}
+
+// the requests of a batch which expire while the pool is halted are dropped by the worker, not by the waiting room
+func TestPoolDropsOfBatches(t *testing.T) {
+	inChan := make(chan request.Request)
+	pool := workerpool.NewWorkerPool(inChan, 1, 0, 10, 0, 0, 0, time.Millisecond)
+	pool.BatchSize = 3
+	pool.BatchLinger = 5
+	pool.Faults = faults.New(0, faults.HaltWindow(0, 60))
+	waitingRoom := waitingroom.New(make(chan request.Request), inChan, 20, time.Millisecond)
+	pool.Start()
+	waitingRoom.Open()
+	for i := 0; i < 3; i++ {
+		waitingRoom.LetIn(request.New(i))
+	}
+	waitingRoom.Close()
+	pool.Stop()
+
+	var buf bytes.Buffer
+	if err := New(pool, waitingRoom).Write(&buf); err != nil {
+		t.Fatal(err)
+	}
+	for _, e := range []string{
+		`droppattern_waiting_room_dropped_total{reason="timeout"} 0` + "\n",
+		`droppattern_pool_dropped_total{reason="timeout"} 3` + "\n",
+	} {
+		if !strings.Contains(buf.String(), e) {
+			t.Errorf("The metrics should contain %q - found\n%v", e, buf.String())
+		}
+	}
+}
@@ -0,0 +1,125 @@
+package middleware
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/EnricoPicci/drop-pattern-with-timeout/src/request"
+	"github.com/EnricoPicci/drop-pattern-with-timeout/src/waitingroom"
+	"github.com/EnricoPicci/drop-pattern-with-timeout/src/workerpool"
+)
+
+// Gate admits the calls of a server, e.g. http requests or grpc calls, through a waiting room in front of a pool of workers:
+// a call waits up to the timeout, or up to its deadline if it comes first, for a worker and then is either executed on the
+// worker or dropped. The gate has to be closed, after the server has been shut down, to stop its workers.
+type Gate struct {
+	// the pool of workers which execute the calls and the waiting room in front of it, e.g. to expose their metrics with the
+	// metrics package
+	Pool        *workerpool.WorkerPool
+	WaitingRoom *waitingroom.WaitingRoom
+
+	// protects the waiting room from calls let in after it has been closed
+	mu     sync.RWMutex
+	closed bool
+}
+
+// Outcome is the outcome of a call passed through the gate
+type Outcome int
+
+const (
+	// the call has been executed on a worker
+	Executed Outcome = iota
+	// the call has been dropped since no worker has taken it in within the timeout or before its deadline
+	Dropped
+	// the call has been refused since the gate is closed
+	Closed
+	// the call has not been executed since its context was done when a worker has taken it in, e.g. the client has gone away
+	Canceled
+)
+
+// NewGate returns a gate with the concurrency and the timeout of the configuration and starts its workers
+func NewGate(config Config) (*Gate, error) {
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
+	// the waiting room and the pool express the times in time units, which here are nanoseconds
+	inPoolCh := make(chan request.Request)
+	pool := workerpool.NewWorkerPool(inPoolCh, config.Workers, 0, 0, 0, 0, 0, time.Nanosecond)
+	waitingRoom := waitingroom.New(make(chan request.Request), inPoolCh, int(config.Timeout), time.Nanosecond)
+	// a server runs for a long time, so the requests are only counted
+	pool.DiscardRequests = true
+	waitingRoom.DiscardRequests = true
+	if config.Events != nil {
+		pool.Events = config.Events
+		waitingRoom.Events = config.Events
+	}
+
+	g := Gate{
+		Pool:        pool,
+		WaitingRoom: waitingRoom,
+	}
+	pool.Start()
+	waitingRoom.Open()
+	return &g, nil
+}
+
+// Admit lets the call in the waiting room and, if a worker takes it in, executes it on the worker. It returns when the call has
+// been executed or dropped. The deadline of the context, if any, is the deadline of the call and a call whose context is done
+// when a worker takes it in is not executed, with the outcome Canceled. A panic of the call is raised again in the goroutine which calls Admit.
+func (g *Gate) Admit(ctx context.Context, traceParent string, call func()) Outcome {
+	done := make(chan request.Request, 1)
+	var panicked interface{}
+	canceled := false
+	req := request.New(0)
+	req.TraceParent = traceParent
+	req.Done = done
+	if deadline, ok := ctx.Deadline(); ok {
+		req.Deadline = deadline
+	}
+	req.Exec = func() {
+		defer func() {
+			panicked = recover()
+		}()
+		// the client may have gone away while the call was waiting for a worker
+		if ctx.Err() != nil {
+			canceled = true
+			return
+		}
+		call()
+	}
+
+	g.mu.RLock()
+	if g.closed {
+		g.mu.RUnlock()
+		return Closed
+	}
+	g.WaitingRoom.LetIn(req)
+	g.mu.RUnlock()
+
+	executed := <-done
+	if executed.Dropped {
+		return Dropped
+	}
+	if panicked != nil {
+		panic(panicked)
+	}
+	if canceled {
+		return Canceled
+	}
+	return Executed
+}
+
+// Close stops the workers after the calls already let in have been executed or dropped - the calls which come in after the
+// gate has been closed are refused
+func (g *Gate) Close() {
+	g.mu.Lock()
+	if g.closed {
+		g.mu.Unlock()
+		return
+	}
+	g.closed = true
+	g.mu.Unlock()
+	g.WaitingRoom.Close()
+	g.Pool.Stop()
+}
@@ -0,0 +1,83 @@
+package middleware
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/EnricoPicci/drop-pattern-with-timeout/src/events"
+)
+
+// Config is the configuration of the drop pattern in front of an http handler
+type Config struct {
+	// the number of requests served concurrently by the handler
+	Workers int `yaml:"workers"`
+	// how long a request waits for a worker before being answered with 503 Service Unavailable
+	Timeout time.Duration `yaml:"timeout"`
+	// the value of the Retry-After header of the 503 responses, rounded up to seconds - 0 means one second
+	RetryAfter time.Duration `yaml:"retryAfter"`
+	// receives the events of the waiting room and of the workers - if nil they are discarded
+	Events events.Sink `yaml:"-"`
+}
+
+// Validate returns an error if the configuration is not valid
+func (c Config) Validate() error {
+	if c.Workers <= 0 {
+		return fmt.Errorf("the number of workers must be greater than 0 - found %v", c.Workers)
+	}
+	if c.Timeout <= 0 {
+		return fmt.Errorf("the timeout must be greater than 0 - found %v", c.Timeout)
+	}
+	if c.RetryAfter < 0 {
+		return fmt.Errorf("the retry after can not be negative - found %v", c.RetryAfter)
+	}
+	return nil
+}
+
+// Middleware is an http handler which fronts another handler with a gate: the incoming requests wait up to the timeout for a
+// worker and then are either served by the handler, on the worker, or answered with 503 and a Retry-After header. The
+// middleware has to be closed, after the http server has been shut down, to stop its workers.
+type Middleware struct {
+	*Gate
+	next       http.Handler
+	retryAfter int
+}
+
+// New returns a middleware which serves the requests with the handler passed, with the concurrency and the timeout of the
+// configuration, and starts its workers
+func New(next http.Handler, config Config) (*Middleware, error) {
+	gate, err := NewGate(config)
+	if err != nil {
+		return nil, err
+	}
+	m := Middleware{
+		Gate:       gate,
+		next:       next,
+		retryAfter: retryAfterSeconds(config.RetryAfter),
+	}
+	return &m, nil
+}
+
+// ServeHTTP lets the request in the waiting room and waits until it has been served by a worker or dropped - the requests
+// which come in after the middleware has been closed, and the ones canceled before a worker has taken them in, are answered
+// with 503 as well
+func (m *Middleware) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	outcome := m.Admit(r.Context(), r.Header.Get("traceparent"), func() {
+		m.next.ServeHTTP(w, r)
+	})
+	if outcome != Executed {
+		w.Header().Set("Retry-After", strconv.Itoa(m.retryAfter))
+		http.Error(w, http.StatusText(http.StatusServiceUnavailable), http.StatusServiceUnavailable)
+	}
+}
+
+// returns the retry after rounded up to seconds, with a minimum of one second
+func retryAfterSeconds(retryAfter time.Duration) int {
+	seconds := int(math.Ceil(retryAfter.Seconds()))
+	if seconds < 1 {
+		return 1
+	}
+	return seconds
+}
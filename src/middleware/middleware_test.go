@@ -0,0 +1,164 @@
+package middleware
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// a handler which takes the time passed to serve a request
+func slowHandler(d time.Duration) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(d)
+		w.Write([]byte("ok"))
+	})
+}
+
+// sends n concurrent requests to the url and returns the responses
+func burst(t *testing.T, url string, n int) []*http.Response {
+	responses := make([]*http.Response, n)
+	var wg sync.WaitGroup
+	wg.Add(n)
+	for i := 0; i < n; i++ {
+		go func(i int) {
+			defer wg.Done()
+			resp, err := http.Get(url)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			resp.Body.Close()
+			responses[i] = resp
+		}(i)
+	}
+	wg.Wait()
+	return responses
+}
+
+func TestServedWithinTimeout(t *testing.T) {
+	mw, err := New(slowHandler(10*time.Millisecond), Config{Workers: 2, Timeout: time.Second})
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewServer(mw)
+	defer mw.Close()
+	defer server.Close()
+
+	for _, resp := range burst(t, server.URL, 6) {
+		if resp != nil && resp.StatusCode != http.StatusOK {
+			t.Errorf("All the requests should have been served - found status %v", resp.StatusCode)
+		}
+	}
+	if mw.Pool.Completed() != 6 || mw.WaitingRoom.Dropped() != 0 {
+		t.Errorf("Expected 6 requests completed and none dropped - found %v and %v", mw.Pool.Completed(), mw.WaitingRoom.Dropped())
+	}
+}
+
+func TestDroppedWith503(t *testing.T) {
+	mw, err := New(slowHandler(200*time.Millisecond), Config{Workers: 1, Timeout: 20 * time.Millisecond, RetryAfter: 1500 * time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewServer(mw)
+	defer mw.Close()
+	defer server.Close()
+
+	ok, unavailable := 0, 0
+	for _, resp := range burst(t, server.URL, 4) {
+		if resp == nil {
+			continue
+		}
+		switch resp.StatusCode {
+		case http.StatusOK:
+			ok++
+		case http.StatusServiceUnavailable:
+			unavailable++
+			if resp.Header.Get("Retry-After") != "2" {
+				t.Errorf("The Retry-After header should be the retry after rounded up to seconds - found %q", resp.Header.Get("Retry-After"))
+			}
+		default:
+			t.Errorf("Unexpected status %v", resp.StatusCode)
+		}
+	}
+	// only one request at a time is served and the others can not wait for it to complete
+	if ok != 1 || unavailable != 3 {
+		t.Errorf("Expected 1 request served and 3 dropped - found %v and %v", ok, unavailable)
+	}
+	if mw.WaitingRoom.Dropped() != 3 {
+		t.Errorf("The waiting room should have dropped 3 requests - found %v", mw.WaitingRoom.Dropped())
+	}
+}
+
+func TestClosed(t *testing.T) {
+	mw, err := New(slowHandler(0), Config{Workers: 1, Timeout: time.Second})
+	if err != nil {
+		t.Fatal(err)
+	}
+	mw.Close()
+	rec := httptest.NewRecorder()
+	mw.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+	if rec.Code != http.StatusServiceUnavailable || rec.Header().Get("Retry-After") != "1" {
+		t.Errorf("A middleware closed should answer 503 with a retry after of 1 second - found %v %q", rec.Code, rec.Header().Get("Retry-After"))
+	}
+}
+
+func TestMuxRoutes(t *testing.T) {
+	mux := NewMux()
+	if err := mux.Handle("/slow", slowHandler(200*time.Millisecond), Config{Workers: 1, Timeout: 20 * time.Millisecond}); err != nil {
+		t.Fatal(err)
+	}
+	if err := mux.Handle("/fast", slowHandler(time.Millisecond), Config{Workers: 4, Timeout: time.Second}); err != nil {
+		t.Fatal(err)
+	}
+	if err := mux.Handle("/fast", slowHandler(0), Config{Workers: 1, Timeout: time.Second}); err == nil {
+		t.Errorf("A route registered twice should return an error")
+	}
+	if err := mux.Handle("/none", slowHandler(0), Config{}); err == nil {
+		t.Errorf("A route without workers should return an error")
+	}
+	if err := mux.Handle("/zero", slowHandler(0), Config{Workers: 1}); err == nil {
+		t.Errorf("A route with a timeout of 0 should return an error")
+	}
+	server := httptest.NewServer(mux)
+	defer mux.Close()
+	defer server.Close()
+
+	burst(t, server.URL+"/slow", 3)
+	burst(t, server.URL+"/fast", 3)
+	if mux.Route("/slow").WaitingRoom.Dropped() != 2 {
+		t.Errorf("The slow route should have dropped 2 requests - found %v", mux.Route("/slow").WaitingRoom.Dropped())
+	}
+	if mux.Route("/fast").WaitingRoom.Dropped() != 0 || mux.Route("/fast").Pool.Completed() != 3 {
+		t.Errorf("The fast route should have served all the requests - found %v dropped", mux.Route("/fast").WaitingRoom.Dropped())
+	}
+}
+
+// a call whose context is done when a worker takes it in is not executed and is not reported as executed
+func TestCanceledBeforeTakenIn(t *testing.T) {
+	gate, err := NewGate(Config{Workers: 1, Timeout: time.Second})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer gate.Close()
+	busy := make(chan struct{})
+	release := make(chan struct{})
+	go gate.Admit(context.Background(), "", func() {
+		close(busy)
+		<-release
+	})
+	<-busy
+	ctx, cancel := context.WithCancel(context.Background())
+	outcome := make(chan Outcome, 1)
+	called := false
+	go func() {
+		outcome <- gate.Admit(ctx, "", func() { called = true })
+	}()
+	cancel()
+	close(release)
+	if o := <-outcome; o != Canceled || called {
+		t.Errorf("The call should have been canceled without being executed - found outcome %v", o)
+	}
+}
@@ -0,0 +1,68 @@
+package middleware
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+)
+
+// Mux is an http request multiplexer where each route is fronted by its own waiting room and worker pool, so that the
+// concurrency and the timeout can be configured for each route
+type Mux struct {
+	mux *http.ServeMux
+
+	mu     sync.Mutex
+	routes map[string]*Middleware
+}
+
+// NewMux returns a multiplexer without routes
+func NewMux() *Mux {
+	m := Mux{
+		mux:    http.NewServeMux(),
+		routes: make(map[string]*Middleware),
+	}
+	return &m
+}
+
+// Handle registers the handler for the pattern, with the syntax of http.ServeMux, fronted by the drop pattern with the
+// configuration passed
+func (m *Mux) Handle(pattern string, handler http.Handler, config Config) error {
+	mw, err := New(handler, config)
+	if err != nil {
+		return fmt.Errorf("route %v: %v", pattern, err)
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.routes[pattern]; ok {
+		mw.Close()
+		return fmt.Errorf("route %v: already registered", pattern)
+	}
+	m.routes[pattern] = mw
+	m.mux.Handle(pattern, mw)
+	return nil
+}
+
+// HandleUnprotected registers a handler which is not fronted by the drop pattern, e.g. the one exposing the metrics
+func (m *Mux) HandleUnprotected(pattern string, handler http.Handler) {
+	m.mux.Handle(pattern, handler)
+}
+
+// Route returns the middleware fronting the handler registered for the pattern, or nil if there is no such route
+func (m *Mux) Route(pattern string) *Middleware {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.routes[pattern]
+}
+
+func (m *Mux) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	m.mux.ServeHTTP(w, r)
+}
+
+// Close closes the middlewares of all the routes - it has to be called after the http server has been shut down
+func (m *Mux) Close() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, mw := range m.routes {
+		mw.Close()
+	}
+}
@@ -3,9 +3,19 @@ package main
 import (
 	"flag"
 	"fmt"
+	"os"
 	"time"
 
+	"github.com/EnricoPicci/drop-pattern-with-timeout/src/arrival"
+	"github.com/EnricoPicci/drop-pattern-with-timeout/src/events"
+	"github.com/EnricoPicci/drop-pattern-with-timeout/src/faults"
+	"github.com/EnricoPicci/drop-pattern-with-timeout/src/recorder"
+	"github.com/EnricoPicci/drop-pattern-with-timeout/src/report"
 	"github.com/EnricoPicci/drop-pattern-with-timeout/src/request"
+	"github.com/EnricoPicci/drop-pattern-with-timeout/src/scenario"
+	"github.com/EnricoPicci/drop-pattern-with-timeout/src/servicetime"
+	"github.com/EnricoPicci/drop-pattern-with-timeout/src/simulation"
+	"github.com/EnricoPicci/drop-pattern-with-timeout/src/tracing"
 	"github.com/EnricoPicci/drop-pattern-with-timeout/src/workerpool"
 )
 
@@ -21,6 +31,33 @@ func main() {
 	_numReq := flag.Int("numReq", 100, "number of requests coming in to be processed")
 	_haltPoolTime := flag.Int("haltPoolTime", 2000, "at which time (after start) the pool is halted and stops processing in milliseconds")
 	_haltPoolDuration := flag.Int("haltPoolDuration", 1000, "for how long the pool is halted in milliseconds")
+	_faultsFile := flag.String("faults", "", "path of a json file with the faults to inject in the worker pool (halts, slowdowns, stalls, jitter, errors)")
+	_procDist := flag.String("procDist", "constant", "distribution of the processing time of the requests: constant, exponential, lognormal, pareto, bimodal, empirical")
+	_procSigma := flag.Float64("procSigma", 1, "standard deviation of the underlying normal distribution for the lognormal distribution")
+	_procAlpha := flag.Float64("procAlpha", 2, "shape of the pareto distribution, the lower the heavier the tail (must be greater than 1)")
+	_procSlowProb := flag.Float64("procSlowProb", 0.1, "probability that a request is slow for the bimodal distribution")
+	_procSlowTime := flag.Int("procSlowTime", 5000, "processing time of the slow requests for the bimodal distribution")
+	_procFile := flag.String("procFile", "", "file with one processing time per line for the empirical distribution")
+	_seed := flag.Int64("seed", 1, "seed of the random generators")
+	_arrivalModel := flag.String("arrival", "fixed", "arrival model of the requests: fixed, poisson, onoff, diurnal, step, closed")
+	_burstInterval := flag.Int("burstInterval", 20, "mean interval between requests during a burst for the onoff model")
+	_onDuration := flag.Int("onDuration", 1000, "mean duration of a burst for the onoff model")
+	_offDuration := flag.Int("offDuration", 3000, "mean duration of the quiet period between bursts for the onoff model")
+	_period := flag.Int("period", 10000, "period of the sine wave modulating the rate of requests for the diurnal model")
+	_amplitude := flag.Float64("amplitude", 0.5, "amplitude, between 0 and 1, of the variation of the rate of requests for the diurnal model")
+	_stepTime := flag.Int("stepTime", 5000, "time at which the interval between requests changes for the step model")
+	_stepInterval := flag.Int("stepInterval", 50, "interval between requests after the step for the step model")
+	_clients := flag.Int("clients", 10, "number of clients for the closed model")
+	_thinkTime := flag.Int("thinkTime", 100, "mean think time of a client between two requests for the closed model")
+	_traceFile := flag.String("trace", "", "path of a csv or json-lines trace to replay - when set, arrivals and processing times are read from the trace")
+	_traceScale := flag.Float64("traceScale", 1, "factor applied to the timings of the trace, e.g. 0.5 replays the trace twice as fast")
+	_scenarioFile := flag.String("scenario", "", "path of a yaml or json scenario file - when set, all the other parameters are ignored")
+	_recordFile := flag.String("record", "", "path of a csv (or json, if the extension is .json) file where the state of the simulation sampled over time is written")
+	_recordEvery := flag.Int("recordEvery", 100, "interval between two samples of the state of the simulation")
+	_eventSink := flag.String("events", "text", "how the events of the requests, of the workers and of the pool are written: text, json (one json object per line) or none")
+	_eventsFile := flag.String("eventsFile", "", "path of the file where the events are written - if not set they are written on the console")
+	_spansFile := flag.String("spansFile", "", "path of the file where the spans of the lifecycle of each request are written in the OTLP json format")
+	_reportFile := flag.String("report", "", "path of an html file where a report with the charts of the run is written")
 	flag.Parse()
 
 	flag.VisitAll(func(f *flag.Flag) {
@@ -28,10 +65,142 @@ func main() {
 	})
 	fmt.Print("\n")
 
-	avgIdleTime, avgWaitTime := workerPoolWithoutDropPattern(*_poolSize, *_reqInterval, *_procTime, *_numReq, *_haltPoolTime, *_haltPoolDuration)
+	var sc *scenario.Scenario
+	var err error
+	if *_scenarioFile != "" {
+		// the scenario file replaces all the other parameters
+		sc, err = scenario.Load(*_scenarioFile)
+	} else {
+		sc = &scenario.Scenario{
+			NumReq:      *_numReq,
+			Seed:        *_seed,
+			Pool:        scenario.Pool{Size: *_poolSize},
+			WaitingRoom: scenario.WaitingRoom{Policy: scenario.NoDrop},
+			Arrival: arrival.Config{
+				Name:          *_arrivalModel,
+				Interval:      *_reqInterval,
+				BurstInterval: *_burstInterval,
+				OnDuration:    *_onDuration,
+				OffDuration:   *_offDuration,
+				Period:        *_period,
+				Amplitude:     *_amplitude,
+				StepTime:      *_stepTime,
+				StepInterval:  *_stepInterval,
+				Clients:       *_clients,
+				ThinkTime:     *_thinkTime,
+			},
+			ServiceTime: servicetime.Config{
+				Name:     *_procDist,
+				Mean:     *_procTime,
+				Sigma:    *_procSigma,
+				Alpha:    *_procAlpha,
+				SlowProb: *_procSlowProb,
+				SlowTime: *_procSlowTime,
+				File:     *_procFile,
+			},
+		}
+		// the halt of the pool is one of the faults injected
+		if *_haltPoolDuration > 0 {
+			sc.FaultTimeline.Faults = append(sc.FaultTimeline.Faults, faults.HaltWindow(*_haltPoolTime, *_haltPoolDuration))
+		}
+		if *_faultsFile != "" {
+			faultScenario, err := faults.Load(*_faultsFile)
+			if err != nil {
+				fmt.Println(err)
+				os.Exit(1)
+			}
+			sc.FaultTimeline.Faults = append(sc.FaultTimeline.Faults, faultScenario.Faults...)
+			sc.FaultTimeline.Seed = faultScenario.Seed
+		}
+		if *_traceFile != "" {
+			sc.Trace = &scenario.Trace{File: *_traceFile, Scale: *_traceScale}
+		}
+		err = sc.Validate()
+	}
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	// the policy of the waiting room is ignored since requests are sent straight to the pool
+	sc.WaitingRoom.Policy = scenario.NoDrop
+
+	fmt.Println("Start processing requests")
+	fmt.Print("\n")
+
+	sim, err := simulation.New(sc)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	sink, closeEvents, err := events.Open(*_eventSink, *_eventsFile)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	defer func() {
+		if err := closeEvents(); err != nil {
+			fmt.Println("Error writing the events:", err)
+		}
+	}()
+	var tracer *tracing.Tracer
+	if *_spansFile != "" {
+		exporter, err := tracing.NewOTLPFile(*_spansFile, "no-drop-pattern")
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		defer exporter.Close()
+		tracer = tracing.New(exporter)
+		sink = events.Multi(sink, tracer)
+	}
+	sim.SetEvents(sink)
 
-	fmt.Printf("Average idle time for a worker: %v\n", avgIdleTime)
-	fmt.Printf("Average wait time for a request: %v\n", avgWaitTime)
+	var rec *recorder.Recorder
+	if *_recordFile != "" || *_reportFile != "" {
+		rec = recorder.New(sim.Pool, sim.WaitingRoom, *_recordEvery, sc.Unit())
+		rec.Start()
+	}
+
+	result := sim.Run()
+
+	if tracer != nil {
+		tracer.Flush()
+		if err := tracer.Err(); err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		if lost := tracer.Lost(); lost > 0 {
+			fmt.Printf("The spans of %v requests have been lost since the exporter could not keep up\n", lost)
+		}
+	}
+
+	var samples []recorder.Sample
+	if rec != nil {
+		samples = rec.Stop()
+	}
+	if *_recordFile != "" {
+		if err := recorder.WriteFile(*_recordFile, samples); err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+	}
+
+	fmt.Printf("Average idle time for a worker: %v\n", result.AvgIdleTime)
+	fmt.Printf("Average wait time for a request: %v\n", result.AvgWaitTime)
+	fmt.Printf("Wait time percentiles - %v\n", result.WaitTimes.Summary())
+	fmt.Printf("Processing time percentiles - %v\n", result.ProcTimes.Summary())
+	fmt.Printf("End to end time percentiles - %v\n", result.EndToEndTimes.Summary())
+	fmt.Printf("Number of requests failed: %v\n", result.Failed)
+
+	if *_reportFile != "" {
+		runs := []report.Run{{Name: "no drop", Result: result, Samples: samples}}
+		r := report.ForRuns("Worker pool without drop pattern", runs, sim.HaltWindows(), sc.Unit())
+		if err := report.WriteFile(*_reportFile, r); err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		fmt.Printf("Report written to %v\n", *_reportFile)
+	}
 }
 
 func workerPoolWithoutDropPattern(
@@ -41,35 +210,39 @@ func workerPoolWithoutDropPattern(
 	numReq int,
 	haltPoolTime int,
 	haltPoolDuration int) (idleTime time.Duration, waitTime time.Duration) {
+	pool, inPoolCh := newPool(poolSize, reqInterval, procTime, numReq, haltPoolTime, haltPoolDuration)
 
-	fmt.Println("Start processing requests")
-	fmt.Print("\n")
+	idleTime, waitTime = _workerPoolWithoutDropPattern(pool, inPoolCh, numReq, reqInterval)
+	return
+}
 
+func newPool(
+	poolSize int,
+	reqInterval int,
+	procTime int,
+	numReq int,
+	haltPoolTime int,
+	haltPoolDuration int) (*workerpool.WorkerPool, chan request.Request) {
 	// the channel that provides requests to the pool has a buffer equal to the number of requests
 	// this makes sure that the requests can come in at the same rythm even if the pool is halted
 	inPoolCh := make(chan request.Request, numReq)
 
 	pool := workerpool.NewWorkerPool(inPoolCh, poolSize, reqInterval, procTime, numReq, haltPoolTime, haltPoolDuration, timeUnit)
+	return pool, inPoolCh
+}
 
-	// start the worker pool
-	pool.Start()
-
-	// we simulate a stream of incoming requests
-	for i := 0; i < numReq; i++ {
-		// interval between each incoming request
-		var intervalBetweenRequests = time.Duration(reqInterval) * timeUnit
-		time.Sleep(time.Duration(intervalBetweenRequests))
-		req := request.Request{Param: i, Created: time.Now(), WaitDuration: 0}
-
-		inPoolCh <- req
+func _workerPoolWithoutDropPattern(
+	pool *workerpool.WorkerPool,
+	inPoolCh chan request.Request,
+	numReq int,
+	reqInterval int) (idleTime time.Duration, waitTime time.Duration) {
 
-		fmt.Printf("Sent %v\n", req.Param)
-	}
+	fmt.Println("Start processing requests")
+	fmt.Print("\n")
 
-	// when there are no more requests that can enter the pool we can stop the pool
-	pool.Stop()
+	result := simulation.RunNoDrop(pool, inPoolCh, numReq, arrival.FixedInterval(reqInterval), nil)
 
-	idleTime = pool.AvgWorkerIdleTime()
-	waitTime = pool.AvgRequestWaitTime(numReq)
+	idleTime = result.AvgIdleTime
+	waitTime = result.AvgWaitTime
 	return
 }
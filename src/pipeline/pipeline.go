@@ -0,0 +1,286 @@
+package pipeline
+
+import (
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/EnricoPicci/drop-pattern-with-timeout/src/histogram"
+	"github.com/EnricoPicci/drop-pattern-with-timeout/src/request"
+	"github.com/EnricoPicci/drop-pattern-with-timeout/src/waitingroom"
+	"github.com/EnricoPicci/drop-pattern-with-timeout/src/workerpool"
+)
+
+// StageConfig is the configuration of a stage of a pipeline - the times are expressed in time units
+type StageConfig struct {
+	Name     string `yaml:"name"`
+	Workers  int    `yaml:"workers"`
+	ProcTime int    `yaml:"procTime"`
+	Timeout  int    `yaml:"timeout"`
+	// the share of the budget left which the stage can use, relative to the shares of the stages which follow - 0 means 1
+	Share float64 `yaml:"share"`
+}
+
+// Stage is a waiting room in front of a pool of workers - the requests processed by the pool are let in the waiting room of
+// the next stage
+type Stage struct {
+	Name        string
+	Pool        *workerpool.WorkerPool
+	WaitingRoom *waitingroom.WaitingRoom
+	share       float64
+	// the distributions of the time spent by the requests in the waiting room of the stage, until they have been sent to the
+	// pool or dropped, and of the time spent by the workers processing them
+	waitTimes *histogram.Histogram
+	procTimes *histogram.Histogram
+}
+
+// WaitTimes returns the distribution of the time spent by the requests in the waiting room of the stage
+func (s *Stage) WaitTimes() *histogram.Histogram {
+	return s.waitTimes
+}
+
+// ProcTimes returns the distribution of the time spent by the workers of the stage processing the requests
+func (s *Stage) ProcTimes() *histogram.Histogram {
+	return s.procTimes
+}
+
+// Pipeline is a chain of stages, each with the drop pattern: a request waits in the waiting room of each stage up to the timeout
+// of the stage, or up to its share of the end to end budget if it comes first, and is dropped by the stage where it waits too
+// long. The events of the waiting rooms and of the pools of the stages can be set before the pipeline is started.
+type Pipeline struct {
+	Stages   []*Stage
+	budget   int
+	timeUnit time.Duration
+
+	// the requests in the pipeline
+	wg sync.WaitGroup
+
+	mu        sync.Mutex
+	submitted int
+	completed int
+	failed    int
+	// the number of requests completed after their end to end deadline
+	late int
+	// the number of requests dropped by each stage
+	dropped map[string]int
+	// the distribution of the time from the creation of the requests completed to the end of their processing in the last stage
+	endToEndTimes *histogram.Histogram
+}
+
+// New returns a pipeline with the stages configured. If the budget is greater than 0 a request must go through all the stages
+// within the budget from its creation, unless it carries its own end to end deadline.
+func New(configs []StageConfig, budget int, timeUnit time.Duration) (*Pipeline, error) {
+	if len(configs) == 0 {
+		return nil, fmt.Errorf("a pipeline must have at least one stage")
+	}
+	if budget < 0 {
+		return nil, fmt.Errorf("the budget can not be negative - found %v", budget)
+	}
+	p := Pipeline{
+		budget:        budget,
+		timeUnit:      timeUnit,
+		dropped:       make(map[string]int),
+		endToEndTimes: histogram.New(),
+	}
+	for _, c := range configs {
+		if c.Name == "" {
+			return nil, fmt.Errorf("the stages of a pipeline must have a name")
+		}
+		if _, ok := p.dropped[c.Name]; ok {
+			return nil, fmt.Errorf("the stage %v is defined more than once", c.Name)
+		}
+		if c.Workers <= 0 {
+			return nil, fmt.Errorf("stage %v: the number of workers must be greater than 0 - found %v", c.Name, c.Workers)
+		}
+		if c.Timeout <= 0 {
+			return nil, fmt.Errorf("stage %v: the timeout must be greater than 0 - found %v", c.Name, c.Timeout)
+		}
+		if c.ProcTime < 0 || c.Share < 0 {
+			return nil, fmt.Errorf("stage %v: the processing time and the share can not be negative", c.Name)
+		}
+		share := c.Share
+		if share == 0 {
+			share = 1
+		}
+		// the channel that provides requests to the pool is unbuffered - this is mandatory for the drop pattern to work
+		inPoolCh := make(chan request.Request)
+		stage := Stage{
+			Name:        c.Name,
+			Pool:        workerpool.NewWorkerPool(inPoolCh, c.Workers, 0, c.ProcTime, 0, 0, 0, timeUnit),
+			WaitingRoom: waitingroom.New(make(chan request.Request), inPoolCh, c.Timeout, timeUnit),
+			share:       share,
+			waitTimes:   histogram.New(),
+			procTimes:   histogram.New(),
+		}
+		p.Stages = append(p.Stages, &stage)
+		p.dropped[c.Name] = 0
+	}
+	return &p, nil
+}
+
+// Start starts the pools and opens the waiting rooms of the stages
+func (p *Pipeline) Start() {
+	for _, s := range p.Stages {
+		s.Pool.Start()
+		s.WaitingRoom.Open()
+	}
+}
+
+// Stop waits until the requests in the pipeline have been completed or dropped and stops the stages
+func (p *Pipeline) Stop() {
+	p.wg.Wait()
+	for _, s := range p.Stages {
+		s.WaitingRoom.Close()
+		s.Pool.Stop()
+	}
+}
+
+// Submit lets a request in the first stage - the request goes through the stages in its own goroutine and is notified on its
+// Done channel, if any, when it has been completed by the last stage, has failed or has been dropped. It can be passed as the
+// submit function of an arrival generator.
+func (p *Pipeline) Submit(req request.Request) {
+	p.mu.Lock()
+	p.submitted++
+	p.mu.Unlock()
+	p.wg.Add(1)
+	go p.run(req)
+}
+
+// carries the request through the stages
+func (p *Pipeline) run(req request.Request) {
+	defer p.wg.Done()
+	if req.Created.IsZero() {
+		req.Created = time.Now()
+	}
+	// the deadline set by the client, if any, is the end to end deadline
+	if req.EndToEndDeadline.IsZero() {
+		req.EndToEndDeadline = req.Deadline
+	}
+	if p.budget > 0 {
+		budget := req.Created.Add(time.Duration(p.budget) * p.timeUnit)
+		if req.EndToEndDeadline.IsZero() || budget.Before(req.EndToEndDeadline) {
+			req.EndToEndDeadline = budget
+		}
+	}
+	notify := req.Done
+	done := make(chan request.Request, 1)
+	var stage *Stage
+	for i, s := range p.Stages {
+		stage = s
+		req.Done = done
+		// if the budget has been used up by the stages before, the deadline has passed and the waiting room drops the request
+		// as soon as it is let in, with the reason deadline
+		req.Deadline = p.stageDeadline(i, req.EndToEndDeadline)
+		// the timeline of the request is the one of the stage
+		req.DispatchedAt, req.StartedAt, req.CompletedAt = time.Time{}, time.Time{}, time.Time{}
+		s.WaitingRoom.LetIn(req)
+		req = <-done
+		s.waitTimes.Record(req.WaitingRoomTime())
+		if !req.Dropped {
+			s.procTimes.Record(req.ProcessingTime())
+		}
+		if req.Dropped || req.Failed {
+			break
+		}
+	}
+
+	p.mu.Lock()
+	switch {
+	case req.Dropped:
+		p.dropped[stage.Name]++
+	case req.Failed:
+		p.failed++
+	default:
+		p.completed++
+		p.endToEndTimes.Record(req.CompletedAt.Sub(req.Created))
+		if !req.EndToEndDeadline.IsZero() && req.CompletedAt.After(req.EndToEndDeadline) {
+			p.late++
+		}
+	}
+	p.mu.Unlock()
+	req.Done = notify
+	req.Deadline = req.EndToEndDeadline
+	req.Notify()
+}
+
+// returns the deadline of the i-th stage: the share of the stage of the budget left until the end to end deadline, so that
+// the stages which follow keep their own shares - zero if there is no end to end deadline
+func (p *Pipeline) stageDeadline(i int, endToEnd time.Time) time.Time {
+	if endToEnd.IsZero() {
+		return endToEnd
+	}
+	shares := 0.0
+	for _, s := range p.Stages[i:] {
+		shares += s.share
+	}
+	left := time.Until(endToEnd)
+	if left <= 0 {
+		return endToEnd
+	}
+	return time.Now().Add(time.Duration(float64(left) * p.Stages[i].share / shares))
+}
+
+// Submitted returns the number of requests submitted to the pipeline
+func (p *Pipeline) Submitted() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.submitted
+}
+
+// Completed returns the number of requests processed by all the stages
+func (p *Pipeline) Completed() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.completed
+}
+
+// Failed returns the number of requests whose processing has failed in one of the stages
+func (p *Pipeline) Failed() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.failed
+}
+
+// Late returns the number of requests completed after their end to end deadline, since the last stage has taken them in in
+// time but their processing has taken longer
+func (p *Pipeline) Late() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.late
+}
+
+// DroppedByStage returns the number of requests dropped by each stage
+func (p *Pipeline) DroppedByStage() map[string]int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	dropped := make(map[string]int, len(p.dropped))
+	for name, n := range p.dropped {
+		dropped[name] = n
+	}
+	return dropped
+}
+
+// EndToEndTimes returns the distribution of the time from the creation of the requests completed to the end of their
+// processing in the last stage
+func (p *Pipeline) EndToEndTimes() *histogram.Histogram {
+	return p.endToEndTimes
+}
+
+// Summary prints the metrics of each stage and the end to end latency of the requests completed
+func (p *Pipeline) Summary(w io.Writer) {
+	dropped := p.DroppedByStage()
+	for _, s := range p.Stages {
+		fmt.Fprintf(w, "Stage %v\n", s.Name)
+		fmt.Fprintf(w, "  Number of requests let in: %v\n", s.WaitingRoom.Admitted())
+		fmt.Fprintf(w, "  Number of requests dropped: %v %v\n", dropped[s.Name], s.WaitingRoom.DroppedByReason())
+		fmt.Fprintf(w, "  Number of requests processed: %v\n", s.Pool.Completed())
+		fmt.Fprintf(w, "  Waiting room time percentiles - %v\n", s.WaitTimes().Summary())
+		fmt.Fprintf(w, "  Processing time percentiles - %v\n", s.ProcTimes().Summary())
+	}
+	fmt.Fprintf(w, "Number of requests submitted: %v\n", p.Submitted())
+	fmt.Fprintf(w, "Number of requests completed: %v\n", p.Completed())
+	fmt.Fprintf(w, "Number of requests completed after their deadline: %v\n", p.Late())
+	fmt.Fprintf(w, "Number of requests failed: %v\n", p.Failed())
+	fmt.Fprintf(w, "End to end latency percentiles of the requests completed - %v\n", p.endToEndTimes.Summary())
+}
@@ -0,0 +1,189 @@
+package pipeline
+
+import (
+	"testing"
+	"time"
+
+	"github.com/EnricoPicci/drop-pattern-with-timeout/src/request"
+	"github.com/EnricoPicci/drop-pattern-with-timeout/src/waitingroom"
+)
+
+var timeUnit = time.Millisecond
+
+// submits n requests at the same time and returns the requests notified at the end of the pipeline
+func submit(p *Pipeline, n int) []request.Request {
+	done := make(chan request.Request, n)
+	for i := 0; i < n; i++ {
+		req := request.New(i)
+		req.Done = done
+		p.Submit(req)
+	}
+	p.Stop()
+	close(done)
+	reqs := make([]request.Request, 0, n)
+	for req := range done {
+		reqs = append(reqs, req)
+	}
+	return reqs
+}
+
+func TestAllStagesCompleted(t *testing.T) {
+	p, err := New([]StageConfig{
+		{Name: "parse", Workers: 4, ProcTime: 5, Timeout: 1000},
+		{Name: "enrich", Workers: 2, ProcTime: 10, Timeout: 1000},
+		{Name: "store", Workers: 4, ProcTime: 5, Timeout: 1000},
+	}, 0, timeUnit)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.Start()
+	reqs := submit(p, 20)
+
+	if len(reqs) != 20 || p.Completed() != 20 || p.EndToEndTimes().Count() != 20 {
+		t.Errorf("Expected 20 requests completed - found %v notified and %v completed", len(reqs), p.Completed())
+	}
+	for _, s := range p.Stages {
+		if s.Pool.Completed() != 20 || s.ProcTimes().Count() != 20 || s.WaitingRoom.Dropped() != 0 {
+			t.Errorf("All the requests should have been processed by the stage %v - found %v", s.Name, s.Pool.Completed())
+		}
+	}
+	// the slowest stage processes 20 requests with 2 workers in 100ms
+	if min := 100 * time.Millisecond; p.EndToEndTimes().Max() < min {
+		t.Errorf("The slowest request should have taken at least %v - found %v", min, p.EndToEndTimes().Max())
+	}
+	for _, req := range reqs {
+		if req.Dropped || req.Failed || req.CompletedAt.IsZero() {
+			t.Errorf("The request %v should have been completed: %+v", req.ID, req)
+		}
+	}
+}
+
+func TestDropsAttributedToStage(t *testing.T) {
+	p, err := New([]StageConfig{
+		{Name: "fast", Workers: 10, ProcTime: 1, Timeout: 100},
+		{Name: "slow", Workers: 1, ProcTime: 50, Timeout: 20},
+	}, 0, timeUnit)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.Start()
+	reqs := submit(p, 10)
+
+	dropped := p.DroppedByStage()
+	if dropped["fast"] != 0 || dropped["slow"] == 0 || p.Completed()+dropped["slow"] != 10 || len(reqs) != 10 {
+		t.Errorf("Expected the requests dropped by the slow stage only - found %v and %v completed", dropped, p.Completed())
+	}
+	if n := p.Stages[1].WaitingRoom.DroppedByReason()[waitingroom.DropTimeout]; n != dropped["slow"] {
+		t.Errorf("Expected %v requests dropped by the timeout of the slow stage - found %v", dropped["slow"], n)
+	}
+	if p.Stages[1].WaitTimes().Count() != 10 {
+		t.Errorf("The time in the waiting room of the slow stage should have been recorded for 10 requests - found %v", p.Stages[1].WaitTimes().Count())
+	}
+}
+
+// with a budget of 100ms split 1 to 3, a request has to leave the first stage within 25ms
+func TestBudgetSplitAcrossStages(t *testing.T) {
+	p, err := New([]StageConfig{
+		{Name: "first", Workers: 1, ProcTime: 40, Timeout: 1000, Share: 1},
+		{Name: "second", Workers: 10, ProcTime: 80, Timeout: 1000, Share: 3},
+	}, 100, timeUnit)
+	if err != nil {
+		t.Fatal(err)
+	}
+	deadline := p.stageDeadline(0, time.Now().Add(100*time.Millisecond))
+	if d := time.Until(deadline); d > 25*time.Millisecond || d < 20*time.Millisecond {
+		t.Errorf("The first stage should have 25ms of the budget - found %v", d)
+	}
+	p.Start()
+	reqs := submit(p, 3)
+
+	dropped := p.DroppedByStage()
+	if p.Completed() != 1 || dropped["first"] != 2 {
+		t.Errorf("Expected 1 request completed and 2 dropped by the first stage - found %v and %v", p.Completed(), dropped)
+	}
+	if n := p.Stages[0].WaitingRoom.DroppedByReason()[waitingroom.DropDeadline]; n != 2 {
+		t.Errorf("Expected 2 requests dropped at their deadline - found %v", n)
+	}
+	// the second stage has taken in the request in time but its processing has gone beyond the budget
+	if p.Late() != 1 {
+		t.Errorf("Expected 1 request completed after its deadline - found %v", p.Late())
+	}
+	for _, req := range reqs {
+		if req.Deadline != req.EndToEndDeadline || req.EndToEndDeadline.Sub(req.Created) != 100*time.Millisecond {
+			t.Errorf("The request should carry the end to end deadline - found %v", req.Deadline.Sub(req.Created))
+		}
+	}
+}
+
+// the first stage uses up the budget, so the request is dropped by the waiting room of the second one as soon as it is let in
+func TestBudgetExpiredBetweenStages(t *testing.T) {
+	p, err := New([]StageConfig{
+		{Name: "slow", Workers: 1, ProcTime: 40, Timeout: 100},
+		{Name: "store", Workers: 1, ProcTime: 5, Timeout: 100},
+	}, 20, timeUnit)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.Start()
+	reqs := submit(p, 1)
+
+	if !reqs[0].Dropped || reqs[0].DroppedAt.Before(reqs[0].EndToEndDeadline) {
+		t.Errorf("The request should have been dropped after its end to end deadline - found %+v", reqs[0])
+	}
+	store := p.Stages[1].WaitingRoom
+	if p.DroppedByStage()["store"] != 1 || p.Stages[0].Pool.Completed() != 1 || store.DroppedByReason()[waitingroom.DropDeadline] != 1 {
+		t.Errorf("The request should have been dropped by the second stage for the deadline - found %v", p.DroppedByStage())
+	}
+	if store.SentToPool() != 0 || p.Stages[1].Pool.Completed() != 0 {
+		t.Errorf("The request should not have been sent to the pool of the second stage")
+	}
+}
+
+// the drops of each stage are the drops of its waiting room, and every request let in a stage is either sent to its pool or
+// dropped
+func TestDropsReconcileWithWaitingRooms(t *testing.T) {
+	p, err := New([]StageConfig{
+		{Name: "parse", Workers: 2, ProcTime: 10, Timeout: 30},
+		{Name: "enrich", Workers: 1, ProcTime: 20, Timeout: 1000},
+		{Name: "store", Workers: 2, ProcTime: 5, Timeout: 1000},
+	}, 60, timeUnit)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.Start()
+	reqs := submit(p, 12)
+
+	dropped := p.DroppedByStage()
+	total := 0
+	for _, s := range p.Stages {
+		wr := s.WaitingRoom
+		byReason := 0
+		for _, n := range wr.DroppedByReason() {
+			byReason += n
+		}
+		if dropped[s.Name] != wr.Dropped() || byReason != wr.Dropped() || wr.Admitted() != wr.SentToPool()+wr.Dropped() {
+			t.Errorf("Stage %v: %v requests dropped by the pipeline, %v by the waiting room (%v) and %v let in of which %v sent to the pool",
+				s.Name, dropped[s.Name], wr.Dropped(), wr.DroppedByReason(), wr.Admitted(), wr.SentToPool())
+		}
+		total += dropped[s.Name]
+	}
+	if total == 0 || total+p.Completed()+p.Failed() != len(reqs) {
+		t.Errorf("Expected some of the %v requests dropped and the others completed - found %v dropped and %v completed", len(reqs), total, p.Completed())
+	}
+}
+
+func TestInvalidStages(t *testing.T) {
+	configs := [][]StageConfig{
+		{},
+		{{Name: "a", Workers: 0, Timeout: 100}},
+		{{Name: "", Workers: 1, Timeout: 100}},
+		{{Name: "a", Workers: 1, Timeout: 100}, {Name: "a", Workers: 1, Timeout: 100}},
+		{{Name: "a", Workers: 1, Timeout: 100, Share: -1}},
+		{{Name: "a", Workers: 1}},
+	}
+	for _, c := range configs {
+		if _, err := New(c, 0, timeUnit); err == nil {
+			t.Errorf("The stages %v should not be valid", c)
+		}
+	}
+}
@@ -0,0 +1,187 @@
+package queue
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/EnricoPicci/drop-pattern-with-timeout/src/middleware"
+)
+
+// the reason of the messages moved to the dead letter queue since they have been dropped by the waiting room
+const ReasonDropped = "dropped"
+
+// Config is the configuration of a consumer
+type Config struct {
+	// the number of workers which process the messages and the time a message waits for a worker before being dropped - a
+	// message also waits at most until its visibility timeout, after which it would be delivered again anyway
+	middleware.Config `yaml:",inline"`
+	// the number of messages which can wait in the waiting room: the consumer stops pulling messages while it is full - the
+	// default is the number of workers
+	MaxWaiting int `yaml:"maxWaiting"`
+	// if true a message dropped is moved to the dead letter queue, otherwise it is negatively acknowledged, so that it is
+	// delivered again, e.g. when the load is lower
+	DeadLetterOnDrop bool `yaml:"deadLetterOnDrop"`
+}
+
+// Validate returns an error if the configuration is not valid
+func (c Config) Validate() error {
+	if c.MaxWaiting < 0 {
+		return fmt.Errorf("the max waiting must not be negative - found %v", c.MaxWaiting)
+	}
+	return c.Config.Validate()
+}
+
+// Handler processes a message - the context is done when the visibility timeout of the message expires. A message whose
+// handler returns an error is negatively acknowledged.
+type Handler func(ctx context.Context, msg Message) error
+
+// Consumer pulls the messages from a broker and processes them through the drop pattern: each message waits in a waiting room
+// for a worker of a bounded pool and, if no worker takes it in in time, is dropped. A message processed is acknowledged, a
+// message whose processing fails is negatively acknowledged and a message dropped is negatively acknowledged or moved to the
+// dead letter queue. The consumer has to be closed, after Run has returned, to stop its workers.
+type Consumer struct {
+	*middleware.Gate
+	broker     Broker
+	handler    Handler
+	deadLetter bool
+	// holds a token for each message waiting in the waiting room
+	slots chan struct{}
+
+	mu           sync.Mutex
+	acked        int
+	nacked       int
+	deadLettered int
+	// the first error returned by the broker when a message is acknowledged
+	err error
+}
+
+// New returns a consumer of the messages of the broker with the concurrency and the timeout of the configuration and starts
+// its workers
+func New(broker Broker, handler Handler, config Config) (*Consumer, error) {
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
+	gate, err := middleware.NewGate(config.Config)
+	if err != nil {
+		return nil, err
+	}
+	maxWaiting := config.MaxWaiting
+	if maxWaiting == 0 {
+		maxWaiting = config.Workers
+	}
+	c := Consumer{
+		Gate:       gate,
+		broker:     broker,
+		handler:    handler,
+		deadLetter: config.DeadLetterOnDrop,
+		slots:      make(chan struct{}, maxWaiting),
+	}
+	return &c, nil
+}
+
+// Run pulls the messages until the context is done or the broker is closed, and returns when all the messages pulled have
+// been processed or dropped. It returns the error of the broker if the messages can not be received.
+func (c *Consumer) Run(ctx context.Context) error {
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	for {
+		// the messages are pulled only while there is room for them in the waiting room
+		select {
+		case c.slots <- struct{}{}:
+		case <-ctx.Done():
+			return nil
+		}
+		msg, err := c.broker.Receive(ctx)
+		if err != nil {
+			<-c.slots
+			if ctx.Err() != nil || errors.Is(err, ErrClosed) {
+				return nil
+			}
+			return err
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			c.process(msg)
+		}()
+	}
+}
+
+// lets the message in the waiting room and acknowledges it according to the outcome
+func (c *Consumer) process(msg Message) {
+	var once sync.Once
+	// the slot is released when the message leaves the waiting room, i.e. when a worker takes it in or it is dropped
+	release := func() {
+		once.Do(func() { <-c.slots })
+	}
+	ctx := context.Background()
+	if !msg.VisibleAt.IsZero() {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithDeadline(ctx, msg.VisibleAt)
+		defer cancel()
+	}
+	var err error
+	outcome := c.Admit(ctx, msg.TraceParent, func() {
+		release()
+		defer func() {
+			if p := recover(); p != nil {
+				err = fmt.Errorf("panic processing message %v: %v", msg.ID, p)
+			}
+		}()
+		err = c.handler(ctx, msg)
+	})
+	release()
+
+	switch {
+	case outcome == middleware.Executed && err == nil:
+		c.settle(c.broker.Ack(msg), &c.acked)
+	case outcome == middleware.Dropped && c.deadLetter:
+		c.settle(c.broker.DeadLetter(msg, ReasonDropped), &c.deadLettered)
+	default:
+		// the message has failed, has been dropped or has expired before a worker has taken it in, or the consumer is closed
+		c.settle(c.broker.Nack(msg), &c.nacked)
+	}
+}
+
+func (c *Consumer) settle(err error, count *int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err != nil {
+		if c.err == nil {
+			c.err = err
+		}
+		return
+	}
+	*count++
+}
+
+// Acked returns the number of messages processed and acknowledged
+func (c *Consumer) Acked() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.acked
+}
+
+// Nacked returns the number of messages negatively acknowledged, since their processing has failed or they have been dropped
+func (c *Consumer) Nacked() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.nacked
+}
+
+// DeadLettered returns the number of messages dropped and moved to the dead letter queue
+func (c *Consumer) DeadLettered() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.deadLettered
+}
+
+// Err returns the first error returned by the broker when a message has been acknowledged, e.g. ErrStaleReceipt if the
+// message has been processed after its visibility timeout
+func (c *Consumer) Err() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.err
+}
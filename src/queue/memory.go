@@ -0,0 +1,218 @@
+package queue
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/EnricoPicci/drop-pattern-with-timeout/src/request"
+)
+
+// the reason of the messages moved to the dead letter queue after too many deliveries
+const ReasonMaxReceives = "max receives"
+
+// DeadLetter is a message moved to the dead letter queue, with the reason
+type DeadLetter struct {
+	Message Message
+	Reason  string
+}
+
+// Memory is an in-memory broker, e.g. for tests and simulations
+type Memory struct {
+	// the time a message received stays hidden if it is not acknowledged - it has to be set before the broker is used
+	VisibilityTimeout time.Duration
+	// the number of deliveries after which a message not acknowledged is moved to the dead letter queue - 0 means no limit
+	MaxReceives int
+
+	mu sync.Mutex
+	// the messages visible, in the order they are delivered
+	visible []Message
+	// the messages received and not yet acknowledged, by receipt
+	inFlight map[string]Message
+	// the messages moved to the dead letter queue
+	deadLetters []DeadLetter
+	receipts    int
+	closed      bool
+	// closed, and replaced, when a message becomes visible or the broker is closed, to wake up the receivers
+	wake chan struct{}
+}
+
+// NewMemory returns an in-memory broker with a visibility timeout of 30 seconds
+func NewMemory() *Memory {
+	m := Memory{
+		VisibilityTimeout: 30 * time.Second,
+		inFlight:          make(map[string]Message),
+		wake:              make(chan struct{}),
+	}
+	return &m
+}
+
+// Send adds a message to the queue and returns its id
+func (m *Memory) Send(body []byte, traceParent string) string {
+	msg := Message{ID: request.NewID(), Body: body, TraceParent: traceParent}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.visible = append(m.visible, msg)
+	m.signal()
+	return msg.ID
+}
+
+// Receive returns the first message visible, waiting for one until the context is done. The messages whose visibility timeout
+// has expired become visible again. When the broker is closed the messages left are not delivered any more.
+func (m *Memory) Receive(ctx context.Context) (Message, error) {
+	for {
+		m.mu.Lock()
+		if m.closed {
+			m.mu.Unlock()
+			return Message{}, ErrClosed
+		}
+		next := m.expire(time.Now())
+		if len(m.visible) > 0 {
+			msg := m.visible[0]
+			m.visible = m.visible[1:]
+			m.receipts++
+			msg.Receipt = fmt.Sprintf("%v-%v", msg.ID, m.receipts)
+			msg.Receives++
+			msg.VisibleAt = time.Now().Add(m.VisibilityTimeout)
+			m.inFlight[msg.Receipt] = msg
+			m.mu.Unlock()
+			return msg, nil
+		}
+		wake := m.wake
+		m.mu.Unlock()
+
+		// waits for a message to be sent or nacked, or for the visibility timeout of the first message in flight to expire
+		var timeout <-chan time.Time
+		var timer *time.Timer
+		if !next.IsZero() {
+			timer = time.NewTimer(time.Until(next))
+			timeout = timer.C
+		}
+		select {
+		case <-ctx.Done():
+		case <-wake:
+		case <-timeout:
+		}
+		if timer != nil {
+			timer.Stop()
+		}
+		if ctx.Err() != nil {
+			return Message{}, ctx.Err()
+		}
+	}
+}
+
+// Ack removes the message from the queue - it returns ErrStaleReceipt if the visibility timeout of the message has expired
+func (m *Memory) Ack(msg Message) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	_, err := m.take(msg)
+	return err
+}
+
+// Nack makes the message visible again, or moves it to the dead letter queue if it has been delivered MaxReceives times
+func (m *Memory) Nack(msg Message) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	msg, err := m.take(msg)
+	if err != nil {
+		return err
+	}
+	m.requeue(msg)
+	return nil
+}
+
+// DeadLetter moves the message to the dead letter queue
+func (m *Memory) DeadLetter(msg Message, reason string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	msg, err := m.take(msg)
+	if err != nil {
+		return err
+	}
+	m.deadLetters = append(m.deadLetters, DeadLetter{Message: msg, Reason: reason})
+	return nil
+}
+
+// Close stops the delivery of the messages: the receivers waiting, and the ones which come later, get ErrClosed
+func (m *Memory) Close() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.closed {
+		return
+	}
+	m.closed = true
+	m.signal()
+}
+
+// Len returns the number of messages visible, i.e. waiting to be delivered
+func (m *Memory) Len() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.expire(time.Now())
+	return len(m.visible)
+}
+
+// InFlight returns the number of messages delivered and not yet acknowledged
+func (m *Memory) InFlight() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.expire(time.Now())
+	return len(m.inFlight)
+}
+
+// DeadLetters returns the messages moved to the dead letter queue
+func (m *Memory) DeadLetters() []DeadLetter {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	deadLetters := make([]DeadLetter, len(m.deadLetters))
+	copy(deadLetters, m.deadLetters)
+	return deadLetters
+}
+
+// removes a message in flight - the caller holds the lock
+func (m *Memory) take(msg Message) (Message, error) {
+	m.expire(time.Now())
+	inFlight, ok := m.inFlight[msg.Receipt]
+	if !ok {
+		return msg, fmt.Errorf("message %v: %w", msg.ID, ErrStaleReceipt)
+	}
+	delete(m.inFlight, msg.Receipt)
+	return inFlight, nil
+}
+
+// makes visible again the messages whose visibility timeout has expired and returns when the next one expires, zero if no
+// message is in flight - the caller holds the lock
+func (m *Memory) expire(now time.Time) time.Time {
+	var next time.Time
+	for receipt, msg := range m.inFlight {
+		if !now.Before(msg.VisibleAt) {
+			delete(m.inFlight, receipt)
+			m.requeue(msg)
+			continue
+		}
+		if next.IsZero() || msg.VisibleAt.Before(next) {
+			next = msg.VisibleAt
+		}
+	}
+	return next
+}
+
+// the caller holds the lock
+func (m *Memory) requeue(msg Message) {
+	if m.MaxReceives > 0 && msg.Receives >= m.MaxReceives {
+		m.deadLetters = append(m.deadLetters, DeadLetter{Message: msg, Reason: ReasonMaxReceives})
+		return
+	}
+	msg.Receipt = ""
+	msg.VisibleAt = time.Time{}
+	m.visible = append(m.visible, msg)
+	m.signal()
+}
+
+// wakes up the receivers waiting - the caller holds the lock
+func (m *Memory) signal() {
+	close(m.wake)
+	m.wake = make(chan struct{})
+}
@@ -0,0 +1,43 @@
+package queue
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+// ErrClosed is the error returned by Receive when the broker has been closed and no more messages will be delivered
+var ErrClosed = errors.New("broker closed")
+
+// ErrStaleReceipt is the error returned when a message is acknowledged after its visibility timeout, when it may have been
+// delivered again to another consumer
+var ErrStaleReceipt = errors.New("stale receipt")
+
+// Message is a message delivered by a broker
+type Message struct {
+	ID   string
+	Body []byte
+	// the W3C trace context of the producer, if any
+	TraceParent string
+	// identifies this delivery of the message - a message delivered again has a new receipt
+	Receipt string
+	// the number of times the message has been delivered, including this one
+	Receives int
+	// the time when the message becomes visible again, and is delivered again, if it is not acknowledged - zero if the broker
+	// has no visibility timeout
+	VisibleAt time.Time
+}
+
+// Broker is a source of messages with the semantics of the visibility timeout: a message received is hidden from the other
+// consumers until it is acknowledged, negatively acknowledged or its visibility timeout expires, in which case it is delivered
+// again. It can be backed by a real queue, e.g. SQS, or by the in-memory broker of this package.
+type Broker interface {
+	// Receive waits for a message until the context is done - it returns ErrClosed when no more messages will be delivered
+	Receive(ctx context.Context) (Message, error)
+	// Ack removes a message processed from the queue
+	Ack(msg Message) error
+	// Nack makes a message visible again, so that it is delivered again
+	Nack(msg Message) error
+	// DeadLetter moves a message which will not be processed to the dead letter queue
+	DeadLetter(msg Message, reason string) error
+}
@@ -0,0 +1,166 @@
+package queue
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/EnricoPicci/drop-pattern-with-timeout/src/middleware"
+)
+
+func TestMemoryBroker(t *testing.T) {
+	broker := NewMemory()
+	broker.VisibilityTimeout = 20 * time.Millisecond
+	broker.MaxReceives = 2
+	id := broker.Send([]byte("hello"), "")
+	ctx := context.Background()
+
+	first, err := broker.Receive(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first.ID != id || string(first.Body) != "hello" || first.Receives != 1 || broker.InFlight() != 1 {
+		t.Errorf("Unexpected message received %+v", first)
+	}
+	// the visibility timeout expires and the message is delivered again
+	second, err := broker.Receive(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if second.ID != id || second.Receives != 2 || second.Receipt == first.Receipt {
+		t.Errorf("The message should have been delivered again - found %+v", second)
+	}
+	if err := broker.Ack(first); !errors.Is(err, ErrStaleReceipt) {
+		t.Errorf("The ack of the first delivery should fail with a stale receipt - found %v", err)
+	}
+	// after the second delivery the message is moved to the dead letter queue
+	if err := broker.Nack(second); err != nil {
+		t.Fatal(err)
+	}
+	if broker.Len() != 0 || len(broker.DeadLetters()) != 1 || broker.DeadLetters()[0].Reason != ReasonMaxReceives {
+		t.Errorf("The message should be in the dead letter queue - found %v", broker.DeadLetters())
+	}
+
+	timeout, cancel := context.WithTimeout(ctx, 10*time.Millisecond)
+	defer cancel()
+	if _, err := broker.Receive(timeout); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Receive on an empty queue should wait until the context is done - found %v", err)
+	}
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		broker.Close()
+	}()
+	if _, err := broker.Receive(ctx); err != ErrClosed {
+		t.Errorf("Receive should return ErrClosed when the broker is closed - found %v", err)
+	}
+}
+
+// runs the consumer until the condition is true and then closes the broker
+func runUntil(t *testing.T, consumer *Consumer, broker *Memory, condition func() bool) {
+	result := make(chan error)
+	go func() {
+		result <- consumer.Run(context.Background())
+	}()
+	deadline := time.Now().Add(5 * time.Second)
+	for !condition() && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	broker.Close()
+	if err := <-result; err != nil {
+		t.Error(err)
+	}
+	consumer.Close()
+}
+
+func TestConsumerStopsPullingWhileFull(t *testing.T) {
+	broker := NewMemory()
+	for i := 0; i < 30; i++ {
+		broker.Send([]byte(fmt.Sprint(i)), "")
+	}
+	// the handlers are blocked until the test checks how many messages have been pulled
+	unblock := make(chan struct{})
+	handler := func(ctx context.Context, msg Message) error {
+		<-unblock
+		return nil
+	}
+	consumer, err := New(broker, handler, Config{MaxWaiting: 2})
+	if err == nil {
+		t.Fatalf("A consumer without workers should not be valid")
+	}
+	consumer, err = New(broker, handler, Config{Config: middleware.Config{Workers: 3, Timeout: time.Second}, MaxWaiting: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		// the messages pulled are the ones taken in by the workers plus the ones waiting
+		time.Sleep(100 * time.Millisecond)
+		if broker.InFlight() != 5 || broker.Len() != 25 {
+			t.Errorf("Expected 5 messages pulled and 25 left in the queue - found %v and %v", broker.InFlight(), broker.Len())
+		}
+		close(unblock)
+	}()
+	runUntil(t, consumer, broker, func() bool { return consumer.Acked() == 30 })
+
+	if consumer.Acked() != 30 || consumer.Nacked() != 0 || consumer.Err() != nil {
+		t.Errorf("Expected 30 messages acked - found %v acked, %v nacked and error %v", consumer.Acked(), consumer.Nacked(), consumer.Err())
+	}
+	if broker.Len() != 0 || broker.InFlight() != 0 {
+		t.Errorf("The queue should be empty - found %v visible and %v in flight", broker.Len(), broker.InFlight())
+	}
+}
+
+func TestDroppedMovedToDeadLetters(t *testing.T) {
+	broker := NewMemory()
+	for i := 0; i < 10; i++ {
+		broker.Send([]byte(fmt.Sprint(i)), "")
+	}
+	handler := func(ctx context.Context, msg Message) error {
+		time.Sleep(50 * time.Millisecond)
+		return nil
+	}
+	consumer, err := New(broker, handler, Config{Config: middleware.Config{Workers: 1, Timeout: 10 * time.Millisecond}, MaxWaiting: 10, DeadLetterOnDrop: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	runUntil(t, consumer, broker, func() bool { return consumer.Acked()+consumer.DeadLettered() == 10 })
+
+	if consumer.DeadLettered() == 0 || consumer.Acked()+consumer.DeadLettered() != 10 {
+		t.Errorf("Expected some of the 10 messages dropped - found %v acked and %v dropped", consumer.Acked(), consumer.DeadLettered())
+	}
+	deadLetters := broker.DeadLetters()
+	if len(deadLetters) != consumer.DeadLettered() || deadLetters[0].Reason != ReasonDropped {
+		t.Errorf("The messages dropped should be in the dead letter queue - found %v", deadLetters)
+	}
+	if consumer.WaitingRoom.Dropped() != consumer.DeadLettered() {
+		t.Errorf("Expected %v messages dropped by the waiting room - found %v", consumer.DeadLettered(), consumer.WaitingRoom.Dropped())
+	}
+}
+
+// the messages failed and the ones dropped are delivered again and processed when the load is lower
+func TestNackedDeliveredAgain(t *testing.T) {
+	broker := NewMemory()
+	for i := 0; i < 10; i++ {
+		broker.Send([]byte(fmt.Sprint(i)), "")
+	}
+	handler := func(ctx context.Context, msg Message) error {
+		if string(msg.Body) == "0" && msg.Receives == 1 {
+			return errors.New("failed")
+		}
+		if string(msg.Body) == "1" && msg.Receives == 1 {
+			panic("failed")
+		}
+		time.Sleep(20 * time.Millisecond)
+		return nil
+	}
+	consumer, err := New(broker, handler, Config{Config: middleware.Config{Workers: 1, Timeout: 5 * time.Millisecond}, MaxWaiting: 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	runUntil(t, consumer, broker, func() bool { return consumer.Acked() == 10 })
+
+	if consumer.Acked() != 10 || consumer.Nacked() < 2 || consumer.DeadLettered() != 0 {
+		t.Errorf("Expected 10 messages acked, after at least 2 nacked - found %v acked and %v nacked", consumer.Acked(), consumer.Nacked())
+	}
+}
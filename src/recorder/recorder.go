@@ -0,0 +1,224 @@
+package recorder
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/EnricoPicci/drop-pattern-with-timeout/src/histogram"
+	"github.com/EnricoPicci/drop-pattern-with-timeout/src/waitingroom"
+	"github.com/EnricoPicci/drop-pattern-with-timeout/src/workerpool"
+)
+
+// Sample holds the state of a simulation at a certain time - times are expressed in time units
+type Sample struct {
+	// the time elapsed since the recorder has been started
+	Time float64 `json:"time"`
+	// the number of requests waiting to be taken in by a worker
+	QueueLength int `json:"queueLength"`
+	// the number of requests taken in by a worker and not yet completed
+	InFlight int `json:"inFlight"`
+	Busy     int `json:"busy"`
+	Idle     int `json:"idle"`
+	Halted   int `json:"halted"`
+	// the number of requests admitted, dropped and completed since the previous sample
+	Admitted  int `json:"admitted"`
+	Dropped   int `json:"dropped"`
+	Completed int `json:"completed"`
+	// the percentiles of the wait time of the requests completed in the rolling window
+	WaitP50 float64 `json:"waitP50"`
+	WaitP90 float64 `json:"waitP90"`
+	WaitP99 float64 `json:"waitP99"`
+}
+
+// Recorder samples the state of a worker pool, and of the waiting room in front of it, at regular intervals
+type Recorder struct {
+	pool *workerpool.WorkerPool
+	// nil if the requests are sent straight to the pool
+	waitingRoom *waitingroom.WaitingRoom
+	// the interval between two samples in time units
+	every    int
+	timeUnit time.Duration
+
+	// the number of samples over which the wait percentiles are calculated
+	Window int
+
+	muSamples sync.Mutex
+	samples   []Sample
+
+	start time.Time
+	done  chan struct{}
+	wg    sync.WaitGroup
+}
+
+// New returns a recorder which samples the pool, and the waiting room if not nil, every "every" time units
+func New(pool *workerpool.WorkerPool, waitingRoom *waitingroom.WaitingRoom, every int, timeUnit time.Duration) *Recorder {
+	r := Recorder{
+		pool:        pool,
+		waitingRoom: waitingRoom,
+		every:       every,
+		timeUnit:    timeUnit,
+		Window:      10,
+		samples:     make([]Sample, 0),
+		done:        make(chan struct{}),
+	}
+	return &r
+}
+
+// Start starts sampling - it should be called just before the simulation is run
+func (r *Recorder) Start() {
+	r.start = time.Now()
+	r.wg.Add(1)
+	go func() {
+		defer r.wg.Done()
+		ticker := time.NewTicker(time.Duration(r.every) * r.timeUnit)
+		defer ticker.Stop()
+
+		// the snapshots of the wait time histogram taken at each sample, used to calculate the percentiles of the rolling window
+		waitSnapshots := []*histogram.Histogram{r.pool.WaitTimes()}
+		var previous totals
+		for {
+			select {
+			case <-r.done:
+				return
+			case <-ticker.C:
+				current := r.totals()
+				waitTimes := r.pool.WaitTimes()
+				oldest := waitSnapshots[0]
+				waitSnapshots = append(waitSnapshots, waitTimes)
+				if len(waitSnapshots) > r.Window {
+					waitSnapshots = waitSnapshots[1:]
+				}
+				r.add(r.sample(current, previous, waitTimes.Since(oldest)))
+				previous = current
+			}
+		}
+	}()
+}
+
+// Stop stops sampling and returns the samples recorded
+func (r *Recorder) Stop() []Sample {
+	close(r.done)
+	r.wg.Wait()
+	return r.Samples()
+}
+
+// Samples returns the samples recorded so far - it can be called while the recorder is running
+func (r *Recorder) Samples() []Sample {
+	r.muSamples.Lock()
+	defer r.muSamples.Unlock()
+	samples := make([]Sample, len(r.samples))
+	copy(samples, r.samples)
+	return samples
+}
+
+func (r *Recorder) add(s Sample) {
+	r.muSamples.Lock()
+	r.samples = append(r.samples, s)
+	r.muSamples.Unlock()
+}
+
+// the counters, cumulated since the start, from which the rates are calculated
+type totals struct {
+	admitted  int
+	dropped   int
+	taken     int
+	completed int
+}
+
+func (r *Recorder) totals() totals {
+	t := totals{
+		taken:     r.pool.Taken(),
+		completed: r.pool.Completed(),
+		// the requests expired while being batched by the workers are dropped by the pool
+		dropped: r.pool.Dropped(),
+	}
+	if r.waitingRoom != nil {
+		t.admitted = r.waitingRoom.Admitted()
+		t.dropped = t.dropped + r.waitingRoom.Dropped()
+	} else {
+		// without waiting room all the requests sent are either in the input channel of the pool or have been taken in by a worker
+		t.admitted = t.taken + r.pool.QueueLength()
+	}
+	return t
+}
+
+func (r *Recorder) sample(current totals, previous totals, window *histogram.Histogram) Sample {
+	idle, busy, halted := r.pool.WorkerStates()
+	s := Sample{
+		Time:      r.toUnits(time.Since(r.start)),
+		InFlight:  current.taken - current.completed,
+		Busy:      busy,
+		Idle:      idle,
+		Halted:    halted,
+		Admitted:  current.admitted - previous.admitted,
+		Dropped:   current.dropped - previous.dropped,
+		Completed: current.completed - previous.completed,
+		WaitP50:   r.toUnits(window.Percentile(50)),
+		WaitP90:   r.toUnits(window.Percentile(90)),
+		WaitP99:   r.toUnits(window.Percentile(99)),
+	}
+	if r.waitingRoom != nil {
+		s.QueueLength = r.waitingRoom.Len()
+	} else {
+		s.QueueLength = r.pool.QueueLength()
+	}
+	return s
+}
+
+func (r *Recorder) toUnits(d time.Duration) float64 {
+	return float64(d) / float64(r.timeUnit)
+}
+
+// WriteCsv writes the samples as csv, with an header line
+func WriteCsv(w io.Writer, samples []Sample) error {
+	writer := csv.NewWriter(w)
+	header := []string{"time", "queueLength", "inFlight", "busy", "idle", "halted", "admitted", "dropped", "completed",
+		"waitP50", "waitP90", "waitP99"}
+	if err := writer.Write(header); err != nil {
+		return err
+	}
+	f := func(v float64) string {
+		return strconv.FormatFloat(v, 'f', 1, 64)
+	}
+	for _, s := range samples {
+		line := []string{f(s.Time), strconv.Itoa(s.QueueLength), strconv.Itoa(s.InFlight), strconv.Itoa(s.Busy),
+			strconv.Itoa(s.Idle), strconv.Itoa(s.Halted), strconv.Itoa(s.Admitted), strconv.Itoa(s.Dropped),
+			strconv.Itoa(s.Completed), f(s.WaitP50), f(s.WaitP90), f(s.WaitP99)}
+		if err := writer.Write(line); err != nil {
+			return err
+		}
+	}
+	writer.Flush()
+	return writer.Error()
+}
+
+// WriteJson writes the samples as a json array
+func WriteJson(w io.Writer, samples []Sample) error {
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(samples)
+}
+
+// WriteFile writes the samples to a json file, if the extension of the path is .json, or to a csv file otherwise
+func WriteFile(path string, samples []Sample) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if filepath.Ext(path) == ".json" {
+		err = WriteJson(f, samples)
+	} else {
+		err = WriteCsv(f, samples)
+	}
+	if err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
@@ -0,0 +1,75 @@
+package recorder
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/EnricoPicci/drop-pattern-with-timeout/src/request"
+	"github.com/EnricoPicci/drop-pattern-with-timeout/src/waitingroom"
+	"github.com/EnricoPicci/drop-pattern-with-timeout/src/workerpool"
+)
+
+// samples a pool with 2 workers, halted from 50ms to 150ms, which receives a request every 5ms - the requests wait up to 20ms
+func TestSamplesHaltAndDrops(t *testing.T) {
+	inPoolCh := make(chan request.Request)
+	pool := workerpool.NewWorkerPool(inPoolCh, 2, 5, 10, 0, 50, 100, time.Millisecond)
+	waitingRoom := waitingroom.New(make(chan request.Request), inPoolCh, 20, time.Millisecond)
+	r := New(pool, waitingRoom, 10, time.Millisecond)
+	pool.Start()
+	waitingRoom.Open()
+	r.Start()
+	numReq := 40
+	for i := 0; i < numReq; i++ {
+		waitingRoom.LetIn(request.Request{Param: i, Created: time.Now()})
+		time.Sleep(5 * time.Millisecond)
+	}
+	waitingRoom.Close()
+	pool.Stop()
+	// the last samples see the requests which have left the waiting room and the pool
+	time.Sleep(30 * time.Millisecond)
+	samples := r.Stop()
+
+	admitted, dropped, completed, maxHalted, maxQueue := 0, 0, 0, 0, 0
+	for _, s := range samples {
+		admitted += s.Admitted
+		dropped += s.Dropped
+		completed += s.Completed
+		if s.Halted > maxHalted {
+			maxHalted = s.Halted
+		}
+		if s.QueueLength > maxQueue {
+			maxQueue = s.QueueLength
+		}
+		if s.Busy+s.Idle+s.Halted != 2 {
+			t.Errorf("Each worker should be busy, idle or halted - found %+v", s)
+		}
+	}
+	if admitted != numReq || dropped != waitingRoom.Dropped() || completed != pool.Completed() {
+		t.Errorf("The samples should add up to %v requests admitted, %v dropped and %v completed - found %v, %v and %v",
+			numReq, waitingRoom.Dropped(), pool.Completed(), admitted, dropped, completed)
+	}
+	if dropped == 0 {
+		t.Errorf("Some requests should have been dropped during the halt")
+	}
+	// a worker is counted as halted only when it has taken in a request during the halt
+	if maxHalted != 2 {
+		t.Errorf("Both workers should have been sampled as halted - found at most %v", maxHalted)
+	}
+	if maxQueue == 0 {
+		t.Errorf("Some requests should have been sampled waiting during the halt")
+	}
+}
+
+func TestWriteCsv(t *testing.T) {
+	var buf bytes.Buffer
+	err := WriteCsv(&buf, []Sample{{Time: 10, QueueLength: 3, Busy: 2, Dropped: 1, WaitP50: 4.5}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 2 || lines[1] != "10.0,3,0,2,0,0,0,1,0,4.5,0.0,0.0" {
+		t.Errorf("Unexpected csv %q", buf.String())
+	}
+}
@@ -0,0 +1,249 @@
+package report
+
+import (
+	"fmt"
+	"html/template"
+	"io"
+	"math"
+	"os"
+	"strings"
+)
+
+// Style is the way the points of a series are drawn
+type Style string
+
+const (
+	// the points are joined by a line
+	Line Style = "line"
+	// each point is drawn as a small mark, e.g. to show events
+	Marks Style = "marks"
+	// each point is drawn as a vertical bar starting from 0
+	Bars Style = "bars"
+)
+
+// Series is a set of points, expressed as x and y, shown in a chart
+type Series struct {
+	Name   string
+	Style  Style
+	Points [][2]float64
+	// true if the line is dashed, e.g. to show a reference value
+	Dashed bool
+}
+
+// Band is an interval of the x axis highlighted in a chart, e.g. the time when the pool is halted
+type Band struct {
+	Label string
+	From  float64
+	To    float64
+}
+
+// Chart is a chart with one or more series sharing the same axes
+type Chart struct {
+	Title  string
+	XLabel string
+	YLabel string
+	Series []Series
+	Bands  []Band
+}
+
+// Report is an html page with some notes and a list of charts
+type Report struct {
+	Title  string
+	Notes  []string
+	Charts []Chart
+}
+
+// the colors of the series, in the order they are used
+var palette = []string{"#1f77b4", "#d62728", "#2ca02c", "#ff7f0e", "#9467bd", "#8c564b", "#e377c2", "#7f7f7f"}
+
+// the size of the charts and of the margins around the plot area
+const (
+	width        = 900
+	height       = 320
+	marginLeft   = 70
+	marginRight  = 20
+	marginTop    = 30
+	marginBottom = 50
+)
+
+var page = template.Must(template.New("report").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>{{.Title}}</title>
+<style>
+body { font-family: sans-serif; margin: 2em; color: #222; }
+h2 { font-size: 1.1em; margin-top: 2em; }
+svg { border: 1px solid #ddd; }
+svg text { font-size: 12px; }
+</style>
+</head>
+<body>
+<h1>{{.Title}}</h1>
+{{range .Notes}}<p>{{.}}</p>
+{{end}}
+{{range .Charts}}<h2>{{.Title}}</h2>
+{{.Svg}}
+{{end}}
+</body>
+</html>
+`))
+
+// Write writes the report as a self-contained html page, with the charts drawn as inline svg
+func Write(w io.Writer, r Report) error {
+	type chart struct {
+		Title string
+		Svg   template.HTML
+	}
+	charts := make([]chart, len(r.Charts))
+	for i, c := range r.Charts {
+		charts[i] = chart{Title: c.Title, Svg: template.HTML(c.svg())}
+	}
+	return page.Execute(w, struct {
+		Title  string
+		Notes  []string
+		Charts []chart
+	}{r.Title, r.Notes, charts})
+}
+
+// WriteFile writes the report to the file at path
+func WriteFile(path string, r Report) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if err := Write(f, r); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// returns the svg drawing of the chart
+func (c Chart) svg() string {
+	xMin, xMax, yMax := c.bounds()
+	plotWidth := float64(width - marginLeft - marginRight)
+	plotHeight := float64(height - marginTop - marginBottom)
+	x := func(v float64) float64 {
+		return marginLeft + (v-xMin)/(xMax-xMin)*plotWidth
+	}
+	y := func(v float64) float64 {
+		return marginTop + plotHeight - v/yMax*plotHeight
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, `<svg width="%d" height="%d" viewBox="0 0 %d %d">`, width, height, width, height)
+	b.WriteString("\n")
+
+	for _, band := range c.Bands {
+		from, to := math.Max(band.From, xMin), math.Min(band.To, xMax)
+		if to <= from {
+			continue
+		}
+		fmt.Fprintf(&b, `<rect x="%.1f" y="%d" width="%.1f" height="%.1f" fill="#f4cccc" fill-opacity="0.6"/>`,
+			x(from), marginTop, x(to)-x(from), plotHeight)
+		fmt.Fprintf(&b, `<text x="%.1f" y="%d" fill="#a00">%v</text>`+"\n", x(from)+3, marginTop+14, escape(band.Label))
+	}
+
+	// the axes with their ticks
+	for _, t := range ticks(0, yMax) {
+		fmt.Fprintf(&b, `<line x1="%d" y1="%.1f" x2="%d" y2="%.1f" stroke="#eee"/>`, marginLeft, y(t), width-marginRight, y(t))
+		fmt.Fprintf(&b, `<text x="%d" y="%.1f" text-anchor="end">%v</text>`+"\n", marginLeft-5, y(t)+4, format(t))
+	}
+	for _, t := range ticks(xMin, xMax) {
+		fmt.Fprintf(&b, `<text x="%.1f" y="%d" text-anchor="middle">%v</text>`+"\n", x(t), height-marginBottom+16, format(t))
+	}
+	fmt.Fprintf(&b, `<line x1="%d" y1="%d" x2="%d" y2="%d" stroke="#444"/>`, marginLeft, height-marginBottom, width-marginRight, height-marginBottom)
+	fmt.Fprintf(&b, `<line x1="%d" y1="%d" x2="%d" y2="%d" stroke="#444"/>`+"\n", marginLeft, marginTop, marginLeft, height-marginBottom)
+	fmt.Fprintf(&b, `<text x="%.1f" y="%d" text-anchor="middle">%v</text>`+"\n", marginLeft+plotWidth/2, height-10, escape(c.XLabel))
+	fmt.Fprintf(&b, `<text x="15" y="%.1f" text-anchor="middle" transform="rotate(-90 15 %.1f)">%v</text>`+"\n",
+		marginTop+plotHeight/2, marginTop+plotHeight/2, escape(c.YLabel))
+
+	for i, s := range c.Series {
+		color := palette[i%len(palette)]
+		switch s.Style {
+		case Marks:
+			for _, p := range s.Points {
+				fmt.Fprintf(&b, `<circle cx="%.1f" cy="%.1f" r="2.5" fill="%v"/>`, x(p[0]), y(p[1]), color)
+			}
+		case Bars:
+			for _, p := range s.Points {
+				fmt.Fprintf(&b, `<line x1="%.1f" y1="%.1f" x2="%.1f" y2="%.1f" stroke="%v" stroke-width="3"/>`,
+					x(p[0]), y(0), x(p[0]), y(p[1]), color)
+			}
+		default:
+			points := make([]string, len(s.Points))
+			for j, p := range s.Points {
+				points[j] = fmt.Sprintf("%.1f,%.1f", x(p[0]), y(p[1]))
+			}
+			dash := ""
+			if s.Dashed {
+				dash = ` stroke-dasharray="6 4"`
+			}
+			fmt.Fprintf(&b, `<polyline points="%v" fill="none" stroke="%v" stroke-width="1.5"%v/>`, strings.Join(points, " "), color, dash)
+		}
+		b.WriteString("\n")
+		// the legend, in the top right corner
+		ly := marginTop + 14 + 16*i
+		fmt.Fprintf(&b, `<rect x="%d" y="%d" width="10" height="10" fill="%v"/>`, width-marginRight-160, ly-9, color)
+		fmt.Fprintf(&b, `<text x="%d" y="%d">%v</text>`+"\n", width-marginRight-145, ly, escape(s.Name))
+	}
+
+	b.WriteString("</svg>")
+	return b.String()
+}
+
+// returns the range of the x axis and the max of the y axis, which always starts from 0
+func (c Chart) bounds() (xMin float64, xMax float64, yMax float64) {
+	xMin, xMax = math.Inf(1), math.Inf(-1)
+	for _, s := range c.Series {
+		for _, p := range s.Points {
+			xMin = math.Min(xMin, p[0])
+			xMax = math.Max(xMax, p[0])
+			yMax = math.Max(yMax, p[1])
+		}
+	}
+	for _, band := range c.Bands {
+		xMin = math.Min(xMin, band.From)
+		xMax = math.Max(xMax, band.To)
+	}
+	if math.IsInf(xMin, 1) {
+		xMin, xMax = 0, 1
+	}
+	if xMax <= xMin {
+		xMax = xMin + 1
+	}
+	if yMax <= 0 {
+		yMax = 1
+	}
+	// some room above the highest point
+	yMax = yMax * 1.05
+	return
+}
+
+// returns about 5 round values between min and max, used as ticks of an axis
+func ticks(min float64, max float64) []float64 {
+	step := math.Pow(10, math.Floor(math.Log10((max-min)/5)))
+	for _, m := range []float64{1, 2, 5, 10} {
+		if (max-min)/(step*m) <= 6 {
+			step = step * m
+			break
+		}
+	}
+	values := make([]float64, 0)
+	for v := math.Ceil(min/step) * step; v <= max; v = v + step {
+		values = append(values, v)
+	}
+	return values
+}
+
+func format(v float64) string {
+	if v == math.Trunc(v) {
+		return fmt.Sprintf("%.0f", v)
+	}
+	return fmt.Sprintf("%.2g", v)
+}
+
+func escape(s string) string {
+	return template.HTMLEscapeString(s)
+}
@@ -0,0 +1,56 @@
+package report
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/EnricoPicci/drop-pattern-with-timeout/src/histogram"
+	"github.com/EnricoPicci/drop-pattern-with-timeout/src/recorder"
+	"github.com/EnricoPicci/drop-pattern-with-timeout/src/request"
+	"github.com/EnricoPicci/drop-pattern-with-timeout/src/simulation"
+)
+
+func TestReportIsSelfContained(t *testing.T) {
+	start := time.Now()
+	processed := make([]request.Request, 0)
+	dropped := make([]request.Request, 0)
+	for i := 0; i < 20; i++ {
+		req := request.Request{Param: i, Created: start.Add(time.Duration(i) * 100 * time.Millisecond)}
+		if i >= 10 && i < 15 {
+			dropped = append(dropped, req)
+			continue
+		}
+		req.WaitDuration = time.Duration(i) * time.Millisecond
+		processed = append(processed, req)
+	}
+	result := simulation.Result{Processed: processed, Dropped: dropped, WaitTimes: histogram.New()}
+	samples := []recorder.Sample{{Time: 0}, {Time: 1000, QueueLength: 3, Dropped: 2}, {Time: 2000}}
+	halts := [][2]time.Duration{{time.Second, 1500 * time.Millisecond}}
+
+	r := ForRuns("test <run>", []Run{{Name: "drop", Result: result, Samples: samples}}, halts, time.Millisecond)
+	if len(r.Charts) != 3 {
+		t.Fatalf("There should be 3 charts - found %v", len(r.Charts))
+	}
+	// the requests created during the halt are the ones from 10 to 14
+	if bands := r.Charts[0].Bands; len(bands) != 1 || bands[0].From != 10 || bands[0].To != 14 {
+		t.Errorf("The halt should be marked from request 10 to 14 - found %v", bands)
+	}
+
+	var b strings.Builder
+	if err := Write(&b, r); err != nil {
+		t.Fatal(err)
+	}
+	html := b.String()
+	if strings.Count(html, "<svg") != 3 {
+		t.Errorf("The report should contain 3 svg charts")
+	}
+	for _, external := range []string{"src=", "href=", "<script"} {
+		if strings.Contains(html, external) {
+			t.Errorf("The report should not reference external assets - found %q", external)
+		}
+	}
+	if !strings.Contains(html, "test &lt;run&gt;") {
+		t.Errorf("The title should be escaped")
+	}
+}
@@ -0,0 +1,121 @@
+package report
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/EnricoPicci/drop-pattern-with-timeout/src/recorder"
+	"github.com/EnricoPicci/drop-pattern-with-timeout/src/simulation"
+)
+
+// Run is the outcome of a simulation shown in a report, e.g. a drop pattern run and a no-drop pattern run of the same scenario
+type Run struct {
+	Name   string
+	Result simulation.Result
+	// the state of the simulation sampled over time - if empty the charts over time are not shown
+	Samples []recorder.Sample
+}
+
+// ForRuns returns a report with the charts of the runs overlaid: the wait time of each request, the length of the queue
+// and the requests dropped over time. The halt windows, relative to the start of the runs, are marked on the charts.
+func ForRuns(title string, runs []Run, haltWindows [][2]time.Duration, timeUnit time.Duration) Report {
+	toUnits := func(d time.Duration) float64 {
+		return float64(d) / float64(timeUnit)
+	}
+	r := Report{Title: title}
+	for _, run := range runs {
+		r.Notes = append(r.Notes, fmt.Sprintf("%v - requests processed: %v - dropped: %v - failed: %v - wait time %v",
+			run.Name, len(run.Result.Processed), len(run.Result.Dropped), run.Result.Failed, run.Result.WaitTimes.Summary()))
+	}
+	r.Notes = append(r.Notes, fmt.Sprintf("All times are expressed in time units of %v", timeUnit))
+
+	haltBands := make([]Band, len(haltWindows))
+	for i, w := range haltWindows {
+		haltBands[i] = Band{Label: "halt", From: toUnits(w[0]), To: toUnits(w[1])}
+	}
+
+	waitChart := Chart{Title: "Wait time per request", XLabel: "request", YLabel: "wait time"}
+	for _, run := range runs {
+		waitChart.Series = append(waitChart.Series, Series{Name: run.Name + " wait", Style: Line, Points: waitPoints(run, toUnits)})
+		if len(run.Result.Dropped) > 0 {
+			dropped := make([][2]float64, len(run.Result.Dropped))
+			for i, req := range run.Result.Dropped {
+				dropped[i] = [2]float64{float64(req.Param), 0}
+			}
+			waitChart.Series = append(waitChart.Series, Series{Name: run.Name + " dropped", Style: Marks, Points: dropped})
+		}
+	}
+	// the requests of the runs are created at the same times, so the halts are marked using the first run
+	if len(runs) > 0 {
+		waitChart.Bands = requestBands(runs[0], haltWindows)
+	}
+	r.Charts = append(r.Charts, waitChart)
+
+	queueChart := Chart{Title: "Queue length over time", XLabel: "time", YLabel: "requests waiting", Bands: haltBands}
+	dropChart := Chart{Title: "Requests dropped over time", XLabel: "time", YLabel: "requests dropped", Bands: haltBands}
+	for _, run := range runs {
+		if len(run.Samples) == 0 {
+			continue
+		}
+		queue := make([][2]float64, len(run.Samples))
+		drops := make([][2]float64, 0)
+		for i, s := range run.Samples {
+			queue[i] = [2]float64{s.Time, float64(s.QueueLength)}
+			if s.Dropped > 0 {
+				drops = append(drops, [2]float64{s.Time, float64(s.Dropped)})
+			}
+		}
+		queueChart.Series = append(queueChart.Series, Series{Name: run.Name, Style: Line, Points: queue})
+		dropChart.Series = append(dropChart.Series, Series{Name: run.Name, Style: Bars, Points: drops})
+	}
+	if len(queueChart.Series) > 0 {
+		r.Charts = append(r.Charts, queueChart, dropChart)
+	}
+	return r
+}
+
+// returns the wait time of the requests processed, ordered by request index
+func waitPoints(run Run, toUnits func(time.Duration) float64) [][2]float64 {
+	points := make([][2]float64, len(run.Result.Processed))
+	for i, req := range run.Result.Processed {
+		points[i] = [2]float64{float64(req.Param), toUnits(req.WaitDuration)}
+	}
+	sort.Slice(points, func(i, j int) bool { return points[i][0] < points[j][0] })
+	return points
+}
+
+// returns, for each halt window, the range of the indexes of the requests created while the pool was halted
+func requestBands(run Run, haltWindows [][2]time.Duration) []Band {
+	reqs := append(append(run.Result.Processed[:0:0], run.Result.Processed...), run.Result.Dropped...)
+	if len(reqs) == 0 {
+		return nil
+	}
+	// the start of the run is approximated with the creation of the first request
+	start := reqs[0].Created
+	for _, req := range reqs {
+		if req.Created.Before(start) {
+			start = req.Created
+		}
+	}
+	bands := make([]Band, 0)
+	for _, w := range haltWindows {
+		from, to := -1, -1
+		for _, req := range reqs {
+			created := req.Created.Sub(start)
+			if created < w[0] || created >= w[1] {
+				continue
+			}
+			if from < 0 || req.Param < from {
+				from = req.Param
+			}
+			if req.Param > to {
+				to = req.Param
+			}
+		}
+		if from >= 0 {
+			bands = append(bands, Band{Label: "halt", From: float64(from), To: float64(to)})
+		}
+	}
+	return bands
+}
@@ -1,9 +1,127 @@
 package request
 
-import "time"
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"sync/atomic"
+	"time"
+)
 
 type Request struct {
+	// the unique identifier of the request, generated by New
+	ID           string
 	Param        int
 	Created      time.Time
 	WaitDuration time.Duration
+	// the time it takes to process the request, in time units - 0 means that the processing time of the pool is used
+	ProcTime int
+	// the priority and the tenant of the request, e.g. as recorded in a production trace
+	Priority int
+	Tenant   string
+	// if not empty, the requests with the same key are identical, so that they can share one execution when they are coalesced
+	Key string
+	// if not empty, the id of the request whose execution has been shared by this request, which has not been executed itself
+	Leader string
+	// true if the request has been answered from a cache, without being processed, and if the entry of the cache had
+	// expired, i.e. the request has been answered with a stale result since it has been dropped
+	Cached bool
+	Stale  bool
+	// the W3C trace context (traceparent header) of the request, if it comes from a traced service
+	TraceParent string
+	// true if the processing of the request failed
+	Failed bool
+	// the result of the processing, if any, e.g. set by the handler of a batch for each request of the batch - the simulated
+	// processing sets it to the param of the request
+	Result interface{}
+	// true if the request has been dropped
+	Dropped bool
+	// if not nil, the request is sent over this channel when it has been processed or dropped - the channel must have
+	// a buffer of 1 so that the notification never blocks the worker or the waiting room
+	Done chan Request
+	// if not zero, the request is dropped when the deadline is reached before it has been sent to the pool, even if the timeout
+	// of the waiting room has not expired, e.g. because the client is not interested in the response after the deadline
+	Deadline time.Time
+	// the time the waiting room would drop the request, i.e. the end of its timeout or its deadline if it comes first - it is set
+	// by the waiting room so that a pool in batch mode drops the requests which expire while they are being batched
+	Expiry time.Time
+	// if not zero, the deadline of the whole processing of a request which goes through several stages, e.g. of a pipeline -
+	// the Deadline of each stage is then a share of the budget left until it
+	EndToEndDeadline time.Time
+	// if not nil, the work done by the worker to process the request, e.g. serving a real http request, in place of the
+	// processing time simulated
+	Exec func()
+
+	// the timeline of the request: when it enters the waiting room, when it is sent to the pool, when a worker starts and
+	// completes its processing, or when it is dropped - the times not reached by the request are zero
+	EnteredAt    time.Time
+	DispatchedAt time.Time
+	StartedAt    time.Time
+	CompletedAt  time.Time
+	DroppedAt    time.Time
+}
+
+// the ids are made of a random prefix, different for each process, and of a counter
+var idPrefix = newIDPrefix()
+var idCounter uint64
+
+func newIDPrefix() string {
+	b := make([]byte, 4)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// NewID returns a new unique identifier for a request
+func NewID() string {
+	return fmt.Sprintf("%v-%v", idPrefix, atomic.AddUint64(&idCounter, 1))
+}
+
+// New returns a request with a new unique identifier, created now
+func New(param int) Request {
+	return Request{ID: NewID(), Param: param, Created: time.Now()}
+}
+
+// signals, over the Done channel if present, that the request has been processed or dropped
+func (req Request) Notify() {
+	if req.Done != nil {
+		req.Done <- req
+	}
+}
+
+// WaitingRoomTime returns the time spent in the waiting room, until the request has been sent to the pool or dropped
+func (req Request) WaitingRoomTime() time.Duration {
+	if req.EnteredAt.IsZero() {
+		return 0
+	}
+	if !req.DroppedAt.IsZero() {
+		return req.DroppedAt.Sub(req.EnteredAt)
+	}
+	return between(req.EnteredAt, req.DispatchedAt)
+}
+
+// HandOffTime returns the time from when the request has been sent to the pool to when a worker has started processing it,
+// which includes the time the worker has been halted
+func (req Request) HandOffTime() time.Duration {
+	return between(req.DispatchedAt, req.StartedAt)
+}
+
+// ProcessingTime returns the time a worker has spent processing the request
+func (req Request) ProcessingTime() time.Duration {
+	return between(req.StartedAt, req.CompletedAt)
+}
+
+// EndToEndTime returns the time from the creation of the request to the end of its processing or to when it has been dropped
+func (req Request) EndToEndTime() time.Duration {
+	if !req.DroppedAt.IsZero() {
+		return between(req.Created, req.DroppedAt)
+	}
+	return between(req.Created, req.CompletedAt)
+}
+
+// returns the time between from and to, or 0 if one of them has not been reached
+func between(from time.Time, to time.Time) time.Duration {
+	if from.IsZero() || to.IsZero() {
+		return 0
+	}
+	return to.Sub(from)
 }
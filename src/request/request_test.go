@@ -0,0 +1,36 @@
+package request
+
+import (
+	"testing"
+	"time"
+)
+
+func TestIdsAreUnique(t *testing.T) {
+	ids := make(map[string]bool)
+	for i := 0; i < 1000; i++ {
+		req := New(i)
+		if ids[req.ID] {
+			t.Fatalf("The id %v has been generated twice", req.ID)
+		}
+		ids[req.ID] = true
+	}
+}
+
+func TestTimeline(t *testing.T) {
+	created := time.Now()
+	at := func(ms int) time.Time {
+		return created.Add(time.Duration(ms) * time.Millisecond)
+	}
+	req := Request{Created: created, EnteredAt: at(1), DispatchedAt: at(10), StartedAt: at(30), CompletedAt: at(100)}
+	if req.WaitingRoomTime() != 9*time.Millisecond || req.HandOffTime() != 20*time.Millisecond ||
+		req.ProcessingTime() != 70*time.Millisecond || req.EndToEndTime() != 100*time.Millisecond {
+		t.Errorf("Wrong durations of the timeline: %v %v %v %v", req.WaitingRoomTime(), req.HandOffTime(), req.ProcessingTime(),
+			req.EndToEndTime())
+	}
+
+	dropped := Request{Created: created, EnteredAt: at(1), DroppedAt: at(51)}
+	if dropped.WaitingRoomTime() != 50*time.Millisecond || dropped.ProcessingTime() != 0 || dropped.EndToEndTime() != 51*time.Millisecond {
+		t.Errorf("Wrong durations of the timeline of a request dropped: %v %v %v", dropped.WaitingRoomTime(), dropped.ProcessingTime(),
+			dropped.EndToEndTime())
+	}
+}
@@ -0,0 +1,352 @@
+package scenario
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+
+	"github.com/EnricoPicci/drop-pattern-with-timeout/src/arrival"
+	"github.com/EnricoPicci/drop-pattern-with-timeout/src/cache"
+	"github.com/EnricoPicci/drop-pattern-with-timeout/src/faults"
+	"github.com/EnricoPicci/drop-pattern-with-timeout/src/servicetime"
+	"github.com/EnricoPicci/drop-pattern-with-timeout/src/trace"
+)
+
+// policies of the waiting room
+const (
+	// requests wait for a worker up to the timeout and then are dropped
+	Drop = "drop"
+	// requests wait for a worker for as long as it takes
+	NoDrop = "none"
+)
+
+// Scenario describes a simulation: the worker pool, the policy of the waiting room, how requests arrive, how long they
+// take to be processed and the faults injected in the pool. All times are expressed in time units.
+type Scenario struct {
+	Name        string `yaml:"name"`
+	Description string `yaml:"description"`
+	// the time unit, e.g. 1ms or 100us - the default is 1ms
+	TimeUnit string `yaml:"timeUnit"`
+	// the number of requests sent - it is ignored if a trace is replayed
+	NumReq int `yaml:"numReq"`
+	// the seed used by all the random generators which do not set their own seed
+	Seed        int64              `yaml:"seed"`
+	Pool        Pool               `yaml:"pool"`
+	WaitingRoom WaitingRoom        `yaml:"waitingRoom"`
+	Arrival     arrival.Config     `yaml:"arrival"`
+	ServiceTime servicetime.Config `yaml:"serviceTime"`
+	// the faults injected in the pool
+	FaultTimeline FaultTimeline `yaml:"faultTimeline"`
+	// if set, the requests are replayed from a trace and the arrival and service time models are ignored
+	Trace *Trace `yaml:"trace"`
+	// if set, a cache of the results is checked before the requests enter the waiting room - it is ignored if the policy is none
+	Cache *Cache `yaml:"cache"`
+	// if set, the requests with the same key waiting in the waiting room share one execution - it is ignored if the policy is
+	// none
+	Coalesce *Coalesce `yaml:"coalesce"`
+
+	// the parsed document, used to find the line of the fields which fail the validation
+	root *yaml.Node
+	// the records of the trace, read during the validation
+	records []trace.Record
+}
+
+type Pool struct {
+	// the number of workers
+	Size int `yaml:"size"`
+}
+
+type WaitingRoom struct {
+	// drop or none
+	Policy string `yaml:"policy"`
+	// the time after which a request not yet taken by a worker is dropped
+	Timeout int `yaml:"timeout"`
+}
+
+type FaultTimeline struct {
+	// the seed used to generate the random values of jitter and error faults
+	Seed   int64          `yaml:"seed"`
+	Faults []faults.Fault `yaml:"faults"`
+}
+
+type Trace struct {
+	File string `yaml:"file"`
+	// the factor applied to the timings of the trace
+	Scale float64 `yaml:"scale"`
+}
+
+type Cache struct {
+	// the maximum number of entries
+	Size int `yaml:"size"`
+	// the time an entry is fresh after it has been stored
+	TTL int `yaml:"ttl"`
+	// the number of distinct keys of the requests, each request having a key drawn at random
+	Keys int `yaml:"keys"`
+	// if true a request dropped is answered with the entry of its key expired, if any, not older than maxStale after its
+	// expiry - a maxStale of 0 means that an entry expired can be served until it is evicted
+	ServeStale bool `yaml:"serveStale"`
+	MaxStale   int  `yaml:"maxStale"`
+}
+
+type Coalesce struct {
+	// the number of distinct keys of the requests, each request having a key drawn at random - if there is also a cache it
+	// must be equal to the keys of the cache
+	Keys int `yaml:"keys"`
+}
+
+// FieldError is the error returned when a field of a scenario is not valid
+type FieldError struct {
+	// the path of the field, e.g. waitingRoom.timeout or faultTimeline.faults[2]
+	Field string
+	// the line of the field in the scenario file - 0 if the scenario has not been read from a file
+	Line int
+	Msg  string
+}
+
+func (e *FieldError) Error() string {
+	if e.Line > 0 {
+		return fmt.Sprintf("line %v: %v: %v", e.Line, e.Field, e.Msg)
+	}
+	return fmt.Sprintf("%v: %v", e.Field, e.Msg)
+}
+
+// Load reads a scenario from a yaml or json file and validates it.
+// Relative paths of files referred by the scenario are resolved starting from the folder of the scenario file.
+func Load(path string) (*Scenario, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	s, err := Parse(data, filepath.Dir(path))
+	if err != nil {
+		return nil, fmt.Errorf("scenario %v: %w", path, err)
+	}
+	return s, nil
+}
+
+// Parse reads a scenario from yaml or json data, resolving relative paths starting from "dir", and validates it
+func Parse(data []byte, dir string) (*Scenario, error) {
+	root := yaml.Node{}
+	if err := yaml.Unmarshal(data, &root); err != nil {
+		return nil, err
+	}
+	s := Scenario{root: &root}
+	// decoding the data again with a strict decoder lets us report the fields which are not known, e.g. because misspelled
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	decoder.KnownFields(true)
+	if err := decoder.Decode(&s); err != nil {
+		return nil, err
+	}
+	s.ServiceTime.File = resolve(dir, s.ServiceTime.File)
+	if s.Trace != nil {
+		s.Trace.File = resolve(dir, s.Trace.File)
+	}
+	if err := s.Validate(); err != nil {
+		return nil, err
+	}
+	return &s, nil
+}
+
+func resolve(dir string, path string) string {
+	if path == "" || filepath.IsAbs(path) {
+		return path
+	}
+	return filepath.Join(dir, path)
+}
+
+// Validate checks the scenario, applies the defaults and reads the trace if one is set - the error returned is a *FieldError
+func (s *Scenario) Validate() error {
+	if s.TimeUnit == "" {
+		s.TimeUnit = "1ms"
+	}
+	if unit, err := time.ParseDuration(s.TimeUnit); err != nil || unit <= 0 {
+		return s.fieldError("timeUnit", "%q is not a valid time unit", s.TimeUnit)
+	}
+	if s.Pool.Size <= 0 {
+		return s.fieldError("pool.size", "must be greater than 0")
+	}
+
+	if s.WaitingRoom.Policy == "" {
+		s.WaitingRoom.Policy = Drop
+	}
+	switch s.WaitingRoom.Policy {
+	case Drop:
+		if s.WaitingRoom.Timeout <= 0 {
+			return s.fieldError("waitingRoom.timeout", "must be greater than 0 when the policy is %v", Drop)
+		}
+	case NoDrop:
+	default:
+		return s.fieldError("waitingRoom.policy", "unknown policy %q, use %v or %v", s.WaitingRoom.Policy, Drop, NoDrop)
+	}
+
+	for i, f := range s.FaultTimeline.Faults {
+		single := faults.Scenario{Faults: []faults.Fault{f}}
+		if err := single.Validate(s.Pool.Size); err != nil {
+			// strip the index of the fault added by faults.Validate since we add the full path of the field
+			msg := strings.TrimPrefix(err.Error(), "faults[0]: ")
+			return s.fieldError(fmt.Sprintf("faultTimeline.faults[%v]", i), "%v", msg)
+		}
+	}
+	if s.FaultTimeline.Seed == 0 {
+		s.FaultTimeline.Seed = s.Seed
+	}
+
+	if s.Cache != nil {
+		if s.Cache.Size <= 0 {
+			return s.fieldError("cache.size", "must be greater than 0")
+		}
+		if s.Cache.TTL <= 0 {
+			return s.fieldError("cache.ttl", "must be greater than 0")
+		}
+		if s.Cache.Keys <= 0 {
+			return s.fieldError("cache.keys", "must be greater than 0")
+		}
+		if s.Cache.MaxStale < 0 {
+			return s.fieldError("cache.maxStale", "can not be negative")
+		}
+	}
+	if s.Coalesce != nil {
+		if s.Coalesce.Keys <= 0 {
+			return s.fieldError("coalesce.keys", "must be greater than 0")
+		}
+		if s.Cache != nil && s.Coalesce.Keys != s.Cache.Keys {
+			return s.fieldError("coalesce.keys", "must be equal to cache.keys")
+		}
+	}
+
+	if s.Trace != nil {
+		if s.Trace.Scale == 0 {
+			s.Trace.Scale = 1
+		}
+		if s.Trace.Scale < 0 {
+			return s.fieldError("trace.scale", "must be greater than 0")
+		}
+		records, err := trace.Load(s.Trace.File)
+		if err != nil {
+			return s.fieldError("trace.file", "%v", err)
+		}
+		s.records = records
+		s.NumReq = len(records)
+		return nil
+	}
+
+	if s.NumReq <= 0 {
+		return s.fieldError("numReq", "must be greater than 0")
+	}
+	if s.Arrival.Interval < 0 {
+		return s.fieldError("arrival.interval", "can not be negative")
+	}
+	if s.Arrival.Seed == 0 {
+		s.Arrival.Seed = s.Seed
+	}
+	if _, err := arrival.NewGenerator(s.Arrival); err != nil {
+		return s.fieldError("arrival", "%v", err)
+	}
+	if s.ServiceTime.Mean <= 0 {
+		return s.fieldError("serviceTime.mean", "must be greater than 0")
+	}
+	if s.ServiceTime.Seed == 0 {
+		s.ServiceTime.Seed = s.Seed
+	}
+	if _, err := servicetime.New(s.ServiceTime); err != nil {
+		return s.fieldError("serviceTime", "%v", err)
+	}
+	return nil
+}
+
+// Unit returns the time unit of the scenario - the scenario must have been validated
+func (s *Scenario) Unit() time.Duration {
+	unit, _ := time.ParseDuration(s.TimeUnit)
+	return unit
+}
+
+// NewDistribution returns the distribution of the processing times of the scenario, or nil if a trace is replayed since
+// the requests of a trace carry their own processing times
+func (s *Scenario) NewDistribution() (servicetime.Distribution, error) {
+	if s.Trace != nil {
+		return nil, nil
+	}
+	return servicetime.New(s.ServiceTime)
+}
+
+// NewGenerator returns the generator of the requests of the scenario, which replays the trace if one is set
+func (s *Scenario) NewGenerator() (arrival.Generator, error) {
+	if s.Trace != nil {
+		return trace.NewReplay(s.records, s.Trace.Scale), nil
+	}
+	return arrival.NewGenerator(s.Arrival)
+}
+
+// NewCache returns the cache of the results, or nil if there is none
+func (s *Scenario) NewCache() *cache.Cache {
+	if s.Cache == nil {
+		return nil
+	}
+	unit := s.Unit()
+	c := cache.New(s.Cache.Size, time.Duration(s.Cache.TTL)*unit)
+	c.ServeStale = s.Cache.ServeStale
+	c.MaxStale = time.Duration(s.Cache.MaxStale) * unit
+	return c
+}
+
+// NewFaults returns the faults to inject in the pool, or nil if there are none
+func (s *Scenario) NewFaults() *faults.Scenario {
+	if len(s.FaultTimeline.Faults) == 0 {
+		return nil
+	}
+	return faults.New(s.FaultTimeline.Seed, s.FaultTimeline.Faults...)
+}
+
+func (s *Scenario) fieldError(field string, format string, args ...interface{}) error {
+	return &FieldError{Field: field, Line: s.lineOf(field), Msg: fmt.Sprintf(format, args...)}
+}
+
+// returns the line of the field in the scenario file, or of its closest parent if the field is not present in the file,
+// or 0 if the scenario has not been read from a file
+func (s *Scenario) lineOf(field string) int {
+	if s.root == nil || len(s.root.Content) == 0 {
+		return 0
+	}
+	node := s.root.Content[0]
+	line := node.Line
+	for _, part := range strings.Split(field, ".") {
+		name := part
+		index := -1
+		if i := strings.Index(part, "["); i >= 0 {
+			name = part[:i]
+			index, _ = strconv.Atoi(strings.TrimSuffix(part[i+1:], "]"))
+		}
+		node = child(node, name)
+		if node == nil {
+			return line
+		}
+		line = node.Line
+		if index >= 0 {
+			if node.Kind != yaml.SequenceNode || index >= len(node.Content) {
+				return line
+			}
+			node = node.Content[index]
+			line = node.Line
+		}
+	}
+	return line
+}
+
+// returns the value of the key "name" of a mapping node
+func child(node *yaml.Node, name string) *yaml.Node {
+	if node.Kind != yaml.MappingNode {
+		return nil
+	}
+	for i := 0; i+1 < len(node.Content); i = i + 2 {
+		if node.Content[i].Value == name {
+			return node.Content[i+1]
+		}
+	}
+	return nil
+}
@@ -0,0 +1,149 @@
+package scenario
+
+import (
+	"errors"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// all the scenarios of the library must be valid
+func TestLoadLibrary(t *testing.T) {
+	paths, err := filepath.Glob("../../scenarios/*.*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, path := range paths {
+		if filepath.Ext(path) != ".yaml" && filepath.Ext(path) != ".json" {
+			continue
+		}
+		s, err := Load(path)
+		if err != nil {
+			t.Errorf("The scenario %v should be valid - %v", path, err)
+			continue
+		}
+		if s.NumReq <= 0 {
+			t.Errorf("The scenario %v should send some requests", path)
+		}
+	}
+}
+
+func TestValidationErrorPointsToField(t *testing.T) {
+	data := `name: invalid
+numReq: 10
+pool:
+  size: 2
+waitingRoom:
+  policy: drop
+  timeout: 100
+arrival:
+  model: fixed
+  interval: 10
+serviceTime:
+  mean: 10
+faultTimeline:
+  faults:
+    - kind: halt
+      start: 0
+      duration: 10
+    - kind: slowdown
+      start: 0
+      duration: 10
+`
+	_, err := Parse([]byte(data), ".")
+	fieldErr := &FieldError{}
+	if !errors.As(err, &fieldErr) {
+		t.Fatalf("The error should be a FieldError - %v", err)
+	}
+	if fieldErr.Field != "faultTimeline.faults[1]" || fieldErr.Line != 18 {
+		t.Errorf("The error should point to the second fault at line 18 - %v", err)
+	}
+}
+
+func TestMissingFieldPointsToParent(t *testing.T) {
+	data := `numReq: 10
+pool:
+  size: 2
+waitingRoom:
+  policy: drop
+arrival:
+  interval: 10
+serviceTime:
+  mean: 10
+`
+	_, err := Parse([]byte(data), ".")
+	fieldErr := &FieldError{}
+	if !errors.As(err, &fieldErr) || fieldErr.Field != "waitingRoom.timeout" || fieldErr.Line != 5 {
+		t.Errorf("The error should point to the waiting room at line 5 - %v", err)
+	}
+}
+
+func TestUnknownField(t *testing.T) {
+	data := `numReq: 10
+pool:
+  size: 2
+  sise: 3
+`
+	if _, err := Parse([]byte(data), "."); err == nil {
+		t.Error("A misspelled field should be reported")
+	}
+}
+
+func TestCache(t *testing.T) {
+	data := `numReq: 10
+pool:
+  size: 2
+waitingRoom:
+  timeout: 100
+arrival:
+  interval: 10
+serviceTime:
+  mean: 10
+cache:
+  size: 5
+  ttl: 100
+  serveStale: true
+`
+	_, err := Parse([]byte(data), ".")
+	fieldErr := &FieldError{}
+	if !errors.As(err, &fieldErr) || fieldErr.Field != "cache.keys" || fieldErr.Line != 11 {
+		t.Errorf("The error should point to the cache at line 11 - %v", err)
+	}
+	s, err := Parse([]byte(data+"  keys: 3\n  maxStale: 50\n"), ".")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := s.NewCache()
+	if !c.ServeStale || c.MaxStale != 50*time.Millisecond {
+		t.Errorf("The cache should serve the entries up to 50ms after their expiry - found %v", c.MaxStale)
+	}
+}
+
+// the requests coalesced and cached have the same keys
+func TestCoalesceWithCache(t *testing.T) {
+	data := `numReq: 10
+pool:
+  size: 2
+waitingRoom:
+  timeout: 100
+arrival:
+  interval: 10
+serviceTime:
+  mean: 10
+cache:
+  size: 5
+  ttl: 100
+  keys: 3
+coalesce:
+  keys: 4
+`
+	_, err := Parse([]byte(data), ".")
+	fieldErr := &FieldError{}
+	if !errors.As(err, &fieldErr) || fieldErr.Field != "coalesce.keys" {
+		t.Errorf("The error should point to the keys of the coalescing - %v", err)
+	}
+	if _, err := Parse([]byte(strings.Replace(data, "keys: 4", "keys: 3", 1)), "."); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,202 @@
+package servicetime
+
+import (
+	"bufio"
+	"fmt"
+	"math"
+	"math/rand"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Distribution generates the processing times of the requests, expressed in time units.
+// The random distributions never return less than 1 time unit.
+type Distribution interface {
+	Next() int
+}
+
+// names of the distributions supported
+const (
+	Constant    = "constant"
+	Exponential = "exponential"
+	LogNormal   = "lognormal"
+	Pareto      = "pareto"
+	Bimodal     = "bimodal"
+	Empirical   = "empirical"
+)
+
+// Config holds the parameters used to build a distribution - not all parameters are used by all distributions
+type Config struct {
+	// the name of the distribution
+	Name string `yaml:"distribution"`
+	// the mean processing time in time units (constant, exponential, lognormal, pareto) or the processing time of the
+	// fast requests (bimodal)
+	Mean int `yaml:"mean"`
+	// the seed of the random generator
+	Seed int64 `yaml:"seed"`
+	// lognormal: the standard deviation of the underlying normal distribution
+	Sigma float64 `yaml:"sigma"`
+	// pareto: the shape of the distribution, which has to be greater than 1 for the mean to exist - the lower the heavier the tail
+	Alpha float64 `yaml:"alpha"`
+	// bimodal: the probability that a request is slow
+	SlowProb float64 `yaml:"slowProb"`
+	// bimodal: the processing time of the slow requests in time units
+	SlowTime int `yaml:"slowTime"`
+	// empirical: the path of a file with one processing time, in time units, per line
+	File string `yaml:"file"`
+}
+
+// New builds the distribution described by the configuration
+func New(cfg Config) (Distribution, error) {
+	// a processing time of 0 would be replaced silently by the processing time of the pool
+	if cfg.Name != Empirical && cfg.Mean <= 0 {
+		return nil, fmt.Errorf("the mean of a %v distribution must be greater than 0", nameOf(cfg))
+	}
+	rnd := rand.New(rand.NewSource(cfg.Seed))
+	switch cfg.Name {
+	case Constant, "":
+		return &constant{value: cfg.Mean}, nil
+	case Exponential:
+		return &exponential{mean: float64(cfg.Mean), rnd: rnd}, nil
+	case LogNormal:
+		if cfg.Sigma <= 0 {
+			return nil, fmt.Errorf("the sigma of a lognormal distribution must be greater than 0")
+		}
+		// mu is chosen so that the mean of the distribution is equal to the mean configured
+		mu := math.Log(float64(cfg.Mean)) - cfg.Sigma*cfg.Sigma/2
+		return &logNormal{mu: mu, sigma: cfg.Sigma, rnd: rnd}, nil
+	case Pareto:
+		if cfg.Alpha <= 1 {
+			return nil, fmt.Errorf("the alpha of a pareto distribution must be greater than 1")
+		}
+		// the scale is chosen so that the mean of the distribution is equal to the mean configured
+		scale := float64(cfg.Mean) * (cfg.Alpha - 1) / cfg.Alpha
+		return &pareto{scale: scale, alpha: cfg.Alpha, rnd: rnd}, nil
+	case Bimodal:
+		if cfg.SlowProb < 0 || cfg.SlowProb > 1 {
+			return nil, fmt.Errorf("the probability of a slow request must be between 0 and 1")
+		}
+		if cfg.SlowTime <= 0 {
+			return nil, fmt.Errorf("the processing time of the slow requests of a bimodal distribution must be greater than 0")
+		}
+		return &bimodal{fast: cfg.Mean, slow: cfg.SlowTime, slowProb: cfg.SlowProb, rnd: rnd}, nil
+	case Empirical:
+		values, err := readValues(cfg.File)
+		if err != nil {
+			return nil, err
+		}
+		return &empirical{values: values, rnd: rnd}, nil
+	}
+	return nil, fmt.Errorf("unknown distribution %q", cfg.Name)
+}
+
+// returns the name of the distribution, which is constant if not set
+func nameOf(cfg Config) string {
+	if cfg.Name == "" {
+		return Constant
+	}
+	return cfg.Name
+}
+
+type constant struct {
+	value int
+}
+
+func (d *constant) Next() int {
+	return d.value
+}
+
+type exponential struct {
+	mean float64
+	rnd  *rand.Rand
+}
+
+func (d *exponential) Next() int {
+	return atLeastOne(d.rnd.ExpFloat64() * d.mean)
+}
+
+type logNormal struct {
+	mu    float64
+	sigma float64
+	rnd   *rand.Rand
+}
+
+func (d *logNormal) Next() int {
+	return atLeastOne(math.Exp(d.mu + d.sigma*d.rnd.NormFloat64()))
+}
+
+type pareto struct {
+	scale float64
+	alpha float64
+	rnd   *rand.Rand
+}
+
+func (d *pareto) Next() int {
+	// inverse transform sampling - 1 - Float64() is in (0, 1] so that we never divide by 0
+	u := 1 - d.rnd.Float64()
+	return atLeastOne(d.scale / math.Pow(u, 1/d.alpha))
+}
+
+type bimodal struct {
+	fast     int
+	slow     int
+	slowProb float64
+	rnd      *rand.Rand
+}
+
+func (d *bimodal) Next() int {
+	if d.rnd.Float64() < d.slowProb {
+		return d.slow
+	}
+	return d.fast
+}
+
+type empirical struct {
+	values []int
+	rnd    *rand.Rand
+}
+
+func (d *empirical) Next() int {
+	return d.values[d.rnd.Intn(len(d.values))]
+}
+
+// rounds a random processing time making sure that a request takes at least 1 time unit
+func atLeastOne(v float64) int {
+	if v < 1 {
+		return 1
+	}
+	return int(math.Round(v))
+}
+
+// reads the values of an empirical distribution, one per line, which must be greater than 0 - empty lines and lines starting with # are ignored
+func readValues(path string) ([]int, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	values := make([]int, 0)
+	scanner := bufio.NewScanner(f)
+	line := 0
+	for scanner.Scan() {
+		line++
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		v, err := strconv.Atoi(text)
+		if err != nil || v <= 0 {
+			return nil, fmt.Errorf("%v:%v: %q is not a valid processing time", path, line, text)
+		}
+		values = append(values, v)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(values) == 0 {
+		return nil, fmt.Errorf("%v: no processing time found", path)
+	}
+	return values, nil
+}
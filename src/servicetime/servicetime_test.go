@@ -0,0 +1,92 @@
+package servicetime
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// all the distributions configured with a mean should generate processing times whose average is close to that mean
+func TestDistributionsMean(t *testing.T) {
+	configs := []Config{
+		{Name: Constant, Mean: 100},
+		{Name: Exponential, Mean: 100, Seed: 1},
+		{Name: LogNormal, Mean: 100, Seed: 1, Sigma: 0.5},
+		{Name: Pareto, Mean: 100, Seed: 1, Alpha: 3},
+	}
+	for _, cfg := range configs {
+		d, err := New(cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		n := 100000
+		sum := 0
+		for i := 0; i < n; i++ {
+			sum = sum + d.Next()
+		}
+		mean := sum / n
+		if mean < 90 || mean > 110 {
+			t.Errorf("The mean of the %v distribution should be close to 100 - mean %v", cfg.Name, mean)
+		}
+	}
+}
+
+func TestSameSeedSameSequence(t *testing.T) {
+	d1, _ := New(Config{Name: Exponential, Mean: 100, Seed: 42})
+	d2, _ := New(Config{Name: Exponential, Mean: 100, Seed: 42})
+	for i := 0; i < 100; i++ {
+		if v1, v2 := d1.Next(), d2.Next(); v1 != v2 {
+			t.Fatalf("Two distributions with the same seed should generate the same values - %v and %v", v1, v2)
+		}
+	}
+}
+
+func TestEmpirical(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "proc-times.txt")
+	err := os.WriteFile(path, []byte("# processing times\n10\n\n20\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d, err := New(Config{Name: Empirical, File: path, Seed: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 100; i++ {
+		if v := d.Next(); v != 10 && v != 20 {
+			t.Fatalf("The empirical distribution should only return values read from the file - %v", v)
+		}
+	}
+
+	err = os.WriteFile(path, []byte("10\nabc\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := New(Config{Name: Empirical, File: path}); err == nil {
+		t.Error("A file with an invalid value should return an error")
+	}
+
+	err = os.WriteFile(path, []byte("10\n0\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := New(Config{Name: Empirical, File: path}); err == nil {
+		t.Error("A file with a processing time of 0 should return an error")
+	}
+}
+
+// a processing time of 0 would be replaced by the processing time of the pool, so it is not accepted
+func TestZeroTimesNotValid(t *testing.T) {
+	configs := []Config{
+		{Name: Exponential},
+		{Name: Constant, Mean: -1},
+		{Name: Bimodal, Mean: 100, SlowProb: 0.1},
+	}
+	for _, cfg := range configs {
+		if _, err := New(cfg); err == nil {
+			t.Errorf("The configuration %+v should not be valid", cfg)
+		}
+	}
+	if _, err := New(Config{Name: Bimodal, Mean: 100, SlowProb: 0.1, SlowTime: 1000}); err != nil {
+		t.Errorf("A bimodal distribution with both times should be valid - %v", err)
+	}
+}
@@ -0,0 +1,292 @@
+package simulation
+
+import (
+	"math/rand"
+	"strconv"
+	"time"
+
+	"github.com/EnricoPicci/drop-pattern-with-timeout/src/arrival"
+	"github.com/EnricoPicci/drop-pattern-with-timeout/src/cache"
+	"github.com/EnricoPicci/drop-pattern-with-timeout/src/coalesce"
+	"github.com/EnricoPicci/drop-pattern-with-timeout/src/events"
+	"github.com/EnricoPicci/drop-pattern-with-timeout/src/histogram"
+	"github.com/EnricoPicci/drop-pattern-with-timeout/src/request"
+	"github.com/EnricoPicci/drop-pattern-with-timeout/src/scenario"
+	"github.com/EnricoPicci/drop-pattern-with-timeout/src/servicetime"
+	"github.com/EnricoPicci/drop-pattern-with-timeout/src/waitingroom"
+	"github.com/EnricoPicci/drop-pattern-with-timeout/src/workerpool"
+)
+
+// Result holds the outcome of a simulation
+type Result struct {
+	// the policy of the waiting room, drop or none
+	Policy string
+	NumReq int
+	// the requests processed by the pool
+	Processed []request.Request
+	// the requests dropped by the waiting room, by the pool, if its workers process the requests in batches, and by the
+	// coalescer - they include the requests answered with a stale entry of the cache, counted by CacheStale
+	Dropped []request.Request
+	// the number of requests whose processing failed
+	Failed int
+	// the average time a worker has been idle
+	AvgIdleTime time.Duration
+	// the average time a request processed has been waiting before being taken in by a worker
+	AvgWaitTime time.Duration
+	// the distributions of the wait, processing and end to end times of the requests processed
+	WaitTimes     *histogram.Histogram
+	ProcTimes     *histogram.Histogram
+	EndToEndTimes *histogram.Histogram
+	// the requests answered from the cache, the ones not found and the ones dropped and answered with a stale entry - 0 if
+	// there is no cache
+	CacheHits   int
+	CacheMisses int
+	CacheStale  int
+	// the requests let in the waiting room as leaders, the followers which have received the outcome of their leader, i.e. the
+	// executions saved, the followers dropped and the processing time of the leaders shared with the followers - 0 if the
+	// requests are not coalesced
+	CoalesceLeaders   int
+	CoalesceShared    int
+	CoalesceDropped   int
+	CoalesceSavedWork time.Duration
+}
+
+// DropRate returns the fraction of requests dropped without a response, i.e. not answered with a stale entry of the cache
+func (r Result) DropRate() float64 {
+	if r.NumReq == 0 {
+		return 0
+	}
+	return float64(len(r.Dropped)-r.CacheStale) / float64(r.NumReq)
+}
+
+// Simulation holds the components described by a scenario
+type Simulation struct {
+	Scenario *scenario.Scenario
+	Pool     *workerpool.WorkerPool
+	// the waiting room in front of the pool - nil if the policy of the scenario is none
+	WaitingRoom *waitingroom.WaitingRoom
+
+	// the cache of the results checked before the requests enter the waiting room - nil if the scenario has no cache or the
+	// policy is none
+	Cache *cache.Cache
+	// the coalescer of the requests with the same key in front of the waiting room - nil if the scenario has no coalescing or
+	// the policy is none
+	Coalescer *coalesce.Coalescer
+
+	// the input channel of the pool
+	inPoolCh  chan request.Request
+	generator arrival.Generator
+	procTimes servicetime.Distribution
+}
+
+// New builds the pool, and the waiting room if the policy is drop, described by the scenario, which must have been validated
+func New(sc *scenario.Scenario) (*Simulation, error) {
+	procTimes, err := sc.NewDistribution()
+	if err != nil {
+		return nil, err
+	}
+	generator, err := sc.NewGenerator()
+	if err != nil {
+		return nil, err
+	}
+	timeUnit := sc.Unit()
+	sim := Simulation{
+		Scenario:  sc,
+		generator: generator,
+		procTimes: procTimes,
+	}
+
+	if sc.WaitingRoom.Policy == scenario.NoDrop {
+		// the channel that provides requests to the pool has a buffer equal to the number of requests
+		// this makes sure that the requests can come in at the same rythm even if the pool is halted
+		sim.inPoolCh = make(chan request.Request, sc.NumReq)
+	} else {
+		// the channel that provides requests to the pool is unbuffered - this is mandatory for the drop pattern to work
+		sim.inPoolCh = make(chan request.Request)
+		sim.WaitingRoom = waitingroom.New(make(chan request.Request), sim.inPoolCh, sc.WaitingRoom.Timeout, timeUnit)
+		sim.Cache = sc.NewCache()
+		if sc.Coalesce != nil {
+			// the coalescer is created before the waiting room is opened, since it is notified of the requests sent to the pool
+			sim.Coalescer = coalesce.New(sim.WaitingRoom)
+		}
+	}
+	sim.Pool = workerpool.NewWorkerPool(sim.inPoolCh, sc.Pool.Size, sc.Arrival.Interval, sc.ServiceTime.Mean, sc.NumReq, 0, 0, timeUnit)
+	sim.Pool.Faults = sc.NewFaults()
+	return &sim, nil
+}
+
+// SetEvents sets the sink which receives the events of the waiting room and of the pool of the simulation
+func (sim *Simulation) SetEvents(sink events.Sink) {
+	sim.Pool.Events = sink
+	if sim.WaitingRoom != nil {
+		sim.WaitingRoom.Events = sink
+	}
+}
+
+// HaltWindows returns the start and the end, relative to the start of the pool, of the periods when all the workers are halted
+func (sim *Simulation) HaltWindows() [][2]time.Duration {
+	if sim.Pool.Faults == nil {
+		return [][2]time.Duration{}
+	}
+	return sim.Pool.Faults.HaltWindows(sim.Scenario.Unit())
+}
+
+// Run runs the simulation and returns when all the requests have been processed or dropped
+func (sim *Simulation) Run() Result {
+	if sim.WaitingRoom == nil {
+		return RunNoDrop(sim.Pool, sim.inPoolCh, sim.Scenario.NumReq, sim.generator, sim.procTimes)
+	}
+	newRequest := newRequestFunc(sim.procTimes)
+	// the cache and the coalescer, if both set, have the same keys
+	if sim.Cache != nil {
+		newRequest = withKeys(newRequest, sim.Scenario.Cache.Keys, sim.Scenario.Seed)
+	} else if sim.Coalescer != nil {
+		newRequest = withKeys(newRequest, sim.Scenario.Coalesce.Keys, sim.Scenario.Seed)
+	}
+	return runDrop(sim.Pool, sim.WaitingRoom, sim.Scenario.NumReq, sim.generator, newRequest, sim.Cache, sim.Coalescer)
+}
+
+// Run builds the simulation described by the scenario, which must have been validated, and runs it
+func Run(sc *scenario.Scenario) (Result, error) {
+	sim, err := New(sc)
+	if err != nil {
+		return Result{}, err
+	}
+	return sim.Run(), nil
+}
+
+// RunDrop sends "numReq" requests, generated by "generator", to the waiting room in front of the pool.
+// If "procTimes" is nil all the requests take the processing time of the pool.
+func RunDrop(
+	pool *workerpool.WorkerPool,
+	waitingRoom *waitingroom.WaitingRoom,
+	numReq int,
+	generator arrival.Generator,
+	procTimes servicetime.Distribution,
+) Result {
+	return runDrop(pool, waitingRoom, numReq, generator, newRequestFunc(procTimes), nil, nil)
+}
+
+// sends the requests to the waiting room through the cache and the coalescer, if not nil
+func runDrop(
+	pool *workerpool.WorkerPool,
+	waitingRoom *waitingroom.WaitingRoom,
+	numReq int,
+	generator arrival.Generator,
+	newRequest func(i int) request.Request,
+	c *cache.Cache,
+	co *coalesce.Coalescer,
+) Result {
+	// start the worker pool
+	pool.Start()
+	// start the waiting room
+	waitingRoom.Open()
+
+	// we simulate a stream of incoming requests which are sent to the waiting room
+	submit := waitingRoom.LetIn
+	if co != nil {
+		submit = co.LetIn
+	}
+	if c != nil {
+		submit = c.Submit(submit)
+	}
+	generator.Run(numReq, pool.TimeUnit, newRequest, submit)
+
+	// close the waiting room since there are no more requests that can arrive - the coalescer closes it once the followers
+	// have received the outcome of their leaders
+	if co != nil {
+		co.Close()
+	} else {
+		waitingRoom.Close()
+	}
+	// when there are no more requests that can enter the pool we can stop the pool
+	pool.Stop()
+
+	result := Result{
+		Policy:      scenario.Drop,
+		NumReq:      numReq,
+		Processed:   pool.GetRequests(),
+		Dropped:     append(waitingRoom.ReqDropped, pool.GetDroppedRequests()...),
+		Failed:      pool.FailedRequests(),
+		AvgIdleTime: pool.AvgWorkerIdleTime(),
+		AvgWaitTime: pool.AvgRequestWaitTime(numReq),
+
+		WaitTimes:     pool.WaitTimes(),
+		ProcTimes:     pool.ProcTimes(),
+		EndToEndTimes: pool.EndToEndTimes(),
+	}
+	if c != nil {
+		c.Wait()
+		result.CacheHits = c.Hits()
+		result.CacheMisses = c.Misses()
+		result.CacheStale = c.Stale()
+	}
+	if co != nil {
+		result.Dropped = append(result.Dropped, co.GetDroppedRequests()...)
+		result.CoalesceLeaders = co.Leaders()
+		result.CoalesceShared = co.Shared()
+		result.CoalesceDropped = co.Dropped()
+		result.CoalesceSavedWork = co.SavedWork()
+	}
+	return result
+}
+
+// RunNoDrop sends "numReq" requests, generated by "generator", straight to the pool through "inPoolCh", which must be the input
+// channel of the pool. If "procTimes" is nil all the requests take the processing time of the pool.
+func RunNoDrop(
+	pool *workerpool.WorkerPool,
+	inPoolCh chan request.Request,
+	numReq int,
+	generator arrival.Generator,
+	procTimes servicetime.Distribution,
+) Result {
+	// start the worker pool
+	pool.Start()
+
+	// we simulate a stream of incoming requests which are sent straight to the pool
+	generator.Run(numReq, pool.TimeUnit, newRequestFunc(procTimes), func(req request.Request) {
+		// the request is dispatched when it enters the input channel of the pool, where it waits for a worker
+		req.DispatchedAt = time.Now()
+		inPoolCh <- req
+
+		pool.Events.Emit(events.OfRequest(events.Dispatched, req))
+	})
+
+	// when there are no more requests that can enter the pool we can stop the pool
+	pool.Stop()
+
+	return Result{
+		Policy:      scenario.NoDrop,
+		NumReq:      numReq,
+		Processed:   pool.GetRequests(),
+		Dropped:     []request.Request{},
+		Failed:      pool.FailedRequests(),
+		AvgIdleTime: pool.AvgWorkerIdleTime(),
+		AvgWaitTime: pool.AvgRequestWaitTime(numReq),
+
+		WaitTimes:     pool.WaitTimes(),
+		ProcTimes:     pool.ProcTimes(),
+		EndToEndTimes: pool.EndToEndTimes(),
+	}
+}
+
+// returns the function which builds the i-th request of the simulation
+func newRequestFunc(procTimes servicetime.Distribution) func(i int) request.Request {
+	return func(i int) request.Request {
+		req := request.New(i)
+		if procTimes != nil {
+			req.ProcTime = procTimes.Next()
+		}
+		return req
+	}
+}
+
+// returns the function which builds the requests with a key drawn at random among "keys" keys
+func withKeys(newRequest func(i int) request.Request, keys int, seed int64) func(i int) request.Request {
+	rnd := rand.New(rand.NewSource(seed))
+	return func(i int) request.Request {
+		req := newRequest(i)
+		req.Key = strconv.Itoa(rnd.Intn(keys))
+		return req
+	}
+}
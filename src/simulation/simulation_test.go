@@ -0,0 +1,144 @@
+package simulation
+
+import (
+	"sync"
+	"testing"
+
+	"github.com/EnricoPicci/drop-pattern-with-timeout/src/arrival"
+	"github.com/EnricoPicci/drop-pattern-with-timeout/src/request"
+	"github.com/EnricoPicci/drop-pattern-with-timeout/src/scenario"
+	"github.com/EnricoPicci/drop-pattern-with-timeout/src/servicetime"
+)
+
+// the requests dropped but answered with a stale entry of the cache have a response, so they are not counted as drops
+func TestDropRateWithoutStaleAnswers(t *testing.T) {
+	result := Result{NumReq: 10, Dropped: make([]request.Request, 4), CacheStale: 3}
+	if rate := result.DropRate(); rate != 0.1 {
+		t.Errorf("Expected a drop rate of 0.1 - found %v", rate)
+	}
+}
+
+// the processing times of a trace come from its records, so a scenario which replays a trace needs no serviceTime
+func TestRunReplay(t *testing.T) {
+	sc, err := scenario.Load("../../scenarios/replay.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	result, err := Run(sc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := len(result.Processed) + len(result.Dropped); n != sc.NumReq {
+		t.Errorf("Expected %v requests processed or dropped - found %v", sc.NumReq, n)
+	}
+	for _, req := range result.Processed {
+		if req.ProcTime <= 0 {
+			t.Errorf("Expected request %v to carry the processing time of the trace - found %v", req.ID, req.ProcTime)
+		}
+	}
+}
+
+// the requests with the same key share the execution of the request waiting or being processed, so every request is
+// processed, dropped or answered with the outcome of its leader
+func TestRunCoalesce(t *testing.T) {
+	sc := scenario.Scenario{
+		NumReq:      40,
+		Seed:        1,
+		Pool:        scenario.Pool{Size: 2},
+		WaitingRoom: scenario.WaitingRoom{Policy: scenario.Drop, Timeout: 100},
+		Arrival:     arrival.Config{Name: arrival.Fixed, Interval: 5},
+		ServiceTime: servicetime.Config{Name: servicetime.Constant, Mean: 50},
+		Coalesce:    &scenario.Coalesce{Keys: 2},
+	}
+	if err := sc.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	result, err := Run(&sc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := len(result.Processed) + len(result.Dropped) + result.CoalesceShared; n != sc.NumReq {
+		t.Errorf("Expected %v requests processed, dropped or shared - found %v", sc.NumReq, n)
+	}
+	if result.CoalesceShared == 0 || result.CoalesceSavedWork == 0 || result.CoalesceLeaders < len(result.Processed) {
+		t.Errorf("Expected some executions saved by %v leaders - found %v shared, %v saved", result.CoalesceLeaders,
+			result.CoalesceShared, result.CoalesceSavedWork)
+	}
+	if _, err := RunVirtual(&sc); err == nil {
+		t.Errorf("The coalescing should not be run on the virtual clock")
+	}
+}
+
+// one worker which takes 25 time units per request and requests arriving every 10 time units with a timeout of 10: the
+// requests 0 and 2 are processed, the request 2 after waiting 5 time units, while the requests 1 and 3 expire while waiting
+func TestRunVirtual(t *testing.T) {
+	sc := scenario.Scenario{
+		NumReq:      4,
+		Pool:        scenario.Pool{Size: 1},
+		WaitingRoom: scenario.WaitingRoom{Policy: scenario.Drop, Timeout: 10},
+		Arrival:     arrival.Config{Name: arrival.Fixed, Interval: 10},
+		ServiceTime: servicetime.Config{Name: servicetime.Constant, Mean: 25},
+	}
+	if err := sc.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	result, err := RunVirtual(&sc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	unit := sc.Unit()
+	if len(result.Processed) != 2 || result.Processed[0].Param != 0 || result.Processed[1].Param != 2 {
+		t.Fatalf("Expected the requests 0 and 2 to be processed - found %+v", result.Processed)
+	}
+	if len(result.Dropped) != 2 || result.Dropped[0].Param != 1 || result.Dropped[1].Param != 3 {
+		t.Fatalf("Expected the requests 1 and 3 to be dropped - found %+v", result.Dropped)
+	}
+	if wait := result.Processed[1].WaitDuration; wait != 5*unit {
+		t.Errorf("Expected the request 2 to wait 5 time units - found %v", wait)
+	}
+	if waited := result.Dropped[1].WaitingRoomTime(); waited != 10*unit {
+		t.Errorf("Expected the request 3 to be dropped after its timeout - found %v", waited)
+	}
+	// the worker is idle only until the first request arrives
+	if result.AvgIdleTime != 10*unit || result.Processed[1].Result != 2 {
+		t.Errorf("Expected 10 time units of idle time and the param as result - found %v and %v", result.AvgIdleTime, result.Processed[1].Result)
+	}
+}
+
+// the simulations on the virtual clock do not depend on the scheduler, so they give the same results when run in parallel
+func TestRunVirtualInParallel(t *testing.T) {
+	paths := []string{"../../scenarios/incident.yaml", "../../scenarios/closed-loop.json", "../../scenarios/cache.yaml"}
+	for _, path := range paths {
+		results := make([]Result, 4)
+		var wg sync.WaitGroup
+		wg.Add(len(results))
+		for i := range results {
+			go func(i int) {
+				defer wg.Done()
+				sc, err := scenario.Load(path)
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				if results[i], err = RunVirtual(sc); err != nil {
+					t.Error(err)
+				}
+			}(i)
+		}
+		wg.Wait()
+		if t.Failed() {
+			t.FailNow()
+		}
+		first := results[0]
+		if n := len(first.Processed) + len(first.Dropped) + first.CacheHits; n != first.NumReq {
+			t.Errorf("%v: expected %v requests processed, dropped or answered from the cache - found %v", path, first.NumReq, n)
+		}
+		for _, r := range results[1:] {
+			if len(r.Processed) != len(first.Processed) || len(r.Dropped) != len(first.Dropped) || r.Failed != first.Failed ||
+				r.AvgWaitTime != first.AvgWaitTime || r.WaitTimes.Percentile(99) != first.WaitTimes.Percentile(99) ||
+				r.AvgIdleTime != first.AvgIdleTime || r.CacheHits != first.CacheHits {
+				t.Errorf("%v: the results of the same scenario differ", path)
+			}
+		}
+	}
+}
@@ -0,0 +1,341 @@
+package simulation
+
+import (
+	"container/heap"
+	"fmt"
+	"time"
+
+	"github.com/EnricoPicci/drop-pattern-with-timeout/src/arrival"
+	"github.com/EnricoPicci/drop-pattern-with-timeout/src/cache"
+	"github.com/EnricoPicci/drop-pattern-with-timeout/src/faults"
+	"github.com/EnricoPicci/drop-pattern-with-timeout/src/histogram"
+	"github.com/EnricoPicci/drop-pattern-with-timeout/src/request"
+	"github.com/EnricoPicci/drop-pattern-with-timeout/src/scenario"
+	"github.com/EnricoPicci/drop-pattern-with-timeout/src/trace"
+)
+
+// RunVirtual runs the simulation described by the scenario, which must have been validated, on a virtual clock: the arrivals,
+// the processing of the requests and the timeouts are events executed in order of time, with no sleep, so that the result does
+// not depend on the real clock nor on the scheduler and many simulations can run in parallel.
+//
+// The components behave as the waiting room and the pool run by Run: a request is taken in by the worker idle for the longest
+// time or waits, in order of arrival, until a worker is free or its timeout expires, and the faults and the cache are applied
+// at the virtual time of each request. The coalescing of the requests is not simulated on the virtual clock, so a scenario
+// with coalescing has to be run with Run.
+func RunVirtual(sc *scenario.Scenario) (Result, error) {
+	if sc.Coalesce != nil && sc.WaitingRoom.Policy == scenario.Drop {
+		return Result{}, fmt.Errorf("scenario %v: the coalescing of the requests can not be run on a virtual clock", sc.Name)
+	}
+	procTimes, err := sc.NewDistribution()
+	if err != nil {
+		return Result{}, err
+	}
+	v := virtualRun{
+		numReq:    sc.NumReq,
+		unit:      sc.Unit(),
+		epoch:     time.Now(),
+		procTime:  time.Duration(sc.ServiceTime.Mean) * sc.Unit(),
+		faults:    sc.NewFaults(),
+		idle:      make([]int, sc.Pool.Size),
+		idleSince: make([]time.Duration, sc.Pool.Size),
+		result: Result{
+			Policy:        sc.WaitingRoom.Policy,
+			NumReq:        sc.NumReq,
+			Processed:     make([]request.Request, 0, sc.NumReq),
+			Dropped:       []request.Request{},
+			WaitTimes:     histogram.New(),
+			ProcTimes:     histogram.New(),
+			EndToEndTimes: histogram.New(),
+		},
+	}
+	// all the workers are idle when the pool starts
+	for w := range v.idle {
+		v.idle[w] = w
+	}
+	newRequest := newRequestFunc(procTimes)
+	if sc.WaitingRoom.Policy == scenario.Drop {
+		v.timeout = time.Duration(sc.WaitingRoom.Timeout) * v.unit
+		v.cache = sc.NewCache()
+	}
+	if v.cache != nil {
+		v.cache.Now = func() time.Time { return v.at(v.now) }
+		newRequest = withKeys(newRequest, sc.Cache.Keys, sc.Seed)
+	}
+	generator, err := sc.NewGenerator()
+	if err != nil {
+		return Result{}, err
+	}
+
+	switch {
+	case sc.Trace != nil:
+		v.replay(generator.(*trace.Replay), newRequest)
+	case sc.Arrival.Name == arrival.Closed:
+		v.closedLoop(sc.Arrival, newRequest)
+	default:
+		process, err := arrival.NewProcess(sc.Arrival)
+		if err != nil {
+			return Result{}, err
+		}
+		v.openLoop(process, newRequest)
+	}
+	for v.events.Len() > 0 {
+		e := heap.Pop(&v.events).(event)
+		v.now = e.at
+		e.run()
+	}
+
+	v.result.AvgIdleTime = time.Duration(int(v.idleTime) / sc.Pool.Size)
+	v.result.AvgWaitTime = time.Duration(int(v.waitTime) / sc.NumReq)
+	if v.cache != nil {
+		v.result.CacheHits = v.cache.Hits()
+		v.result.CacheMisses = v.cache.Misses()
+		v.result.CacheStale = v.cache.Stale()
+	}
+	return v.result, nil
+}
+
+// the state of a simulation run on a virtual clock - times are durations since the start of the run
+type virtualRun struct {
+	numReq int
+	unit   time.Duration
+	// the real time corresponding to the start of the run, used to set the times of the requests
+	epoch time.Time
+	now   time.Duration
+	// the events to execute and the number of events scheduled, which orders the events at the same time
+	events eventQueue
+	seq    int
+
+	// the processing time of the pool and the timeout of the waiting room - 0 if the policy is none
+	procTime time.Duration
+	timeout  time.Duration
+	faults   *faults.Scenario
+	cache    *cache.Cache
+
+	// the workers idle, from the one idle for the longest time, and when each worker has become idle
+	idle      []int
+	idleSince []time.Duration
+	// the requests waiting for a worker, in order of arrival
+	waiting []*virtualReq
+
+	result   Result
+	idleTime time.Duration
+	waitTime time.Duration
+}
+
+// a request of a virtual run
+type virtualReq struct {
+	req request.Request
+	// if not nil, called when the request has been processed, dropped or answered from the cache
+	answered func()
+	// true if the result of the request has to be stored in the cache when it is processed
+	store   bool
+	taken   bool
+	dropped bool
+}
+
+// returns the real time corresponding to a time of the run
+func (v *virtualRun) at(d time.Duration) time.Time {
+	return v.epoch.Add(d)
+}
+
+func (v *virtualRun) schedule(at time.Duration, run func()) {
+	v.seq++
+	heap.Push(&v.events, event{at: at, seq: v.seq, run: run})
+}
+
+// sends the requests at the intervals generated by the process, as the open loop generators do
+func (v *virtualRun) openLoop(process arrival.Process, newRequest func(i int) request.Request) {
+	var send func(i int)
+	send = func(i int) {
+		v.arrive(newRequest(i), nil)
+		if i+1 < v.numReq {
+			v.schedule(v.now+time.Duration(process.Next())*v.unit, func() { send(i + 1) })
+		}
+	}
+	if v.numReq > 0 {
+		v.schedule(time.Duration(process.Next())*v.unit, func() { send(0) })
+	}
+}
+
+// each client sends a request and, when it has been answered, thinks before sending the next one, as the closed loop
+// generator does
+func (v *virtualRun) closedLoop(cfg arrival.Config, newRequest func(i int) request.Request) {
+	think := arrival.ThinkTimes(cfg)
+	next := 0
+	var send func()
+	send = func() {
+		if next >= v.numReq {
+			return
+		}
+		i := next
+		next++
+		v.arrive(newRequest(i), func() {
+			v.schedule(v.now+time.Duration(think())*v.unit, send)
+		})
+	}
+	for c := 0; c < cfg.NumClients(); c++ {
+		v.schedule(0, send)
+	}
+}
+
+// sends the requests of the trace at their offsets
+func (v *virtualRun) replay(replay *trace.Replay, newRequest func(i int) request.Request) {
+	for i := 0; i < v.numReq; i++ {
+		i := i
+		v.schedule(replay.Offset(i, v.unit), func() {
+			req := newRequest(i)
+			replay.Prepare(i, &req)
+			v.arrive(req, nil)
+		})
+	}
+}
+
+// a request arrives: it is answered from the cache, taken in by an idle worker or put to wait
+func (v *virtualRun) arrive(req request.Request, answered func()) {
+	r := &virtualReq{req: req, answered: answered}
+	r.req.Created = v.at(v.now)
+	if v.cache != nil && req.Key != "" {
+		if stored, ok := v.cache.Lookup(req.Key); ok {
+			cache.Answer(&r.req, stored, false, v.at(v.now))
+			v.answer(r)
+			return
+		}
+		r.store = true
+	}
+	if v.timeout > 0 {
+		r.req.EnteredAt = v.at(v.now)
+		r.req.Expiry = v.at(v.now + v.timeout)
+	} else {
+		// without the waiting room the request is dispatched when it enters the input channel of the pool
+		r.req.DispatchedAt = v.at(v.now)
+	}
+	if len(v.idle) > 0 {
+		w := v.idle[0]
+		v.idle = v.idle[1:]
+		v.dispatch(w, r)
+		return
+	}
+	v.waiting = append(v.waiting, r)
+	if v.timeout > 0 {
+		v.schedule(v.now+v.timeout, func() { v.expire(r) })
+	}
+}
+
+// the timeout of a request expires: it is dropped if it has not been taken in by a worker
+func (v *virtualRun) expire(r *virtualReq) {
+	if r.taken {
+		return
+	}
+	r.dropped = true
+	r.req.Dropped = true
+	r.req.DroppedAt = v.at(v.now)
+	v.result.Dropped = append(v.result.Dropped, r.req)
+	if r.store {
+		if stored, ok := v.cache.LookupStale(r.req.Key); ok {
+			r.req.Dropped = false
+			cache.Answer(&r.req, stored, true, v.at(v.now))
+		}
+	}
+	v.answer(r)
+}
+
+// the worker takes in the request and, after the halts and stalls affecting it, processes it
+func (v *virtualRun) dispatch(w int, r *virtualReq) {
+	r.taken = true
+	v.idleTime = v.idleTime + v.now - v.idleSince[w]
+	if r.req.DispatchedAt.IsZero() {
+		r.req.DispatchedAt = v.at(v.now)
+	}
+	start := v.now
+	procTime := v.procTime
+	if r.req.ProcTime > 0 {
+		procTime = time.Duration(r.req.ProcTime) * v.unit
+	}
+	if v.faults != nil {
+		// faults can follow one another, so we check again after each wait
+		for wait := v.faults.StallFor(w, start, v.unit); wait > 0; wait = v.faults.StallFor(w, start, v.unit) {
+			start = start + wait
+		}
+		procTime = v.faults.ProcTime(procTime, start, v.unit)
+	}
+	r.req.StartedAt = v.at(start)
+	r.req.WaitDuration = r.req.StartedAt.Sub(r.req.Created)
+	v.schedule(start+procTime, func() { v.complete(w, r) })
+}
+
+// the worker completes the processing of the request and takes in the request waiting for the longest time, if any
+func (v *virtualRun) complete(w int, r *virtualReq) {
+	if v.faults != nil {
+		r.req.Failed = v.faults.Fail(v.now, v.unit)
+	}
+	// the result of the simulated processing is the param of the request, as for the workers of the pool
+	r.req.Result = r.req.Param
+	r.req.CompletedAt = v.at(v.now)
+	v.result.Processed = append(v.result.Processed, r.req)
+	if r.req.Failed {
+		v.result.Failed++
+	}
+	v.waitTime = v.waitTime + r.req.WaitDuration
+	v.result.WaitTimes.Record(r.req.WaitDuration)
+	v.result.ProcTimes.Record(r.req.ProcessingTime())
+	v.result.EndToEndTimes.Record(r.req.CompletedAt.Sub(r.req.Created))
+	if r.store && !r.req.Failed {
+		v.cache.Put(r.req.Key, r.req)
+	}
+	v.answer(r)
+
+	v.idleSince[w] = v.now
+	for len(v.waiting) > 0 {
+		next := v.waiting[0]
+		v.waiting = v.waiting[1:]
+		// a request whose timeout expires now is left to be dropped
+		if next.dropped || (v.timeout > 0 && !v.at(v.now).Before(next.req.Expiry)) {
+			continue
+		}
+		v.dispatch(w, next)
+		return
+	}
+	v.idle = append(v.idle, w)
+}
+
+func (v *virtualRun) answer(r *virtualReq) {
+	if r.answered != nil {
+		r.answered()
+	}
+}
+
+// an event of a virtual run
+type event struct {
+	at  time.Duration
+	seq int
+	run func()
+}
+
+// the events ordered by time and, at the same time, in the order they have been scheduled - it implements heap.Interface
+type eventQueue []event
+
+func (q eventQueue) Len() int {
+	return len(q)
+}
+
+func (q eventQueue) Less(i, j int) bool {
+	if q[i].at != q[j].at {
+		return q[i].at < q[j].at
+	}
+	return q[i].seq < q[j].seq
+}
+
+func (q eventQueue) Swap(i, j int) {
+	q[i], q[j] = q[j], q[i]
+}
+
+func (q *eventQueue) Push(x interface{}) {
+	*q = append(*q, x.(event))
+}
+
+func (q *eventQueue) Pop() interface{} {
+	old := *q
+	e := old[len(old)-1]
+	*q = old[:len(old)-1]
+	return e
+}
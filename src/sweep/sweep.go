@@ -0,0 +1,382 @@
+package main
+
+import (
+	"encoding/csv"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/EnricoPicci/drop-pattern-with-timeout/src/arrival"
+	"github.com/EnricoPicci/drop-pattern-with-timeout/src/faults"
+	"github.com/EnricoPicci/drop-pattern-with-timeout/src/report"
+	"github.com/EnricoPicci/drop-pattern-with-timeout/src/scenario"
+	"github.com/EnricoPicci/drop-pattern-with-timeout/src/servicetime"
+	"github.com/EnricoPicci/drop-pattern-with-timeout/src/simulation"
+)
+
+// In this example we run the same scenario many times, with and without the drop pattern, varying its parameters,
+// so that the timeout can be chosen looking at the data - the simulations run on a virtual clock, so they can run in parallel
+// and their results do not depend on the load of the machine
+
+func main() {
+	scenarioFile := flag.String("scenario", "", "path of the yaml or json scenario used as base - if not set a balanced system with 10 workers is used")
+	timeouts := flag.String("timeouts", "250:1000:250", "timeouts to try, as a list (100,200) or a range (from:to:step)")
+	poolSizes := flag.String("poolSizes", "", "pool sizes to try, as a list or a range - if not set the size of the base scenario is used")
+	reqIntervals := flag.String("reqIntervals", "", "intervals between requests to try, as a list or a range - if not set the interval of the base scenario is used")
+	haltDurations := flag.String("haltDurations", "0,2000", "durations of the halt of the pool to try, as a list or a range - they replace the halts of the base scenario")
+	haltTime := flag.Int("haltTime", 1000, "at which time (after start) the pool is halted")
+	parallel := flag.Int("parallel", runtime.NumCPU(), "number of simulations run in parallel")
+	out := flag.String("out", "", "path of the csv file where the results are written - if not set a table is printed on the console")
+	reportFile := flag.String("report", "", "path of an html file where the charts of the wait percentiles and of the drop rate per timeout are written")
+	flag.Parse()
+
+	base, err := baseScenario(*scenarioFile)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	runs, err := buildRuns(base, *timeouts, *poolSizes, *reqIntervals, *haltDurations, *haltTime)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	fmt.Printf("Running %v simulations, %v in parallel\n", len(runs), *parallel)
+	results, err := sweep(runs, *parallel)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	if *reportFile != "" {
+		if err := report.WriteFile(*reportFile, sweepReport(results)); err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		fmt.Printf("Report written to %v\n", *reportFile)
+	}
+	if *out == "" {
+		writeTable(os.Stdout, results)
+		return
+	}
+	f, err := os.Create(*out)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	defer f.Close()
+	if err := writeCsv(f, results); err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	fmt.Printf("Results written to %v\n", *out)
+}
+
+// the parameters of a single simulation of the sweep
+type run struct {
+	policy       string
+	timeout      int
+	poolSize     int
+	reqInterval  int
+	haltDuration int
+	scenario     *scenario.Scenario
+}
+
+// the outcome of a single simulation - times are expressed in time units
+type row struct {
+	run
+	processed int
+	dropped   int
+	dropRate  float64
+	avgWait   float64
+	p50       float64
+	p90       float64
+	p99       float64
+	p999      float64
+	maxWait   float64
+	avgIdle   float64
+}
+
+// returns the scenario loaded from the file or, if no file is passed, a balanced system
+func baseScenario(path string) (*scenario.Scenario, error) {
+	if path != "" {
+		return scenario.Load(path)
+	}
+	sc := scenario.Scenario{
+		NumReq:      100,
+		Seed:        1,
+		Pool:        scenario.Pool{Size: 10},
+		WaitingRoom: scenario.WaitingRoom{Policy: scenario.Drop, Timeout: 500},
+		Arrival:     arrival.Config{Name: arrival.Fixed, Interval: 100},
+		ServiceTime: servicetime.Config{Name: servicetime.Constant, Mean: 1000},
+	}
+	return &sc, sc.Validate()
+}
+
+// returns all the combinations of the parameters - the no-drop simulations do not depend on the timeout and so they are run
+// only once for each combination of the other parameters
+func buildRuns(base *scenario.Scenario, timeouts, poolSizes, reqIntervals, haltDurations string, haltTime int) ([]run, error) {
+	timeoutValues, err := parseValues("timeouts", timeouts, base.WaitingRoom.Timeout)
+	if err != nil {
+		return nil, err
+	}
+	poolSizeValues, err := parseValues("poolSizes", poolSizes, base.Pool.Size)
+	if err != nil {
+		return nil, err
+	}
+	reqIntervalValues, err := parseValues("reqIntervals", reqIntervals, base.Arrival.Interval)
+	if err != nil {
+		return nil, err
+	}
+	haltDurationValues, err := parseValues("haltDurations", haltDurations, -1)
+	if err != nil {
+		return nil, err
+	}
+
+	runs := make([]run, 0)
+	for _, poolSize := range poolSizeValues {
+		for _, reqInterval := range reqIntervalValues {
+			for _, haltDuration := range haltDurationValues {
+				r := run{policy: scenario.NoDrop, poolSize: poolSize, reqInterval: reqInterval, haltDuration: haltDuration}
+				runs = append(runs, r)
+				for _, timeout := range timeoutValues {
+					r.policy = scenario.Drop
+					r.timeout = timeout
+					runs = append(runs, r)
+				}
+			}
+		}
+	}
+	for i := range runs {
+		sc, err := runScenario(base, runs[i], haltTime)
+		if err != nil {
+			return nil, err
+		}
+		runs[i].scenario = sc
+	}
+	return runs, nil
+}
+
+// returns a copy of the base scenario with the parameters of the run
+func runScenario(base *scenario.Scenario, r run, haltTime int) (*scenario.Scenario, error) {
+	sc := *base
+	sc.Pool.Size = r.poolSize
+	sc.Arrival.Interval = r.reqInterval
+	sc.WaitingRoom = scenario.WaitingRoom{Policy: r.policy, Timeout: r.timeout}
+	// a halt duration of -1 means that the halts of the base scenario are kept
+	if r.haltDuration >= 0 {
+		fs := make([]faults.Fault, 0, len(base.FaultTimeline.Faults)+1)
+		for _, f := range base.FaultTimeline.Faults {
+			if f.Kind != faults.Halt {
+				fs = append(fs, f)
+			}
+		}
+		if r.haltDuration > 0 {
+			fs = append(fs, faults.HaltWindow(haltTime, r.haltDuration))
+		}
+		sc.FaultTimeline.Faults = fs
+	}
+	if err := sc.Validate(); err != nil {
+		return nil, err
+	}
+	return &sc, nil
+}
+
+// runs the simulations on the virtual clock, "parallel" at a time, and returns the results in the same order of the runs
+func sweep(runs []run, parallel int) ([]row, error) {
+	if parallel < 1 {
+		parallel = 1
+	}
+	rows := make([]row, len(runs))
+	errs := make([]error, len(runs))
+	var muDone sync.Mutex
+	done := 0
+
+	// a buffered channel used as semaphore to limit the number of simulations running at the same time
+	sem := make(chan struct{}, parallel)
+	var wg sync.WaitGroup
+	wg.Add(len(runs))
+	for i := range runs {
+		sem <- struct{}{}
+		go func(i int) {
+			defer wg.Done()
+			defer func() { <-sem }()
+
+			result, err := simulation.RunVirtual(runs[i].scenario)
+			rows[i] = newRow(runs[i], result)
+			errs[i] = err
+
+			muDone.Lock()
+			done++
+			fmt.Printf("Completed %v of %v\n", done, len(runs))
+			muDone.Unlock()
+		}(i)
+	}
+	wg.Wait()
+
+	for _, err := range errs {
+		if err != nil {
+			return nil, err
+		}
+	}
+	return rows, nil
+}
+
+func newRow(r run, result simulation.Result) row {
+	unit := float64(r.scenario.Unit())
+	toUnits := func(d time.Duration) float64 {
+		return float64(d) / unit
+	}
+	return row{
+		run:       r,
+		processed: len(result.Processed),
+		dropped:   len(result.Dropped),
+		dropRate:  result.DropRate(),
+		avgWait:   toUnits(result.AvgWaitTime),
+		p50:       toUnits(result.WaitTimes.Percentile(50)),
+		p90:       toUnits(result.WaitTimes.Percentile(90)),
+		p99:       toUnits(result.WaitTimes.Percentile(99)),
+		p999:      toUnits(result.WaitTimes.Percentile(99.9)),
+		maxWait:   toUnits(result.WaitTimes.Max()),
+		avgIdle:   toUnits(result.AvgIdleTime),
+	}
+}
+
+var header = []string{
+	"policy", "timeout", "poolSize", "reqInterval", "haltDuration",
+	"processed", "dropped", "dropRate", "avgWait", "p50Wait", "p90Wait", "p99Wait", "p999Wait", "maxWait", "avgIdle",
+}
+
+func (r row) values() []string {
+	timeout := "-"
+	if r.policy == scenario.Drop {
+		timeout = strconv.Itoa(r.timeout)
+	}
+	haltDuration := "base"
+	if r.haltDuration >= 0 {
+		haltDuration = strconv.Itoa(r.haltDuration)
+	}
+	f := func(v float64) string {
+		return strconv.FormatFloat(v, 'f', 1, 64)
+	}
+	return []string{
+		r.policy, timeout, strconv.Itoa(r.poolSize), strconv.Itoa(r.reqInterval), haltDuration,
+		strconv.Itoa(r.processed), strconv.Itoa(r.dropped), strconv.FormatFloat(r.dropRate, 'f', 3, 64),
+		f(r.avgWait), f(r.p50), f(r.p90), f(r.p99), f(r.p999), f(r.maxWait), f(r.avgIdle),
+	}
+}
+
+func writeCsv(w io.Writer, rows []row) error {
+	writer := csv.NewWriter(w)
+	if err := writer.Write(header); err != nil {
+		return err
+	}
+	for _, r := range rows {
+		if err := writer.Write(r.values()); err != nil {
+			return err
+		}
+	}
+	writer.Flush()
+	return writer.Error()
+}
+
+func writeTable(w io.Writer, rows []row) {
+	fmt.Fprint(w, "\nAll times are expressed in time units\n\n")
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintln(tw, strings.Join(header, "\t")+"\t")
+	for _, r := range rows {
+		fmt.Fprintln(tw, strings.Join(r.values(), "\t")+"\t")
+	}
+	tw.Flush()
+}
+
+// returns a report with the p99 wait time and the drop rate per timeout - there is a line for each combination of the other
+// parameters, and the p99 wait time of the corresponding no-drop run is shown as a dashed line
+func sweepReport(rows []row) report.Report {
+	p99Chart := report.Chart{Title: "p99 wait time per timeout", XLabel: "timeout", YLabel: "p99 wait time"}
+	dropChart := report.Chart{Title: "Drop rate per timeout", XLabel: "timeout", YLabel: "drop rate"}
+	minTimeout, maxTimeout := 0, 0
+	for _, r := range rows {
+		if r.policy == scenario.Drop && (maxTimeout == 0 || r.timeout < minTimeout) {
+			minTimeout = r.timeout
+		}
+		if r.policy == scenario.Drop && r.timeout > maxTimeout {
+			maxTimeout = r.timeout
+		}
+	}
+
+	// the rows are grouped by the parameters other than the timeout, each group starting with its no-drop row
+	for i := 0; i < len(rows); {
+		noDrop := rows[i]
+		haltDuration := "base"
+		if noDrop.haltDuration >= 0 {
+			haltDuration = strconv.Itoa(noDrop.haltDuration)
+		}
+		name := fmt.Sprintf("pool %v - interval %v - halt %v", noDrop.poolSize, noDrop.reqInterval, haltDuration)
+		p99 := make([][2]float64, 0)
+		dropRate := make([][2]float64, 0)
+		for i++; i < len(rows) && rows[i].policy == scenario.Drop; i++ {
+			p99 = append(p99, [2]float64{float64(rows[i].timeout), rows[i].p99})
+			dropRate = append(dropRate, [2]float64{float64(rows[i].timeout), rows[i].dropRate})
+		}
+		p99Chart.Series = append(p99Chart.Series,
+			report.Series{Name: name, Style: report.Line, Points: p99},
+			report.Series{Name: name + " no drop", Style: report.Line, Dashed: true,
+				Points: [][2]float64{{float64(minTimeout), noDrop.p99}, {float64(maxTimeout), noDrop.p99}}},
+		)
+		dropChart.Series = append(dropChart.Series, report.Series{Name: name, Style: report.Line, Points: dropRate})
+	}
+	return report.Report{
+		Title:  "Sweep of the drop pattern with timeout",
+		Notes:  []string{"All times are expressed in time units"},
+		Charts: []report.Chart{p99Chart, dropChart},
+	}
+}
+
+// parses a list of values (100,200,500) or a range (from:to:step) - if the string is empty the default value is returned
+func parseValues(name string, s string, defaultValue int) ([]int, error) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return []int{defaultValue}, nil
+	}
+	if strings.Contains(s, ":") {
+		parts := strings.Split(s, ":")
+		if len(parts) != 3 {
+			return nil, fmt.Errorf("%v: a range must be expressed as from:to:step", name)
+		}
+		bounds := make([]int, 3)
+		for i, p := range parts {
+			v, err := strconv.Atoi(strings.TrimSpace(p))
+			if err != nil {
+				return nil, fmt.Errorf("%v: %q is not a number", name, p)
+			}
+			bounds[i] = v
+		}
+		if bounds[2] <= 0 || bounds[1] < bounds[0] {
+			return nil, fmt.Errorf("%v: the step must be greater than 0 and from not greater than to", name)
+		}
+		values := make([]int, 0)
+		for v := bounds[0]; v <= bounds[1]; v = v + bounds[2] {
+			values = append(values, v)
+		}
+		return values, nil
+	}
+	values := make([]int, 0)
+	for _, p := range strings.Split(s, ",") {
+		v, err := strconv.Atoi(strings.TrimSpace(p))
+		if err != nil {
+			return nil, fmt.Errorf("%v: %q is not a number", name, p)
+		}
+		values = append(values, v)
+	}
+	sort.Ints(values)
+	return values, nil
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/EnricoPicci/drop-pattern-with-timeout/src/faults"
+	"github.com/EnricoPicci/drop-pattern-with-timeout/src/scenario"
+)
+
+func TestParseValues(t *testing.T) {
+	values, err := parseValues("timeouts", "100:400:100", 0)
+	if err != nil || !reflect.DeepEqual(values, []int{100, 200, 300, 400}) {
+		t.Errorf("Unexpected values for a range %v - %v", values, err)
+	}
+	values, err = parseValues("timeouts", "500, 100", 0)
+	if err != nil || !reflect.DeepEqual(values, []int{100, 500}) {
+		t.Errorf("Unexpected values for a list %v - %v", values, err)
+	}
+	values, err = parseValues("timeouts", "", 7)
+	if err != nil || !reflect.DeepEqual(values, []int{7}) {
+		t.Errorf("The default value should be returned for an empty string %v - %v", values, err)
+	}
+	if _, err = parseValues("timeouts", "1:10", 0); err == nil {
+		t.Error("A range without step should be an error")
+	}
+}
+
+// each combination of the parameters is run once without drop pattern and once for each timeout with the drop pattern
+func TestBuildRuns(t *testing.T) {
+	base, err := baseScenario("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	runs, err := buildRuns(base, "250,500", "5,10", "", "0,2000", 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 2 pool sizes * 2 halt durations * (1 no-drop + 2 timeouts)
+	if len(runs) != 12 {
+		t.Fatalf("There should be 12 runs - found %v", len(runs))
+	}
+	last := runs[len(runs)-1]
+	if last.policy != scenario.Drop || last.timeout != 500 || last.poolSize != 10 || last.haltDuration != 2000 {
+		t.Errorf("Unexpected parameters of the last run %+v", last)
+	}
+	sc := last.scenario
+	if sc.Pool.Size != 10 || sc.WaitingRoom.Timeout != 500 || len(sc.FaultTimeline.Faults) != 1 || sc.FaultTimeline.Faults[0].Kind != faults.Halt {
+		t.Errorf("The scenario of the run does not match its parameters %+v", sc)
+	}
+	// the base scenario must not be changed by the runs
+	if base.Pool.Size != 10 || len(base.FaultTimeline.Faults) != 0 {
+		t.Errorf("The base scenario has been changed %+v", base)
+	}
+}
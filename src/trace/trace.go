@@ -0,0 +1,181 @@
+package trace
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/EnricoPicci/drop-pattern-with-timeout/src/request"
+)
+
+// Record is a request recorded in a trace - times are expressed in time units
+type Record struct {
+	// the time at which the request arrived, relative to the start of the trace
+	Offset int `json:"offset"`
+	// the time it took to process the request
+	ServiceTime int    `json:"serviceTime"`
+	Priority    int    `json:"priority"`
+	Tenant      string `json:"tenant"`
+}
+
+// Load reads a trace from a csv file (extension .csv) or from a json-lines file (any other extension).
+//
+// The columns of the csv file are offset, serviceTime, priority and tenant - a first line with these names is
+// treated as header and skipped. Each line of a json-lines file is a json object like this one
+//
+//	{"offset": 120, "serviceTime": 850, "priority": 1, "tenant": "acme"}
+//
+// The records returned are sorted by offset.
+func Load(path string) ([]Record, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var records []Record
+	if strings.ToLower(filepath.Ext(path)) == ".csv" {
+		records, err = readCsv(f)
+	} else {
+		records, err = readJsonLines(f)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("trace %v: %w", path, err)
+	}
+	sort.SliceStable(records, func(i, j int) bool { return records[i].Offset < records[j].Offset })
+	return records, nil
+}
+
+func readCsv(r io.Reader) ([]Record, error) {
+	reader := csv.NewReader(r)
+	// priority and tenant are optional
+	reader.FieldsPerRecord = -1
+	reader.TrimLeadingSpace = true
+
+	records := make([]Record, 0)
+	line := 0
+	for {
+		fields, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		line++
+		if line == 1 && strings.EqualFold(fields[0], "offset") {
+			continue
+		}
+		if len(fields) < 2 {
+			return nil, fmt.Errorf("line %v: offset and serviceTime are mandatory", line)
+		}
+		rec := Record{}
+		if rec.Offset, err = strconv.Atoi(fields[0]); err != nil {
+			return nil, fmt.Errorf("line %v: invalid offset %q", line, fields[0])
+		}
+		if rec.ServiceTime, err = strconv.Atoi(fields[1]); err != nil {
+			return nil, fmt.Errorf("line %v: invalid serviceTime %q", line, fields[1])
+		}
+		if len(fields) > 2 && fields[2] != "" {
+			if rec.Priority, err = strconv.Atoi(fields[2]); err != nil {
+				return nil, fmt.Errorf("line %v: invalid priority %q", line, fields[2])
+			}
+		}
+		if len(fields) > 3 {
+			rec.Tenant = fields[3]
+		}
+		if err := rec.validate(); err != nil {
+			return nil, fmt.Errorf("line %v: %w", line, err)
+		}
+		records = append(records, rec)
+	}
+	return records, nil
+}
+
+func readJsonLines(r io.Reader) ([]Record, error) {
+	records := make([]Record, 0)
+	scanner := bufio.NewScanner(r)
+	line := 0
+	for scanner.Scan() {
+		line++
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" {
+			continue
+		}
+		rec := Record{}
+		if err := json.Unmarshal([]byte(text), &rec); err != nil {
+			return nil, fmt.Errorf("line %v: %w", line, err)
+		}
+		if err := rec.validate(); err != nil {
+			return nil, fmt.Errorf("line %v: %w", line, err)
+		}
+		records = append(records, rec)
+	}
+	return records, scanner.Err()
+}
+
+// a negative offset would send the request before the start of the replay and a negative service time can not be simulated
+func (rec Record) validate() error {
+	if rec.Offset < 0 {
+		return fmt.Errorf("offset %v can not be negative", rec.Offset)
+	}
+	if rec.ServiceTime < 0 {
+		return fmt.Errorf("serviceTime %v can not be negative", rec.ServiceTime)
+	}
+	return nil
+}
+
+// Replay sends the requests with the exact timings recorded in a trace, optionally scaled.
+// It implements the arrival.Generator interface.
+type Replay struct {
+	records []Record
+	// the factor applied to offsets and service times - e.g. 0.5 replays the trace twice as fast
+	scale float64
+}
+
+// NewReplay returns a replay of the records - a scale of 1 replays the trace with the timings recorded
+func NewReplay(records []Record, scale float64) *Replay {
+	r := Replay{records: records, scale: scale}
+	return &r
+}
+
+// Run sends the first "numReq" requests of the trace (or all of them if the trace is shorter) to "submit", each one at its offset
+// from the start of the replay and carrying its own service time, priority and tenant
+func (r *Replay) Run(numReq int, timeUnit time.Duration, newReq func(i int) request.Request, submit func(req request.Request)) {
+	start := time.Now()
+	for i := range r.records {
+		if i >= numReq {
+			return
+		}
+		// we wait until the offset from the start, rather than sleeping for the interval, so that delays do not accumulate
+		offset := r.Offset(i, timeUnit)
+		time.Sleep(time.Until(start.Add(offset)))
+
+		req := newReq(i)
+		r.Prepare(i, &req)
+		submit(req)
+	}
+}
+
+// Offset returns the time, scaled, at which the i-th request of the trace is sent from the start of the replay
+func (r *Replay) Offset(i int, timeUnit time.Duration) time.Duration {
+	return time.Duration(float64(r.records[i].Offset) * r.scale * float64(timeUnit))
+}
+
+// Prepare sets the service time, scaled, the priority and the tenant recorded for the i-th request of the trace on the request
+func (r *Replay) Prepare(i int, req *request.Request) {
+	rec := r.records[i]
+	// a request takes at least 1 time unit, since a processing time of 0 means that the processing time of the pool is used
+	req.ProcTime = int(math.Max(1, math.Round(float64(rec.ServiceTime)*r.scale)))
+	req.Priority = rec.Priority
+	req.Tenant = rec.Tenant
+}
@@ -0,0 +1,90 @@
+package trace
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/EnricoPicci/drop-pattern-with-timeout/src/request"
+)
+
+func TestLoadCsv(t *testing.T) {
+	records, err := Load("example-trace.csv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 20 {
+		t.Fatalf("The trace should contain 20 records - found %v", len(records))
+	}
+	expected := Record{Offset: 150, ServiceTime: 870, Priority: 2, Tenant: "globex"}
+	if records[2] != expected {
+		t.Errorf("The third record should be %v - found %v", expected, records[2])
+	}
+}
+
+func TestLoadJsonLines(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "trace.jsonl")
+	data := `{"offset": 20, "serviceTime": 5, "tenant": "b"}
+
+{"offset": 10, "serviceTime": 7, "priority": 1, "tenant": "a"}
+`
+	if err := os.WriteFile(path, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+	records, err := Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the records are sorted by offset
+	if len(records) != 2 || records[0].Tenant != "a" || records[1].Tenant != "b" {
+		t.Errorf("Unexpected records %v", records)
+	}
+}
+
+// negative offsets and service times are rejected with the line where they are found
+func TestNegativeTimings(t *testing.T) {
+	dir := t.TempDir()
+	for name, data := range map[string]string{
+		"offset.csv":        "offset,serviceTime\n-20,5\n",
+		"serviceTime.csv":   "offset,serviceTime\n20,-5\n",
+		"offset.jsonl":      `{"offset": 10, "serviceTime": 5}` + "\n" + `{"offset": -20, "serviceTime": 5}` + "\n",
+		"serviceTime.jsonl": `{"offset": 10, "serviceTime": 5}` + "\n" + `{"offset": 20, "serviceTime": -5}` + "\n",
+	} {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+		field := strings.TrimSuffix(name, filepath.Ext(name))
+		_, err := Load(path)
+		if err == nil || !strings.Contains(err.Error(), "line 2: "+field) {
+			t.Errorf("%v: the negative %v should be rejected at line 2 - found %v", name, field, err)
+		}
+	}
+}
+
+// the replay sends the requests at their offsets and with their own service time, both scaled
+func TestReplay(t *testing.T) {
+	records := []Record{{Offset: 0, ServiceTime: 10}, {Offset: 40, ServiceTime: 20, Priority: 3, Tenant: "a"}}
+	replay := NewReplay(records, 0.5)
+
+	timeUnit := time.Millisecond
+	start := time.Now()
+	sent := make([]request.Request, 0)
+	arrivals := make([]time.Duration, 0)
+	replay.Run(10, timeUnit, func(i int) request.Request { return request.Request{Param: i} }, func(req request.Request) {
+		sent = append(sent, req)
+		arrivals = append(arrivals, time.Since(start))
+	})
+
+	if len(sent) != 2 {
+		t.Fatalf("All the records of the trace should have been replayed - replayed %v", len(sent))
+	}
+	if sent[1].ProcTime != 10 || sent[1].Priority != 3 || sent[1].Tenant != "a" {
+		t.Errorf("The request does not carry the data of the trace %v", sent[1])
+	}
+	if arrivals[1] < 20*timeUnit {
+		t.Errorf("The second request should arrive after 20ms - it arrived after %v", arrivals[1])
+	}
+}
@@ -0,0 +1,193 @@
+package tracing
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+)
+
+// Memory is an exporter which keeps all the spans in memory, e.g. to check them in tests
+type Memory struct {
+	mu    sync.Mutex
+	spans []Span
+}
+
+// NewMemory returns an empty memory exporter
+func NewMemory() *Memory {
+	m := Memory{spans: make([]Span, 0)}
+	return &m
+}
+
+func (m *Memory) Export(spans []Span) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.spans = append(m.spans, spans...)
+	return nil
+}
+
+// Spans returns the spans exported so far
+func (m *Memory) Spans() []Span {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	spans := make([]Span, len(m.spans))
+	copy(spans, m.spans)
+	return spans
+}
+
+// OTLPFile is an exporter which writes the spans in the OTLP json format, one ExportTraceServiceRequest per line, which is the
+// format read by the file receiver of the OpenTelemetry collector
+type OTLPFile struct {
+	mu          sync.Mutex
+	w           io.Writer
+	file        *os.File
+	serviceName string
+}
+
+// NewOTLPWriter returns an exporter writing the spans on w, as produced by a service with the name passed
+func NewOTLPWriter(w io.Writer, serviceName string) *OTLPFile {
+	e := OTLPFile{w: w, serviceName: serviceName}
+	return &e
+}
+
+// NewOTLPFile returns an exporter writing the spans on the file at path, which is created or truncated
+func NewOTLPFile(path string, serviceName string) (*OTLPFile, error) {
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	e := NewOTLPWriter(f, serviceName)
+	e.file = f
+	return e, nil
+}
+
+// Close closes the file, if the exporter writes on a file
+func (e *OTLPFile) Close() error {
+	if e.file == nil {
+		return nil
+	}
+	return e.file.Close()
+}
+
+// the OTLP json messages - the 64 bit integers are encoded as strings, as required by the protobuf json mapping
+type otlpRequest struct {
+	ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+}
+
+type otlpResourceSpans struct {
+	Resource   otlpResource     `json:"resource"`
+	ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+}
+
+type otlpResource struct {
+	Attributes []otlpAttribute `json:"attributes"`
+}
+
+type otlpScopeSpans struct {
+	Scope otlpScope  `json:"scope"`
+	Spans []otlpSpan `json:"spans"`
+}
+
+type otlpScope struct {
+	Name string `json:"name"`
+}
+
+type otlpSpan struct {
+	TraceID           string          `json:"traceId"`
+	SpanID            string          `json:"spanId"`
+	ParentSpanID      string          `json:"parentSpanId,omitempty"`
+	Name              string          `json:"name"`
+	Kind              int             `json:"kind"`
+	StartTimeUnixNano string          `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string          `json:"endTimeUnixNano"`
+	Attributes        []otlpAttribute `json:"attributes,omitempty"`
+	Status            otlpStatus      `json:"status"`
+}
+
+type otlpAttribute struct {
+	Key   string    `json:"key"`
+	Value otlpValue `json:"value"`
+}
+
+type otlpValue struct {
+	StringValue *string `json:"stringValue,omitempty"`
+	IntValue    *string `json:"intValue,omitempty"`
+	BoolValue   *bool   `json:"boolValue,omitempty"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code,omitempty"`
+	Message string `json:"message,omitempty"`
+}
+
+// the span kind internal and the status codes of OTLP
+const (
+	otlpKindInternal = 1
+	otlpStatusOk     = 1
+	otlpStatusError  = 2
+)
+
+// the name of the instrumentation scope of the spans
+const scopeName = "github.com/EnricoPicci/drop-pattern-with-timeout"
+
+func (e *OTLPFile) Export(spans []Span) error {
+	out := make([]otlpSpan, len(spans))
+	for i, s := range spans {
+		out[i] = otlpSpan{
+			TraceID:           s.TraceID,
+			SpanID:            s.SpanID,
+			ParentSpanID:      s.ParentSpanID,
+			Name:              s.Name,
+			Kind:              otlpKindInternal,
+			StartTimeUnixNano: strconv.FormatInt(s.Start.UnixNano(), 10),
+			EndTimeUnixNano:   strconv.FormatInt(s.End.UnixNano(), 10),
+			Attributes:        otlpAttributes(s.Attributes),
+			Status:            otlpStatus{Code: otlpStatusOk},
+		}
+		if s.Error {
+			out[i].Status = otlpStatus{Code: otlpStatusError, Message: s.StatusMessage}
+		}
+	}
+	req := otlpRequest{ResourceSpans: []otlpResourceSpans{{
+		Resource:   otlpResource{Attributes: otlpAttributes(map[string]interface{}{"service.name": e.serviceName})},
+		ScopeSpans: []otlpScopeSpans{{Scope: otlpScope{Name: scopeName}, Spans: out}},
+	}}}
+	data, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	_, err = e.w.Write(append(data, '\n'))
+	return err
+}
+
+// returns the attributes sorted by key, so that the output is stable
+func otlpAttributes(attributes map[string]interface{}) []otlpAttribute {
+	keys := make([]string, 0, len(attributes))
+	for k := range attributes {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	out := make([]otlpAttribute, len(keys))
+	for i, k := range keys {
+		var v otlpValue
+		switch value := attributes[k].(type) {
+		case int:
+			s := strconv.Itoa(value)
+			v.IntValue = &s
+		case bool:
+			v.BoolValue = &value
+		case string:
+			v.StringValue = &value
+		default:
+			s := fmt.Sprint(value)
+			v.StringValue = &s
+		}
+		out[i] = otlpAttribute{Key: k, Value: v}
+	}
+	return out
+}
@@ -0,0 +1,331 @@
+package tracing
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/EnricoPicci/drop-pattern-with-timeout/src/events"
+)
+
+// the names of the spans of the lifecycle of a request
+const (
+	// the whole life of the request, from when it enters the waiting room to when it is processed or dropped
+	RequestSpan = "request"
+	// the time spent in the waiting room, until the request is sent to the pool or dropped
+	WaitingRoomSpan = "waiting room"
+	// the time from when the request is sent to the pool to when a worker starts processing it
+	HandOffSpan = "hand-off"
+	// the processing of the request on a worker
+	ExecutionSpan = "execution"
+	// the time a request dropped by a worker in batch mode has spent in the batch, from when it has been sent to the pool
+	BatchingSpan = "batching"
+)
+
+// Span is a timed operation of the lifecycle of a request, identified as in OpenTelemetry by a trace id and a span id
+type Span struct {
+	// hex encoded ids, 32 characters for the trace id and 16 for the span ids - the parent span id is empty for a root span
+	TraceID      string
+	SpanID       string
+	ParentSpanID string
+	Name         string
+	Start        time.Time
+	End          time.Time
+	// the values of the attributes can be strings, ints or bools
+	Attributes map[string]interface{}
+	// true if the operation has failed, e.g. the request has been dropped
+	Error         bool
+	StatusMessage string
+}
+
+// Exporter receives the spans of each request when its lifecycle is over
+type Exporter interface {
+	Export(spans []Span) error
+}
+
+// Buffer is the number of requests whose spans can wait to be exported
+const Buffer = 1024
+
+// Tracer builds the spans of the requests from the events emitted by the waiting room and the worker pool, so it has to be set
+// as their events sink, and sends them to an exporter when a request is completed or dropped.
+// If a request carries a W3C trace context its spans belong to that trace, with the request span child of the incoming span.
+// The spans are exported in a separate goroutine, through a buffer, so that a slow exporter, e.g. one writing on a file, never
+// blocks the waiting room and the worker pool - if the buffer is full the spans of the request are discarded and counted as lost.
+type Tracer struct {
+	exporter Exporter
+	queue    chan []Span
+	exported chan struct{}
+
+	mu sync.Mutex
+	// the requests whose lifecycle is not over
+	open map[string]*lifecycle
+	// true after the tracer has been flushed or closed
+	flushed bool
+	lost    int
+
+	// the first error returned by the exporter
+	muErr sync.Mutex
+	err   error
+}
+
+// the events received for a request whose lifecycle is not over - the events of a request are emitted by different goroutines,
+// e.g. a worker can emit the started event before the waiting room emits the dispatched one, so the spans are built only when
+// all the events have been received
+type lifecycle struct {
+	admitted   *events.Event
+	dispatched *events.Event
+	started    *events.Event
+	completed  *events.Event
+	dropped    *events.Event
+	// dropped by a worker in batch mode
+	batchDropped *events.Event
+}
+
+// New returns a tracer which exports the spans to the exporter passed - the tracer exports the spans in a goroutine which runs
+// until Flush or Close is called, so one of them has to be called when the tracer is no longer used
+func New(exporter Exporter) *Tracer {
+	t := Tracer{
+		exporter: exporter,
+		queue:    make(chan []Span, Buffer),
+		exported: make(chan struct{}),
+		open:     make(map[string]*lifecycle),
+	}
+	go func() {
+		defer close(t.exported)
+		for spans := range t.queue {
+			t.export(spans)
+		}
+	}()
+	return &t
+}
+
+// Emit records the event of the request it refers to and, if the lifecycle of the request is over, exports its spans
+func (t *Tracer) Emit(e events.Event) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.flushed {
+		return
+	}
+
+	l, ok := t.open[e.Request]
+	if !ok {
+		l = &lifecycle{}
+	}
+	switch e.Kind {
+	case events.Admitted:
+		l.admitted = &e
+	case events.Dispatched:
+		l.dispatched = &e
+	case events.Dropped:
+		l.dropped = &e
+	case events.Started:
+		l.started = &e
+	case events.Completed:
+		l.completed = &e
+	case events.BatchDropped:
+		l.batchDropped = &e
+	default:
+		// the events of the workers and of the pool are not part of the lifecycle of a request
+		return
+	}
+	// a request processed, or dropped by a worker, is always dispatched to the pool, by the waiting room or straight by the
+	// client
+	if l.dropped != nil || ((l.completed != nil || l.batchDropped != nil) && l.dispatched != nil) {
+		delete(t.open, e.Request)
+		select {
+		case t.queue <- l.spans():
+		default:
+			t.lost++
+		}
+		return
+	}
+	t.open[e.Request] = l
+}
+
+// Flush exports the spans of the requests whose lifecycle is not over, e.g. the ones processed by a pool which receives the
+// requests without the dispatched event, waits until all the spans have been exported and stops the export goroutine - it
+// should be called at the end of a run, since the events received afterwards are ignored
+func (t *Tracer) Flush() {
+	t.stop(true)
+}
+
+// Close stops the export goroutine after the spans of the requests whose lifecycle is over have been exported, discarding
+// the ones of the requests still open - the events received afterwards are ignored
+func (t *Tracer) Close() {
+	t.stop(false)
+}
+
+// stops receiving events and, once the spans queued, and optionally the ones of the requests still open, have been exported,
+// the export goroutine
+func (t *Tracer) stop(flushOpen bool) {
+	// the requests still open are taken under the lock, but their spans are queued after releasing it, since the queue can
+	// be full and the events emitted meanwhile by other goroutines must not wait for the exporter
+	t.mu.Lock()
+	stopping := !t.flushed
+	t.flushed = true
+	open := t.open
+	t.open = make(map[string]*lifecycle)
+	t.mu.Unlock()
+	if stopping {
+		// once flushed no event is queued, so the queue can be closed after the last spans have been sent
+		if flushOpen {
+			for _, l := range open {
+				t.queue <- l.spans()
+			}
+		}
+		close(t.queue)
+	}
+	<-t.exported
+}
+
+// Err returns the first error returned by the exporter, if any
+func (t *Tracer) Err() error {
+	t.muErr.Lock()
+	defer t.muErr.Unlock()
+	return t.err
+}
+
+// Lost returns the number of requests whose spans have been discarded because the buffer was full
+func (t *Tracer) Lost() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.lost
+}
+
+func (t *Tracer) export(spans []Span) {
+	if err := t.exporter.Export(spans); err != nil {
+		t.muErr.Lock()
+		if t.err == nil {
+			t.err = err
+		}
+		t.muErr.Unlock()
+	}
+}
+
+// returns the spans of the request built from the events received
+func (l *lifecycle) spans() []Span {
+	// all the events carry the same request data
+	var first events.Event
+	for _, e := range []*events.Event{l.admitted, l.dispatched, l.started, l.completed, l.dropped, l.batchDropped} {
+		if e != nil {
+			first = *e
+			break
+		}
+	}
+	traceID, parentID, ok := ParseTraceParent(first.TraceParent)
+	if !ok {
+		traceID = newID(16)
+		parentID = ""
+	}
+	request := Span{
+		TraceID:      traceID,
+		SpanID:       newID(8),
+		ParentSpanID: parentID,
+		Name:         RequestSpan,
+		Start:        first.Time,
+		End:          first.Time,
+		Attributes: map[string]interface{}{"request.id": first.Request, "request.param": first.Param,
+			"request.priority": first.Priority},
+	}
+	// the request span covers all its children
+	extend := func(start time.Time, end time.Time) {
+		if start.Before(request.Start) {
+			request.Start = start
+		}
+		if end.After(request.End) {
+			request.End = end
+		}
+	}
+	child := func(name string, start time.Time, end time.Time) Span {
+		extend(start, end)
+		return Span{
+			TraceID:      traceID,
+			SpanID:       newID(8),
+			ParentSpanID: request.SpanID,
+			Name:         name,
+			Start:        start,
+			End:          end,
+			Attributes:   map[string]interface{}{"request.id": first.Request, "request.priority": first.Priority},
+		}
+	}
+
+	children := make([]Span, 0, 3)
+	if l.admitted != nil || l.dropped != nil {
+		// the time spent in the waiting room is the wait of the dispatched or dropped event
+		end := l.dropped
+		if end == nil {
+			end = l.dispatched
+		}
+		if end != nil {
+			s := child(WaitingRoomSpan, end.Time.Add(-end.Wait), end.Time)
+			if l.dropped != nil {
+				s.Error = true
+				s.StatusMessage = "dropped"
+				s.Attributes["drop.reason"] = l.dropped.Reason
+				request.Error = true
+				request.StatusMessage = "dropped"
+				request.Attributes["drop.reason"] = l.dropped.Reason
+			}
+			children = append(children, s)
+		}
+	}
+	if l.dispatched != nil && l.started != nil {
+		children = append(children, child(HandOffSpan, l.dispatched.Time, l.started.Time))
+	}
+	if l.batchDropped != nil {
+		// the wait of the event is the time spent in the batch since the request has been sent to the pool
+		s := child(BatchingSpan, l.batchDropped.Time.Add(-l.batchDropped.Wait), l.batchDropped.Time)
+		s.Error = true
+		s.StatusMessage = "dropped"
+		s.Attributes["drop.reason"] = l.batchDropped.Reason
+		s.Attributes["worker.id"] = l.batchDropped.Worker
+		request.Error = true
+		request.StatusMessage = "dropped"
+		request.Attributes["drop.reason"] = l.batchDropped.Reason
+		request.Attributes["worker.id"] = l.batchDropped.Worker
+		children = append(children, s)
+	}
+	if l.completed != nil {
+		s := child(ExecutionSpan, l.completed.Time.Add(-l.completed.Duration), l.completed.Time)
+		s.Attributes["worker.id"] = l.completed.Worker
+		request.Attributes["worker.id"] = l.completed.Worker
+		if l.completed.Failed {
+			s.Error = true
+			s.StatusMessage = "failed"
+			request.Error = true
+			request.StatusMessage = "failed"
+		}
+		// the request span starts when the request is created, which is known from the wait since creation
+		extend(l.completed.Time.Add(-l.completed.Wait-l.completed.Duration), l.completed.Time)
+		children = append(children, s)
+	}
+	return append([]Span{request}, children...)
+}
+
+// ParseTraceParent returns the trace id and the parent span id of a W3C traceparent header, e.g.
+// 00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01, and false if the header is not valid
+func ParseTraceParent(traceParent string) (traceID string, spanID string, ok bool) {
+	parts := strings.Split(traceParent, "-")
+	if len(parts) != 4 || len(parts[0]) != 2 || len(parts[1]) != 32 || len(parts[2]) != 16 || len(parts[3]) != 2 {
+		return "", "", false
+	}
+	for _, p := range parts {
+		if _, err := hex.DecodeString(p); err != nil {
+			return "", "", false
+		}
+	}
+	// all zeros ids are not valid
+	if strings.Trim(parts[1], "0") == "" || strings.Trim(parts[2], "0") == "" {
+		return "", "", false
+	}
+	return parts[1], parts[2], true
+}
+
+// returns a random id of n bytes, hex encoded
+func newID(n int) string {
+	b := make([]byte, n)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
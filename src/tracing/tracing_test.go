@@ -0,0 +1,249 @@
+package tracing
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/EnricoPicci/drop-pattern-with-timeout/src/events"
+	"github.com/EnricoPicci/drop-pattern-with-timeout/src/internal/scenariotest"
+	"github.com/EnricoPicci/drop-pattern-with-timeout/src/simulation"
+)
+
+const traceParent = "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+
+// the events of a request can be received out of order, e.g. the started event before the dispatched one
+func TestSpansOfARequestProcessed(t *testing.T) {
+	exporter := NewMemory()
+	tracer := New(exporter)
+	start := time.Now()
+	at := func(ms int) time.Time {
+		return start.Add(time.Duration(ms) * time.Millisecond)
+	}
+	tracer.Emit(events.Event{Kind: events.Admitted, Time: at(0), Request: "a-7", Param: 7, Priority: 2, TraceParent: traceParent})
+	tracer.Emit(events.Event{Kind: events.Started, Time: at(101), Request: "a-7", Param: 7, Worker: 3, Wait: 101 * time.Millisecond})
+	tracer.Emit(events.Event{Kind: events.Dispatched, Time: at(100), Request: "a-7", Param: 7, Wait: 100 * time.Millisecond})
+	if len(exporter.Spans()) != 0 {
+		t.Fatalf("No span should be exported before the request is completed")
+	}
+	tracer.Emit(events.Event{Kind: events.Completed, Time: at(301), Request: "a-7", Param: 7, Worker: 3, Wait: 101 * time.Millisecond,
+		Duration: 200 * time.Millisecond})
+	tracer.Flush()
+
+	spans := exporter.Spans()
+	if len(spans) != 4 {
+		t.Fatalf("There should be 4 spans - found %v", len(spans))
+	}
+	request := spans[0]
+	if request.Name != RequestSpan || request.TraceID != "4bf92f3577b34da6a3ce929d0e0e4736" || request.ParentSpanID != "00f067aa0ba902b7" {
+		t.Errorf("The request span should be child of the incoming trace context - found %+v", request)
+	}
+	if !request.Start.Equal(at(0)) || !request.End.Equal(at(301)) {
+		t.Errorf("The request span should last from 0 to 301ms - found %v %v", request.Start.Sub(start), request.End.Sub(start))
+	}
+	expected := []struct {
+		name  string
+		start int
+		end   int
+	}{{WaitingRoomSpan, 0, 100}, {HandOffSpan, 100, 101}, {ExecutionSpan, 101, 301}}
+	for i, e := range expected {
+		s := spans[i+1]
+		if s.Name != e.name || !s.Start.Equal(at(e.start)) || !s.End.Equal(at(e.end)) {
+			t.Errorf("The span %v should last from %v to %v - found %v from %v to %v", e.name, e.start, e.end, s.Name,
+				s.Start.Sub(start), s.End.Sub(start))
+		}
+		if s.ParentSpanID != request.SpanID || s.TraceID != request.TraceID {
+			t.Errorf("The span %v should be child of the request span", s.Name)
+		}
+	}
+	if spans[3].Attributes["worker.id"] != 3 || spans[3].Attributes["request.priority"] != 2 {
+		t.Errorf("The execution span should carry the worker id and the priority - found %v", spans[3].Attributes)
+	}
+}
+
+// a request dropped by a worker in batch mode spends in the waiting room only the time until it is sent to the pool, the rest
+// is spent in the batch
+func TestSpansOfARequestDroppedFromABatch(t *testing.T) {
+	exporter := NewMemory()
+	tracer := New(exporter)
+	start := time.Now()
+	at := func(ms int) time.Time {
+		return start.Add(time.Duration(ms) * time.Millisecond)
+	}
+	tracer.Emit(events.Event{Kind: events.Admitted, Time: at(0), Request: "a-7", Param: 7})
+	tracer.Emit(events.Event{Kind: events.BatchDropped, Time: at(60), Request: "a-7", Param: 7, Worker: 2, Wait: 55 * time.Millisecond,
+		Reason: "timeout"})
+	if len(exporter.Spans()) != 0 {
+		t.Fatalf("No span should be exported before the request is sent to the pool")
+	}
+	tracer.Emit(events.Event{Kind: events.Dispatched, Time: at(5), Request: "a-7", Param: 7, Wait: 5 * time.Millisecond})
+	tracer.Flush()
+
+	spans := exporter.Spans()
+	if len(spans) != 3 {
+		t.Fatalf("There should be 3 spans - found %v", len(spans))
+	}
+	if !spans[0].Error || spans[0].Attributes["drop.reason"] != "timeout" || !spans[0].End.Equal(at(60)) {
+		t.Errorf("The request span should be dropped for the timeout at 60ms - found %+v", spans[0])
+	}
+	waitingRoom, batching := spans[1], spans[2]
+	if waitingRoom.Name != WaitingRoomSpan || waitingRoom.Error || !waitingRoom.End.Equal(at(5)) {
+		t.Errorf("The waiting room span should end without error when the request is sent to the pool - found %+v", waitingRoom)
+	}
+	if batching.Name != BatchingSpan || !batching.Error || !batching.Start.Equal(at(5)) || !batching.End.Equal(at(60)) ||
+		batching.Attributes["worker.id"] != 2 {
+		t.Errorf("The batching span should last from 5 to 60ms on the worker 2 and be dropped - found %+v", batching)
+	}
+}
+
+// runs a simulation where some requests are dropped and writes the spans in the OTLP json format
+func TestSpansOfASimulation(t *testing.T) {
+	sc, err := scenariotest.Example()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sim, err := simulation.New(sc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var b strings.Builder
+	tracer := New(NewOTLPWriter(&b, "test"))
+	sim.SetEvents(tracer)
+	result := sim.Run()
+	tracer.Flush()
+	if tracer.Err() != nil {
+		t.Fatal(tracer.Err())
+	}
+
+	lines := strings.Split(strings.TrimSpace(b.String()), "\n")
+	if len(lines) != sc.NumReq {
+		t.Fatalf("There should be a line for each request - found %v", len(lines))
+	}
+	dropped := 0
+	for _, line := range lines {
+		var req otlpRequest
+		if err := json.Unmarshal([]byte(line), &req); err != nil {
+			t.Fatal(err)
+		}
+		spans := req.ResourceSpans[0].ScopeSpans[0].Spans
+		if spans[0].Status.Code == otlpStatusError {
+			dropped++
+			if len(spans) != 2 || spans[1].Name != WaitingRoomSpan || spans[1].Status.Message != "dropped" {
+				t.Errorf("A request dropped should have the request and the waiting room spans - found %+v", spans)
+			}
+			continue
+		}
+		if len(spans) != 4 {
+			t.Errorf("A request processed should have 4 spans - found %v", len(spans))
+		}
+	}
+	if dropped != len(result.Dropped) || dropped == 0 {
+		t.Errorf("The spans of %v requests should be dropped - found %v", len(result.Dropped), dropped)
+	}
+}
+
+// an exporter which blocks until it is released
+type blockedExporter struct {
+	release chan struct{}
+	// the number of requests whose spans have been exported - read only after the tracer has been flushed
+	exported int
+}
+
+func (e *blockedExporter) Export(spans []Span) error {
+	<-e.release
+	e.exported++
+	return nil
+}
+
+// a slow exporter does not block the events, whose spans are discarded when the buffer is full
+func TestSlowExporterDoesNotBlock(t *testing.T) {
+	exporter := &blockedExporter{release: make(chan struct{})}
+	tracer := New(exporter)
+	emitted := make(chan struct{})
+	go func() {
+		// the exporter holds the spans of one request and the buffer the ones of Buffer requests
+		for i := 0; i < Buffer+11; i++ {
+			tracer.Emit(events.Event{Kind: events.Dropped, Time: time.Now(), Request: fmt.Sprint(i)})
+			if i == 0 {
+				time.Sleep(10 * time.Millisecond)
+			}
+		}
+		close(emitted)
+	}()
+	select {
+	case <-emitted:
+	case <-time.After(time.Second):
+		t.Fatalf("The events should not be blocked by the exporter")
+	}
+	close(exporter.release)
+	tracer.Flush()
+	if tracer.Lost() != 10 {
+		t.Errorf("Expected the spans of 10 requests lost - found %v", tracer.Lost())
+	}
+}
+
+// while a flush waits for a slow exporter the events emitted by other goroutines, e.g. of requests ending late, are not blocked
+func TestEmitDuringFlushDoesNotBlock(t *testing.T) {
+	exporter := &blockedExporter{release: make(chan struct{})}
+	tracer := New(exporter)
+	// requests still open, whose spans are exported by the flush
+	for i := 0; i < 5; i++ {
+		tracer.Emit(events.Event{Kind: events.Admitted, Time: time.Now(), Request: fmt.Sprint("open-", i)})
+	}
+	// the exporter holds the spans of one request and the buffer the ones of Buffer requests, so the flush waits
+	for i := 0; i < Buffer+1; i++ {
+		tracer.Emit(events.Event{Kind: events.Dropped, Time: time.Now(), Request: fmt.Sprint(i)})
+		if i == 0 {
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	flushed := make(chan struct{})
+	go func() {
+		tracer.Flush()
+		close(flushed)
+	}()
+	time.Sleep(10 * time.Millisecond)
+
+	emitted := make(chan struct{})
+	go func() {
+		tracer.Emit(events.Event{Kind: events.Dropped, Time: time.Now(), Request: "open-0"})
+		tracer.Emit(events.Event{Kind: events.Dropped, Time: time.Now(), Request: "late"})
+		tracer.Lost()
+		close(emitted)
+	}()
+	select {
+	case <-emitted:
+	case <-time.After(time.Second):
+		t.Fatalf("The events should not be blocked by the flush")
+	}
+	select {
+	case <-flushed:
+		t.Fatalf("The flush should wait for the exporter")
+	default:
+	}
+	close(exporter.release)
+	<-flushed
+
+	if exporter.exported != Buffer+6 || tracer.Lost() != 0 {
+		t.Errorf("Expected the spans of %v requests exported and none lost - found %v exported and %v lost", Buffer+6,
+			exporter.exported, tracer.Lost())
+	}
+}
+
+// closing the tracer stops the export goroutine, discarding the spans of the requests still open
+func TestClose(t *testing.T) {
+	exporter := NewMemory()
+	tracer := New(exporter)
+	tracer.Emit(events.Event{Kind: events.Admitted, Time: time.Now(), Request: "open"})
+	tracer.Emit(events.Event{Kind: events.Dropped, Time: time.Now(), Request: "dropped"})
+	tracer.Close()
+	tracer.Emit(events.Event{Kind: events.Dropped, Time: time.Now(), Request: "late"})
+	// flushing a closed tracer does nothing
+	tracer.Flush()
+
+	if spans := exporter.Spans(); len(spans) != 2 || spans[0].Attributes["request.id"] != "dropped" {
+		t.Errorf("Expected the spans of the request dropped only - found %v", spans)
+	}
+}
@@ -2,13 +2,33 @@ package waitingroom
 
 import (
 	"context"
-	"fmt"
 	"sync"
 	"time"
 
+	"github.com/EnricoPicci/drop-pattern-with-timeout/src/events"
 	"github.com/EnricoPicci/drop-pattern-with-timeout/src/request"
 )
 
+// the reasons why a request is dropped
+const (
+	// the request has not been taken in by the pool within the timeout
+	DropTimeout = "timeout"
+	// the request has not been taken in by the pool before its deadline, which comes before the timeout
+	DropDeadline = "deadline"
+	// the request has been recovered from the journal after its timeout or its deadline
+	DropExpired = "expired"
+	// the request could not be recorded in the journal
+	DropJournal = "journal"
+)
+
+// Journal records the requests let in the waiting room and when they leave it, so that the requests still waiting can be
+// recovered after a crash
+type Journal interface {
+	Admitted(req request.Request) error
+	Dispatched(req request.Request) error
+	Dropped(req request.Request, reason string) error
+}
+
 type WaitingRoom struct {
 	inChan   chan request.Request
 	outChan  chan<- request.Request
@@ -17,24 +37,58 @@ type WaitingRoom struct {
 
 	muReqSentToPool sync.Mutex
 	ReqSentToPool   []request.Request
+	sentToPoolCount int
 
 	muReqDropped sync.Mutex
 	ReqDropped   []request.Request
+	droppedCount int
+	// the number of requests dropped for each reason
+	droppedByReason map[string]int
 
 	WgReq sync.WaitGroup
 
 	// holds the number of requests which are waiting in the waiting room
 	QueueLength   int
 	muQueueLength sync.Mutex
+
+	// the number of requests let in the waiting room
+	muAdmitted sync.Mutex
+	admitted   int
+
+	// the end of the timeout of the requests let in with LetInUntil, by id, until they enter the waiting room
+	muExpiries sync.Mutex
+	expiries   map[string]time.Time
+
+	// receives the events of the requests entering and leaving the waiting room - by default they are discarded
+	Events events.Sink
+
+	// if true the requests sent to the pool and dropped are counted but not kept, e.g. in a long running server - it has to be
+	// set before the waiting room is opened
+	DiscardRequests bool
+
+	// if not nil, the requests are recorded in the journal when they are let in and when they are sent to the pool or dropped -
+	// it has to be set before the waiting room is opened
+	Journal Journal
+	// the first error returned by the journal when a request leaves the waiting room
+	muJournalErr sync.Mutex
+	journalErr   error
+
+	// the drop handler: if not nil it is called with each request dropped and the reason, e.g. to answer its client
+	OnDrop func(req request.Request, reason string)
+	// if not nil it is called with each request sent to the pool - it has to be set before the waiting room is opened
+	OnDispatch func(req request.Request)
 }
 
 func New(inChan chan request.Request, outChan chan request.Request, timeout int, timeUnit time.Duration) *WaitingRoom {
 	wr := WaitingRoom{
-		inChan:     inChan,
-		outChan:    outChan,
-		timeout:    timeout,
-		timeUnit:   timeUnit,
-		ReqDropped: make([]request.Request, 0),
+		inChan:          inChan,
+		outChan:         outChan,
+		timeout:         timeout,
+		timeUnit:        timeUnit,
+		ReqDropped:      make([]request.Request, 0),
+		droppedByReason: make(map[string]int),
+		expiries:        make(map[string]time.Time),
+		Events:          events.Discard,
 	}
 	return &wr
 }
@@ -45,8 +99,9 @@ func (wr *WaitingRoom) Open() {
 
 		for req := range wr.inChan {
 			// within this goroutine we implement the drop with timeout pattern
+			// the event is emitted before the request can be sent to the pool, so that the events of a request are in order
+			wr.Events.Emit(events.OfRequest(events.Admitted, req))
 			go wr.sendOrDrop(ctx, req)
-			fmt.Printf("Request %v in the waiting room\n", req.Param)
 		}
 	}()
 }
@@ -57,17 +112,148 @@ func (wr *WaitingRoom) Close() {
 }
 
 func (wr *WaitingRoom) LetIn(req request.Request) {
+	if req.ID == "" {
+		req.ID = request.NewID()
+	}
 	wr.WgReq.Add(1)
+	wr.muAdmitted.Lock()
+	wr.admitted++
+	wr.muAdmitted.Unlock()
+	// the request is recorded before it can be sent to the pool, otherwise it could be lost in a crash
+	if wr.Journal != nil {
+		if err := wr.Journal.Admitted(req); err != nil {
+			wr.setJournalErr(err)
+			wr.takeExpiry(req.ID)
+			wr.drop(req, DropJournal, 0)
+			wr.WgReq.Done()
+			return
+		}
+	}
 	wr.inChan <- req
 }
 
+// LetInUntil lets in a request which is dropped, with the reason timeout, at expiry if it comes before the end of the timeout of
+// the waiting room, e.g. a request which has already spent part of its timeout waiting elsewhere. Its deadline, if any, still
+// applies.
+func (wr *WaitingRoom) LetInUntil(req request.Request, expiry time.Time) {
+	if req.ID == "" {
+		req.ID = request.NewID()
+	}
+	wr.muExpiries.Lock()
+	wr.expiries[req.ID] = expiry
+	wr.muExpiries.Unlock()
+	wr.LetIn(req)
+}
+
+// returns, and forgets, the end of the timeout of a request let in with LetInUntil
+func (wr *WaitingRoom) takeExpiry(id string) (time.Time, bool) {
+	wr.muExpiries.Lock()
+	defer wr.muExpiries.Unlock()
+	expiry, ok := wr.expiries[id]
+	delete(wr.expiries, id)
+	return expiry, ok
+}
+
+// Recover lets in again the requests recovered from the journal, e.g. after a restart, with the time they entered the
+// waiting room the first time. A request waits only for what is left of its timeout, and is then dropped with the reason
+// timeout, or until its deadline if it comes first, which it keeps. The requests which have already expired are dropped, with
+// the reason expired.
+func (wr *WaitingRoom) Recover(reqs []request.Request) {
+	for _, req := range reqs {
+		timeoutEnd := req.EnteredAt.Add(wr.getTimeout())
+		expiry := timeoutEnd
+		if !req.Deadline.IsZero() && req.Deadline.Before(expiry) {
+			expiry = req.Deadline
+		}
+		if !time.Now().Before(expiry) {
+			wr.muAdmitted.Lock()
+			wr.admitted++
+			wr.muAdmitted.Unlock()
+			wr.drop(req, DropExpired, time.Since(req.EnteredAt))
+			continue
+		}
+		wr.LetInUntil(req, timeoutEnd)
+	}
+}
+
+// returns the first error returned by the journal, if any - it can be called while the waiting room is open
+func (wr *WaitingRoom) JournalErr() error {
+	wr.muJournalErr.Lock()
+	defer wr.muJournalErr.Unlock()
+	return wr.journalErr
+}
+
+func (wr *WaitingRoom) setJournalErr(err error) {
+	wr.muJournalErr.Lock()
+	defer wr.muJournalErr.Unlock()
+	if wr.journalErr == nil {
+		wr.journalErr = err
+	}
+}
+
+// returns the number of requests waiting in the waiting room - it can be called while the waiting room is open
+func (wr *WaitingRoom) Len() int {
+	wr.muQueueLength.Lock()
+	defer wr.muQueueLength.Unlock()
+	return wr.QueueLength
+}
+
+// returns the number of requests let in the waiting room since it has been opened
+func (wr *WaitingRoom) Admitted() int {
+	wr.muAdmitted.Lock()
+	defer wr.muAdmitted.Unlock()
+	return wr.admitted
+}
+
+// returns the number of requests sent to the pool since the waiting room has been opened
+func (wr *WaitingRoom) SentToPool() int {
+	wr.muReqSentToPool.Lock()
+	defer wr.muReqSentToPool.Unlock()
+	return wr.sentToPoolCount
+}
+
+// returns the number of requests dropped since the waiting room has been opened
+func (wr *WaitingRoom) Dropped() int {
+	wr.muReqDropped.Lock()
+	defer wr.muReqDropped.Unlock()
+	return wr.droppedCount
+}
+
+// returns the number of requests dropped for each reason since the waiting room has been opened
+func (wr *WaitingRoom) DroppedByReason() map[string]int {
+	wr.muReqDropped.Lock()
+	defer wr.muReqDropped.Unlock()
+	dropped := make(map[string]int, len(wr.droppedByReason))
+	for reason, n := range wr.droppedByReason {
+		dropped[reason] = n
+	}
+	return dropped
+}
+
 // this function implements the drop with timeout pattern
 func (wr *WaitingRoom) sendOrDrop(ctx context.Context, req request.Request) {
 	// defer wr.wgReq.Done()
 	defer wr.WgReq.Done()
 
-	// the timeout context
-	ctx, cancel := context.WithTimeout(ctx, wr.getTimeout())
+	// the timeout context - the deadline of the request, if it comes first, replaces the timeout
+	timeout := wr.getTimeout()
+	reason := DropTimeout
+	if expiry, ok := wr.takeExpiry(req.ID); ok && time.Until(expiry) < timeout {
+		timeout = time.Until(expiry)
+	}
+	if !req.Deadline.IsZero() && time.Until(req.Deadline) < timeout {
+		timeout = time.Until(req.Deadline)
+		reason = DropDeadline
+	}
+	start := time.Now()
+	req.EnteredAt = start
+	// a request already expired is dropped, otherwise the select below could still send it to an idle pool
+	if timeout <= 0 {
+		wr.drop(req, reason, 0)
+		return
+	}
+	req.Expiry = start.Add(timeout)
+	ctx, cancel := context.WithTimeout(ctx, timeout)
 	defer cancel()
 
 	wr.muQueueLength.Lock()
@@ -77,28 +263,67 @@ func (wr *WaitingRoom) sendOrDrop(ctx context.Context, req request.Request) {
 	select {
 	case wr.outChan <- req:
 		// the request is sent to the output channel
-		wr.sentToPool(req)
+		wr.sentToPool(req, time.Since(start))
 	case <-ctx.Done():
 		// the context times out and the request is dropped
-		wr.drop(req)
+		wr.drop(req, reason, time.Since(start))
 	}
 	wr.muQueueLength.Lock()
 	wr.QueueLength--
 	wr.muQueueLength.Unlock()
 }
 
-func (wr *WaitingRoom) sentToPool(req request.Request) {
-	fmt.Printf("Request %v sent to pool\n", req.Param)
+func (wr *WaitingRoom) sentToPool(req request.Request, waited time.Duration) {
+	// the worker which has taken in the request records the same time on its own copy of the request
+	req.DispatchedAt = time.Now()
+	if wr.Journal != nil {
+		if err := wr.Journal.Dispatched(req); err != nil {
+			wr.setJournalErr(err)
+		}
+	}
+	e := events.OfRequest(events.Dispatched, req)
+	e.Wait = waited
+	wr.Events.Emit(e)
 	wr.muReqSentToPool.Lock()
-	wr.ReqSentToPool = append(wr.ReqSentToPool, req)
+	if !wr.DiscardRequests {
+		wr.ReqSentToPool = append(wr.ReqSentToPool, req)
+	}
+	wr.sentToPoolCount++
 	wr.muReqSentToPool.Unlock()
+	if wr.OnDispatch != nil {
+		wr.OnDispatch(req)
+	}
 }
 
-func (wr *WaitingRoom) drop(req request.Request) {
-	fmt.Printf("Request %v dropped\n", req.Param)
+func (wr *WaitingRoom) drop(req request.Request, reason string, waited time.Duration) {
+	req.DroppedAt = time.Now()
+	// a request which could not be recorded is not in the journal
+	if wr.Journal != nil && reason != DropJournal {
+		if err := wr.Journal.Dropped(req, reason); err != nil {
+			wr.setJournalErr(err)
+		}
+	}
+	e := events.OfRequest(events.Dropped, req)
+	e.Wait = waited
+	e.Reason = reason
+	wr.Events.Emit(e)
+	req.Dropped = true
 	wr.muReqDropped.Lock()
-	wr.ReqDropped = append(wr.ReqDropped, req)
+	if !wr.DiscardRequests {
+		wr.ReqDropped = append(wr.ReqDropped, req)
+	}
+	wr.droppedCount++
+	wr.droppedByReason[reason]++
 	wr.muReqDropped.Unlock()
+	if wr.OnDrop != nil {
+		wr.OnDrop(req, reason)
+	}
+	req.Notify()
+}
+
+// Timeout returns the time a request waits to be sent to the pool before being dropped
+func (wr *WaitingRoom) Timeout() time.Duration {
+	return wr.getTimeout()
 }
 
 func (wr *WaitingRoom) getTimeout() time.Duration {
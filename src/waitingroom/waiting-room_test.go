@@ -0,0 +1,42 @@
+package waitingroom
+
+import (
+	"testing"
+	"time"
+
+	"github.com/EnricoPicci/drop-pattern-with-timeout/src/request"
+)
+
+// a request whose deadline has passed is dropped even if the pool is idle
+func TestExpiredDeadlineIsDropped(t *testing.T) {
+	// an idle pool always ready to take in the requests
+	inPoolCh := make(chan request.Request)
+	poolDone := make(chan struct{})
+	go func() {
+		for range inPoolCh {
+		}
+		close(poolDone)
+	}()
+	wr := New(make(chan request.Request), inPoolCh, 1000, time.Millisecond)
+	wr.Open()
+	numReq := 200
+	done := make(chan request.Request, numReq)
+	for i := 0; i < numReq; i++ {
+		req := request.New(i)
+		req.Deadline = time.Now().Add(-time.Millisecond)
+		req.Done = done
+		wr.LetIn(req)
+	}
+	wr.Close()
+	close(inPoolCh)
+	<-poolDone
+
+	if wr.Dropped() != numReq || wr.SentToPool() != 0 || wr.DroppedByReason()[DropDeadline] != numReq {
+		t.Errorf("Expected %v requests dropped for the deadline - found %v dropped and %v sent to the pool", numReq, wr.Dropped(), wr.SentToPool())
+	}
+	for i := 0; i < numReq; i++ {
+		if req := <-done; !req.Dropped {
+			t.Fatalf("The request %v should have been dropped", req.Param)
+		}
+	}
+}
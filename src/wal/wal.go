@@ -0,0 +1,320 @@
+package wal
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/EnricoPicci/drop-pattern-with-timeout/src/request"
+)
+
+// SyncPolicy says when the log is flushed to the disk with fsync
+type SyncPolicy string
+
+const (
+	// each record is flushed before the request goes on, so no request let in is lost in a crash, at the price of an fsync for
+	// each request
+	SyncAlways SyncPolicy = "always"
+	// the log is flushed periodically, so the requests let in during the last interval can be lost in a crash of the machine,
+	// but not in a crash of the process
+	SyncInterval SyncPolicy = "interval"
+	// the log is never flushed explicitly and the operating system decides when the data reaches the disk
+	SyncNever SyncPolicy = "never"
+)
+
+// Options are the options of a log
+type Options struct {
+	Sync SyncPolicy
+	// the interval between two flushes with the interval policy - the default is 100ms
+	SyncInterval time.Duration
+}
+
+// the operations recorded in the log
+const (
+	opAdmitted   = "admitted"
+	opDispatched = "dispatched"
+	opDropped    = "dropped"
+)
+
+// a line of the log - for the dispatched and dropped operations only the id of the request is recorded
+type record struct {
+	Op     string    `json:"op"`
+	Time   time.Time `json:"time"`
+	ID     string    `json:"id"`
+	Reason string    `json:"reason,omitempty"`
+	// the data of the request, for the admitted operation
+	Param       int       `json:"param,omitempty"`
+	Created     time.Time `json:"created"`
+	ProcTime    int       `json:"procTime,omitempty"`
+	Priority    int       `json:"priority,omitempty"`
+	Tenant      string    `json:"tenant,omitempty"`
+	TraceParent string    `json:"traceParent,omitempty"`
+	Deadline    time.Time `json:"deadline"`
+}
+
+// WAL is a write-ahead log of the requests let in a waiting room, to be set as its journal: the requests are appended to a
+// local file when they are let in and marked when they are sent to the pool or dropped, so that the requests still waiting
+// can be recovered when the log is opened again after a crash or a restart. The recovery is at least once: a request sent to
+// the pool just before a crash, or whose mark could not be written, is recovered again.
+type WAL struct {
+	path    string
+	options Options
+
+	mu   sync.Mutex
+	file *os.File
+	// the requests still waiting when the log has been opened
+	pending []request.Request
+	// true if some records have been written since the last flush
+	dirty  bool
+	closed bool
+	done   chan struct{}
+	// the first error of the periodic flush
+	err error
+}
+
+// Open opens the log at path, creating it if it does not exist. The requests which were still waiting when the log has been
+// closed, or when the process has crashed, are returned by Pending. The log is compacted, so that it contains only the
+// requests still waiting.
+func Open(path string, options Options) (*WAL, error) {
+	switch options.Sync {
+	case "":
+		options.Sync = SyncAlways
+	case SyncAlways, SyncInterval, SyncNever:
+	default:
+		return nil, fmt.Errorf("unknown sync policy %q - valid values are always, interval and never", options.Sync)
+	}
+	if options.SyncInterval <= 0 {
+		options.SyncInterval = 100 * time.Millisecond
+	}
+	pending, err := replay(path)
+	if err != nil {
+		return nil, err
+	}
+	if err := compact(path, pending); err != nil {
+		return nil, err
+	}
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	w := WAL{
+		path:    path,
+		options: options,
+		file:    file,
+		pending: pending,
+		done:    make(chan struct{}),
+	}
+	if options.Sync == SyncInterval {
+		go w.syncPeriodically()
+	}
+	return &w, nil
+}
+
+// Pending returns the requests still waiting when the log has been opened, in the order they have been let in, with the time
+// they have been let in as EnteredAt - they can be let in again with the Recover method of the waiting room
+func (w *WAL) Pending() []request.Request {
+	pending := make([]request.Request, len(w.pending))
+	copy(pending, w.pending)
+	return pending
+}
+
+// Admitted records a request let in the waiting room
+func (w *WAL) Admitted(req request.Request) error {
+	// a request recovered keeps the time it has been let in the first time
+	t := req.EnteredAt
+	if t.IsZero() {
+		t = time.Now()
+	}
+	return w.append(admitted(req, t))
+}
+
+// returns the record of a request let in at time t
+func admitted(req request.Request, t time.Time) record {
+	return record{
+		Op:          opAdmitted,
+		Time:        t,
+		ID:          req.ID,
+		Param:       req.Param,
+		Created:     req.Created,
+		ProcTime:    req.ProcTime,
+		Priority:    req.Priority,
+		Tenant:      req.Tenant,
+		TraceParent: req.TraceParent,
+		Deadline:    req.Deadline,
+	}
+}
+
+// Dispatched marks a request as sent to the pool
+func (w *WAL) Dispatched(req request.Request) error {
+	return w.append(record{Op: opDispatched, Time: time.Now(), ID: req.ID})
+}
+
+// Dropped marks a request as dropped
+func (w *WAL) Dropped(req request.Request, reason string) error {
+	return w.append(record{Op: opDropped, Time: time.Now(), ID: req.ID, Reason: reason})
+}
+
+// Close flushes and closes the log - it has to be called after the waiting room has been closed
+func (w *WAL) Close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.closed {
+		return nil
+	}
+	w.closed = true
+	close(w.done)
+	err := w.file.Sync()
+	if closeErr := w.file.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = w.err
+	}
+	return err
+}
+
+func (w *WAL) append(r record) error {
+	data, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.closed {
+		return fmt.Errorf("the log %v is closed", w.path)
+	}
+	if _, err := w.file.Write(append(data, '\n')); err != nil {
+		return err
+	}
+	if w.options.Sync == SyncAlways {
+		return w.file.Sync()
+	}
+	w.dirty = true
+	return nil
+}
+
+// flushes the log at the interval of the options until the log is closed
+func (w *WAL) syncPeriodically() {
+	ticker := time.NewTicker(w.options.SyncInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-w.done:
+			return
+		case <-ticker.C:
+			w.mu.Lock()
+			if w.dirty && !w.closed {
+				if err := w.file.Sync(); err != nil && w.err == nil {
+					w.err = err
+				}
+				w.dirty = false
+			}
+			w.mu.Unlock()
+		}
+	}
+}
+
+// reads the log and returns the requests let in and neither dispatched nor dropped - the last line is ignored if it is not
+// complete, since it can have been torn by a crash
+func replay(path string) ([]request.Request, error) {
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	waiting := make(map[string]request.Request)
+	order := make(map[string]int)
+	lines := bytes.Split(data, []byte("\n"))
+	for i, line := range lines {
+		if len(bytes.TrimSpace(line)) == 0 {
+			continue
+		}
+		var r record
+		if err := json.Unmarshal(line, &r); err != nil {
+			// only the last line, which is not terminated by a new line, can be torn
+			if i == len(lines)-1 {
+				break
+			}
+			return nil, fmt.Errorf("%v, line %v: %v", path, i+1, err)
+		}
+		switch r.Op {
+		case opAdmitted:
+			// a request recovered is recorded again when it is let in again
+			if _, ok := waiting[r.ID]; ok {
+				continue
+			}
+			waiting[r.ID] = request.Request{
+				ID:          r.ID,
+				Param:       r.Param,
+				Created:     r.Created,
+				ProcTime:    r.ProcTime,
+				Priority:    r.Priority,
+				Tenant:      r.Tenant,
+				TraceParent: r.TraceParent,
+				Deadline:    r.Deadline,
+				EnteredAt:   r.Time,
+			}
+			order[r.ID] = i
+		case opDispatched, opDropped:
+			delete(waiting, r.ID)
+		default:
+			return nil, fmt.Errorf("%v, line %v: unknown operation %q", path, i+1, r.Op)
+		}
+	}
+	pending := make([]request.Request, 0, len(waiting))
+	for _, req := range waiting {
+		pending = append(pending, req)
+	}
+	sort.Slice(pending, func(i, j int) bool { return order[pending[i].ID] < order[pending[j].ID] })
+	return pending, nil
+}
+
+// rewrites the log with only the requests pending - the new log is written in a temporary file which replaces the old one
+// only when it is complete, so that a crash during the compaction does not lose any request
+func compact(path string, pending []request.Request) error {
+	tmp := path + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	for _, req := range pending {
+		data, err := json.Marshal(admitted(req, req.EnteredAt))
+		if err == nil {
+			_, err = w.Write(append(data, '\n'))
+		}
+		if err != nil {
+			f.Close()
+			return err
+		}
+	}
+	if err := w.Flush(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return err
+	}
+	// the rename is durable only when the directory is flushed
+	dir, err := os.Open(filepath.Dir(path))
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+	return dir.Sync()
+}
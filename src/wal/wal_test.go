@@ -0,0 +1,206 @@
+package wal
+
+import (
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/EnricoPicci/drop-pattern-with-timeout/src/request"
+	"github.com/EnricoPicci/drop-pattern-with-timeout/src/waitingroom"
+	"github.com/EnricoPicci/drop-pattern-with-timeout/src/workerpool"
+)
+
+var timeUnit = time.Millisecond
+
+// requests are let in a waiting room whose pool does not take them in, then the process "crashes": the log is closed while
+// the requests are still waiting. When the log is opened again the requests still inside their timeout are recovered and
+// processed, while the ones whose deadline has expired are sent to the drop handler.
+func TestRecoverAfterCrash(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "waiting-room.wal")
+	log, err := Open(path, Options{Sync: SyncAlways})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(log.Pending()) != 0 {
+		t.Fatalf("A new log should have no requests pending")
+	}
+	// nobody reads the output channel, as if the pool were stuck
+	stuck := waitingroom.New(make(chan request.Request), make(chan request.Request), 1000, timeUnit)
+	stuck.Journal = log
+	stuck.Open()
+	for i := 0; i < 5; i++ {
+		req := request.New(i)
+		req.Tenant = "acme"
+		// the last 2 requests have a short deadline which expires before the restart
+		if i >= 3 {
+			req.Deadline = time.Now().Add(20 * time.Millisecond)
+		}
+		stuck.LetIn(req)
+	}
+	// the requests with the deadline are dropped and marked in the log
+	time.Sleep(50 * time.Millisecond)
+	// the crash
+	log.Close()
+
+	log, err = Open(path, Options{Sync: SyncAlways})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer log.Close()
+	pending := log.Pending()
+	if len(pending) != 3 {
+		t.Fatalf("Expected 3 requests pending - found %v", len(pending))
+	}
+	for i, req := range pending {
+		if req.Param != i || req.Tenant != "acme" || req.EnteredAt.IsZero() || req.ID == "" {
+			t.Errorf("The request %v has not been recovered correctly: %+v", i, req)
+		}
+	}
+
+	inPoolCh := make(chan request.Request)
+	pool := workerpool.NewWorkerPool(inPoolCh, 2, 0, 1, 0, 0, 0, timeUnit)
+	waitingRoom := waitingroom.New(make(chan request.Request), inPoolCh, 1000, timeUnit)
+	waitingRoom.Journal = log
+	var mu sync.Mutex
+	expired := 0
+	waitingRoom.OnDrop = func(req request.Request, reason string) {
+		mu.Lock()
+		defer mu.Unlock()
+		if reason == waitingroom.DropExpired {
+			expired++
+		}
+	}
+	pool.Start()
+	waitingRoom.Open()
+	// the first request has expired while the process was down
+	pending[0].EnteredAt = time.Now().Add(-2 * time.Second)
+	waitingRoom.Recover(pending)
+	waitingRoom.Close()
+	pool.Stop()
+
+	if pool.Completed() != 2 || expired != 1 {
+		t.Errorf("Expected 2 requests recovered and processed and 1 expired - found %v and %v", pool.Completed(), expired)
+	}
+	if waitingRoom.JournalErr() != nil {
+		t.Error(waitingRoom.JournalErr())
+	}
+	log.Close()
+
+	// all the requests have left the waiting room
+	log, err = Open(path, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer log.Close()
+	if len(log.Pending()) != 0 {
+		t.Errorf("No request should be pending - found %v", len(log.Pending()))
+	}
+}
+
+// a request recovered keeps its deadline and, when what is left of its timeout expires, is dropped for the timeout - the
+// record written again in the log keeps the deadline of the client
+func TestRecoveredRequestTimesOut(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "waiting-room.wal")
+	log, err := Open(path, Options{Sync: SyncAlways})
+	if err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(time.Hour).Round(0)
+	req := request.New(0)
+	req.Deadline = deadline
+	req.EnteredAt = time.Now().Add(-980 * time.Millisecond)
+	if err := log.Admitted(req); err != nil {
+		t.Fatal(err)
+	}
+	log.Close()
+
+	log, err = Open(path, Options{Sync: SyncAlways})
+	if err != nil {
+		t.Fatal(err)
+	}
+	pending := log.Pending()
+	// nobody reads the output channel, so the request waits for the 20ms left of its timeout of 1 second
+	waitingRoom := waitingroom.New(make(chan request.Request), make(chan request.Request), 1000, timeUnit)
+	waitingRoom.Journal = log
+	waitingRoom.Open()
+	waitingRoom.Recover(pending)
+	waitingRoom.Close()
+	log.Close()
+
+	if dropped := waitingRoom.DroppedByReason(); dropped[waitingroom.DropTimeout] != 1 || waitingRoom.Dropped() != 1 {
+		t.Errorf("The request recovered should have been dropped for the timeout - found %v", dropped)
+	}
+	if got := waitingRoom.ReqDropped[0].Deadline; !got.Equal(deadline) {
+		t.Errorf("The request recovered should keep its deadline %v - found %v", deadline, got)
+	}
+}
+
+// the last line of the log can be torn by a crash while it is being written
+func TestTornLastLine(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "waiting-room.wal")
+	log, err := Open(path, Options{Sync: SyncNever})
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := request.New(1)
+	if err := log.Admitted(req); err != nil {
+		t.Fatal(err)
+	}
+	log.Close()
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteString(`{"op":"dispatched","time":"2026-`)
+	f.Close()
+
+	log, err = Open(path, Options{Sync: SyncNever})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer log.Close()
+	if pending := log.Pending(); len(pending) != 1 || pending[0].ID != req.ID {
+		t.Errorf("The request whose mark has been torn should be pending - found %v", pending)
+	}
+	data, _ := os.ReadFile(path)
+	if n := len(splitLines(data)); n != 1 {
+		t.Errorf("The log should have been compacted to 1 line - found %v", n)
+	}
+}
+
+func TestSyncPolicies(t *testing.T) {
+	dir := t.TempDir()
+	if _, err := Open(filepath.Join(dir, "wrong.wal"), Options{Sync: "sometimes"}); err == nil {
+		t.Errorf("An unknown sync policy should return an error")
+	}
+	log, err := Open(filepath.Join(dir, "interval.wal"), Options{Sync: SyncInterval, SyncInterval: time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 10; i++ {
+		if err := log.Admitted(request.New(i)); err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if err := log.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := log.Admitted(request.New(11)); err == nil {
+		t.Errorf("Writing on a log closed should return an error")
+	}
+}
+
+func splitLines(data []byte) []string {
+	lines := make([]string, 0)
+	start := 0
+	for i, b := range data {
+		if b == '\n' {
+			lines = append(lines, string(data[start:i]))
+			start = i + 1
+		}
+	}
+	return lines
+}
@@ -4,9 +4,24 @@ import (
 	"sync"
 	"time"
 
+	"github.com/EnricoPicci/drop-pattern-with-timeout/src/events"
+	"github.com/EnricoPicci/drop-pattern-with-timeout/src/faults"
+	"github.com/EnricoPicci/drop-pattern-with-timeout/src/histogram"
 	"github.com/EnricoPicci/drop-pattern-with-timeout/src/request"
 )
 
+// WorkerState is the state of a worker of the pool
+type WorkerState int
+
+const (
+	// the worker is waiting for a request to come in
+	Idle WorkerState = iota
+	// the worker is processing a request
+	Busy
+	// the worker has taken in a request but can not process it because the pool is halted or the worker is stalled
+	Halted
+)
+
 // WorkerPool type
 type WorkerPool struct {
 	// set the size of the worker pool
@@ -25,8 +40,15 @@ type WorkerPool struct {
 
 	// protect the update of request related data
 	muReq sync.Mutex
-	// requests processed
-	requests []request.Request
+	// requests processed and requests dropped while being batched
+	requests        []request.Request
+	droppedRequests []request.Request
+	// the number of requests processed, of the ones whose processing has failed and of the ones dropped while being batched
+	completed int
+	failed    int
+	dropped   int
+	// the number of requests dropped while being batched for each reason - the reasons are the ones of the waiting room
+	droppedByReason map[string]int
 
 	// a flag that signals if thethe server is halted
 	halted   bool
@@ -41,8 +63,42 @@ type WorkerPool struct {
 	workersIdleTime   time.Duration
 	// measure the time spent by requests waiting to be taken in by a worker
 	cumulativeReqWaitTime time.Duration
+	// the distributions of the time spent by requests waiting to be taken in by a worker, of the time spent processing them
+	// and of the time from their creation to the end of their processing
+	waitTimes     *histogram.Histogram
+	procTimes     *histogram.Histogram
+	endToEndTimes *histogram.Histogram
+
+	// the state of each worker and the number of requests taken in by the workers
+	muWorkerStates sync.Mutex
+	workerStates   []WorkerState
+	taken          int
 
 	TimeUnit time.Duration
+
+	// optional faults injected in the pool while it is running - it has to be set before the pool is started
+	Faults *faults.Scenario
+
+	// receives the events of the workers, of the requests they process and of the halts of the pool - by default they are discarded
+	Events events.Sink
+	// closed when the pool is stopped
+	stopped chan struct{}
+
+	// if true the requests processed are counted but not kept, e.g. in a long running server - it has to be set before the
+	// pool is started
+	DiscardRequests bool
+
+	// if greater than 1 each worker collects up to BatchSize requests, waiting up to BatchLinger time units after the first one,
+	// and processes them together - they have to be set before the pool is started
+	BatchSize   int
+	BatchLinger int
+	// the time, in time units, it takes to process each request of a batch after the first one, which takes the processing time
+	// of the pool
+	BatchItemProcTime int
+	// if not nil, the work done by a worker to process a batch in place of the processing time simulated - it returns the
+	// error of each request of the batch, or nil if all of them have succeeded, and can set the Result of each request of the
+	// batch. In batch mode the Exec of the requests is not called.
+	BatchExec func(batch []request.Request) []error
 }
 
 func NewWorkerPool(
@@ -62,13 +118,25 @@ func NewWorkerPool(
 		haltPoolTime:     haltPoolTime,
 		haltPoolDuration: haltPoolDuration,
 		TimeUnit:         timeUnit,
+		Events:           events.Discard,
+		stopped:          make(chan struct{}),
+
+		requests:        make([]request.Request, 0, numReq),
+		droppedByReason: make(map[string]int),
 
-		requests: make([]request.Request, 0, numReq),
+		waitTimes:     histogram.New(),
+		procTimes:     histogram.New(),
+		endToEndTimes: histogram.New(),
+
+		workerStates: make([]WorkerState, poolSize),
 	}
 
 	// manages the halt and restore of the server based on the values of haltPoolTime and haltPoolDuration properties
-	go wp.halt()
-	go wp.restore()
+	// if the duration is 0 there is no halt, and we avoid the risk that restore runs before halt leaving the pool halted forever
+	if haltPoolDuration > 0 {
+		go wp.halt()
+		go wp.restore()
+	}
 
 	return &wp
 }
@@ -78,6 +146,11 @@ func (wp *WorkerPool) Start() {
 	wp.wgPool.Add(wp.poolSize)
 
 	wp.startPoolTime = time.Now()
+	if wp.Faults != nil {
+		for _, w := range wp.Faults.HaltWindows(wp.TimeUnit) {
+			go wp.notifyHaltWindow(w[0], w[1])
+		}
+	}
 	// start the workers
 	i := 0
 	for i < wp.poolSize {
@@ -93,16 +166,64 @@ func (wp *WorkerPool) Stop() {
 
 	// This Wait makes sure that we return from this function before all requests in the channel have been completely processed
 	wp.wgPool.Wait()
+	close(wp.stopped)
 }
 
-// add a request to the collection of requests processed by the pool and
-// update the cumulative time that measure how long requests have waited before entering the pool to start processing
-func (wp *WorkerPool) addRequest(req request.Request) {
+// emits the halted and restored events at the start and at the end of a halt window of the faults injected
+func (wp *WorkerPool) notifyHaltWindow(start time.Duration, end time.Duration) {
+	select {
+	case <-wp.stopped:
+		return
+	case <-time.After(start):
+		wp.Events.Emit(events.Event{Kind: events.Halted, Time: time.Now()})
+	}
+	select {
+	case <-wp.stopped:
+		return
+	case <-time.After(end - start):
+		wp.Events.Emit(events.Event{Kind: events.Restored, Time: time.Now(), Duration: end - start})
+	}
+}
+
+// add a request to the collection of requests processed by the pool,
+// update the cumulative time that measure how long requests have waited before entering the pool to start processing and
+// record the wait, processing and end to end times in their histograms
+func (wp *WorkerPool) addRequest(req request.Request, procDuration time.Duration) {
 	wp.muReq.Lock()
-	wp.requests = append(wp.requests, req)
+	if !wp.DiscardRequests {
+		wp.requests = append(wp.requests, req)
+	}
+	wp.completed++
+	if req.Failed {
+		wp.failed++
+	}
 	// update the cumulative wait time
 	wp.cumulativeReqWaitTime = wp.cumulativeReqWaitTime + req.WaitDuration
 	wp.muReq.Unlock()
+
+	wp.waitTimes.Record(req.WaitDuration)
+	wp.procTimes.Record(procDuration)
+	wp.endToEndTimes.Record(time.Since(req.Created))
+}
+
+// drops a request which has expired while it was being batched by a worker - the reason is the one the waiting room would
+// have given, i.e. waitingroom.DropTimeout or waitingroom.DropDeadline
+func (wp *WorkerPool) dropRequest(workerId int, req request.Request, at time.Time, reason string) {
+	req.Dropped = true
+	req.DroppedAt = at
+	wp.muReq.Lock()
+	if !wp.DiscardRequests {
+		wp.droppedRequests = append(wp.droppedRequests, req)
+	}
+	wp.dropped++
+	wp.droppedByReason[reason]++
+	wp.muReq.Unlock()
+	e := events.OfRequest(events.BatchDropped, req)
+	e.Worker = workerId
+	e.Wait = at.Sub(req.DispatchedAt)
+	e.Reason = reason
+	wp.Events.Emit(e)
+	req.Notify()
 }
 
 // add the time spent idle
@@ -122,11 +243,125 @@ func (wp *WorkerPool) AvgRequestWaitTime(numReq int) time.Duration {
 	return time.Duration(int(wp.cumulativeReqWaitTime) / numReq)
 }
 
+// sets the state of a worker and, if the worker has just taken in a request, counts it - in batch mode the requests are
+// counted by startBatch instead, since all the requests of a batch can expire while the worker is halted
+func (wp *WorkerPool) setWorkerState(workerId int, state WorkerState) {
+	wp.muWorkerStates.Lock()
+	if wp.BatchSize <= 1 && wp.workerStates[workerId] == Idle && state != Idle {
+		wp.taken++
+	}
+	wp.workerStates[workerId] = state
+	wp.muWorkerStates.Unlock()
+}
+
+// sets a worker busy processing a batch and counts the requests of the batch as taken in
+func (wp *WorkerPool) startBatch(workerId int, n int) {
+	wp.muWorkerStates.Lock()
+	wp.workerStates[workerId] = Busy
+	wp.taken += n
+	wp.muWorkerStates.Unlock()
+}
+
+// returns the number of workers which are idle, busy processing a request and halted - it can be called while the pool is running
+func (wp *WorkerPool) WorkerStates() (idle int, busy int, halted int) {
+	wp.muWorkerStates.Lock()
+	defer wp.muWorkerStates.Unlock()
+	for _, state := range wp.workerStates {
+		switch state {
+		case Idle:
+			idle++
+		case Busy:
+			busy++
+		case Halted:
+			halted++
+		}
+	}
+	return
+}
+
+// returns the state of each worker, indexed by worker id - it can be called while the pool is running
+func (wp *WorkerPool) States() []WorkerState {
+	wp.muWorkerStates.Lock()
+	defer wp.muWorkerStates.Unlock()
+	states := make([]WorkerState, len(wp.workerStates))
+	copy(states, wp.workerStates)
+	return states
+}
+
+// returns the number of requests taken in by the workers since the start of the pool, including the ones still being processed
+func (wp *WorkerPool) Taken() int {
+	wp.muWorkerStates.Lock()
+	defer wp.muWorkerStates.Unlock()
+	return wp.taken
+}
+
+// returns the number of requests processed since the start of the pool
+func (wp *WorkerPool) Completed() int {
+	wp.muReq.Lock()
+	defer wp.muReq.Unlock()
+	return wp.completed
+}
+
+// returns the number of requests dropped since they have expired while they were being batched
+func (wp *WorkerPool) Dropped() int {
+	wp.muReq.Lock()
+	defer wp.muReq.Unlock()
+	return wp.dropped
+}
+
+// returns the number of requests dropped for each reason since they have expired while they were being batched
+func (wp *WorkerPool) DroppedByReason() map[string]int {
+	wp.muReq.Lock()
+	defer wp.muReq.Unlock()
+	dropped := make(map[string]int, len(wp.droppedByReason))
+	for reason, n := range wp.droppedByReason {
+		dropped[reason] = n
+	}
+	return dropped
+}
+
+// returns the number of requests waiting in the input channel of the pool, which is always 0 if the channel is unbuffered
+func (wp *WorkerPool) QueueLength() int {
+	return len(wp.inChan)
+}
+
+// returns a snapshot of the distribution of the time requests have been waiting before being taken in by a worker -
+// it can be called while the pool is running
+func (wp *WorkerPool) WaitTimes() *histogram.Histogram {
+	return wp.waitTimes.Snapshot()
+}
+
+// returns a snapshot of the distribution of the time spent by the workers processing the requests -
+// it can be called while the pool is running
+func (wp *WorkerPool) ProcTimes() *histogram.Histogram {
+	return wp.procTimes.Snapshot()
+}
+
+// returns a snapshot of the distribution of the time from the creation of the requests to the end of their processing -
+// it can be called while the pool is running
+func (wp *WorkerPool) EndToEndTimes() *histogram.Histogram {
+	return wp.endToEndTimes.Snapshot()
+}
+
 // returns the requests processed
 func (wp *WorkerPool) GetRequests() []request.Request {
 	return wp.requests
 }
 
+// returns the requests dropped since they have expired while they were being batched
+func (wp *WorkerPool) GetDroppedRequests() []request.Request {
+	wp.muReq.Lock()
+	defer wp.muReq.Unlock()
+	return wp.droppedRequests
+}
+
+// returns the number of requests whose processing has failed
+func (wp *WorkerPool) FailedRequests() int {
+	wp.muReq.Lock()
+	defer wp.muReq.Unlock()
+	return wp.failed
+}
+
 // sets the halted flag to true when the server has to be halted
 func (wp *WorkerPool) halt() {
 	// after haltPoolTime the pool is halted
@@ -135,10 +370,11 @@ func (wp *WorkerPool) halt() {
 	wp.muHalted.Lock()
 	wp.halted = true
 	wp.muHalted.Unlock()
+	wp.Events.Emit(events.Event{Kind: events.Halted, Time: time.Now()})
 }
 
 // if the server is halted it waits until it is restored to normal operations
-func (wp *WorkerPool) waitIfHalted() {
+func (wp *WorkerPool) waitIfHalted(workerId int) {
 	var isHalted bool
 	var restored chan struct{}
 	// if the pool is halted, we want to add a chan to the "restoredChans" slice in an isolated way, i.e. we want to avoid the risk
@@ -154,6 +390,7 @@ func (wp *WorkerPool) waitIfHalted() {
 	// by the same semaphore
 	wp.muHalted.Unlock()
 	if isHalted {
+		wp.setWorkerState(workerId, Halted)
 		// restored is closed when the server is restored to signal that operations are back to normal
 		<-restored
 	}
@@ -173,4 +410,41 @@ func (wp *WorkerPool) restore() {
 		close(wp.restoredChans[i])
 	}
 	wp.muHalted.Unlock()
+	wp.Events.Emit(events.Event{Kind: events.Restored, Time: time.Now(), Duration: haltDuration})
+}
+
+// if the worker is affected by a halt or stall fault it waits until the fault is over
+func (wp *WorkerPool) waitIfStalled(workerId int) {
+	if wp.Faults == nil {
+		return
+	}
+	// faults can follow one another, so we check again after each wait
+	for {
+		wait := wp.Faults.StallFor(workerId, time.Since(wp.startPoolTime), wp.TimeUnit)
+		if wait == 0 {
+			return
+		}
+		wp.setWorkerState(workerId, Halted)
+		time.Sleep(wait)
+	}
+}
+
+// returns the time it takes to process a request considering its own processing time, if set, and the slowdown and jitter faults active
+func (wp *WorkerPool) getProcTime(req request.Request) time.Duration {
+	procTime := time.Duration(wp.procTime) * wp.TimeUnit
+	if req.ProcTime > 0 {
+		procTime = time.Duration(req.ProcTime) * wp.TimeUnit
+	}
+	if wp.Faults == nil {
+		return procTime
+	}
+	return wp.Faults.ProcTime(procTime, time.Since(wp.startPoolTime), wp.TimeUnit)
+}
+
+// returns true if the request being processed has to fail because of an error fault
+func (wp *WorkerPool) injectFailure() bool {
+	if wp.Faults == nil {
+		return false
+	}
+	return wp.Faults.Fail(time.Since(wp.startPoolTime), wp.TimeUnit)
 }
@@ -0,0 +1,178 @@
+package workerpool
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/EnricoPicci/drop-pattern-with-timeout/src/faults"
+	"github.com/EnricoPicci/drop-pattern-with-timeout/src/request"
+	"github.com/EnricoPicci/drop-pattern-with-timeout/src/waitingroom"
+)
+
+// sends the requests to the pool and returns them, in the order they have been sent, when they have been processed or dropped
+func sendAll(inChan chan request.Request, reqs []request.Request) []request.Request {
+	done := make([]chan request.Request, len(reqs))
+	for i := range reqs {
+		done[i] = make(chan request.Request, 1)
+		reqs[i].Done = done[i]
+		inChan <- reqs[i]
+	}
+	for i := range reqs {
+		reqs[i] = <-done[i]
+	}
+	return reqs
+}
+
+func TestBatching(t *testing.T) {
+	inChan := make(chan request.Request)
+	pool := NewWorkerPool(inChan, 1, 0, 0, 0, 0, 0, time.Millisecond)
+	pool.BatchSize = 5
+	pool.BatchLinger = 100
+	var mu sync.Mutex
+	sizes := []int{}
+	pool.BatchExec = func(batch []request.Request) []error {
+		mu.Lock()
+		sizes = append(sizes, len(batch))
+		mu.Unlock()
+		errs := make([]error, len(batch))
+		for i, req := range batch {
+			if req.Param == 3 {
+				errs[i] = errors.New("failed")
+			}
+			batch[i].Result = req.Param * 10
+		}
+		return errs
+	}
+	pool.Start()
+	reqs := make([]request.Request, 10)
+	for i := range reqs {
+		reqs[i] = request.New(i)
+	}
+	reqs = sendAll(inChan, reqs)
+	pool.Stop()
+
+	if len(sizes) != 2 || sizes[0] != 5 || sizes[1] != 5 {
+		t.Errorf("Expected 2 batches of 5 requests - found %v", sizes)
+	}
+	if pool.Completed() != 10 || pool.FailedRequests() != 1 || pool.Taken() != 10 || pool.Dropped() != 0 {
+		t.Errorf("Expected 10 requests taken in and completed, of which 1 failed - found %v taken, %v completed and %v failed",
+			pool.Taken(), pool.Completed(), pool.FailedRequests())
+	}
+	for _, req := range reqs {
+		if req.Failed != (req.Param == 3) {
+			t.Errorf("Only the request 3 should have failed - found %v for the request %v", req.Failed, req.Param)
+		}
+		if req.WaitDuration != req.StartedAt.Sub(req.Created) || req.CompletedAt.IsZero() {
+			t.Errorf("The request %v should have its own wait time", req.Param)
+		}
+		if req.Result != req.Param*10 {
+			t.Errorf("The request %v should have its own result - found %v", req.Param, req.Result)
+		}
+	}
+}
+
+// a batch not full is processed after the linger time, and the requests whose deadline is reached meanwhile are dropped
+func TestBatchLingerAndDeadline(t *testing.T) {
+	inChan := make(chan request.Request)
+	pool := NewWorkerPool(inChan, 1, 0, 10, 0, 0, 0, time.Millisecond)
+	pool.BatchSize = 10
+	pool.BatchLinger = 30
+	pool.BatchItemProcTime = 5
+	pool.Start()
+	reqs := []request.Request{request.New(0), request.New(1), request.New(2)}
+	reqs[1].Deadline = time.Now().Add(10 * time.Millisecond)
+	reqs = sendAll(inChan, reqs)
+	pool.Stop()
+
+	if !reqs[1].Dropped || reqs[1].DroppedAt.IsZero() || reqs[0].Dropped || reqs[2].Dropped {
+		t.Errorf("Only the request with the deadline should have been dropped")
+	}
+	if pool.Completed() != 2 || pool.Dropped() != 1 {
+		t.Errorf("Expected 2 requests completed and 1 dropped - found %v and %v", pool.Completed(), pool.Dropped())
+	}
+	if waited := reqs[0].StartedAt.Sub(reqs[0].DispatchedAt); waited < 30*time.Millisecond {
+		t.Errorf("The batch should have been processed after the linger time - found %v", waited)
+	}
+	// the batch of 2 requests takes 10ms for the first request and 5ms for the second
+	if d := reqs[0].ProcessingTime(); d < 15*time.Millisecond {
+		t.Errorf("The batch should have taken at least 15ms - found %v", d)
+	}
+}
+
+// the requests sent by a waiting room are dropped if the timeout of the waiting room expires while they are being batched
+func TestBatchTimeoutOfWaitingRoom(t *testing.T) {
+	inChan := make(chan request.Request)
+	pool := NewWorkerPool(inChan, 1, 0, 10, 0, 0, 0, time.Millisecond)
+	pool.BatchSize = 10
+	pool.BatchLinger = 50
+	waitingRoom := waitingroom.New(make(chan request.Request), inChan, 20, time.Millisecond)
+	pool.Start()
+	waitingRoom.Open()
+	done := make(chan request.Request, 3)
+	for i := 0; i < 3; i++ {
+		req := request.New(i)
+		req.Done = done
+		waitingRoom.LetIn(req)
+	}
+	for i := 0; i < 3; i++ {
+		if req := <-done; !req.Dropped || req.Expiry.IsZero() {
+			t.Errorf("The request %v should have been dropped since its timeout has expired in the batch", req.Param)
+		}
+	}
+	waitingRoom.Close()
+	pool.Stop()
+
+	if pool.Dropped() != 3 || pool.Completed() != 0 || len(pool.GetDroppedRequests()) != 3 || waitingRoom.SentToPool() != 3 {
+		t.Errorf("Expected 3 requests sent to the pool and dropped while batched - found %v dropped", pool.Dropped())
+	}
+}
+
+// the requests of a batch collected while the pool is halted all expire before the pool is restored, so the worker processes
+// nothing and is not counted as having taken them in
+func TestBatchExpiredWhileHalted(t *testing.T) {
+	inChan := make(chan request.Request)
+	pool := NewWorkerPool(inChan, 1, 0, 10, 0, 0, 0, time.Millisecond)
+	pool.BatchSize = 3
+	pool.BatchLinger = 5
+	pool.Faults = faults.New(0, faults.HaltWindow(0, 60))
+	waitingRoom := waitingroom.New(make(chan request.Request), inChan, 20, time.Millisecond)
+	pool.Start()
+	waitingRoom.Open()
+	done := make(chan request.Request, 3)
+	for i := 0; i < 3; i++ {
+		req := request.New(i)
+		req.Done = done
+		waitingRoom.LetIn(req)
+	}
+	for i := 0; i < 3; i++ {
+		if req := <-done; !req.Dropped || !req.StartedAt.IsZero() {
+			t.Errorf("The request %v should have been dropped without being processed", req.Param)
+		}
+	}
+	waitingRoom.Close()
+	pool.Stop()
+
+	if pool.Dropped() != 3 || pool.Completed() != 0 || pool.Taken() != 0 {
+		t.Errorf("Expected 3 requests dropped and none taken in - found %v dropped, %v completed and %v taken in",
+			pool.Dropped(), pool.Completed(), pool.Taken())
+	}
+	if idle, busy, halted := pool.WorkerStates(); idle != 1 || busy != 0 || halted != 0 {
+		t.Errorf("The worker should be idle - found %v idle, %v busy and %v halted", idle, busy, halted)
+	}
+}
+
+// a halt lasting 0 time units does not halt the pool, even if the restore runs before the halt
+func TestNoHaltWithoutDuration(t *testing.T) {
+	for i := 0; i < 100; i++ {
+		pool := NewWorkerPool(make(chan request.Request), 1, 0, 1, 0, 0, 0, time.Millisecond)
+		time.Sleep(time.Millisecond)
+		pool.muHalted.Lock()
+		halted := pool.halted
+		pool.muHalted.Unlock()
+		if halted {
+			t.Fatalf("The pool should not be halted by a halt of 0 time units")
+		}
+	}
+}
@@ -1,10 +1,11 @@
 package workerpool
 
 import (
-	"fmt"
 	"time"
 
+	"github.com/EnricoPicci/drop-pattern-with-timeout/src/events"
 	"github.com/EnricoPicci/drop-pattern-with-timeout/src/request"
+	"github.com/EnricoPicci/drop-pattern-with-timeout/src/waitingroom"
 )
 
 type Worker struct {
@@ -17,34 +18,185 @@ func NewWorker(id int) *Worker {
 }
 
 func (w *Worker) start(pool *WorkerPool) {
-	fmt.Printf("Worker %v started\n", w.id)
+	if pool.BatchSize > 1 {
+		w.startBatching(pool)
+		return
+	}
+	pool.Events.Emit(events.Event{Kind: events.WorkerStarted, Time: time.Now(), Worker: w.id})
 
 	var startIdleTime = time.Now()
 
 	for req := range pool.inChan {
 		// add the time spent idle - the startIdleTime value is reset at the end of the processing logic
 		pool.addIdleTime(startIdleTime)
+		if req.ID == "" {
+			req.ID = request.NewID()
+		}
+		// the channel from the waiting room is unbuffered, so the request is dispatched when the worker takes it in
+		if req.DispatchedAt.IsZero() {
+			req.DispatchedAt = time.Now()
+		}
 
-		pool.waitIfHalted()
+		pool.waitIfHalted(w.id)
+		pool.waitIfStalled(w.id)
 
 		// calculate how long the request has been waiting before being picked up by one worker of the pool
 		waitDuration := time.Since(req.Created)
 		req.WaitDuration = waitDuration
 
 		// execute the request
-		w.execReq(req, time.Duration(pool.procTime)*pool.TimeUnit)
+		pool.setWorkerState(w.id, Busy)
+		startProcTime := time.Now()
+		req.StartedAt = startProcTime
+		started := events.OfRequest(events.Started, req)
+		started.Worker = w.id
+		started.Wait = req.WaitDuration
+		pool.Events.Emit(started)
+		w.execReq(&req, pool.getProcTime(req))
+		req.Failed = pool.injectFailure()
 
-		pool.addRequest(req)
+		req.CompletedAt = time.Now()
+		procDuration := req.CompletedAt.Sub(startProcTime)
+		pool.addRequest(req, procDuration)
+		completed := events.OfRequest(events.Completed, req)
+		completed.Worker = w.id
+		completed.Wait = req.WaitDuration
+		completed.Duration = procDuration
+		completed.Failed = req.Failed
+		pool.Events.Emit(completed)
+		req.Notify()
 
+		pool.setWorkerState(w.id, Idle)
 		startIdleTime = time.Now()
+		pool.Events.Emit(events.Event{Kind: events.WorkerIdle, Time: startIdleTime, Worker: w.id})
 	}
+	// the event is emitted before signalling that the worker is done, so that no event is emitted after the pool is stopped
+	pool.Events.Emit(events.Event{Kind: events.WorkerStopped, Time: time.Now(), Worker: w.id})
 	pool.wgPool.Done()
-	fmt.Printf("Worker %v shutting down\n", w.id)
 }
 
 // execute a request
-func (w *Worker) execReq(req request.Request, procTime time.Duration) {
+func (w *Worker) execReq(req *request.Request, procTime time.Duration) {
+	if req.Exec != nil {
+		req.Exec()
+		return
+	}
 	// sleep time that simulates the work done while processing a request
 	time.Sleep(procTime)
-	fmt.Printf("===>>>> Request executed with parameter %v - wait time %v\n", req.Param, req.WaitDuration)
+	req.Result = simulatedResult(*req)
+}
+
+// the result of the simulated processing of a request, which is its param
+func simulatedResult(req request.Request) interface{} {
+	return req.Param
+}
+
+// the loop of a worker which collects up to BatchSize requests, waiting up to BatchLinger after the first one, and processes
+// them together
+func (w *Worker) startBatching(pool *WorkerPool) {
+	pool.Events.Emit(events.Event{Kind: events.WorkerStarted, Time: time.Now(), Worker: w.id})
+
+	var startIdleTime = time.Now()
+	closed := false
+	for !closed {
+		first, ok := <-pool.inChan
+		if !ok {
+			break
+		}
+		pool.addIdleTime(startIdleTime)
+		batch := []request.Request{takeIn(first)}
+		linger := time.NewTimer(time.Duration(pool.BatchLinger) * pool.TimeUnit)
+	collect:
+		for len(batch) < pool.BatchSize {
+			select {
+			case req, ok := <-pool.inChan:
+				if !ok {
+					closed = true
+					break collect
+				}
+				batch = append(batch, takeIn(req))
+			case <-linger.C:
+				break collect
+			}
+		}
+		linger.Stop()
+
+		pool.waitIfHalted(w.id)
+		pool.waitIfStalled(w.id)
+		w.execBatch(pool, batch)
+
+		pool.setWorkerState(w.id, Idle)
+		startIdleTime = time.Now()
+		pool.Events.Emit(events.Event{Kind: events.WorkerIdle, Time: startIdleTime, Worker: w.id})
+	}
+	pool.Events.Emit(events.Event{Kind: events.WorkerStopped, Time: time.Now(), Worker: w.id})
+	pool.wgPool.Done()
+}
+
+// sets the id and the time of dispatch of a request taken in by a worker, if not set
+func takeIn(req request.Request) request.Request {
+	if req.ID == "" {
+		req.ID = request.NewID()
+	}
+	if req.DispatchedAt.IsZero() {
+		req.DispatchedAt = time.Now()
+	}
+	return req
+}
+
+// drops the requests of the batch which have expired, i.e. whose deadline or timeout in the waiting room has been reached while
+// they were being batched, and processes the others together - each request keeps its own wait time, outcome and result
+func (w *Worker) execBatch(pool *WorkerPool, batch []request.Request) {
+	startProcTime := time.Now()
+	live := make([]request.Request, 0, len(batch))
+	for _, req := range batch {
+		if !req.Deadline.IsZero() && !startProcTime.Before(req.Deadline) {
+			pool.dropRequest(w.id, req, startProcTime, waitingroom.DropDeadline)
+			continue
+		}
+		if !req.Expiry.IsZero() && !startProcTime.Before(req.Expiry) {
+			pool.dropRequest(w.id, req, startProcTime, waitingroom.DropTimeout)
+			continue
+		}
+		live = append(live, req)
+	}
+	// if all the requests have expired, e.g. while the pool was halted, the worker has processed nothing
+	if len(live) == 0 {
+		return
+	}
+
+	pool.startBatch(w.id, len(live))
+	for i := range live {
+		live[i].WaitDuration = startProcTime.Sub(live[i].Created)
+		live[i].StartedAt = startProcTime
+		started := events.OfRequest(events.Started, live[i])
+		started.Worker = w.id
+		started.Wait = live[i].WaitDuration
+		pool.Events.Emit(started)
+	}
+	var errs []error
+	if pool.BatchExec != nil {
+		errs = pool.BatchExec(live)
+	} else {
+		// sleep time that simulates the work done while processing the batch
+		time.Sleep(pool.getProcTime(live[0]) + time.Duration((len(live)-1)*pool.BatchItemProcTime)*pool.TimeUnit)
+		for i := range live {
+			live[i].Result = simulatedResult(live[i])
+		}
+	}
+
+	completedAt := time.Now()
+	procDuration := completedAt.Sub(startProcTime)
+	for i, req := range live {
+		req.Failed = (i < len(errs) && errs[i] != nil) || pool.injectFailure()
+		req.CompletedAt = completedAt
+		pool.addRequest(req, procDuration)
+		completed := events.OfRequest(events.Completed, req)
+		completed.Worker = w.id
+		completed.Wait = req.WaitDuration
+		completed.Duration = procDuration
+		completed.Failed = req.Failed
+		pool.Events.Emit(completed)
+		req.Notify()
+	}
 }